@@ -1,62 +1,232 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/CanadianCommander/MicroWeb/pkg/logger"
 	mwsettings "github.com/CanadianCommander/MicroWeb/pkg/mwSettings"
+	"github.com/CanadianCommander/MicroWeb/pkg/pluginUtil"
 )
 
+// defaultShutdownTimeout is used when "tune/shutdownTimeout" is missing or invalid
+const defaultShutdownTimeout = 10 * time.Second
+
 // HTTPServer contains an, http server + tcp connection all wrapped up in to one struct
 type HTTPServer struct {
 	server          *http.Server
 	tcpListener     net.Listener
-	redirectServers []HTTPServer
+	redirectServers []*HTTPServer
+	// additional listeners needed by virtual hosts. These share the handler of the primary server
+	listenerServers []*HTTPServer
+	// request handler shared by all listeners, before any h2c wrapping
+	handler http.Handler
+
+	shutdownOnce     sync.Once
+	shutdownComplete chan bool
+
+	// connections accepted but whose first request has not yet been read
+	connLock  sync.Mutex
+	newConns  map[net.Conn]bool
+	bStopping bool
+}
+
+/*
+closeOnceListener wraps a listener so that it can be closed by both HTTPServer.Shutdown
+and http.Server.Shutdown without error.
+*/
+type closeOnceListener struct {
+	net.Listener
+	once     sync.Once
+	closeErr error
+}
+
+func (listener *closeOnceListener) Close() error {
+	listener.once.Do(func() {
+		listener.closeErr = listener.Listener.Close()
+	})
+	return listener.closeErr
 }
 
 /*
-ServeHTTP start the http server. BLOCKS until server exits
+ServeHTTP start the http server. BLOCKS until server exits. If the server is stopped with
+Shutdown(), ServeHTTP does not return until all in-flight requests have been drained.
 */
 func (svr *HTTPServer) ServeHTTP() {
 	// start redirect servers
 	for _, rServer := range svr.redirectServers {
+		if rServer.tcpListener == nil {
+			continue
+		}
 		logger.LogInfo("Starting redirect server on port: %s", rServer.tcpListener.Addr().String())
 
 		rServerCpy := rServer
 		go func() {
 			err := rServerCpy.server.Serve(rServerCpy.tcpListener)
-			if err != nil {
+			if err != nil && err != http.ErrServerClosed && !svr.isStopping() {
 				logger.LogError("Failed to start redirect server on port %s with error: %s",
 					rServerCpy.tcpListener.Addr().String(), err.Error())
 			}
 		}()
 	}
 
+	// start virtual host listeners
+	for _, lServer := range svr.listenerServers {
+		lServerCpy := lServer
+		go func() {
+			err := lServerCpy.serve()
+			if err != nil && err != http.ErrServerClosed && !svr.isStopping() {
+				logger.LogError("Could not serve HTTP(S) on %s with error: %s", lServerCpy.server.Addr, err.Error())
+			}
+		}()
+	}
+
 	// start primary server
-	if mwsettings.GetSettingBool("tls/enableTLS") {
+	err := svr.serve()
+	if err == http.ErrServerClosed || svr.isStopping() {
+		// wait for in-flight requests to drain
+		<-svr.shutdownComplete
+	} else if err != nil {
+		logger.LogError("Could not serve HTTP(S) with error: %s", err.Error())
+	}
+}
+
+// serve serves HTTPS if the server has a TLS configuration, else HTTP. BLOCKS until the server exits.
+func (svr *HTTPServer) serve() error {
+	if svr.server.TLSConfig != nil {
 		logger.LogInfo("Serving HTTPS on: %s", svr.tcpListener.Addr().String())
-		err := svr.server.ServeTLS(svr.tcpListener, mwsettings.GetSettingString("tls/certFile"), mwsettings.GetSettingString("tls/keyFile"))
-		if err != nil {
-			logger.LogError("Could not server HTTPS with error: %s", err.Error())
+		return svr.server.ServeTLS(svr.tcpListener, "", "")
+	}
+	logger.LogInfo("Serving HTTP on: %s", svr.tcpListener.Addr().String())
+	return svr.server.Serve(svr.tcpListener)
+}
+
+/*
+Shutdown gracefully shuts down the redirect servers and the primary server. New connections are refused
+while in-flight requests are given up to timeout to complete, after which remaining connections are closed.
+Connections that have been accepted but not yet sent a request are given a chance (up to the read timeout) to do so
+before the server shuts down, as http.Server.Shutdown would otherwise drop them. WebSocket connections, which
+http.Server.Shutdown does not track, are closed with CloseGoingAway. Only the first call has any effect.
+*/
+func (svr *HTTPServer) Shutdown(timeout time.Duration) error {
+	var err error
+	svr.shutdownOnce.Do(func() {
+		defer close(svr.shutdownComplete)
+		startTime := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		svr.stopAccepting()
+		waitTime := timeout
+		if svr.server.ReadTimeout > 0 && svr.server.ReadTimeout < waitTime {
+			waitTime = svr.server.ReadTimeout
 		}
-	} else {
-		logger.LogInfo("Serving HTTP on: %s", svr.tcpListener.Addr().String())
-		err := svr.server.Serve(svr.tcpListener)
+		svr.waitForNewConnections(startTime.Add(waitTime))
+		pluginUtil.CloseAllWebSockets()
+
+		for _, rServer := range svr.redirectServers {
+			if rErr := rServer.server.Shutdown(ctx); rErr != nil {
+				logger.LogWarning("Redirect server on %s did not shutdown cleanly: %s", rServer.server.Addr, rErr.Error())
+				rServer.server.Close()
+			}
+		}
+		for _, lServer := range svr.listenerServers {
+			if lErr := lServer.server.Shutdown(ctx); lErr != nil {
+				logger.LogWarning("Server on %s did not shutdown cleanly: %s", lServer.server.Addr, lErr.Error())
+				lServer.server.Close()
+			}
+		}
+
+		err = svr.server.Shutdown(ctx)
 		if err != nil {
-			logger.LogError("Could not server HTTP with error: %s", err.Error())
+			logger.LogWarning("Connections still open after %s, closing them: %s", timeout, err.Error())
+			svr.server.Close()
+		}
+		logger.LogInfo("Server shutdown in %d ms", time.Since(startTime)/time.Millisecond)
+	})
+	return err
+}
+
+// stopAccepting closes the listening sockets of the server and its redirect servers.
+func (svr *HTTPServer) stopAccepting() {
+	svr.connLock.Lock()
+	svr.bStopping = true
+	svr.connLock.Unlock()
+
+	for _, server := range svr.allServers() {
+		if server.tcpListener != nil {
+			server.tcpListener.Close()
 		}
 	}
 }
 
+// allServers returns the primary server followed by the virtual host listeners and redirect servers
+func (svr *HTTPServer) allServers() []*HTTPServer {
+	servers := append([]*HTTPServer{svr}, svr.listenerServers...)
+	return append(servers, svr.redirectServers...)
+}
+
+func (svr *HTTPServer) isStopping() bool {
+	svr.connLock.Lock()
+	defer svr.connLock.Unlock()
+	return svr.bStopping
+}
+
+// waitForNewConnections waits until all accepted connections have started a request or deadline passes
+func (svr *HTTPServer) waitForNewConnections(deadline time.Time) {
+	for time.Now().Before(deadline) {
+		svr.connLock.Lock()
+		pending := len(svr.newConns)
+		svr.connLock.Unlock()
+
+		if pending == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// trackConnState is the http.Server ConnState hook used to keep track of new connections
+func (svr *HTTPServer) trackConnState(conn net.Conn, state http.ConnState) {
+	svr.connLock.Lock()
+	defer svr.connLock.Unlock()
+
+	if state == http.StateNew {
+		svr.newConns[conn] = true
+	} else {
+		delete(svr.newConns, conn)
+	}
+}
+
+/*
+GetShutdownTimeout returns the time in-flight requests are given to complete on shutdown. set with "tune/shutdownTimeout"
+*/
+func GetShutdownTimeout() time.Duration {
+	if !mwsettings.HasSetting("tune/shutdownTimeout") {
+		return defaultShutdownTimeout
+	}
+
+	timeout, err := time.ParseDuration(mwsettings.GetSettingString("tune/shutdownTimeout"))
+	if err != nil {
+		logger.LogError("Could not parse shutdown timeout: %s. defaulting to %s",
+			mwsettings.GetSettingString("tune/shutdownTimeout"), defaultShutdownTimeout)
+		return defaultShutdownTimeout
+	}
+	return timeout
+}
+
 /*
 CreateHTTPServer creates a new http server on the given port,
-using the given protocol and outputing errors to the given error logger. The created
+using the given protocol and outputing errors to the given error logger. Additional listeners
+required by virtual hosts are created along side it (see GetAllListeners). HTTP/2 is configured
+on all of them with http2Options (see GetHTTP2Options), nil for the defaults. The created
 server is returned on success, else (nil, error) is returned
 */
-func CreateHTTPServer(port string, proto string, errLogger *log.Logger) (*HTTPServer, error) {
+func CreateHTTPServer(port string, proto string, errLogger *log.Logger, http2Options *HTTP2Options) (*HTTPServer, error) {
 	srvMux := http.NewServeMux()
 	srvMux.HandleFunc("/", HandleRequest)
 
@@ -74,24 +244,78 @@ func CreateHTTPServer(port string, proto string, errLogger *log.Logger) (*HTTPSe
 		writeTimout, _ = time.ParseDuration("1s")
 	}
 
-	var srv HTTPServer
+	srv := &HTTPServer{shutdownComplete: make(chan bool), newConns: make(map[net.Conn]bool), handler: srvMux}
 	srv.server = &http.Server{
 		Addr:         port,
-		Handler:      srvMux,
 		ErrorLog:     errLogger,
 		ReadTimeout:  readTimout,
-		WriteTimeout: writeTimout}
+		WriteTimeout: writeTimout,
+		ConnState:    srv.trackConnState}
 
-	var netErr error
-	srv.tcpListener, netErr = net.Listen(proto, port)
+	listener, netErr := Listen(proto, port)
 	if netErr != nil {
 		logger.LogError("Failed to create TCP socket using protocol: %s on port: %s", proto, port)
 		return nil, netErr
 	}
+	srv.tcpListener = &closeOnceListener{Listener: listener}
+
+	var tlsErr error
+	srv.server.TLSConfig, tlsErr = CreateTLSConfig(port)
+	if tlsErr != nil {
+		listener.Close()
+		return nil, tlsErr
+	}
+
+	if h2Err := configureHTTP2(srv.server, srvMux, http2Options); h2Err != nil {
+		logger.LogError("Failed to configure HTTP/2 on port: %s", port)
+		listener.Close()
+		return nil, h2Err
+	}
 
-	CreateRedirectServers(port, proto, errLogger, writeTimout, readTimout, &srv)
+	CreateVirtualHostServers(port, proto, srv, http2Options)
+	CreateRedirectServers(port, proto, errLogger, writeTimout, readTimout, srv)
+	CloseUnusedInheritedListeners()
 
-	return &srv, nil
+	return srv, nil
+}
+
+/*
+CreateVirtualHostServers creates a server for each virtual host listener other than port. The servers share
+the handler, timeouts and error logger of the primary server. Listeners that cannot be created are logged and skipped.
+*/
+func CreateVirtualHostServers(port string, proto string, server *HTTPServer, http2Options *HTTP2Options) {
+	for _, listenAddr := range GetAllListeners() {
+		if listenAddr == port {
+			continue
+		}
+
+		tlsConfig, err := CreateTLSConfig(listenAddr)
+		if err != nil {
+			logger.LogError("Failed to create TLS configuration for listener %s with error: %s", listenAddr, err.Error())
+			continue
+		}
+
+		lServer := &HTTPServer{}
+		lServer.server = &http.Server{
+			Addr:         listenAddr,
+			ErrorLog:     server.server.ErrorLog,
+			ReadTimeout:  server.server.ReadTimeout,
+			WriteTimeout: server.server.WriteTimeout,
+			ConnState:    server.trackConnState,
+			TLSConfig:    tlsConfig}
+		if err = configureHTTP2(lServer.server, server.handler, http2Options); err != nil {
+			logger.LogError("Failed to configure HTTP/2 for listener %s with error: %s", listenAddr, err.Error())
+			continue
+		}
+
+		listener, err := Listen(proto, listenAddr)
+		if err != nil {
+			logger.LogError("Failed to create listener on %s with error: %s", listenAddr, err.Error())
+			continue
+		}
+		lServer.tcpListener = &closeOnceListener{Listener: listener}
+		server.listenerServers = append(server.listenerServers, lServer)
+	}
 }
 
 // CreateRedirectServers creates zero - N redirect servers. These servers simply redirect
@@ -104,28 +328,31 @@ func CreateRedirectServers(port string, proto string, errLogger *log.Logger, wri
 		res.Header().Add("Location", rURL+port+req.URL.String())
 		res.WriteHeader(301)
 	})
+	// redirect servers also answer ACME HTTP-01 challenges
+	redirectHandler := wrapACMEChallengeHandler(redirectMux)
 
 	if rdirects != nil {
 		rdirects, bOk := rdirects.([]interface{})
 		if !bOk {
 			logger.LogWarning("Setting \"general/redirectPorts\" has incorrect value. should be list of strings.")
 		} else {
-			redirectServers := make([]HTTPServer, len(rdirects))
+			redirectServers := make([]*HTTPServer, len(rdirects))
 			for i, redirect := range rdirects {
 				redirectPort := redirect.(string)
 
-				redirectServers[i] = HTTPServer{}
+				redirectServers[i] = &HTTPServer{}
 				redirectServers[i].server = &http.Server{
 					Addr:         redirectPort,
-					Handler:      redirectMux,
+					Handler:      redirectHandler,
 					ErrorLog:     errLogger,
 					ReadTimeout:  readTimeout,
 					WriteTimeout: writeTimeout}
 
-				var err error
-				redirectServers[i].tcpListener, err = net.Listen(proto, redirectPort)
+				listener, err := Listen(proto, redirectPort)
 				if err != nil {
 					logger.LogError("Failed to create redirect server on port %s with error: %s", redirectPort, err.Error())
+				} else {
+					redirectServers[i].tcpListener = &closeOnceListener{Listener: listener}
 				}
 			}
 			server.redirectServers = redirectServers
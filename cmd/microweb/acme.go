@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CanadianCommander/MicroWeb/pkg/logger"
+	mwsettings "github.com/CanadianCommander/MicroWeb/pkg/mwSettings"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// defaultACMECacheDirectory is where certificates and the ACME account key are stored if "acme/cacheDirectory" is not set
+const defaultACMECacheDirectory = "/var/lib/microweb/acme"
+
+var acmeManagerOnce sync.Once
+var acmeManager *autocert.Manager
+
+//AddACMESettingDecoders adds setting decoders for the "acme" section of the config file
+func AddACMESettingDecoders() {
+	acmeSettings := []string{"acme/enable", "acme/directoryURL", "acme/email", "acme/cacheDirectory",
+		"acme/hostnames", "acme/caCertFile", "acme/renewBefore"}
+
+	for _, set := range acmeSettings {
+		mwsettings.AddSettingDecoder(mwsettings.NewBasicDecoder(set))
+	}
+}
+
+/*
+GetACMEManager returns the ACME (RFC 8555) certificate manager, or nil if "acme/enable" is not set.
+The manager obtains certificates for the ACME host names (see IsACMEHostname) on first use, caches them
+on disk and renews them in the background. Renewed certificates are picked up by new TLS connections
+without a restart. Configured by:
+	"acme": {
+	  "enable":         true,
+	  "directoryURL":   "https://acme-v02.api.letsencrypt.org/directory",
+	  "email":          "admin@example.com",
+	  "cacheDirectory": "/var/lib/microweb/acme",
+	  "hostnames":      ["example.com"],
+	  "caCertFile":     "/path/to/pebble.minica.pem",
+	  "renewBefore":    "720h"
+	}
+"hostnames" are the ACME managed names of the default virtual host, other virtual hosts opt in with
+"tls": {"acme": true}. "caCertFile" adds a trusted root for talking to the ACME server, for use with
+test servers such as Pebble. The manager is created once, changes to the "acme" section require a restart.
+*/
+func GetACMEManager() *autocert.Manager {
+	acmeManagerOnce.Do(func() {
+		if !mwsettings.GetSettingBool("acme/enable") {
+			return
+		}
+
+		manager, err := newACMEManager()
+		if err != nil {
+			logger.LogError("Could not setup ACME certificate management with error: %s", err.Error())
+			return
+		}
+		acmeManager = manager
+	})
+	return acmeManager
+}
+
+func newACMEManager() (*autocert.Manager, error) {
+	cacheDirectory := defaultACMECacheDirectory
+	if mwsettings.HasSetting("acme/cacheDirectory") {
+		cacheDirectory = mwsettings.GetSettingString("acme/cacheDirectory")
+	}
+
+	client := &acme.Client{DirectoryURL: autocert.DefaultACMEDirectory}
+	if mwsettings.HasSetting("acme/directoryURL") {
+		client.DirectoryURL = mwsettings.GetSettingString("acme/directoryURL")
+	}
+
+	if mwsettings.HasSetting("acme/caCertFile") {
+		pemData, err := ioutil.ReadFile(mwsettings.GetSettingString("acme/caCertFile"))
+		if err != nil {
+			return nil, err
+		}
+
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil {
+			rootCAs = x509.NewCertPool()
+		}
+		if !rootCAs.AppendCertsFromPEM(pemData) {
+			return nil, errors.New("no certificates found in " + mwsettings.GetSettingString("acme/caCertFile"))
+		}
+		client.HTTPClient = &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: rootCAs}}}
+	}
+
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cacheDirectory),
+		HostPolicy: acmeHostPolicy,
+		Client:     client,
+		Email:      mwsettings.GetSettingString("acme/email"),
+	}
+
+	if mwsettings.HasSetting("acme/renewBefore") {
+		renewBefore, err := time.ParseDuration(mwsettings.GetSettingString("acme/renewBefore"))
+		if err != nil {
+			logger.LogError("Could not parse acme/renewBefore: %s. using default", mwsettings.GetSettingString("acme/renewBefore"))
+		} else {
+			manager.RenewBefore = renewBefore
+		}
+	}
+
+	logger.LogInfo("ACME certificate management enabled using directory: %s", client.DirectoryURL)
+	return manager, nil
+}
+
+/*
+GetACMEHostnames returns every host name whose certificate is managed by ACME. Wild card host names are
+skipped as they cannot be validated with HTTP-01 or TLS-ALPN-01 challenges.
+*/
+func GetACMEHostnames() []string {
+	var names []string
+	if mwsettings.HasSetting("acme/hostnames") {
+		hostnames, err := decodeStringList(mwsettings.GetSetting("acme/hostnames"))
+		if err != nil {
+			logger.LogError("bad value for acme/hostnames: %s", err.Error())
+		}
+		names = append(names, hostnames...)
+	}
+	for _, vhost := range GetVirtualHosts() {
+		if vhost.ACME {
+			names = append(names, vhost.Hostnames...)
+		}
+	}
+
+	out := make([]string, 0, len(names))
+	for _, name := range names {
+		name = normalizeHostname(name)
+		if name != "" && !strings.Contains(name, "*") {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+/*
+IsACMEHostname returns true if ACME is enabled and the certificate for host is managed by ACME.
+*/
+func IsACMEHostname(host string) bool {
+	if GetACMEManager() == nil {
+		return false
+	}
+
+	host = normalizeHostname(host)
+	for _, name := range GetACMEHostnames() {
+		if name == host {
+			return true
+		}
+	}
+	return false
+}
+
+// acmeHostPolicy only allows certificates to be requested for the configured ACME host names
+func acmeHostPolicy(ctx context.Context, host string) error {
+	if !IsACMEHostname(host) {
+		return errors.New("ACME is not enabled for host: " + host)
+	}
+	return nil
+}
+
+/*
+listenerUsesACME returns true if any ACME managed virtual host (including the default virtual host
+when "tls/enableTLS" is set) is served on listenAddr.
+*/
+func listenerUsesACME(listenAddr string) bool {
+	if GetACMEManager() == nil {
+		return false
+	}
+
+	defaultHost := GetDefaultVirtualHost()
+	if mwsettings.GetSettingBool("tls/enableTLS") && defaultHost.listensOn(listenAddr) && mwsettings.HasSetting("acme/hostnames") {
+		return true
+	}
+	for _, vhost := range virtualHostsOnListener(listenAddr) {
+		if vhost.ACME {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+wrapACMEChallengeHandler answers ACME HTTP-01 challenges, passing all other requests on to handler.
+If ACME is not enabled handler is returned as is.
+*/
+func wrapACMEChallengeHandler(handler http.Handler) http.Handler {
+	manager := GetACMEManager()
+	if manager == nil {
+		return handler
+	}
+	return manager.HTTPHandler(handler)
+}
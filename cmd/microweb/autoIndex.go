@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	templateHTML "html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/CanadianCommander/MicroWeb/pkg/cache"
+	"github.com/CanadianCommander/MicroWeb/pkg/logger"
+	mwsettings "github.com/CanadianCommander/MicroWeb/pkg/mwSettings"
+)
+
+// autoIndexMarkerFile enables directory listings for the directory containing it and all directories below it
+const autoIndexMarkerFile = ".autoindex"
+
+/*
+AutoIndex controls directory listings for a virtual host. Directories without an index file are listed if
+Enable is set, or if they, or a parent directory within the static directory, contain a ".autoindex" file.
+Configured in the "autoIndex" section of the config file (default virtual host) or of a vhost:
+	"autoIndex": {
+	  "enable":     true,
+	  "template":   "/etc/microweb/listing.gohtml",
+	  "showHidden": false
+	}
+"template" is a html/template that replaces the built in listing page. It is executed with a DirectoryListing.
+Hidden files (names starting with ".") are left out unless "showHidden" is set.
+*/
+type AutoIndex struct {
+	Enable     bool
+	Template   string
+	ShowHidden bool
+}
+
+/*
+DirectoryListing is the data a directory listing is rendered from. As JSON (request with "?format=json"
+or "Accept: application/json") it is sent as is.
+*/
+type DirectoryListing struct {
+	// URL path of the directory, always ending in "/"
+	Path string `json:"path"`
+	// URL path of the parent directory, "" for the root of the static directory
+	Parent  string           `json:"parent"`
+	SortBy  string           `json:"sort"`
+	Order   string           `json:"order"`
+	Entries []DirectoryEntry `json:"entries"`
+}
+
+/*
+DirectoryEntry is one file or directory in a DirectoryListing.
+*/
+type DirectoryEntry struct {
+	Name    string    `json:"name"`
+	URL     string    `json:"url"`
+	IsDir   bool      `json:"isDir"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// the built in listing page
+var defaultAutoIndexTemplate = templateHTML.Must(templateHTML.New("autoIndex").Funcs(templateHTML.FuncMap{
+	"sortURL": autoIndexSortURL,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Index of {{.Path}}</title></head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<table>
+<tr>
+<th><a href="{{sortURL . "name"}}">Name</a></th>
+<th><a href="{{sortURL . "size"}}">Size</a></th>
+<th><a href="{{sortURL . "mtime"}}">Modified</a></th>
+</tr>
+{{if .Parent}}<tr><td><a href="{{.Parent}}">../</a></td><td></td><td></td></tr>
+{{end}}{{range .Entries}}<tr><td><a href="{{.URL}}">{{.Name}}{{if .IsDir}}/{{end}}</a></td><td>{{if not .IsDir}}{{.Size}}{{end}}</td><td>{{.ModTime.UTC.Format "2006-01-02 15:04:05"}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+//AddAutoIndexSettingDecoders adds setting decoders for the "autoIndex" section of the config file
+func AddAutoIndexSettingDecoders() {
+	autoIndexSettings := []string{"autoIndex/enable", "autoIndex/template", "autoIndex/showHidden"}
+
+	for _, set := range autoIndexSettings {
+		mwsettings.AddSettingDecoder(mwsettings.NewBasicDecoder(set))
+	}
+}
+
+// decodeAutoIndex decodes the "autoIndex" section of a vhost
+func decodeAutoIndex(raw interface{}) AutoIndex {
+	autoIndex := AutoIndex{}
+	if autoIndexMap, bOk := raw.(map[string]interface{}); bOk {
+		autoIndex.Enable, _ = autoIndexMap["enable"].(bool)
+		autoIndex.Template, _ = autoIndexMap["template"].(string)
+		autoIndex.ShowHidden, _ = autoIndexMap["showHidden"].(bool)
+	}
+	return autoIndex
+}
+
+/*
+autoIndexDirectory returns the file system path of the directory url resolves to if it should be listed.
+*/
+func (vhost *VirtualHost) autoIndexDirectory(url string) (string, bool) {
+	webRoot := path.Clean(vhost.StaticDirectory)
+	dirPath := path.Join(webRoot, url)
+	if dirPath != webRoot && !strings.HasPrefix(dirPath, webRoot+"/") {
+		return "", false
+	}
+
+	if fInfo, err := os.Stat(dirPath); err != nil || !fInfo.IsDir() {
+		return "", false
+	}
+	if vhost.AutoIndex.Enable {
+		return dirPath, true
+	}
+
+	for markerDir := dirPath; ; markerDir = path.Dir(markerDir) {
+		if _, err := os.Stat(path.Join(markerDir, autoIndexMarkerFile)); err == nil {
+			return dirPath, true
+		}
+		if markerDir == webRoot || markerDir == "/" {
+			return "", false
+		}
+	}
+}
+
+/*
+serveDirectoryListing lists the directory dirPath, which the url path of req resolves to. The listing is sorted
+with the "sort" (name, size or mtime) and "order" (asc or desc) query parameters, directories first.
+*/
+func serveDirectoryListing(res http.ResponseWriter, req *http.Request, vhost *VirtualHost, dirPath string) bool {
+	if !strings.HasSuffix(req.URL.Path, "/") {
+		// relative links in the listing need the trailing slash
+		redirectURL := *req.URL
+		redirectURL.Path += "/"
+		http.Redirect(res, req, redirectURL.String(), http.StatusMovedPermanently)
+		return true
+	}
+
+	listing, err := buildDirectoryListing(dirPath, req.URL.Path, vhost.AutoIndex.ShowHidden)
+	if err != nil {
+		logger.LogError("Could not list directory: %s with error: %s", dirPath, err.Error())
+		WriteErrorResponse(res, req, http.StatusInternalServerError, "")
+		return false
+	}
+	sortDirectoryListing(listing, req.URL.Query().Get("sort"), req.URL.Query().Get("order"))
+
+	res.Header().Add("Vary", "Accept")
+	if wantsJSONListing(req) {
+		res.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(res).Encode(listing) == nil
+	}
+
+	listingTemplate := defaultAutoIndexTemplate
+	if vhost.AutoIndex.Template != "" {
+		if listingTemplate, err = loadAutoIndexTemplate(vhost.AutoIndex.Template); err != nil {
+			logger.LogError("Could not load directory listing template: %s with error: %s", vhost.AutoIndex.Template, err.Error())
+			WriteErrorResponse(res, req, http.StatusInternalServerError, "")
+			return false
+		}
+	}
+
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err = listingTemplate.Execute(res, listing); err != nil {
+		logger.LogError("Could not render directory listing of: %s with error: %s", dirPath, err.Error())
+		return false
+	}
+	return true
+}
+
+// buildDirectoryListing reads the directory dirPath, served at urlPath, in to a DirectoryListing
+func buildDirectoryListing(dirPath string, urlPath string, bShowHidden bool) (*DirectoryListing, error) {
+	dirEntries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	listing := &DirectoryListing{Path: urlPath, Entries: make([]DirectoryEntry, 0, len(dirEntries))}
+	if urlPath != "/" {
+		listing.Parent = path.Dir(strings.TrimSuffix(urlPath, "/"))
+		if listing.Parent != "/" {
+			listing.Parent += "/"
+		}
+	}
+
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		if !bShowHidden && strings.HasPrefix(name, ".") {
+			continue
+		}
+		// stat, not lstat, so that symbolic links are listed as what they point to
+		fInfo, err := os.Stat(path.Join(dirPath, name))
+		if err != nil {
+			continue
+		}
+
+		entryURL := (&url.URL{Path: name}).EscapedPath()
+		if fInfo.IsDir() {
+			entryURL += "/"
+		}
+		listing.Entries = append(listing.Entries, DirectoryEntry{
+			Name:    name,
+			URL:     "./" + entryURL,
+			IsDir:   fInfo.IsDir(),
+			Size:    fInfo.Size(),
+			ModTime: fInfo.ModTime(),
+		})
+	}
+	return listing, nil
+}
+
+// sortDirectoryListing sorts the listing by name, size or mtime, directories first
+func sortDirectoryListing(listing *DirectoryListing, sortBy string, order string) {
+	if sortBy != "size" && sortBy != "mtime" {
+		sortBy = "name"
+	}
+	if order != "desc" {
+		order = "asc"
+	}
+	listing.SortBy = sortBy
+	listing.Order = order
+
+	lessFunction := func(i, j int) bool {
+		a, b := listing.Entries[i], listing.Entries[j]
+		if a.IsDir != b.IsDir {
+			return a.IsDir
+		}
+		if order == "desc" {
+			a, b = b, a
+		}
+
+		switch sortBy {
+		case "size":
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+		case "mtime":
+			if !a.ModTime.Equal(b.ModTime) {
+				return a.ModTime.Before(b.ModTime)
+			}
+		}
+		return a.Name < b.Name
+	}
+	sort.SliceStable(listing.Entries, lessFunction)
+}
+
+// autoIndexSortURL returns the query string that sorts the listing by sortBy, flipping the order if it is already sorted by it
+func autoIndexSortURL(listing *DirectoryListing, sortBy string) string {
+	order := "asc"
+	if listing.SortBy == sortBy && listing.Order == "asc" {
+		order = "desc"
+	}
+	return "?sort=" + sortBy + "&order=" + order
+}
+
+// wantsJSONListing returns true if the client asked for a JSON directory listing
+func wantsJSONListing(req *http.Request) bool {
+	if format := req.URL.Query().Get("format"); format != "" {
+		return format == "json"
+	}
+	accept := req.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
+
+// cachedAutoIndexTemplate is a parsed listing template and the modification time of the file it was parsed at
+type cachedAutoIndexTemplate struct {
+	template *templateHTML.Template
+	modTime  time.Time
+}
+
+/*
+loadAutoIndexTemplate parses the listing template at templatePath. sortURL is available to the template.
+The parsed template is cached until the file changes.
+*/
+func loadAutoIndexTemplate(templatePath string) (*templateHTML.Template, error) {
+	fInfo, err := os.Stat(templatePath)
+	if err != nil {
+		return nil, err
+	}
+
+	cacheKey := "autoIndex:" + templatePath
+	if cached, bOk := cache.FetchFromCache(cache.CacheTypeTemplate, cacheKey).(*cachedAutoIndexTemplate); bOk && cached.modTime.Equal(fInfo.ModTime()) {
+		return cached.template, nil
+	}
+
+	// read the file directly, the resource cache does not notice changes
+	source, err := os.ReadFile(templatePath)
+	if err != nil {
+		return nil, err
+	}
+	logger.LogVerbose("Parsing directory listing template: %s", templatePath)
+	listingTemplate, err := templateHTML.New(path.Base(templatePath)).Funcs(templateHTML.FuncMap{
+		"sortURL": autoIndexSortURL,
+	}).Parse(string(source))
+	if err != nil {
+		return nil, err
+	}
+	cache.RemoveFromCache(cache.CacheTypeTemplate, cacheKey)
+	cache.AddToCache(cache.CacheTypeTemplate, cacheKey, &cachedAutoIndexTemplate{template: listingTemplate, modTime: fInfo.ModTime()})
+	return listingTemplate, nil
+}
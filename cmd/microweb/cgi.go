@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CanadianCommander/MicroWeb/pkg/logger"
+	"github.com/CanadianCommander/MicroWeb/pkg/pluginUtil"
+)
+
+const (
+	defaultCGITimeout = 30 * time.Second
+	// request bodies of unknown length are read in to memory, up to this size, to find CONTENT_LENGTH
+	maxCGIBufferedBody = 32 * 1024 * 1024
+)
+
+/*
+CGISettings configures a plugin binding that executes CGI scripts (RFC 3875), key "cgi", or forwards requests to a
+FastCGI responder such as php-fpm, key "fastcgi", ex:
+	{"binding": "/cgi-bin/", "cgi": {"root": "/usr/lib/cgi-bin", "inheritEnv": ["LANG"], "timeout": "10s", "maxConcurrent": 8}}
+	{"binding": "/tool", "cgi": {"script": "/usr/local/bin/tool.sh", "env": {"TOOL_MODE": "web"}}}
+	{"binding": "/php/", "fastcgi": {"address": "unix:/run/php/php-fpm.sock", "root": "/var/www/php", "maxConcurrent": 32}}
+With "script" every request of the binding goes to that script, the rest of the url path becomes PATH_INFO. With "root"
+the url path after the binding is looked up below root, ex. /cgi-bin/tool.sh/extra runs root/tool.sh with PATH_INFO /extra.
+"address" is host:port or unix:/path/to/socket. "env" is added to the environment of every request, CGI scripts
+also get the server environment variables listed in "inheritEnv". Requests that take longer than "timeout" (30s by default)
+get a 504, the script is killed. At most "maxConcurrent" (0 for no limit) requests are handled at once, others wait
+for a free slot up to "timeout".
+*/
+type CGISettings struct {
+	Script string
+	Root   string
+	// FastCGI is the address of the FastCGI responder, empty for CGI
+	FastCGI       string
+	Env           []string
+	InheritEnv    []string
+	Timeout       time.Duration
+	MaxConcurrent int
+	// request slots, nil if MaxConcurrent is 0
+	slots chan bool
+}
+
+/*
+decodeCGISettings decodes the "cgi" or, if bFastCGI, the "fastcgi" object of a plugin binding, see CGISettings
+*/
+func decodeCGISettings(raw interface{}, bFastCGI bool) (*CGISettings, error) {
+	cgiMap, bOk := raw.(map[string]interface{})
+	if !bOk {
+		return nil, errors.New("cgi / fastcgi must be an object")
+	}
+
+	cgiSettings := &CGISettings{Timeout: defaultCGITimeout}
+	cgiSettings.Script, _ = cgiMap["script"].(string)
+	cgiSettings.Root, _ = cgiMap["root"].(string)
+	if (cgiSettings.Script == "") == (cgiSettings.Root == "") {
+		return nil, errors.New("expecting one of script or root")
+	}
+	if bFastCGI {
+		if cgiSettings.FastCGI, _ = cgiMap["address"].(string); cgiSettings.FastCGI == "" {
+			return nil, errors.New("fastcgi needs an address")
+		}
+	}
+
+	if envMap, bOk := cgiMap["env"].(map[string]interface{}); bOk {
+		for name, value := range envMap {
+			strValue, bOk := value.(string)
+			if !bOk {
+				return nil, errors.New("env values must be strings")
+			}
+			cgiSettings.Env = append(cgiSettings.Env, name+"="+strValue)
+		}
+		sort.Strings(cgiSettings.Env)
+	}
+	var err error
+	if cgiSettings.InheritEnv, err = decodeStringList(cgiMap["inheritEnv"]); err != nil {
+		return nil, errors.New("bad inheritEnv: " + err.Error())
+	}
+	if timeoutString, bOk := cgiMap["timeout"].(string); bOk {
+		if cgiSettings.Timeout, err = time.ParseDuration(timeoutString); err != nil || cgiSettings.Timeout <= 0 {
+			return nil, errors.New("bad timeout: " + timeoutString)
+		}
+	}
+	if maxConcurrent, bOk := cgiMap["maxConcurrent"].(float64); bOk {
+		if maxConcurrent < 0 {
+			return nil, errors.New("maxConcurrent cannot be negative")
+		}
+		cgiSettings.MaxConcurrent = int(maxConcurrent)
+	}
+	if cgiSettings.MaxConcurrent > 0 {
+		cgiSettings.slots = make(chan bool, cgiSettings.MaxConcurrent)
+	}
+	return cgiSettings, nil
+}
+
+/*
+resolveScript finds the script for urlPath, which is below bindingPrefix. Returns the script file, the url path of the
+script (SCRIPT_NAME) and the rest of the url path (PATH_INFO). ok is false if there is no such script.
+*/
+func (cgiSettings *CGISettings) resolveScript(urlPath string, bindingPrefix string) (scriptFile string, scriptName string, pathInfo string, ok bool) {
+	if cgiSettings.Script != "" {
+		scriptName = strings.TrimSuffix(bindingPrefix, "/")
+		return cgiSettings.Script, scriptName, strings.TrimPrefix(urlPath, scriptName), true
+	}
+
+	relPath := path.Clean("/" + strings.TrimPrefix(urlPath, bindingPrefix))
+	segments := strings.Split(strings.TrimPrefix(relPath, "/"), "/")
+	scriptFile = cgiSettings.Root
+	for i, segment := range segments {
+		if segment == "" {
+			break
+		}
+		scriptFile = filepath.Join(scriptFile, segment)
+		fInfo, err := os.Stat(scriptFile)
+		if err != nil {
+			return "", "", "", false
+		}
+		if fInfo.Mode().IsRegular() {
+			scriptName = strings.TrimSuffix(bindingPrefix, "/") + "/" + strings.Join(segments[:i+1], "/")
+			return scriptFile, scriptName, strings.TrimPrefix(relPath, "/"+strings.Join(segments[:i+1], "/")), true
+		}
+	}
+	return "", "", "", false
+}
+
+/*
+cgiEnvironment returns the RFC 3875 meta variables of req, followed by the "env" of the binding.
+*/
+func cgiEnvironment(req *http.Request, cgiSettings *CGISettings, scriptFile string, scriptName string, pathInfo string, contentLength int64) []string {
+	host, port, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host, port = req.Host, "80"
+		if req.TLS != nil {
+			port = "443"
+		}
+	}
+	remoteHost, remotePort, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		remoteHost, remotePort = req.RemoteAddr, ""
+	}
+
+	env := []string{
+		"GATEWAY_INTERFACE=CGI/1.1",
+		"SERVER_SOFTWARE=MicroWeb",
+		"SERVER_NAME=" + host,
+		"SERVER_PORT=" + port,
+		"SERVER_PROTOCOL=" + req.Proto,
+		"REQUEST_METHOD=" + req.Method,
+		"REQUEST_URI=" + req.URL.RequestURI(),
+		"QUERY_STRING=" + req.URL.RawQuery,
+		"SCRIPT_NAME=" + scriptName,
+		"SCRIPT_FILENAME=" + scriptFile,
+		"PATH_INFO=" + pathInfo,
+		"REMOTE_ADDR=" + remoteHost,
+		"REMOTE_HOST=" + remoteHost,
+		"REMOTE_PORT=" + remotePort,
+		// php-cgi refuses to run without it
+		"REDIRECT_STATUS=200",
+		"MICROWEB_REQUEST_ID=" + pluginUtil.GetRequestID(req),
+	}
+	if cgiSettings.Root != "" {
+		env = append(env, "DOCUMENT_ROOT="+cgiSettings.Root)
+		if pathInfo != "" {
+			env = append(env, "PATH_TRANSLATED="+filepath.Join(cgiSettings.Root, pathInfo))
+		}
+	}
+	if req.TLS != nil {
+		env = append(env, "HTTPS=on")
+	}
+	if contentLength > 0 {
+		env = append(env, "CONTENT_LENGTH="+strconv.FormatInt(contentLength, 10))
+	}
+	if contentType := req.Header.Get("Content-Type"); contentType != "" {
+		env = append(env, "CONTENT_TYPE="+contentType)
+	}
+
+	for name, values := range req.Header {
+		name = strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+		// Proxy would become HTTP_PROXY, see httpoxy
+		if name == "PROXY" || name == "CONTENT_TYPE" || name == "CONTENT_LENGTH" {
+			continue
+		}
+		separator := ", "
+		if name == "COOKIE" {
+			separator = "; "
+		}
+		env = append(env, "HTTP_"+name+"="+strings.Join(values, separator))
+	}
+	return append(env, cgiSettings.Env...)
+}
+
+/*
+serveCGIResource runs the CGI script, or asks the FastCGI responder, bound to req and sends the response.
+*/
+func serveCGIResource(res http.ResponseWriter, req *http.Request, binding *pluginBinding) bool {
+	cgiSettings := binding.CGI
+	scriptFile, scriptName, pathInfo, bOk := cgiSettings.resolveScript(req.URL.Path, bindingPrefixOf(binding, req.URL.Path))
+	if !bOk {
+		logger.LogInfo("No CGI script for: %s", req.URL.Path)
+		WriteErrorResponse(res, req, http.StatusNotFound, "")
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), cgiSettings.Timeout)
+	defer cancel()
+	if cgiSettings.slots != nil {
+		select {
+		case cgiSettings.slots <- true:
+			defer func() { <-cgiSettings.slots }()
+		case <-ctx.Done():
+			logger.LogWarning("No free CGI slot for [%s] after %s", req.URL.Path, cgiSettings.Timeout)
+			WriteErrorResponse(res, req, http.StatusServiceUnavailable, "")
+			return false
+		}
+	}
+
+	// CONTENT_LENGTH has to be known up front
+	var body io.Reader = req.Body
+	contentLength := req.ContentLength
+	if contentLength < 0 {
+		buffer, err := io.ReadAll(http.MaxBytesReader(res, req.Body, maxCGIBufferedBody))
+		if err != nil {
+			WriteErrorResponse(res, req, http.StatusRequestEntityTooLarge, "")
+			return false
+		}
+		body, contentLength = bytes.NewReader(buffer), int64(len(buffer))
+	}
+	env := cgiEnvironment(req, cgiSettings, scriptFile, scriptName, pathInfo, contentLength)
+
+	responseReader, responseWriter := io.Pipe()
+	go func() {
+		var err error
+		if cgiSettings.FastCGI != "" {
+			err = doFastCGIRequest(ctx, cgiSettings.FastCGI, env, body, responseWriter, &pluginOutputLogger{command: scriptFile})
+		} else {
+			err = runCGIScript(ctx, cgiSettings, scriptFile, env, body, responseWriter)
+		}
+		responseWriter.CloseWithError(err)
+	}()
+
+	err := writeCGIResponse(res, req, responseReader)
+	responseReader.CloseWithError(err)
+	if err != nil {
+		if err == errCGIResponseStarted {
+			logger.LogWarning("CGI script %s output cut short", scriptFile)
+		} else if ctx.Err() == context.DeadlineExceeded {
+			logger.LogWarning("CGI script %s timed out after %s", scriptFile, cgiSettings.Timeout)
+			WriteErrorResponse(res, req, http.StatusGatewayTimeout, "")
+		} else {
+			logger.LogWarning("CGI script %s failed with error: %s", scriptFile, err.Error())
+			WriteErrorResponse(res, req, http.StatusBadGateway, "")
+		}
+		return false
+	}
+	return true
+}
+
+/*
+runCGIScript runs scriptFile with env, feeding it body and copying its output to stdout. The script is killed when ctx is done.
+*/
+func runCGIScript(ctx context.Context, cgiSettings *CGISettings, scriptFile string, env []string, body io.Reader, stdout io.Writer) error {
+	cmd := exec.CommandContext(ctx, scriptFile)
+	cmd.Dir = filepath.Dir(scriptFile)
+	cmd.Env = append([]string{"PATH=" + os.Getenv("PATH")}, env...)
+	for _, name := range cgiSettings.InheritEnv {
+		if value, bOk := os.LookupEnv(name); bOk {
+			cmd.Env = append(cmd.Env, name+"="+value)
+		}
+	}
+	cmd.Stdin = body
+	cmd.Stdout = stdout
+	cmd.Stderr = &pluginOutputLogger{command: scriptFile}
+	// do not wait on children of the script that hold on to its output
+	cmd.WaitDelay = time.Second
+	return cmd.Run()
+}
+
+// errCGIResponseStarted is returned by writeCGIResponse if the output failed after the response was sent
+var errCGIResponseStarted = errors.New("CGI output failed after the response started")
+
+/*
+writeCGIResponse parses the CGI response (RFC 3875 section 6) read from output and sends it. A "Status" header
+sets the status, a "Location" header without one results in a 302.
+*/
+func writeCGIResponse(res http.ResponseWriter, req *http.Request, output io.Reader) error {
+	reader := bufio.NewReader(output)
+	header, err := textproto.NewReader(reader).ReadMIMEHeader()
+	if err != nil {
+		if err == io.EOF {
+			err = errors.New("no CGI response headers")
+		}
+		return err
+	}
+
+	status := http.StatusOK
+	if statusLine := header.Get("Status"); statusLine != "" {
+		codeString, _, _ := strings.Cut(statusLine, " ")
+		if status, err = strconv.Atoi(codeString); err != nil || status < 100 || status > 999 {
+			return errors.New("bad CGI status: " + statusLine)
+		}
+		header.Del("Status")
+	} else if header.Get("Location") != "" {
+		status = http.StatusFound
+	}
+
+	for name, values := range header {
+		res.Header()[name] = values
+	}
+	res.WriteHeader(status)
+	if req.Method == http.MethodHead {
+		io.Copy(io.Discard, reader)
+		return nil
+	}
+	if _, err = io.Copy(res, reader); err != nil {
+		return errCGIResponseStarted
+	}
+	return nil
+}
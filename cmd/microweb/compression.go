@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/CanadianCommander/MicroWeb/pkg/cache"
+	"github.com/CanadianCommander/MicroWeb/pkg/logger"
+	mwsettings "github.com/CanadianCommander/MicroWeb/pkg/mwSettings"
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	encodingBrotli = "br"
+	encodingGzip   = "gzip"
+	// used when "tune/compressMinSize" is not set
+	defaultCompressMinSize = 1024
+)
+
+// supportedEncodings in order of preference
+var supportedEncodings = []string{encodingBrotli, encodingGzip}
+
+// file extension of precompressed siblings, ex. "app.js.br"
+var encodingExtensions = map[string]string{encodingBrotli: ".br", encodingGzip: ".gz"}
+
+// used when "tune/compressMimeTypes" is not set
+var defaultCompressMimeTypes = []string{"text/*", "application/javascript", "application/json", "application/xml",
+	"application/wasm", "image/svg+xml"}
+
+//AddCompressionSettingDecoders adds setting decoders for the compression settings in the "tune" section of the config file
+func AddCompressionSettingDecoders() {
+	compressionSettings := []string{"tune/compress", "tune/compressMimeTypes", "tune/compressMinSize"}
+
+	for _, set := range compressionSettings {
+		mwsettings.AddSettingDecoder(mwsettings.NewBasicDecoder(set))
+	}
+}
+
+/*
+IsCompressionEnabled returns true if responses are compressed. Configured in the "tune" section of the config file:
+	"tune": {
+	  "compress":          true,
+	  "compressMimeTypes": ["text/*", "application/javascript", "application/json"],
+	  "compressMinSize":   1024
+	}
+Responses are compressed with brotli or gzip, as negotiated with Accept-Encoding, if there Content-Type
+matches "compressMimeTypes" and they are at least "compressMinSize" bytes long. Static files with a ".br" or ".gz"
+sibling (ex. "app.js.br") are served precompressed from the sibling regardless of type and size. Compressed variants
+of other static files are kept in the resource cache. Plugins can opt out per response with pluginUtil.DisableCompression.
+*/
+func IsCompressionEnabled() bool {
+	return mwsettings.GetSettingBool("tune/compress")
+}
+
+// getCompressMinSize returns the size, in bytes, under which responses are not compressed
+func getCompressMinSize() int {
+	if !mwsettings.HasSetting("tune/compressMinSize") {
+		return defaultCompressMinSize
+	}
+	return mwsettings.GetSettingInt("tune/compressMinSize")
+}
+
+/*
+isCompressibleType returns true if contentType matches "tune/compressMimeTypes". Patterns are
+full MIME types or a type followed by "/*", ex. "text/*".
+*/
+func isCompressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	patterns := defaultCompressMimeTypes
+	if mwsettings.HasSetting("tune/compressMimeTypes") {
+		if patterns, err = decodeStringList(mwsettings.GetSetting("tune/compressMimeTypes")); err != nil {
+			logger.LogError("bad value for tune/compressMimeTypes: %s", err.Error())
+			return false
+		}
+	}
+
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if pattern == mediaType || (strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, pattern[:len(pattern)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+negotiateEncoding picks the content coding to use from available based on the Accept-Encoding header of req.
+The encoding with the highest q value wins, ties are broken by the order of available. "" is returned if
+none of available are acceptable, in which case the response should not be encoded.
+*/
+func negotiateEncoding(req *http.Request, available []string) string {
+	accept := req.Header.Get("Accept-Encoding")
+	if accept == "" || len(available) == 0 {
+		return ""
+	}
+
+	qValues := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if parsed, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		qValues[coding] = q
+	}
+
+	bestEncoding := ""
+	bestQ := 0.0
+	for _, encoding := range available {
+		q, bOk := qValues[encoding]
+		if !bOk {
+			q, bOk = qValues["*"]
+		}
+		if bOk && q > bestQ {
+			bestEncoding = encoding
+			bestQ = q
+		}
+	}
+	return bestEncoding
+}
+
+/*
+findPrecompressedSibling returns the encoding and path of the best precompressed sibling of fsPath acceptable
+to the client, ex. ("br", "/var/www/app.js.br"). If there is none ("", fsPath) is returned.
+*/
+func findPrecompressedSibling(req *http.Request, fsPath string) (string, string) {
+	var available []string
+	for _, encoding := range supportedEncodings {
+		if fInfo, err := os.Stat(fsPath + encodingExtensions[encoding]); err == nil && !fInfo.IsDir() {
+			available = append(available, encoding)
+		}
+	}
+
+	encoding := negotiateEncoding(req, available)
+	if encoding == "" {
+		return "", fsPath
+	}
+	return encoding, fsPath + encodingExtensions[encoding]
+}
+
+/*
+getCompressedResource returns resource compressed with encoding. The compressed variant is kept in
+the resource cache under CacheTypeCompressedResource so that each file is compressed once.
+*/
+func getCompressedResource(fsPath string, resource *cache.Resource, encoding string) (*cache.Resource, error) {
+	cacheName := encoding + ":" + fsPath
+	if cached, bOk := cache.FetchFromCache(cache.CacheTypeCompressedResource, cacheName).(*cache.Resource); bOk && cached.ModTime.Equal(resource.ModTime) {
+		return cached, nil
+	}
+
+	var buff bytes.Buffer
+	encoder, err := newEncoder(&buff, encoding)
+	if err != nil {
+		return nil, err
+	}
+	encoder.Write(*resource.Buffer)
+	if err = encoder.Close(); err != nil {
+		return nil, err
+	}
+
+	compressed := buff.Bytes()
+	compressedResource := &cache.Resource{Buffer: &compressed, ModTime: resource.ModTime, ETag: encodedETag(resource.ETag, encoding)}
+	cache.RemoveFromCache(cache.CacheTypeCompressedResource, cacheName)
+	cache.AddToCache(cache.CacheTypeCompressedResource, cacheName, compressedResource)
+	return compressedResource, nil
+}
+
+// encodedETag derives the entity tag of an encoded representation from the tag of the identity representation
+func encodedETag(eTag string, encoding string) string {
+	if !strings.HasSuffix(eTag, "\"") {
+		return eTag
+	}
+	return eTag[:len(eTag)-1] + "-" + encoding + "\""
+}
+
+// encoder is a compressing writer
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+func newEncoder(w io.Writer, encoding string) (encoder, error) {
+	switch encoding {
+	case encodingBrotli:
+		return brotli.NewWriterLevel(w, brotli.DefaultCompression), nil
+	case encodingGzip:
+		return gzip.NewWriterLevel(w, gzip.DefaultCompression)
+	}
+	return nil, errors.New("unsupported content encoding: " + encoding)
+}
+
+/*
+compressResponseWriter compresses a response on the fly. The first "tune/compressMinSize" bytes are buffered
+to decide if the response is worth compressing, the rest is compressed as it is written.
+Call Close once the response is complete.
+*/
+type compressResponseWriter struct {
+	res      http.ResponseWriter
+	encoding string
+	minSize  int
+
+	buff       []byte
+	statusCode int
+	encoder    encoder
+
+	bDecided  bool
+	bDisabled bool
+	bHijacked bool
+}
+
+/*
+newCompressResponseWriter wraps res for on-the-fly compression, if it is enabled and the client accepts a supported encoding.
+Otherwise res is returned unchanged.
+*/
+func newCompressResponseWriter(res http.ResponseWriter, req *http.Request) http.ResponseWriter {
+	if !IsCompressionEnabled() || req.Method == http.MethodHead {
+		return res
+	}
+	return &compressResponseWriter{
+		res:      res,
+		encoding: negotiateEncoding(req, supportedEncodings),
+		minSize:  getCompressMinSize(),
+	}
+}
+
+func (cRes *compressResponseWriter) Header() http.Header {
+	return cRes.res.Header()
+}
+
+func (cRes *compressResponseWriter) WriteHeader(statusCode int) {
+	if cRes.bDecided || statusCode < 200 {
+		cRes.res.WriteHeader(statusCode)
+		return
+	}
+	if cRes.statusCode != 0 {
+		return
+	}
+
+	cRes.statusCode = statusCode
+	if statusCode == http.StatusNoContent || statusCode == http.StatusNotModified {
+		// no body
+		cRes.decide(false)
+	}
+}
+
+func (cRes *compressResponseWriter) Write(data []byte) (int, error) {
+	if !cRes.bDecided {
+		cRes.buff = append(cRes.buff, data...)
+		if len(cRes.buff) < cRes.minSize {
+			return len(data), nil
+		}
+		return len(data), cRes.decide(true)
+	}
+
+	if cRes.encoder != nil {
+		return cRes.encoder.Write(data)
+	}
+	return cRes.res.Write(data)
+}
+
+/*
+decide compresses the response if it qualifies, then sends the header and any buffered body.
+bBigEnough is true if the response is at least "tune/compressMinSize" bytes or is being streamed.
+*/
+func (cRes *compressResponseWriter) decide(bBigEnough bool) error {
+	cRes.bDecided = true
+	header := cRes.res.Header()
+
+	if header.Get("Content-Type") == "" && len(cRes.buff) > 0 {
+		// same as net/http would do for the uncompressed body
+		header.Set("Content-Type", http.DetectContentType(cRes.buff))
+	}
+
+	bCompressible := !cRes.bDisabled && isCompressibleType(header.Get("Content-Type")) &&
+		header.Get("Content-Encoding") == "" && header.Get("Content-Range") == "" &&
+		(cRes.statusCode == 0 || cRes.statusCode == http.StatusOK)
+	if bCompressible && bBigEnough {
+		header.Add("Vary", "Accept-Encoding")
+	}
+
+	if bCompressible && bBigEnough && cRes.encoding != "" {
+		var err error
+		if cRes.encoder, err = newEncoder(cRes.res, cRes.encoding); err != nil {
+			return err
+		}
+		header.Set("Content-Encoding", cRes.encoding)
+		header.Del("Content-Length")
+		header.Del("Accept-Ranges")
+		if eTag := header.Get("ETag"); eTag != "" {
+			header.Set("ETag", encodedETag(eTag, cRes.encoding))
+		}
+	}
+
+	if cRes.statusCode != 0 {
+		cRes.res.WriteHeader(cRes.statusCode)
+	}
+	if len(cRes.buff) > 0 {
+		buff := cRes.buff
+		cRes.buff = nil
+		if _, err := cRes.Write(buff); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ReadFrom lets io.Copy, and so http.ServeContent, hand the body over in one go. Once the response is known not to be
+compressed the source goes straight to the wrapped response writer, keeping sendfile for static files.
+*/
+func (cRes *compressResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	var written int64
+	if !cRes.bDecided {
+		// buffer up to the minimum size, through Write, to decide as Write would
+		toFill := int64(cRes.minSize - len(cRes.buff))
+		if toFill < 1 {
+			toFill = 1
+		}
+		n, err := io.CopyN(writerOnly{cRes}, src, toFill)
+		written += n
+		if err == io.EOF {
+			return written, nil
+		} else if err != nil {
+			return written, err
+		}
+		if !cRes.bDecided {
+			if err = cRes.decide(true); err != nil {
+				return written, err
+			}
+		}
+	}
+
+	var n int64
+	var err error
+	if cRes.encoder != nil {
+		n, err = io.Copy(cRes.encoder, src)
+	} else if readerFrom, bOk := cRes.res.(io.ReaderFrom); bOk {
+		n, err = readerFrom.ReadFrom(src)
+	} else {
+		n, err = io.Copy(writerOnly{cRes.res}, src)
+	}
+	return written + n, err
+}
+
+// writerOnly hides the ReadFrom of a writer, so that io.Copy to it does not call back in to ReadFrom
+type writerOnly struct {
+	io.Writer
+}
+
+/*
+DisableCompression opts this response out of compression, see pluginUtil.DisableCompression
+*/
+func (cRes *compressResponseWriter) DisableCompression() {
+	cRes.bDisabled = true
+}
+
+// Flush sends any buffered data to the client. Streamed responses are compressed regardless of size
+func (cRes *compressResponseWriter) Flush() {
+	if !cRes.bDecided {
+		cRes.decide(true)
+	}
+	if cRes.encoder != nil {
+		cRes.encoder.Flush()
+	}
+	if flusher, bOk := cRes.res.(http.Flusher); bOk {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets plugins take over the connection, ex. for WebSocket. Nothing is compressed after hijacking
+func (cRes *compressResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, bOk := cRes.res.(http.Hijacker)
+	if !bOk {
+		return nil, nil, errors.New("connection does not support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil {
+		cRes.bHijacked = true
+	}
+	return conn, rw, err
+}
+
+// Unwrap returns the wrapped response writer, for use by http.ResponseController
+func (cRes *compressResponseWriter) Unwrap() http.ResponseWriter {
+	return cRes.res
+}
+
+// Close completes the response, sending any buffered data and finishing the compressed stream
+func (cRes *compressResponseWriter) Close() error {
+	if cRes.bHijacked {
+		return nil
+	}
+	if !cRes.bDecided {
+		if err := cRes.decide(false); err != nil {
+			return err
+		}
+	}
+	if cRes.encoder != nil {
+		return cRes.encoder.Close()
+	}
+	return nil
+}
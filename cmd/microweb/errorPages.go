@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/CanadianCommander/MicroWeb/pkg/logger"
+	mwsettings "github.com/CanadianCommander/MicroWeb/pkg/mwSettings"
+	"github.com/CanadianCommander/MicroWeb/pkg/pluginUtil"
+	"github.com/CanadianCommander/MicroWeb/pkg/templateHelper"
+)
+
+const (
+	errorPageSettingPath = "errorPages"
+	// header carrying the request ID, see assignRequestID
+	requestIDHeader = "X-Request-Id"
+	// longest client supplied request ID that is accepted
+	maxRequestIDLength = 128
+)
+
+/*
+ErrorContext is the data error page templates are executed with.
+*/
+type ErrorContext struct {
+	Status     int
+	StatusText string
+	Method     string
+	Path       string
+	Host       string
+	RequestID  string
+	// human readable explanation of the error, may be ""
+	Detail string
+}
+
+/*
+problemDetails is a RFC 7807 problem+json body
+*/
+type problemDetails struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+//AddErrorPageSettingDecoder adds a decoder for the "errorPages" section of the config file.
+func AddErrorPageSettingDecoder() {
+	mwsettings.AddSettingDecoder(mwsettings.NewFunctionalSettingDecoder(func(s interface{}) (string, interface{}) {
+		errorPages, err := decodeErrorPages(s)
+		if err != nil {
+			logger.LogError("Error parsing errorPages: %s", err.Error())
+			return "ERROR", nil
+		}
+		return errorPageSettingPath, errorPages
+	},
+		func(path string) bool {
+			return path == errorPageSettingPath
+		}))
+}
+
+/*
+decodeErrorPages decodes a map of status to error page, ex.
+	"errorPages": {
+	  "404":     "/var/www/errors/404.html",
+	  "5xx":     "/var/www/errors/5xx.gohtml",
+	  "default": "/var/www/errors/error.gohtml"
+	}
+Keys are a status code, a status class ("4xx", "5xx") or "default". Pages ending in ".gohtml" are executed
+as html/template templates with an ErrorContext, other pages are served as is.
+*/
+func decodeErrorPages(raw interface{}) (map[string]string, error) {
+	rawMap, bOk := raw.(map[string]interface{})
+	if !bOk {
+		return nil, errors.New("errorPages must be an object")
+	}
+
+	errorPages := make(map[string]string, len(rawMap))
+	for key, rawPage := range rawMap {
+		page, bOk := rawPage.(string)
+		if !bOk {
+			return nil, errors.New("error page for " + key + " must be a string")
+		}
+		errorPages[strings.ToLower(key)] = page
+	}
+	return errorPages, nil
+}
+
+/*
+getErrorPage returns the error page configured for status, the most specific match wins. "" if there is none.
+*/
+func (vhost *VirtualHost) getErrorPage(status int) string {
+	statusString := strconv.Itoa(status)
+	for _, key := range []string{statusString, statusString[:1] + "xx", "default"} {
+		if page, bOk := vhost.ErrorPages[key]; bOk {
+			return page
+		}
+	}
+	return ""
+}
+
+/*
+WriteErrorResponse writes an error response for req. Clients that prefer JSON over HTML (by there Accept header)
+get a RFC 7807 problem+json body. Everyone else gets the error page configured for status in the requests virtual host,
+or a short plain text message if there is none. This is also what plugins get from pluginUtil.WriteError.
+*/
+func WriteErrorResponse(res http.ResponseWriter, req *http.Request, status int, detail string) {
+	errorContext := ErrorContext{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Method:     req.Method,
+		Path:       req.URL.Path,
+		Host:       req.Host,
+		RequestID:  pluginUtil.GetRequestID(req),
+		Detail:     detail,
+	}
+
+	res.Header().Add("Vary", "Accept")
+	res.Header().Del("Content-Length")
+	res.Header().Del("Content-Encoding")
+	res.Header().Del("ETag")
+	res.Header().Set("Cache-Control", "no-store")
+
+	if wantsProblemJSON(req) {
+		writeProblemJSON(res, errorContext)
+		return
+	}
+
+	if page := GetVirtualHost(req).getErrorPage(status); page != "" {
+		if writeErrorPage(res, page, errorContext) {
+			return
+		}
+	}
+
+	res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	res.Header().Set("X-Content-Type-Options", "nosniff")
+	res.WriteHeader(status)
+	res.Write([]byte(strconv.Itoa(status) + " " + errorContext.StatusText + "\n"))
+}
+
+// writeProblemJSON writes errorContext as a RFC 7807 problem+json body
+func writeProblemJSON(res http.ResponseWriter, errorContext ErrorContext) {
+	res.Header().Set("Content-Type", "application/problem+json")
+	res.WriteHeader(errorContext.Status)
+	json.NewEncoder(res).Encode(problemDetails{
+		Type:      "about:blank",
+		Title:     errorContext.StatusText,
+		Status:    errorContext.Status,
+		Detail:    errorContext.Detail,
+		Instance:  errorContext.Path,
+		RequestID: errorContext.RequestID,
+	})
+}
+
+/*
+writeErrorPage writes the error page at pagePath. If the page cannot be read or rendered nothing is written
+and false is returned.
+*/
+func writeErrorPage(res http.ResponseWriter, pagePath string, errorContext ErrorContext) bool {
+	buff := ReadFileToBuff(pagePath)
+	if buff == nil {
+		logger.LogError("Could not read error page: %s", pagePath)
+		return false
+	}
+
+	if path.Ext(pagePath) != templateFileExt {
+		if mimeType := mime.TypeByExtension(path.Ext(pagePath)); mimeType != "" {
+			res.Header().Set("Content-Type", mimeType)
+		}
+		res.WriteHeader(errorContext.Status)
+		res.Write(*buff)
+		return true
+	}
+
+	// render in to a buffer first so that a broken template does not leave a half written page
+	var page strings.Builder
+	if err := templateHelper.ProcessTemplateHTML(buff, &page, errorContext); err != nil {
+		logger.LogError("Could not render error page: %s with error: %s", pagePath, err.Error())
+		return false
+	}
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	res.WriteHeader(errorContext.Status)
+	res.Write([]byte(page.String()))
+	return true
+}
+
+// wantsProblemJSON returns true if the client prefers a JSON error body over HTML
+func wantsProblemJSON(req *http.Request) bool {
+	accept := req.Header.Get("Accept")
+	return (strings.Contains(accept, "application/json") || strings.Contains(accept, "application/problem+json")) &&
+		!strings.Contains(accept, "text/html")
+}
+
+/*
+assignRequestID gives req a request ID, see pluginUtil.GetRequestID, and sends it to the client in the X-Request-Id header.
+A well formed X-Request-Id sent by the client (or a proxy in front of us) is kept, else a random ID is generated.
+*/
+func assignRequestID(res http.ResponseWriter, req *http.Request) *http.Request {
+	requestID := req.Header.Get(requestIDHeader)
+	if !isValidRequestID(requestID) {
+		idBytes := make([]byte, 16)
+		rand.Read(idBytes)
+		requestID = hex.EncodeToString(idBytes)
+	}
+
+	res.Header().Set(requestIDHeader, requestID)
+	return pluginUtil.WithRequestID(req, requestID)
+}
+
+// isValidRequestID returns true if requestID is non empty, not too long and made of characters safe to log and echo
+func isValidRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		return false
+	}
+	for _, char := range requestID {
+		bSafe := (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') || (char >= '0' && char <= '9') ||
+			char == '-' || char == '_' || char == '.'
+		if !bSafe {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// FastCGI record types and roles, see the FastCGI specification
+const (
+	fcgiVersion1      = 1
+	fcgiBeginRequest  = 1
+	fcgiEndRequest    = 3
+	fcgiParams        = 4
+	fcgiStdin         = 5
+	fcgiStdout        = 6
+	fcgiStderr        = 7
+	fcgiRoleResponder = 1
+	// protocol status of a completed request in the end request record
+	fcgiRequestComplete = 0
+	fcgiMaxContent      = 65535
+	// all requests are sent on a connection of there own
+	fcgiRequestID = 1
+)
+
+/*
+doFastCGIRequest sends a request, made up of the CGI environment env and body, to the FastCGI responder at address
+(host:port or unix:/path) and copies the CGI response the responder sends to stdout, and its error output to stderr.
+The connection is closed when ctx is done.
+*/
+func doFastCGIRequest(ctx context.Context, address string, env []string, body io.Reader, stdout io.Writer, stderr io.Writer) error {
+	network := "tcp"
+	if strings.HasPrefix(address, "unix:") {
+		network, address = "unix", strings.TrimPrefix(address, "unix:")
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stopClose := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stopClose()
+
+	writer := bufio.NewWriter(conn)
+	// begin request: role, flags (0, close the connection when done), 5 reserved bytes
+	beginBody := []byte{0, fcgiRoleResponder, 0, 0, 0, 0, 0, 0}
+	if err = writeFCGIRecord(writer, fcgiBeginRequest, beginBody); err != nil {
+		return err
+	}
+	if err = writeFCGIStream(writer, fcgiParams, bytes.NewReader(encodeFCGIParams(env))); err != nil {
+		return err
+	}
+	if err = writeFCGIStream(writer, fcgiStdin, body); err != nil {
+		return err
+	}
+	if err = writer.Flush(); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(conn)
+	for {
+		recordType, content, err := readFCGIRecord(reader)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		switch recordType {
+		case fcgiStdout:
+			if _, err = stdout.Write(content); err != nil {
+				return err
+			}
+		case fcgiStderr:
+			stderr.Write(content)
+		case fcgiEndRequest:
+			if len(content) < 5 {
+				return errors.New("short FastCGI end request record")
+			}
+			if content[4] != fcgiRequestComplete {
+				return fmt.Errorf("FastCGI responder rejected the request with protocol status %d", content[4])
+			}
+			return nil
+		}
+	}
+}
+
+// writeFCGIRecord writes a single record of recordType, content must not be longer than fcgiMaxContent
+func writeFCGIRecord(writer io.Writer, recordType byte, content []byte) error {
+	padding := (8 - len(content)%8) % 8
+	header := []byte{fcgiVersion1, recordType, 0, fcgiRequestID, byte(len(content) >> 8), byte(len(content)), byte(padding), 0}
+	if _, err := writer.Write(header); err != nil {
+		return err
+	}
+	if _, err := writer.Write(content); err != nil {
+		return err
+	}
+	_, err := writer.Write(make([]byte, padding))
+	return err
+}
+
+// writeFCGIStream writes all of source as a stream of recordType records, followed by the empty record ending the stream
+func writeFCGIStream(writer io.Writer, recordType byte, source io.Reader) error {
+	buffer := make([]byte, fcgiMaxContent)
+	for {
+		n, err := source.Read(buffer)
+		if n > 0 {
+			if wErr := writeFCGIRecord(writer, recordType, buffer[:n]); wErr != nil {
+				return wErr
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	return writeFCGIRecord(writer, recordType, nil)
+}
+
+// readFCGIRecord reads one record, returning its type and content
+func readFCGIRecord(reader io.Reader) (byte, []byte, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, nil, err
+	}
+	if header[0] != fcgiVersion1 {
+		return 0, nil, errors.New("unsupported FastCGI version")
+	}
+
+	contentLength := binary.BigEndian.Uint16(header[4:6])
+	content := make([]byte, int(contentLength)+int(header[6]))
+	if _, err := io.ReadFull(reader, content); err != nil {
+		return 0, nil, err
+	}
+	return header[1], content[:contentLength], nil
+}
+
+// encodeFCGIParams encodes the NAME=value pairs of env as FastCGI name value pairs
+func encodeFCGIParams(env []string) []byte {
+	var params []byte
+	for _, pair := range env {
+		name, value, _ := strings.Cut(pair, "=")
+		params = appendFCGILength(params, len(name))
+		params = appendFCGILength(params, len(value))
+		params = append(params, name...)
+		params = append(params, value...)
+	}
+	return params
+}
+
+// appendFCGILength appends length in 1 byte if it is below 128, otherwise in 4 bytes with the high bit set
+func appendFCGILength(buffer []byte, length int) []byte {
+	if length < 128 {
+		return append(buffer, byte(length))
+	}
+	return binary.BigEndian.AppendUint32(buffer, uint32(length)|1<<31)
+}
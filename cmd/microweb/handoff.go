@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CanadianCommander/MicroWeb/pkg/logger"
+)
+
+const (
+	// inheritedListenersEnv lists the addresses of the listening sockets passed to a new process on hand off.
+	// the sockets are passed as file descriptors 3, 4, ... in the same order.
+	inheritedListenersEnv = "MICROWEB_LISTENERS"
+	// handOffReadyEnv holds the file descriptor of the pipe a new process writes to once it is ready to serve
+	handOffReadyEnv = "MICROWEB_READY_FD"
+	// how long to wait for a new process to become ready
+	handOffTimeout = 30 * time.Second
+	// first file descriptor passed through exec.Cmd.ExtraFiles
+	firstExtraFD = 3
+)
+
+var inheritedListenersLock = sync.Mutex{}
+var inheritedListeners map[string]net.Listener
+
+/*
+Listen works like net.Listen but if a listening socket for addr was inherited from a previous
+process (see HandOffListeners) that socket is used instead.
+*/
+func Listen(proto string, addr string) (net.Listener, error) {
+	inheritedListenersLock.Lock()
+	defer inheritedListenersLock.Unlock()
+	loadInheritedListeners()
+
+	if listener, bOk := inheritedListeners[addr]; bOk {
+		logger.LogInfo("Using inherited socket for %s", addr)
+		delete(inheritedListeners, addr)
+		return listener, nil
+	}
+	return net.Listen(proto, addr)
+}
+
+/*
+CloseUnusedInheritedListeners closes any inherited sockets that have not been claimed by Listen.
+This happens when the listen addresses are changed in the configuration between processes.
+*/
+func CloseUnusedInheritedListeners() {
+	inheritedListenersLock.Lock()
+	defer inheritedListenersLock.Unlock()
+	loadInheritedListeners()
+
+	for addr, listener := range inheritedListeners {
+		logger.LogInfo("Closing unused inherited socket for %s", addr)
+		listener.Close()
+		delete(inheritedListeners, addr)
+	}
+}
+
+/*
+SignalHandOffReady tells the process that started us (if any) that we are ready to serve requests.
+The old process will then start shutting down.
+*/
+func SignalHandOffReady() {
+	fdString := os.Getenv(handOffReadyEnv)
+	if fdString == "" {
+		return
+	}
+	os.Unsetenv(handOffReadyEnv)
+
+	fd, err := strconv.Atoi(fdString)
+	if err != nil {
+		logger.LogError("bad value for %s: %s", handOffReadyEnv, fdString)
+		return
+	}
+
+	readyPipe := os.NewFile(uintptr(fd), "ready")
+	readyPipe.Write([]byte("ready"))
+	readyPipe.Close()
+}
+
+/*
+HandOffListeners starts a new copy of this program, passing it the listening sockets of svr, its
+virtual host listeners and its redirect servers. It returns once the new process reports that it is ready to serve requests, at which
+point this process should shutdown. The pid of the new process is returned. Because the sockets are never closed no connections are dropped.
+*/
+func HandOffListeners(svr *HTTPServer) (int, error) {
+	servers := svr.allServers()
+
+	var addrList []string
+	var files []*os.File
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	for _, server := range servers {
+		listener := server.tcpListener
+		if onceListener, bOk := listener.(*closeOnceListener); bOk {
+			listener = onceListener.Listener
+		}
+		tcpListener, bOk := listener.(*net.TCPListener)
+		if !bOk {
+			continue
+		}
+
+		file, err := tcpListener.File()
+		if err != nil {
+			return 0, err
+		}
+		files = append(files, file)
+		addrList = append(addrList, server.server.Addr)
+	}
+
+	readyRead, readyWrite, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer readyRead.Close()
+	files = append(files, readyWrite)
+
+	executable, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(filterEnv(os.Environ(), inheritedListenersEnv, handOffReadyEnv),
+		inheritedListenersEnv+"="+strings.Join(addrList, ","),
+		handOffReadyEnv+"="+strconv.Itoa(firstExtraFD+len(files)-1))
+
+	err = cmd.Start()
+	if err != nil {
+		return 0, err
+	}
+	// close our copy of the write end so that read returns if the child exits
+	readyWrite.Close()
+	files = files[:len(files)-1]
+
+	readyChan := make(chan error, 1)
+	go func() {
+		buff := make([]byte, 5)
+		_, err := readyRead.Read(buff)
+		readyChan <- err
+	}()
+
+	select {
+	case err = <-readyChan:
+		if err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return 0, errors.New("new process exited before becoming ready")
+		}
+	case <-time.After(handOffTimeout):
+		cmd.Process.Kill()
+		cmd.Wait()
+		return 0, errors.New("timed out waiting for new process to become ready")
+	}
+
+	// the new process outlives us, we never wait on it
+	pid := cmd.Process.Pid
+	cmd.Process.Release()
+	return pid, nil
+}
+
+// loadInheritedListeners builds the inherited listener map from the environment. Lock inheritedListenersLock first.
+func loadInheritedListeners() {
+	if inheritedListeners != nil {
+		return
+	}
+	inheritedListeners = make(map[string]net.Listener)
+
+	addrString := os.Getenv(inheritedListenersEnv)
+	if addrString == "" {
+		return
+	}
+	os.Unsetenv(inheritedListenersEnv)
+
+	for i, addr := range strings.Split(addrString, ",") {
+		file := os.NewFile(uintptr(firstExtraFD+i), addr)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			logger.LogError("Could not use inherited socket for %s with error: %s", addr, err.Error())
+			continue
+		}
+		inheritedListeners[addr] = listener
+	}
+}
+
+// filterEnv returns env with the given variables removed
+func filterEnv(env []string, names ...string) []string {
+	out := make([]string, 0, len(env))
+	for _, variable := range env {
+		bKeep := true
+		for _, name := range names {
+			if strings.HasPrefix(variable, name+"=") {
+				bKeep = false
+				break
+			}
+		}
+		if bKeep {
+			out = append(out, variable)
+		}
+	}
+	return out
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/CanadianCommander/MicroWeb/pkg/logger"
+	mwsettings "github.com/CanadianCommander/MicroWeb/pkg/mwSettings"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+/*
+HTTP2Options controls how HTTP/2 is served. HTTP/2 is always offered on TLS listeners through ALPN.
+If H2C is set, plain HTTP listeners also serve HTTP/2 over clear text (RFC 7540 prior knowledge or
+"Upgrade: h2c"), for deployments behind a TLS terminating proxy. Zero values use the http2 package defaults.
+*/
+type HTTP2Options struct {
+	H2C                  bool
+	MaxConcurrentStreams uint32
+	MaxReadFrameSize     uint32
+	// how long an idle HTTP/2 connection is kept open. Defaults to the read timeout of the server
+	IdleTimeout time.Duration
+}
+
+/*
+GetHTTP2Options returns the HTTP/2 options set in the config file:
+	"general": {
+	  "enableH2C": true
+	},
+	"tune": {
+	  "http2MaxConcurrentStreams": 250,
+	  "http2MaxFrameSize":         16384,
+	  "http2IdleTimeout":          "120s"
+	}
+*/
+func GetHTTP2Options() *HTTP2Options {
+	options := &HTTP2Options{
+		H2C:                  mwsettings.GetSettingBool("general/enableH2C"),
+		MaxConcurrentStreams: uint32(mwsettings.GetSettingInt("tune/http2MaxConcurrentStreams")),
+		MaxReadFrameSize:     uint32(mwsettings.GetSettingInt("tune/http2MaxFrameSize")),
+	}
+
+	if mwsettings.HasSetting("tune/http2IdleTimeout") {
+		idleTimeout, err := time.ParseDuration(mwsettings.GetSettingString("tune/http2IdleTimeout"))
+		if err != nil {
+			logger.LogError("Could not parse HTTP/2 idle timeout: %s. using default",
+				mwsettings.GetSettingString("tune/http2IdleTimeout"))
+		} else {
+			options.IdleTimeout = idleTimeout
+		}
+	}
+	return options
+}
+
+/*
+checkHTTP2CipherSuites returns an error if tlsConfig offers HTTP/2 with a restricted cipher suite list lacking the
+suite HTTP/2 requires (RFC 7540 section 9.2.2), the check http2.ConfigureServer does on the servers own TLS configuration.
+*/
+func checkHTTP2CipherSuites(tlsConfig *tls.Config) error {
+	bH2 := false
+	for _, proto := range tlsConfig.NextProtos {
+		bH2 = bH2 || proto == http2.NextProtoTLS
+	}
+	if !bH2 || tlsConfig.CipherSuites == nil || tlsConfig.MinVersion >= tls.VersionTLS13 {
+		return nil
+	}
+
+	for _, suite := range tlsConfig.CipherSuites {
+		if suite == tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 || suite == tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+			return nil
+		}
+	}
+	return errors.New("tls/cipherSuites must include TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 " +
+		"for HTTP/2, or remove h2 from tls/alpn")
+}
+
+/*
+configureHTTP2 sets up HTTP/2 on server according to options, which may be nil for the defaults.
+handler is the handler the server should use, it is wrapped for h2c if required.
+Call after server.TLSConfig has been set.
+*/
+func configureHTTP2(server *http.Server, handler http.Handler, options *HTTP2Options) error {
+	if options == nil {
+		options = &HTTP2Options{}
+	}
+
+	h2Server := &http2.Server{
+		MaxConcurrentStreams: options.MaxConcurrentStreams,
+		MaxReadFrameSize:     options.MaxReadFrameSize,
+		IdleTimeout:          options.IdleTimeout,
+	}
+
+	bTLS := server.TLSConfig != nil
+	server.Handler = handler
+	if !bTLS && !options.H2C {
+		return nil
+	}
+
+	// even for h2c, ConfigureServer is needed so that HTTP/2 connections are sent GOAWAY on Shutdown
+	if err := http2.ConfigureServer(server, h2Server); err != nil {
+		return err
+	}
+	if !bTLS {
+		// ConfigureServer creates a TLS configuration, which would make serve() switch to HTTPS
+		server.TLSConfig = nil
+		server.Handler = h2c.NewHandler(handler, h2Server)
+	}
+	return nil
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/CanadianCommander/MicroWeb/pkg/database"
 	"github.com/CanadianCommander/MicroWeb/pkg/logger"
 	mwsettings "github.com/CanadianCommander/MicroWeb/pkg/mwSettings"
+	"github.com/CanadianCommander/MicroWeb/pkg/pluginUtil"
 	"github.com/CanadianCommander/MicroWeb/pkg/templateHelper"
 )
 
@@ -33,9 +34,17 @@ func main() {
 	// build setting decoders
 	AddPrimarySettingDecoders()
 	AddPluginSettingDecoder()
+	AddPluginRegistrySettingDecoders()
+	AddVirtualHostSettingDecoder()
 	AddSecuritySettingDecoders()
+	AddTLSSettingDecoders()
+	AddACMESettingDecoders()
+	AddCompressionSettingDecoders()
+	AddAutoIndexSettingDecoders()
+	AddErrorPageSettingDecoder()
 	AddLogSettingDecoders()
 	cache.AddCacheSettingDecoders()
+	pluginUtil.AddWebSocketSettingDecoders()
 	database.AddDatabaseSettingDecoder()
 	templateHelper.AddTemplateHelperSettingDecoders()
 
@@ -50,17 +59,34 @@ func main() {
 	}
 
 	//setup logging
-	InitLogging()
+	stopLogRotation := InitLogging()
+	defer logger.Flush()
+	if stopLogRotation != nil {
+		defer stopLogRotation()
+	}
 
 	// setup cache
 	cache.StartCache()
 
+	//plugins render errors through pluginUtil.WriteError
+	pluginUtil.SetErrorRenderer(WriteErrorResponse)
+
 	//load plugins
 	LoadAllPlugins()
 
+	// stop the proxies of bindings that have been removed
+	mwsettings.AddSettingListener(pruneReverseProxies)
+	mwsettings.AddSettingListener(prunePluginProcesses)
+	// a settings reload also picks up rebuilt plugins
+	mwsettings.AddSettingListener(ReloadAllPlugins)
+	mwsettings.AddSettingListener(notifyPluginsSettingsChanged)
+	mwsettings.AddSettingListener(resetPluginGuards)
+
 	if mwsettings.GetSettingBool("general/autoReloadSettings") {
 		stopChanAutoLoad := mwsettings.WatchConfigurationFile(mwsettings.GetSettingString("configurationFilePath"))
-		defer close(stopChanAutoLoad)
+		if stopChanAutoLoad != nil {
+			defer close(stopChanAutoLoad)
+		}
 	}
 
 	// listen for reload command on fifo.
@@ -81,15 +107,21 @@ func main() {
 	}
 
 	//create webserver
-	httpServer, err := CreateHTTPServer(mwsettings.GetSettingString("general/TCPPort"), mwsettings.GetSettingString("general/TCPProtocol"), logger.GetErrorLogger())
+	httpServer, err := CreateHTTPServer(mwsettings.GetSettingString("general/TCPPort"), mwsettings.GetSettingString("general/TCPProtocol"), logger.GetErrorLogger(), GetHTTP2Options())
 	if err != nil {
 		logger.LogError("Failed to start webserver")
 	} else {
 		EmitSecurityWarning()
 		// drop root privileges
 		DropRootPrivilege()
-		//start web server
+		StartPluginProcesses()
+		// shutdown gracefully on SIGTERM / SIGINT, hand off to a new process on SIGUSR2
+		HandleSignals(httpServer)
+		NotifyReady()
+		//start web server. returns once the server has been shutdown
 		httpServer.ServeHTTP()
+		ShutdownAllPlugins()
+		logger.LogInfo("Exiting")
 	}
 }
 
@@ -97,8 +129,9 @@ func main() {
 func AddPrimarySettingDecoders() {
 	basicSettings := []string{"general/TCPProtocol", "general/TCPPort", "general/staticDirectory",
 		"general/autoReloadSettings", "general/redirectPorts",
-		"general/redirectURL", "tls/enableTLS", "tls/certFile", "tls/keyFile", "tune/httpReadTimeout",
-		"tune/httpResponseTimeout", "tune/max-age"}
+		"general/redirectURL", "general/enableH2C", "tls/enableTLS", "tls/certFile", "tls/keyFile", "tune/httpReadTimeout",
+		"tune/httpResponseTimeout", "tune/max-age", "tune/shutdownTimeout", "tune/http2MaxConcurrentStreams",
+		"tune/http2MaxFrameSize", "tune/http2IdleTimeout"}
 
 	for _, set := range basicSettings {
 		basicDec := mwsettings.NewBasicDecoder(set)
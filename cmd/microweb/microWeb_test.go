@@ -1,23 +1,46 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/big"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/http/fcgi"
+	"net/http/httputil"
+	"net/url"
 	"os"
 	"os/exec"
 	"path"
 	"regexp"
 	"runtime"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/CanadianCommander/MicroWeb/pkg/cache"
 	"github.com/CanadianCommander/MicroWeb/pkg/logger"
 	mwsettings "github.com/CanadianCommander/MicroWeb/pkg/mwSettings"
+	"github.com/CanadianCommander/MicroWeb/pkg/pluginUtil"
+	"github.com/andybalholm/brotli"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/http2"
 )
 
 //TestMain sets up the testing environment
@@ -73,6 +96,7 @@ func buildNStartMicroWeb(srvCtx *context.Context) *exec.Cmd {
 
 	//build plugins
 	buildPlugins("../../testEnvironment/plugins/")
+	buildProcessPlugins("../../testEnvironment/processPlugins/")
 
 	//copy test file
 	copyTestEnv := exec.Command("cp", "-r", os.Getenv("GOPATH")+"/src/github.com/CanadianCommander/MicroWeb/testEnvironment", "/tmp/")
@@ -113,6 +137,29 @@ func buildPlugins(pluginDir string) {
 	}
 }
 
+/*
+buildProcessPlugins builds every out-of-process plugin found in the directory denoted by pluginDir.
+*/
+func buildProcessPlugins(pluginDir string) {
+	pluginDirList, err := ioutil.ReadDir(pluginDir)
+	if err != nil {
+		fmt.Printf("Could not read process plugin dir: %s with error: %s", pluginDir, err.Error())
+		os.Exit(1)
+	}
+
+	for _, file := range pluginDirList {
+		if file.IsDir() {
+			buildPath := path.Join(pluginDir, file.Name())
+			buildCmd := exec.Command("go", "build", "-o", path.Join(buildPath, file.Name()), buildPath)
+			buildError := buildCmd.Run()
+			if buildError != nil {
+				fmt.Printf("failed to build process plugin at path %s with error %s", buildPath, buildError.Error())
+				os.Exit(1)
+			}
+		}
+	}
+}
+
 //test getting normal html
 func TestHTTPNormalContent(t *testing.T) {
 	err := doGet("http://localhost:8080/normal.html", 200, func(b []byte) {
@@ -122,19 +169,1055 @@ func TestHTTPNormalContent(t *testing.T) {
 		}
 	})
 
-	if err != nil {
+	if err != nil {
+		t.Fail()
+	}
+
+	//index.html redirect
+	err = doGet("http://localhost:8080/", 200, func(b []byte) {
+		if matched, _ := regexp.MatchString("index.html", string(b)); !matched {
+			fmt.Printf("HTML file did not have expected string. It contained: %s", string(b))
+			t.Fail()
+		}
+	})
+
+	if err != nil {
+		t.Fail()
+	}
+}
+
+//test ETags, conditional GETs and byte range requests on static files
+func TestConditionalAndRangeRequests(t *testing.T) {
+	doRequest := func(headers map[string]string) *http.Response {
+		request, _ := http.NewRequest("GET", "http://localhost:8080/normal.html", nil)
+		for key, value := range headers {
+			request.Header.Set(key, value)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			fmt.Printf("Could Not send GET request with error: %s\n", err.Error())
+			t.Fail()
+			return &http.Response{Header: http.Header{}, Body: ioutil.NopCloser(&bytes.Buffer{})}
+		}
+		return response
+	}
+
+	response := doRequest(nil)
+	fullBody, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	eTag := response.Header.Get("ETag")
+	lastModified := response.Header.Get("Last-Modified")
+	if eTag == "" || lastModified == "" || response.Header.Get("Accept-Ranges") != "bytes" {
+		fmt.Printf("static file missing validators. ETag: %s Last-Modified: %s\n", eTag, lastModified)
+		t.Fail()
+		return
+	}
+
+	if response = doRequest(map[string]string{"If-None-Match": eTag}); response.StatusCode != 304 {
+		fmt.Printf("If-None-Match with current ETag got status %d expecting 304\n", response.StatusCode)
+		t.Fail()
+	}
+	if response = doRequest(map[string]string{"If-Modified-Since": lastModified}); response.StatusCode != 304 {
+		fmt.Printf("If-Modified-Since with current date got status %d expecting 304\n", response.StatusCode)
+		t.Fail()
+	}
+	if response = doRequest(map[string]string{"If-None-Match": "\"stale\""}); response.StatusCode != 200 {
+		fmt.Printf("If-None-Match with stale ETag got status %d expecting 200\n", response.StatusCode)
+		t.Fail()
+	}
+	if response = doRequest(map[string]string{"If-Match": "\"stale\""}); response.StatusCode != 412 {
+		fmt.Printf("If-Match with stale ETag got status %d expecting 412\n", response.StatusCode)
+		t.Fail()
+	}
+
+	response = doRequest(map[string]string{"Range": "bytes=4-9"})
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if response.StatusCode != 206 || !bytes.Equal(body, fullBody[4:10]) {
+		fmt.Printf("range request got status %d body: %s\n", response.StatusCode, string(body))
+		t.Fail()
+	}
+
+	response = doRequest(map[string]string{"Range": "bytes=0-1,4-5"})
+	body, _ = ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if response.StatusCode != 206 || !strings.HasPrefix(response.Header.Get("Content-Type"), "multipart/byteranges") ||
+		!bytes.Contains(body, fullBody[0:2]) || !bytes.Contains(body, fullBody[4:6]) {
+		fmt.Printf("multipart range request got status %d type %s\n", response.StatusCode, response.Header.Get("Content-Type"))
+		t.Fail()
+	}
+
+	// If-Range with a stale ETag returns the whole file
+	response = doRequest(map[string]string{"Range": "bytes=4-9", "If-Range": "\"stale\""})
+	body, _ = ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if response.StatusCode != 200 || !bytes.Equal(body, fullBody) {
+		fmt.Printf("If-Range with stale ETag got status %d expecting 200\n", response.StatusCode)
+		t.Fail()
+	}
+
+	if response = doRequest(map[string]string{"Range": "bytes=100000-"}); response.StatusCode != 416 {
+		fmt.Printf("unsatisfiable range got status %d expecting 416\n", response.StatusCode)
+		t.Fail()
+	}
+}
+
+//test that files over "tune/streamThresholdMB" are streamed correctly, including ranges
+func TestLargeFileStreaming(t *testing.T) {
+	largeFile := make([]byte, 3*1024*1024)
+	rand.Read(largeFile)
+	if err := ioutil.WriteFile("/tmp/testEnvironment/web/large.bin", largeFile, 0644); err != nil {
+		fmt.Printf("could not write large test file: %s\n", err.Error())
+		t.Fail()
+		return
+	}
+	defer os.Remove("/tmp/testEnvironment/web/large.bin")
+
+	err := doGet("http://localhost:8080/large.bin", 200, func(b []byte) {
+		if !bytes.Equal(b, largeFile) {
+			fmt.Printf("streamed file differs from file on disk. got %d bytes expecting %d\n", len(b), len(largeFile))
+			t.Fail()
+		}
+	})
+	if err != nil {
+		t.Fail()
+	}
+
+	request, _ := http.NewRequest("GET", "http://localhost:8080/large.bin", nil)
+	request.Header.Set("Range", "bytes=2000000-2000099")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		fmt.Printf("Could Not send GET request with error: %s\n", err.Error())
+		t.Fail()
+		return
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if response.StatusCode != 206 || !bytes.Equal(body, largeFile[2000000:2000100]) || response.Header.Get("ETag") == "" {
+		fmt.Printf("range request on streamed file got status %d and %d bytes\n", response.StatusCode, len(body))
+		t.Fail()
+	}
+
+	// large files are never read in to memory, plugins without a HandleRequest stream them too
+	logger.LogToStd(logger.VError)
+	cache.StartCache()
+	mwsettings.AddSetting("tune/streamThresholdMB", 1)
+	if buff := ReadFileToBuff("/tmp/testEnvironment/web/large.bin"); buff != nil {
+		fmt.Printf("large file read in to memory, %d bytes\n", len(*buff))
+		t.Fail()
+	}
+	recorder := httptest.NewRecorder()
+	request = httptest.NewRequest("GET", "/large.bin", nil)
+	request.Header.Set("Range", "bytes=2000000-2000099")
+	if !defaultHandleRequest(request, recorder, "/tmp/testEnvironment/web/large.bin") || recorder.Code != 206 ||
+		!bytes.Equal(recorder.Body.Bytes(), largeFile[2000000:2000100]) {
+		fmt.Printf("default plugin HandleRequest on large file got status %d and %d bytes\n", recorder.Code, recorder.Body.Len())
+		t.Fail()
+	}
+}
+
+//test brotli / gzip negotiation for static files, precompressed siblings and plugin responses
+func TestCompression(t *testing.T) {
+	textFile := []byte(strings.Repeat("compress me please ", 100))
+	preFile := []byte(strings.Repeat("identity ", 100))
+	var gzBuff bytes.Buffer
+	gzWriter := gzip.NewWriter(&gzBuff)
+	gzWriter.Write([]byte("PRECOMPRESSED"))
+	gzWriter.Close()
+	ioutil.WriteFile("/tmp/testEnvironment/web/compress.txt", textFile, 0644)
+	ioutil.WriteFile("/tmp/testEnvironment/web/pre.txt", preFile, 0644)
+	ioutil.WriteFile("/tmp/testEnvironment/web/pre.txt.gz", gzBuff.Bytes(), 0644)
+	defer os.Remove("/tmp/testEnvironment/web/compress.txt")
+	defer os.Remove("/tmp/testEnvironment/web/pre.txt")
+	defer os.Remove("/tmp/testEnvironment/web/pre.txt.gz")
+
+	// returns the Content-Encoding and decoded body of url
+	doEncodedGet := func(url string, acceptEncoding string) (string, []byte) {
+		client := http.Client{Transport: &http.Transport{DisableCompression: true}}
+		request, _ := http.NewRequest("GET", url, nil)
+		request.Header.Set("Accept-Encoding", acceptEncoding)
+		response, err := client.Do(request)
+		if err != nil {
+			fmt.Printf("Could Not send GET request with error: %s\n", err.Error())
+			return "", nil
+		}
+		defer response.Body.Close()
+
+		var reader io.Reader = response.Body
+		switch response.Header.Get("Content-Encoding") {
+		case "gzip":
+			reader, _ = gzip.NewReader(response.Body)
+		case "br":
+			reader = brotli.NewReader(response.Body)
+		}
+		body, _ := ioutil.ReadAll(reader)
+		return response.Header.Get("Content-Encoding"), body
+	}
+
+	if encoding, body := doEncodedGet("http://localhost:8080/compress.txt", "gzip, br"); encoding != "br" || !bytes.Equal(body, textFile) {
+		fmt.Printf("static file with Accept-Encoding: gzip, br got encoding \"%s\"\n", encoding)
+		t.Fail()
+	}
+	if encoding, body := doEncodedGet("http://localhost:8080/compress.txt", "gzip;q=1, br;q=0.5"); encoding != "gzip" || !bytes.Equal(body, textFile) {
+		fmt.Printf("static file preferring gzip got encoding \"%s\"\n", encoding)
+		t.Fail()
+	}
+	if encoding, body := doEncodedGet("http://localhost:8080/compress.txt", ""); encoding != "" || !bytes.Equal(body, textFile) {
+		fmt.Printf("static file without Accept-Encoding got encoding \"%s\"\n", encoding)
+		t.Fail()
+	}
+	if encoding, _ := doEncodedGet("http://localhost:8080/normal.html", "gzip"); encoding != "" {
+		fmt.Printf("static file under compressMinSize got encoding \"%s\"\n", encoding)
+		t.Fail()
+	}
+
+	if encoding, body := doEncodedGet("http://localhost:8080/pre.txt", "gzip, br"); encoding != "gzip" || string(body) != "PRECOMPRESSED" {
+		fmt.Printf("precompressed sibling not served. got encoding \"%s\" body: %s\n", encoding, string(body))
+		t.Fail()
+	}
+	if encoding, body := doEncodedGet("http://localhost:8080/pre.txt", "br"); encoding != "br" || !bytes.Equal(body, preFile) {
+		fmt.Printf("static file without matching sibling got encoding \"%s\"\n", encoding)
+		t.Fail()
+	}
+
+	repeatBody := []byte(strings.Repeat("REPEAT ", 1000))
+	if encoding, body := doEncodedGet("http://localhost:8080/api/repeat", "gzip"); encoding != "gzip" || !bytes.Equal(body, repeatBody) {
+		fmt.Printf("plugin response got encoding \"%s\"\n", encoding)
+		t.Fail()
+	}
+	if encoding, body := doEncodedGet("http://localhost:8080/api/repeat?compress=no", "gzip"); encoding != "" || !bytes.Equal(body, repeatBody) {
+		fmt.Printf("plugin response that opted out got encoding \"%s\"\n", encoding)
+		t.Fail()
+	}
+}
+
+//test directory listings enabled by a .autoindex file and by a virtual host with a custom template
+func TestDirectoryListing(t *testing.T) {
+	listDir := "/tmp/testEnvironment/web/artifacts/"
+	os.MkdirAll(listDir+"sub", 0755)
+	os.MkdirAll("/tmp/testEnvironment/web/unlisted", 0755)
+	defer os.RemoveAll(listDir)
+	defer os.RemoveAll("/tmp/testEnvironment/web/unlisted")
+	ioutil.WriteFile(listDir+".autoindex", []byte{}, 0644)
+	ioutil.WriteFile(listDir+".hidden", []byte("hidden"), 0644)
+	ioutil.WriteFile(listDir+"a.txt", make([]byte, 300), 0644)
+	ioutil.WriteFile(listDir+"b.txt", make([]byte, 100), 0644)
+
+	err := doGet("http://localhost:8080/artifacts/", 200, func(b []byte) {
+		if !bytes.Contains(b, []byte(`href="./a.txt"`)) || !bytes.Contains(b, []byte(`href="./sub/"`)) || bytes.Contains(b, []byte(".hidden")) {
+			fmt.Printf("bad directory listing: %s\n", string(b))
+			t.Fail()
+		}
+	})
+	if err != nil {
+		t.Fail()
+	}
+
+	err = doGet("http://localhost:8080/artifacts/?format=json&sort=size&order=desc", 200, func(b []byte) {
+		listing := DirectoryListing{}
+		if jErr := json.Unmarshal(b, &listing); jErr != nil {
+			fmt.Printf("could not decode JSON listing: %s\n", jErr.Error())
+			t.Fail()
+			return
+		}
+		var names []string
+		for _, entry := range listing.Entries {
+			names = append(names, entry.Name)
+		}
+		if strings.Join(names, ",") != "sub,a.txt,b.txt" || listing.Entries[1].Size != 300 {
+			fmt.Printf("JSON listing sorted by size got: %v\n", names)
+			t.Fail()
+		}
+	})
+	if err != nil {
+		t.Fail()
+	}
+
+	// redirected to add the trailing slash
+	if err = doGet("http://localhost:8080/artifacts", 200, func(b []byte) {}); err != nil {
+		t.Fail()
+	}
+	// sub directories inherit .autoindex
+	if err = doGet("http://localhost:8080/artifacts/sub/", 200, func(b []byte) {}); err != nil {
+		t.Fail()
+	}
+	if err = doGet("http://localhost:8080/unlisted/", 404, func(b []byte) {}); err != nil {
+		t.Fail()
+	}
+
+	// virtual host with autoIndex enabled and a custom template
+	err = doGetHost("http://localhost:8082/", "listener.test", 200, func(b []byte) {
+		if strings.TrimSpace(string(b)) != "CUSTOM LISTING / [normal.html]" {
+			fmt.Printf("custom directory listing template got: %s\n", string(b))
+			t.Fail()
+		}
+	})
+	if err != nil {
+		t.Fail()
+	}
+
+	// the parsed template is cached until the file changes
+	templatePath := "/tmp/testEnvironment/autoIndex.gohtml"
+	original, _ := ioutil.ReadFile(templatePath)
+	defer ioutil.WriteFile(templatePath, original, 0644)
+	ioutil.WriteFile(templatePath, []byte("CHANGED LISTING {{.Path}}"), 0644)
+	os.Chtimes(templatePath, time.Now(), time.Now().Add(time.Second))
+	err = doGetHost("http://localhost:8082/", "listener.test", 200, func(b []byte) {
+		if strings.TrimSpace(string(b)) != "CHANGED LISTING /" {
+			fmt.Printf("changed directory listing template got: %s\n", string(b))
+			t.Fail()
+		}
+	})
+	if err != nil {
+		t.Fail()
+	}
+}
+
+//test configured error pages, problem+json error bodies and request IDs
+func TestErrorPages(t *testing.T) {
+	doErrorGet := func(url string, headers map[string]string) (*http.Response, []byte) {
+		request, _ := http.NewRequest("GET", url, nil)
+		for key, value := range headers {
+			request.Header.Set(key, value)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			fmt.Printf("Could Not send GET request with error: %s\n", err.Error())
+			t.Fail()
+			return &http.Response{Header: http.Header{}}, nil
+		}
+		defer response.Body.Close()
+		body, _ := ioutil.ReadAll(response.Body)
+		return response, body
+	}
+
+	response, body := doErrorGet("http://localhost:8080/does/not/exist.html", map[string]string{"Accept": "text/html"})
+	requestID := response.Header.Get("X-Request-Id")
+	if response.StatusCode != 404 || requestID == "" || !bytes.Contains(body, []byte("Nothing at /does/not/exist.html")) ||
+		!bytes.Contains(body, []byte("Request ID: "+requestID)) {
+		fmt.Printf("404 error page got status %d body: %s\n", response.StatusCode, string(body))
+		t.Fail()
+	}
+
+	response, body = doErrorGet("http://localhost:8080/does/not/exist.html",
+		map[string]string{"Accept": "application/json", "X-Request-Id": "client-id-1"})
+	problem := map[string]interface{}{}
+	json.Unmarshal(body, &problem)
+	if response.StatusCode != 404 || response.Header.Get("Content-Type") != "application/problem+json" ||
+		problem["status"] != float64(404) || problem["instance"] != "/does/not/exist.html" || problem["requestId"] != "client-id-1" {
+		fmt.Printf("problem+json 404 got status %d body: %s\n", response.StatusCode, string(body))
+		t.Fail()
+	}
+
+	// plugins render errors the same way
+	response, body = doErrorGet("http://localhost:8080/api/teapot", map[string]string{"Accept": "application/problem+json"})
+	problem = map[string]interface{}{}
+	json.Unmarshal(body, &problem)
+	if response.StatusCode != 418 || problem["detail"] != "short and stout" {
+		fmt.Printf("plugin error got status %d body: %s\n", response.StatusCode, string(body))
+		t.Fail()
+	}
+	response, body = doErrorGet("http://localhost:8080/api/teapot", nil)
+	if response.StatusCode != 418 || !bytes.Contains(body, []byte("Something went wrong")) {
+		fmt.Printf("plugin error with default error page got status %d body: %s\n", response.StatusCode, string(body))
+		t.Fail()
+	}
+}
+
+//test serving .gohtml pages without a plugin
+func TestTemplatePages(t *testing.T) {
+	request, _ := http.NewRequest("GET", "http://localhost:8080/native.gohtml?name=%3Cbob%3E", nil)
+	request.Header.Set("X-Test", "yes")
+	request.AddCookie(&http.Cookie{Name: "flavour", Value: "chocolate"})
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		fmt.Printf("Could Not send GET request with error: %s\n", err.Error())
+		t.FailNow()
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	for _, expected := range []string{"Hello &lt;bob&gt;, GET /native.gohtml", "Header: yes Cookie: chocolate", "Plugin: (native)"} {
+		if !bytes.Contains(body, []byte(expected)) {
+			fmt.Printf("template page missing: %s got status %d body: %s\n", expected, response.StatusCode, string(body))
+			t.Fail()
+		}
+	}
+	if response.Header.Get("Content-Type") != "text/html; charset=utf-8" || response.Header.Get("Cache-Control") != "no-cache" {
+		fmt.Printf("template page has wrong headers: %v\n", response.Header)
+		t.Fail()
+	}
+
+	response, err = http.PostForm("http://localhost:8080/native.gohtml", url.Values{"formName": {"alice"}})
+	if err != nil {
+		fmt.Printf("Could Not send POST request with error: %s\n", err.Error())
+		t.FailNow()
+	}
+	body, _ = ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if response.StatusCode != 200 || !bytes.Contains(body, []byte("Hello alice, POST /native.gohtml")) {
+		fmt.Printf("template page form got status %d body: %s\n", response.StatusCode, string(body))
+		t.Fail()
+	}
+}
+
+//test pages using layouts, partials and the standard template functions
+func TestTemplateLayouts(t *testing.T) {
+	err := doGet("http://localhost:8080/layout.gohtml?text=abcdefgh", 200, func(b []byte) {
+		for _, expected := range []string{"<title>Layout Test</title>", `<nav><a href="/layout.gohtml">/layout.gohtml</a></nav>`,
+			"<p>1 parameter, abcd…</p>"} {
+			if !bytes.Contains(b, []byte(expected)) {
+				fmt.Printf("layout page missing: %s got: %s\n", expected, string(b))
+				t.Fail()
+			}
+		}
+	})
+	if err != nil {
+		t.Fail()
+	}
+
+	// layouts and partials are not pages
+	for _, pageURL := range []string{"http://localhost:8080/layouts/base.gohtml", "http://localhost:8080/partials/nav.gohtml"} {
+		if err := doGet(pageURL, 404, func(b []byte) {}); err != nil {
+			t.Fail()
+		}
+	}
+}
+
+//test proxy bindings, balancing, health checks, header rewriting and upgrades
+func TestReverseProxy(t *testing.T) {
+	type upstream struct {
+		name      string
+		bDown     int32
+		slowEnter chan bool
+		slowExit  chan bool
+	}
+	upstreamHandler := func(up *upstream) http.HandlerFunc {
+		return func(res http.ResponseWriter, req *http.Request) {
+			switch {
+			case strings.HasSuffix(req.URL.Path, "/health"):
+				if atomic.LoadInt32(&up.bDown) == 1 {
+					res.WriteHeader(http.StatusServiceUnavailable)
+				}
+			case strings.HasSuffix(req.URL.Path, "/slow"):
+				up.slowEnter <- true
+				<-up.slowExit
+			case strings.HasSuffix(req.URL.Path, "/ws"):
+				conn, buff, _ := res.(http.Hijacker).Hijack()
+				defer conn.Close()
+				buff.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+				buff.Flush()
+				line, _ := buff.ReadString('\n')
+				buff.WriteString(up.name + ":" + line)
+				buff.Flush()
+			default:
+				res.Header().Set("X-Upstream-Internal", "secret")
+				fmt.Fprintf(res, "%s %s proxy=%s secret=%s xff=%s proto=%s", up.name, req.URL.Path, req.Header.Get("X-Proxy-Test"),
+					req.Header.Get("X-Secret"), req.Header.Get("X-Forwarded-For"), req.Header.Get("X-Forwarded-Proto"))
+			}
+		}
+	}
+
+	upA := &upstream{name: "A", slowEnter: make(chan bool, 1), slowExit: make(chan bool)}
+	upB := &upstream{name: "B", slowEnter: make(chan bool, 1), slowExit: make(chan bool)}
+	serverA := &http.Server{Addr: "127.0.0.1:8091", Handler: upstreamHandler(upA)}
+	serverB := &http.Server{Addr: "127.0.0.1:8092", Handler: upstreamHandler(upB)}
+	go serverA.ListenAndServe()
+	go serverB.ListenAndServe()
+	defer serverA.Close()
+	defer serverB.Close()
+
+	proxyGet := func(url string) (*http.Response, string) {
+		request, _ := http.NewRequest("GET", url, nil)
+		request.Header.Set("X-Secret", "hunter2")
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			fmt.Printf("Could Not send GET request with error: %s\n", err.Error())
+			return &http.Response{Header: http.Header{}}, ""
+		}
+		defer response.Body.Close()
+		body, _ := ioutil.ReadAll(response.Body)
+		return response, string(body)
+	}
+	// collect the upstreams that answer n requests
+	collectUpstreams := func(url string, n int) map[string]int {
+		counts := map[string]int{}
+		for i := 0; i < n; i++ {
+			_, body := proxyGet(url)
+			counts[strings.SplitN(body, " ", 2)[0]]++
+		}
+		return counts
+	}
+	// wait for the health checks to find both upstreams
+	for start := time.Now(); time.Since(start) < 2*time.Second; time.Sleep(20 * time.Millisecond) {
+		if counts := collectUpstreams("http://localhost:8080/proxy/who", 2); counts["A"] == 1 && counts["B"] == 1 {
+			break
+		}
+	}
+
+	response, body := proxyGet("http://localhost:8080/proxy/who")
+	if strings.HasPrefix(body, "A") && body != "A /who proxy=yes secret= xff=127.0.0.1 proto=http" ||
+		strings.HasPrefix(body, "B") && body != "B /base/who proxy=yes secret= xff=127.0.0.1 proto=http" ||
+		response.Header.Get("X-Served-By") != "microweb" || response.Header.Get("X-Upstream-Internal") != "" {
+		fmt.Printf("Bad proxy response, status %d headers %v body: %s\n", response.StatusCode, response.Header, body)
+		t.Fail()
+	}
+
+	if counts := collectUpstreams("http://localhost:8080/proxy/who", 4); counts["A"] != 2 || counts["B"] != 2 {
+		fmt.Printf("round robin is not balanced: %v\n", counts)
+		t.Fail()
+	}
+
+	// unhealthy upstreams are left out
+	atomic.StoreInt32(&upA.bDown, 1)
+	time.Sleep(200 * time.Millisecond)
+	if counts := collectUpstreams("http://localhost:8080/proxy/who", 4); counts["B"] != 4 {
+		fmt.Printf("request sent to unhealthy upstream: %v\n", counts)
+		t.Fail()
+	}
+	atomic.StoreInt32(&upA.bDown, 0)
+
+	// least-conn avoids the upstream busy with the slow request
+	go proxyGet("http://localhost:8080/leastConn/slow")
+	select {
+	case <-upA.slowEnter:
+		if counts := collectUpstreams("http://localhost:8080/leastConn/who", 3); counts["B"] != 3 {
+			fmt.Printf("least-conn sent requests to a busy upstream: %v\n", counts)
+			t.Fail()
+		}
+		upA.slowExit <- true
+	case <-time.After(2 * time.Second):
+		fmt.Printf("slow request never reached upstream A\n")
+		t.Fail()
+	}
+
+	// upgrades are tunneled, past the response timeout of the server
+	conn, err := net.Dial("tcp", "127.0.0.1:8080")
+	if err != nil {
+		fmt.Printf("Could not connect with error: %s\n", err.Error())
+		t.FailNow()
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET /proxy/ws HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"))
+	reader := bufio.NewReader(conn)
+	upgradeResponse, err := http.ReadResponse(reader, nil)
+	if err != nil || upgradeResponse.StatusCode != http.StatusSwitchingProtocols {
+		fmt.Printf("upgrade through proxy failed: %v %v\n", upgradeResponse, err)
+		t.FailNow()
+	}
+	time.Sleep(300 * time.Millisecond)
+	conn.Write([]byte("ping\n"))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if echo, _ := reader.ReadString('\n'); echo != "A:ping\n" && echo != "B:ping\n" {
+		fmt.Printf("upgraded connection did not echo, got: %q\n", echo)
+		t.Fail()
+	}
+}
+
+// webSocketTestClient is a minimal RFC 6455 client
+type webSocketTestClient struct {
+	conn     net.Conn
+	reader   *bufio.Reader
+	bSawPing bool
+}
+
+func dialWebSocket(urlPath string) (*webSocketTestClient, *http.Response, error) {
+	return dialWebSocketAt("127.0.0.1:8080", urlPath, "")
+}
+
+// dialWebSocketAt opens a WebSocket to the server at addr, extraHeaders ("Name: value\r\n" lines) are added to the handshake
+func dialWebSocketAt(addr string, urlPath string, extraHeaders string) (*webSocketTestClient, *http.Response, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.Write([]byte("GET " + urlPath + " HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n" +
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" + extraHeaders + "\r\n"))
+	client := &webSocketTestClient{conn: conn, reader: bufio.NewReader(conn)}
+	response, err := http.ReadResponse(client.reader, nil)
+	return client, response, err
+}
+
+func (client *webSocketTestClient) writeFrame(bFin bool, opcode byte, payload []byte, bMask bool) {
+	frame := []byte{opcode}
+	if bFin {
+		frame[0] |= 0x80
+	}
+	maskBit := byte(0)
+	if bMask {
+		maskBit = 0x80
+	}
+	frame = append(frame, maskBit|byte(len(payload)))
+	if bMask {
+		mask := []byte{1, 2, 3, 4}
+		frame = append(frame, mask...)
+		for i, b := range payload {
+			frame = append(frame, b^mask[i%4])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+	client.conn.Write(frame)
+}
+
+// readFrame reads the next frame, skipping (and noting) the pings the server sends on its own
+func (client *webSocketTestClient) readFrame() (bool, byte, []byte) {
+	client.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(client.reader, header); err != nil {
+			return false, 0, nil
+		}
+		payload := make([]byte, header[1]&0x7f)
+		io.ReadFull(client.reader, payload)
+		if header[0]&0x0f == 9 && len(payload) == 0 {
+			client.bSawPing = true
+			continue
+		}
+		return header[0]&0x80 != 0, header[0] & 0x0f, payload
+	}
+}
+
+//test WebSocket plugins
+func TestWebSocket(t *testing.T) {
+	expectFrame := func(client *webSocketTestClient, bFin bool, opcode byte, payload string) {
+		frameFin, frameOpcode, framePayload := client.readFrame()
+		if frameFin != bFin || frameOpcode != opcode || string(framePayload) != payload {
+			fmt.Printf("expected frame fin %v opcode %d payload %q got fin %v opcode %d payload %q\n",
+				bFin, opcode, payload, frameFin, frameOpcode, string(framePayload))
+			t.Fail()
+		}
+	}
+
+	client, response, err := dialWebSocket("/api/ws")
+	if err != nil || response.StatusCode != http.StatusSwitchingProtocols ||
+		response.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		fmt.Printf("WebSocket handshake failed: %v %v\n", response, err)
+		t.FailNow()
+	}
+	defer client.conn.Close()
+
+	client.writeFrame(true, 1, []byte("hello"), true)
+	expectFrame(client, true, 1, "hello")
+
+	// fragmented message with a ping in the middle
+	client.writeFrame(false, 1, []byte("hel"), true)
+	client.writeFrame(true, 9, []byte("p"), true)
+	expectFrame(client, true, 10, "p")
+	client.writeFrame(true, 0, []byte("lo"), true)
+	expectFrame(client, true, 1, "hello")
+
+	// fragmented by the server
+	client.writeFrame(true, 1, []byte("fragment:abcde"), true)
+	expectFrame(client, false, 1, "ab")
+	expectFrame(client, false, 0, "cd")
+	expectFrame(client, true, 0, "e")
+
+	// connections outlive the response timeout and are pinged
+	time.Sleep(400 * time.Millisecond)
+	client.writeFrame(true, 2, []byte("late"), true)
+	expectFrame(client, true, 2, "late")
+	if !client.bSawPing {
+		fmt.Printf("server did not ping the client\n")
+		t.Fail()
+	}
+
+	// broadcast through the hub
+	otherClient, _, err := dialWebSocket("/api/ws")
+	if err != nil {
+		t.FailNow()
+	}
+	defer otherClient.conn.Close()
+	client.writeFrame(true, 1, []byte("broadcast:hi all"), true)
+	expectFrame(client, true, 1, "hi all")
+	expectFrame(otherClient, true, 1, "hi all")
+
+	// closing handshake
+	otherClient.writeFrame(true, 8, []byte{0x03, 0xe8, 'b', 'y', 'e'}, true)
+	expectFrame(otherClient, true, 8, "\x03\xe8")
+
+	// protocol violations close the connection with the matching code
+	for _, violation := range []struct {
+		payload []byte
+		bMask   bool
+		code    string
+	}{{[]byte("unmasked"), false, "\x03\xea"}, {[]byte{0xff, 0xfe}, true, "\x03\xef"}} {
+		badClient, _, err := dialWebSocket("/api/ws")
+		if err != nil {
+			t.FailNow()
+		}
+		badClient.writeFrame(true, 1, violation.payload, violation.bMask)
+		_, opcode, payload := badClient.readFrame()
+		if opcode != 8 || len(payload) < 2 || string(payload[:2]) != violation.code {
+			fmt.Printf("expected close %q got opcode %d payload %q\n", violation.code, opcode, string(payload))
+			t.Fail()
+		}
+		badClient.conn.Close()
+	}
+
+	// browsers may only connect from the same host or an allowed origin
+	for origin, status := range map[string]int{"http://localhost": 101, "https://allowed.test": 101, "http://evil.test": 403} {
+		originClient, response, err := dialWebSocketAt("127.0.0.1:8080", "/api/ws", "Origin: "+origin+"\r\n")
+		if err != nil || response.StatusCode != status {
+			fmt.Printf("WebSocket handshake from origin %s got: %v %v expecting status %d\n", origin, response, err, status)
+			t.Fail()
+		}
+		if originClient != nil {
+			originClient.conn.Close()
+		}
+	}
+}
+
+//test Server-Sent Events and per binding response timeouts
+func TestServerSentEvents(t *testing.T) {
+	readStream := func(url string, lastEventID string) (*http.Response, string) {
+		request, _ := http.NewRequest("GET", url, nil)
+		if lastEventID != "" {
+			request.Header.Set("Last-Event-ID", lastEventID)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			fmt.Printf("Could Not send GET request with error: %s\n", err.Error())
+			return &http.Response{Header: http.Header{}}, ""
+		}
+		defer response.Body.Close()
+		// a stream cut off by the response timeout ends in an error, keep what arrived
+		body, _ := ioutil.ReadAll(response.Body)
+		return response, string(body)
+	}
+
+	response, body := readStream("http://localhost:8080/events/stream", "")
+	if response.Header.Get("Content-Type") != "text/event-stream; charset=utf-8" || response.Header.Get("Content-Encoding") != "" ||
+		!strings.Contains(body, "id: 1\nevent: tick\nretry: 2000\ndata: tick 1\ndata: second line\n\n") ||
+		!strings.Contains(body, "id: 3\nevent: tick\ndata: tick 3\ndata: second line\n\n") || !strings.Contains(body, ": heartbeat\n\n") {
+		fmt.Printf("bad event stream, headers: %v body: %q\n", response.Header, body)
+		t.Fail()
+	}
+
+	_, body = readStream("http://localhost:8080/events/stream", "7")
+	if !strings.Contains(body, "id: 8\n") || !strings.Contains(body, "id: 10\n") || strings.Contains(body, "id: 7\n") {
+		fmt.Printf("event stream did not resume after Last-Event-ID, body: %q\n", body)
+		t.Fail()
+	}
+
+	// without the longer responseTimeout the stream is cut off
+	_, body = readStream("http://localhost:8080/api/stream", "")
+	if strings.Contains(body, "id: 3\n") {
+		fmt.Printf("stream outlived the response timeout, body: %q\n", body)
+		t.Fail()
+	}
+}
+
+//test hot reloading a plugin while a request is in-flight on the old version
+func TestPluginReload(t *testing.T) {
+	pluginPath := "/tmp/testEnvironment/plugins/reloadPlugin/reloadPlugin.so"
+	os.Remove("/tmp/reloadPlugin-shutdown-1")
+
+	err := doGet("http://localhost:8080/reload/", 200, func(b []byte) {
+		if string(b) != "version 1" {
+			fmt.Printf("unexpected plugin version: %s\n", string(b))
+			t.Fail()
+		}
+	})
+	if err != nil {
+		t.Fail()
+	}
+
+	// a new build needs its own plugin path, Go will not load two plugins with the same one.
+	// built from its source files the plugin path is a hash of the build
+	buildCmd := exec.Command("go", "build", "-o", "/tmp/reloadPlugin-v2.so", "-buildmode=plugin",
+		"-ldflags", "-X main.version=2", "../../testEnvironment/plugins/reloadPlugin/reload.go")
+	if out, bErr := buildCmd.CombinedOutput(); bErr != nil {
+		fmt.Printf("failed to build new plugin version with error: %s %s\n", bErr.Error(), string(out))
+		t.FailNow()
+	}
+
+	slowBody := make(chan string, 1)
+	go func() {
+		body := ""
+		doGet("http://localhost:8080/reload/slow", 200, func(b []byte) { body = string(b) })
+		slowBody <- body
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if mvErr := os.Rename("/tmp/reloadPlugin-v2.so", pluginPath); mvErr != nil {
+		fmt.Printf("could not deploy new plugin version with error: %s\n", mvErr.Error())
+		t.FailNow()
+	}
+
+	bSwapped := false
+	for startTime := time.Now(); time.Since(startTime) < 3*time.Second && !bSwapped; time.Sleep(50 * time.Millisecond) {
+		doGet("http://localhost:8080/reload/", 200, func(b []byte) { bSwapped = string(b) == "version 2" })
+	}
+	if !bSwapped {
+		fmt.Print("plugin was not reloaded\n")
+		t.Fail()
+	}
+	// the old version must drain before it is shut down
+	if _, sErr := os.Stat("/tmp/reloadPlugin-shutdown-1"); sErr == nil {
+		fmt.Print("old plugin version shut down with a request in-flight\n")
+		t.Fail()
+	}
+
+	if body := <-slowBody; body != "version 1" {
+		fmt.Printf("in-flight request was not finished by the old version, got: %s\n", body)
+		t.Fail()
+	}
+	bShutdown := false
+	for startTime := time.Now(); time.Since(startTime) < 1*time.Second && !bShutdown; time.Sleep(20 * time.Millisecond) {
+		_, sErr := os.Stat("/tmp/reloadPlugin-shutdown-1")
+		bShutdown = sErr == nil
+	}
+	if !bShutdown {
+		fmt.Print("old plugin version was not shut down\n")
+		t.Fail()
+	}
+}
+
+//test plugin config blocks, failing plugin initialization, the health endpoint, OnSettingsChanged and Shutdown
+func TestPluginLifecycle(t *testing.T) {
+	doGet("http://localhost:8080/lifecycle/", 200, func(b []byte) {
+		if !strings.HasPrefix(string(b), "hello from config") {
+			fmt.Printf("plugin did not get its config, got: %s\n", string(b))
+			t.Fail()
+		}
+	})
+	// init failed, the binding is unavailable
+	if err := doGet("http://localhost:8080/failing/", 503, func(b []byte) {}); err != nil {
+		t.Fail()
+	}
+
+	// plugins are named after there bindings, paths and errors are not reported
+	err := doGet("http://localhost:8080/health", 503, func(b []byte) {
+		var report struct {
+			Status  string
+			Plugins map[string]map[string]string
+		}
+		if jErr := json.Unmarshal(b, &report); jErr != nil {
+			fmt.Printf("bad health report: %s\n", string(b))
+			t.Fail()
+			return
+		}
+		if report.Status != "unhealthy" || report.Plugins["/lifecycle/"]["status"] != "ok" || report.Plugins["/failing/"]["status"] != "unavailable" ||
+			len(report.Plugins["/failing/"]) != 1 || strings.Contains(string(b), "/tmp/") {
+			fmt.Printf("unexpected health report: %s\n", string(b))
+			t.Fail()
+		}
+	})
+	if err != nil {
+		t.Fail()
+	}
+
+	// only loopback clients get the report
+	addrList, _ := net.InterfaceAddrs()
+	for _, addr := range addrList {
+		if ipNet, bOk := addr.(*net.IPNet); bOk && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+			if err := doGet("http://"+ipNet.IP.String()+":8080/health", 404, func(b []byte) {}); err != nil {
+				t.Fail()
+			}
+			break
+		}
+	}
+
+	// in this process: a settings reload hands the new config to the unchanged plugin and shutdown gets a live context
+	logger.LogToStd(logger.VError)
+	mwsettings.ClearSettings()
+	lifecyclePath := "/tmp/testEnvironment/plugins/lifecyclePlugin/lifecyclePlugin.so"
+	setGreeting := func(greeting string) {
+		mwsettings.AddSetting("plugin/plugins", []pluginBinding{{BindingList: []string{"/lifecycle/"}, Plugin: lifecyclePath,
+			Config: map[string]interface{}{"greeting": greeting}}})
+	}
+	expectGreeting := func(plugin IPlugin, expected string) {
+		recorder := httptest.NewRecorder()
+		plugin.HandleVirtualRequest(httptest.NewRequest("GET", "/lifecycle/", nil), recorder)
+		if recorder.Body.String() != expected {
+			fmt.Printf("lifecycle plugin answered: %s expecting: %s\n", recorder.Body.String(), expected)
+			t.Fail()
+		}
+	}
+
+	setGreeting("before")
+	plugin, err := LoadPlugin(lifecyclePath)
+	if err != nil {
+		fmt.Printf("could not load lifecycle plugin: %s\n", err.Error())
+		t.FailNow()
+	}
+	expectGreeting(plugin, "before (settings changed 0 times, running)")
+
+	setGreeting("after")
+	ReloadAllPlugins()
+	notifyPluginsSettingsChanged()
+	expectGreeting(plugin, "after (settings changed 1 times, running)")
+
+	ShutdownAllPlugins()
+	expectGreeting(plugin, "after (settings changed 1 times, shut down)")
+}
+
+//test plugin panic recovery, timeouts, the concurrency cap and the circuit breaker
+func TestPluginLimits(t *testing.T) {
+	if err := doGet("http://localhost:8080/faulty/ok", 200, func(b []byte) {}); err != nil {
+		t.Fail()
+	}
+	// a panic is answered with a 500, the server keeps going
+	if err := doGet("http://localhost:8080/faulty/panic", 500, func(b []byte) {}); err != nil {
+		t.Fail()
+	}
+	if err := doGet("http://localhost:8080/faulty/slow", 504, func(b []byte) {}); err != nil {
+		t.Fail()
+	}
+	// the timed out request still holds the only slot
+	if err := doGet("http://localhost:8080/faulty/ok", 503, func(b []byte) {}); err != nil {
+		t.Fail()
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	// third failure in a row opens the circuit
+	if err := doGet("http://localhost:8080/faulty/panic", 500, func(b []byte) {}); err != nil {
+		t.Fail()
+	}
+	response, err := http.Get("http://localhost:8080/faulty/ok")
+	if err != nil {
+		fmt.Printf("Could Not send GET request with error: %s\n", err.Error())
+		t.FailNow()
+	}
+	response.Body.Close()
+	if response.StatusCode != 503 || response.Header.Get("Retry-After") == "" {
+		fmt.Printf("circuit not open, status: %d Retry-After: %s\n", response.StatusCode, response.Header.Get("Retry-After"))
+		t.Fail()
+	}
+
+	// after the cooldown a probe closes the circuit again
+	time.Sleep(1100 * time.Millisecond)
+	if err := doGet("http://localhost:8080/faulty/ok", 200, func(b []byte) {}); err != nil {
+		t.Fail()
+	}
+	if err := doGet("http://localhost:8080/faulty/ok", 200, func(b []byte) {}); err != nil {
+		t.Fail()
+	}
+
+	// a panic after the response started aborts the connection instead of ending the response cleanly
+	response, err = http.Get("http://localhost:8080/faulty/panicLate")
+	if err != nil {
+		fmt.Printf("Could Not send GET request with error: %s\n", err.Error())
+		t.FailNow()
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if err == nil {
+		fmt.Printf("truncated response was not aborted, status: %d body: %s\n", response.StatusCode, string(body))
+		t.Fail()
+	}
+}
+
+//test out-of-process plugins, including restarting them after a crash
+func TestProcessPlugin(t *testing.T) {
+	request, _ := http.NewRequest("POST", "http://localhost:8080/ext/echo?a=b", strings.NewReader("posted"))
+	request.Header.Set("X-Test", "header")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		fmt.Printf("Could Not send POST request with error: %s\n", err.Error())
+		t.FailNow()
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if response.StatusCode != 201 || response.Header.Get("X-Echo-Env") != "from config" || string(body) != "hi POST /ext/echo?a=b header body: posted" {
+		fmt.Printf("bad response from process plugin, status: %d headers: %v body: %s\n", response.StatusCode, response.Header, string(body))
+		t.Fail()
+	}
+
+	// a panic is answered with a 500 without taking the plugin down
+	pid := ""
+	doGet("http://localhost:8080/ext/pid", 200, func(b []byte) { pid = string(b) })
+	doGet("http://localhost:8080/ext/panic", 500, func(b []byte) {})
+	doGet("http://localhost:8080/ext/badStatus", 502, func(b []byte) {})
+	doGet("http://localhost:8080/ext/pid", 200, func(b []byte) {
+		if string(b) != pid {
+			fmt.Printf("process plugin restarted after panic, pid %s is now %s\n", pid, string(b))
+			t.Fail()
+		}
+	})
+
+	// a crash fails the request in-flight, the plugin is then restarted
+	if err = doGet("http://localhost:8080/ext/crash", 502, func(b []byte) {}); err != nil {
 		t.Fail()
 	}
-
-	//index.html redirect
-	err = doGet("http://localhost:8080/", 200, func(b []byte) {
-		if matched, _ := regexp.MatchString("index.html", string(b)); !matched {
-			fmt.Printf("HTML file did not have expected string. It contained: %s", string(b))
+	err = doGet("http://localhost:8080/ext/pid", 200, func(b []byte) {
+		if string(b) == pid || string(b) == "" {
+			fmt.Printf("process plugin not restarted, pid: %s\n", string(b))
 			t.Fail()
 		}
 	})
+	if err != nil {
+		t.Fail()
+	}
+}
+
+//test CGI scripts and a FastCGI responder
+func TestCGI(t *testing.T) {
+	doRequest := func(method string, url string, body string) (*http.Response, string) {
+		request, _ := http.NewRequest(method, url, strings.NewReader(body))
+		request.Header.Set("X-Test", "header")
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			fmt.Printf("Could Not send %s request with error: %s\n", method, err.Error())
+			return &http.Response{Header: http.Header{}}, ""
+		}
+		defer response.Body.Close()
+		resBody, _ := ioutil.ReadAll(response.Body)
+		return response, string(resBody)
+	}
+
+	response, body := doRequest("POST", "http://localhost:8080/cgi-bin/echo.sh/extra/path?a=b", "posted")
+	if response.StatusCode != 200 || response.Header.Get("X-Script") != "echo" || body != "POST|/cgi-bin/echo.sh|/extra/path|a=b|header|configured|posted" {
+		fmt.Printf("bad CGI response, status: %d headers: %v body: %s\n", response.StatusCode, response.Header, body)
+		t.Fail()
+	}
+	if response, _ = doRequest("GET", "http://localhost:8080/cgi-bin/echo.sh?teapot", ""); response.StatusCode != 418 {
+		fmt.Printf("CGI Status header ignored, got: %d\n", response.StatusCode)
+		t.Fail()
+	}
+	if response, _ = doRequest("GET", "http://localhost:8080/cgi-bin/missing.sh", ""); response.StatusCode != 404 {
+		fmt.Printf("expected 404 for missing CGI script, got: %d\n", response.StatusCode)
+		t.Fail()
+	}
+	if response, _ = doRequest("GET", "http://localhost:8080/cgi-bin/slow.sh", ""); response.StatusCode != 504 {
+		fmt.Printf("expected 504 for slow CGI script, got: %d\n", response.StatusCode)
+		t.Fail()
+	}
 
+	// FastCGI responder
+	listener, err := net.Listen("tcp", "127.0.0.1:8093")
 	if err != nil {
+		fmt.Printf("Could not start FastCGI responder: %s\n", err.Error())
+		t.FailNow()
+	}
+	defer listener.Close()
+	go fcgi.Serve(listener, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/slow") {
+			time.Sleep(300 * time.Millisecond)
+		}
+		reqBody, _ := ioutil.ReadAll(req.Body)
+		env := fcgi.ProcessEnv(req)
+		fmt.Fprintf(res, "%s|%s|%s|%s|%s", req.Method, req.URL.RequestURI(), env["SCRIPT_FILENAME"], req.Header.Get("X-Test"), string(reqBody))
+	}))
+
+	response, body = doRequest("PUT", "http://localhost:8080/fcgi/page?x=1", "fcgi body")
+	if response.StatusCode != 200 || body != "PUT|/fcgi/page?x=1|/tmp/testEnvironment/cgi/index.php|header|fcgi body" {
+		fmt.Printf("bad FastCGI response, status: %d body: %s\n", response.StatusCode, body)
+		t.Fail()
+	}
+
+	// maxConcurrent is 1, the second request waits for the first
+	startTime := time.Now()
+	done := make(chan bool, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			doRequest("GET", "http://localhost:8080/fcgi/slow", "")
+			done <- true
+		}()
+	}
+	<-done
+	<-done
+	if time.Since(startTime) < 600*time.Millisecond {
+		fmt.Printf("FastCGI requests not limited to one at a time, took: %s\n", time.Since(startTime))
 		t.Fail()
 	}
 }
@@ -175,6 +1258,55 @@ func TestAPIPlugin(t *testing.T) {
 	}
 }
 
+//test that routers registered by plugins take priority over the core routers
+func TestPluginRouter(t *testing.T) {
+	err := doGet("http://localhost:8080/api/routed", 200, func(b []byte) {
+		if string(b) != "ROUTED BY PLUGIN ROUTER" {
+			fmt.Printf("Plugin router did not handle request. Got: %s\n", string(b))
+			t.Fail()
+		}
+	})
+	if err != nil {
+		t.Fail()
+	}
+}
+
+//test that requests are dispatched to virtual hosts by listener and Host header
+func TestVirtualHosts(t *testing.T) {
+	expectBody := func(expected string) func([]byte) {
+		return func(b []byte) {
+			if matched, _ := regexp.MatchString(expected, string(b)); !matched {
+				fmt.Printf("Virtual host served wrong content, expecting: %s got: %s\n", expected, string(b))
+				t.Fail()
+			}
+		}
+	}
+
+	testCases := []struct {
+		url, host, expected string
+	}{
+		{"http://localhost:8080/normal.html", "vhost.test", "Virtual Host HTML"},
+		{"http://localhost:8080/normal.html", "www.vhost.test:8080", "Virtual Host HTML"},
+		{"http://localhost:8080/normal.html", "unknown.test", "Normal HTML"},
+		{"http://localhost:8080/normal.html", "listener.test", "Normal HTML"},
+		{"http://localhost:8082/normal.html", "listener.test", "Virtual Host Listener HTML"},
+		{"http://localhost:8082/normal.html", "unknown.test", "Virtual Host Listener HTML"},
+		{"http://localhost:8080/vapi/", "vhost.test", "HELLO FROM AN API FUNCTION!"},
+	}
+
+	for _, testCase := range testCases {
+		if err := doGetHost(testCase.url, testCase.host, 200, expectBody(testCase.expected)); err != nil {
+			fmt.Printf("Request for %s with host %s failed\n", testCase.url, testCase.host)
+			t.Fail()
+		}
+	}
+
+	//plugin bindings are per virtual host
+	if err := doGetHost("http://localhost:8080/vapi/", "", 404, func(b []byte) {}); err != nil {
+		t.Fail()
+	}
+}
+
 func TestDB(t *testing.T) {
 	err := doGet("http://localhost:8080/api/add", 200, func(b []byte) {
 		if matched, _ := regexp.MatchString("ADD", string(b)); !matched {
@@ -226,6 +1358,567 @@ func TestRedirect(t *testing.T) {
 	}
 }
 
+//test that plugin bindings requiring a client certificate reject clients without a verified one
+func TestClientCertBinding(t *testing.T) {
+	caPEM, err := ioutil.ReadFile("/tmp/testEnvironment/tls/ca.crt")
+	if err != nil {
+		fmt.Printf("could not read test CA: %s\n", err.Error())
+		t.Fail()
+		return
+	}
+	rootCAs := x509.NewCertPool()
+	rootCAs.AppendCertsFromPEM(caPEM)
+
+	clientCert, err := tls.LoadX509KeyPair("/tmp/testEnvironment/tls/client.crt", "/tmp/testEnvironment/tls/client.key")
+	if err != nil {
+		fmt.Printf("could not load test client certificate: %s\n", err.Error())
+		t.Fail()
+		return
+	}
+
+	doTLSGet := func(url string, certs []tls.Certificate) (int, string) {
+		client := http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: rootCAs, Certificates: certs}}}
+		response, err := client.Get(url)
+		if err != nil {
+			fmt.Printf("Could Not send GET request with error: %s\n", err.Error())
+			return 0, ""
+		}
+		defer response.Body.Close()
+		body, _ := ioutil.ReadAll(response.Body)
+		return response.StatusCode, string(body)
+	}
+
+	if status, _ := doTLSGet("https://localhost:8443/mtls/whoami", nil); status != 403 {
+		fmt.Printf("request without client certificate got status %d expecting 403\n", status)
+		t.Fail()
+	}
+	if status, body := doTLSGet("https://localhost:8443/mtls/whoami", []tls.Certificate{clientCert}); status != 200 || body != "test-client client.test" {
+		fmt.Printf("request with client certificate got status %d body: %s\n", status, body)
+		t.Fail()
+	}
+	// certificates issued by any other CA are rejected
+	otherCert, err := newTestClientCertificate("test-client")
+	if err != nil {
+		fmt.Printf("could not create client certificate: %s\n", err.Error())
+		t.Fail()
+		return
+	}
+	if status, body := doTLSGet("https://localhost:8443/mtls/whoami", []tls.Certificate{otherCert}); status == 200 {
+		fmt.Printf("request with client certificate from another CA got status %d body: %s\n", status, body)
+		t.Fail()
+	}
+	if status, body := doTLSGet("https://localhost:8443/open/whoami", nil); status != 200 || body != "ANONYMOUS" {
+		fmt.Printf("request to open binding got status %d body: %s\n", status, body)
+		t.Fail()
+	}
+
+	// routers registered by plugins are behind the client certificate check too
+	if status, body := doTLSGet("https://localhost:8443/mtls/routed", nil); status != 403 {
+		fmt.Printf("plugin routed request without client certificate got status %d body: %s expecting 403\n", status, body)
+		t.Fail()
+	}
+	if status, body := doTLSGet("https://localhost:8443/mtls/routed", []tls.Certificate{clientCert}); status != 200 || body != "ROUTED BY PLUGIN ROUTER" {
+		fmt.Printf("plugin routed request with client certificate got status %d body: %s\n", status, body)
+		t.Fail()
+	}
+}
+
+//test HTTP/2 over clear text (h2c prior knowledge) and over TLS
+func TestHTTP2(t *testing.T) {
+	h2cClient := http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network string, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		}}}
+	response, err := h2cClient.Get("http://localhost:8080/normal.html")
+	if err != nil {
+		fmt.Printf("h2c request failed with error: %s\n", err.Error())
+		t.Fail()
+	} else {
+		response.Body.Close()
+		if response.StatusCode != 200 || response.ProtoMajor != 2 {
+			fmt.Printf("h2c request got status %d protocol %s\n", response.StatusCode, response.Proto)
+			t.Fail()
+		}
+	}
+
+	caPEM, _ := ioutil.ReadFile("/tmp/testEnvironment/tls/ca.crt")
+	rootCAs := x509.NewCertPool()
+	rootCAs.AppendCertsFromPEM(caPEM)
+	tlsClient := http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: rootCAs}, ForceAttemptHTTP2: true}}
+	response, err = tlsClient.Get("https://localhost:8443/open/whoami")
+	if err != nil {
+		fmt.Printf("HTTP/2 over TLS request failed with error: %s\n", err.Error())
+		t.Fail()
+	} else {
+		response.Body.Close()
+		if response.StatusCode != 200 || response.ProtoMajor != 2 {
+			fmt.Printf("HTTP/2 over TLS request got status %d protocol %s\n", response.StatusCode, response.Proto)
+			t.Fail()
+		}
+	}
+}
+
+//test that redirect servers answer ACME HTTP-01 challenges for ACME host names only
+func TestACMEChallenge(t *testing.T) {
+	challengeURL := "http://localhost:8081/.well-known/acme-challenge/unknownToken"
+
+	if err := doGetHost(challengeURL, "acme.test", 404, func(b []byte) {}); err != nil {
+		fmt.Printf("unknown challenge token for ACME host was not rejected\n")
+		t.Fail()
+	}
+	if err := doGetHost(challengeURL, "other.test", 403, func(b []byte) {}); err != nil {
+		fmt.Printf("challenge for non ACME host was not forbidden\n")
+		t.Fail()
+	}
+}
+
+/*
+test obtaining certificates from a Pebble ACME test server (https://github.com/letsencrypt/pebble) with both challenge
+types. Skipped unless the pebble binary is in $PEBBLE or on the PATH. A second server is started that answers TLS-ALPN-01
+on 127.0.0.1 only and HTTP-01 on 127.0.0.2 only. The test DNS server points each ACME host name at one of the two
+addresses, so each certificate can only be obtained through one challenge type.
+*/
+func TestACMEPebble(t *testing.T) {
+	pebbleBin := os.Getenv("PEBBLE")
+	if pebbleBin == "" {
+		var err error
+		if pebbleBin, err = exec.LookPath("pebble"); err != nil {
+			t.Skip("pebble not found, set PEBBLE to the path of the pebble binary to run this test")
+		}
+	}
+
+	workDir, err := ioutil.TempDir("/tmp/", "microweb-pebble-")
+	if err != nil {
+		t.Fatalf("could not create work directory: %s", err.Error())
+	}
+	defer os.RemoveAll(workDir)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dnsAddr, stopDNS, err := serveTestDNS(map[string][4]byte{
+		"alpn.pebble.test.": {127, 0, 0, 1},
+		"http.pebble.test.": {127, 0, 0, 2},
+	})
+	if err != nil {
+		t.Fatalf("could not start test DNS server: %s", err.Error())
+	}
+	defer stopDNS()
+
+	// the certificate of the pebble API, the server trusts it as its ACME CA
+	certFile, keyFile := path.Join(workDir, "pebble.crt"), path.Join(workDir, "pebble.key")
+	if err = writeTestCertificate(certFile, keyFile, "pebble"); err != nil {
+		t.Fatalf("could not write pebble certificate: %s", err.Error())
+	}
+	pebbleConfig := map[string]interface{}{"pebble": map[string]interface{}{
+		"listenAddress":                  "127.0.0.1:14001",
+		"managementListenAddress":        "127.0.0.1:15001",
+		"certificate":                    certFile,
+		"privateKey":                     keyFile,
+		"httpPort":                       8095,
+		"tlsPort":                        8094,
+		"ocspResponderURL":               "",
+		"externalAccountBindingRequired": false,
+		"profiles":                       map[string]interface{}{"default": map[string]interface{}{"validityPeriod": 7776000}},
+	}}
+	serverConfig := map[string]interface{}{
+		"general": map[string]interface{}{
+			"TCPProtocol":     "tcp4",
+			"TCPPort":         "127.0.0.1:8094",
+			"staticDirectory": "/tmp/testEnvironment/web/",
+			"redirectPorts":   []string{"127.0.0.2:8095"},
+			"redirectURL":     "https://127.0.0.1",
+		},
+		"tls": map[string]interface{}{"enableTLS": true, "certFile": "", "keyFile": ""},
+		"acme": map[string]interface{}{
+			"enable":         true,
+			"directoryURL":   "https://localhost:14002/dir",
+			"caCertFile":     certFile,
+			"cacheDirectory": path.Join(workDir, "acme"),
+			"hostnames":      []string{"alpn.pebble.test", "http.pebble.test"},
+		},
+		"logging": map[string]interface{}{"logFile": path.Join(workDir, "microWeb.log"), "verbosity": "verbose"},
+		// the first handshake waits for the certificate to be issued
+		"tune": map[string]interface{}{"httpReadTimeout": "60s", "httpResponseTimeout": "60s", "cacheTTL": "60s"},
+	}
+	for file, config := range map[string]interface{}{"pebble.json": pebbleConfig, "microweb.json": serverConfig} {
+		configJSON, _ := json.Marshal(config)
+		if err = ioutil.WriteFile(path.Join(workDir, file), configJSON, 0644); err != nil {
+			t.Fatalf("could not write %s: %s", file, err.Error())
+		}
+	}
+
+	pebbleLog, _ := os.Create(path.Join(workDir, "pebble.log"))
+	defer pebbleLog.Close()
+	pebbleCmd := exec.CommandContext(ctx, pebbleBin, "-config", path.Join(workDir, "pebble.json"), "-dnsserver", dnsAddr)
+	pebbleCmd.Env = append(os.Environ(), "PEBBLE_VA_NOSLEEP=1", "PEBBLE_WFE_NONCEREJECT=0")
+	pebbleCmd.Stdout, pebbleCmd.Stderr = pebbleLog, pebbleLog
+	if err = pebbleCmd.Start(); err != nil {
+		t.Fatalf("could not start pebble: %s", err.Error())
+	}
+	defer pebbleCmd.Wait()
+	serverCmd := exec.CommandContext(ctx, "/tmp/microweb.a", "-c", path.Join(workDir, "microweb.json"))
+	if err = serverCmd.Start(); err != nil {
+		t.Fatalf("could not start server: %s", err.Error())
+	}
+	defer serverCmd.Wait()
+	defer cancel()
+
+	// pebble answers finalize requests without the Location of the order, which x/crypto/acme follows to wait for the
+	// certificate. The server talks to pebble through this proxy, that adds it
+	pebbleURL, _ := url.Parse("https://127.0.0.1:14001")
+	pebbleProxy := httputil.NewSingleHostReverseProxy(pebbleURL)
+	pebbleProxy.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	director := pebbleProxy.Director
+	pebbleProxy.Director = func(req *http.Request) {
+		director(req)
+		// pebble builds its URLs from the Host header, keeping them pointed at the proxy
+		req.Header.Set("X-Forwarded-Proto", "https")
+	}
+	pebbleProxy.ModifyResponse = func(res *http.Response) error {
+		if strings.HasPrefix(res.Request.URL.Path, "/finalize-order/") && res.Header.Get("Location") == "" {
+			res.Header.Set("Location", "https://"+res.Request.Host+"/my-order/"+strings.TrimPrefix(res.Request.URL.Path, "/finalize-order/"))
+		}
+		return nil
+	}
+	proxyListener, err := net.Listen("tcp4", "127.0.0.1:14002")
+	if err != nil {
+		t.Fatalf("could not start pebble proxy: %s", err.Error())
+	}
+	proxyServer := &http.Server{Handler: pebbleProxy}
+	go proxyServer.ServeTLS(proxyListener, certFile, keyFile)
+	defer proxyServer.Close()
+
+	for _, addr := range []string{"127.0.0.1:14001", "127.0.0.1:8094", "127.0.0.2:8095"} {
+		if !waitForListener(addr, 5*time.Second) {
+			logFile, _ := ioutil.ReadFile(path.Join(workDir, "pebble.log"))
+			t.Fatalf("nothing listening on %s, pebble log:\n%s", addr, string(logFile))
+		}
+	}
+
+	for _, hostname := range []string{"alpn.pebble.test", "http.pebble.test"} {
+		dialer := &net.Dialer{Timeout: 60 * time.Second}
+		conn, err := tls.DialWithDialer(dialer, "tcp", "127.0.0.1:8094", &tls.Config{ServerName: hostname, InsecureSkipVerify: true})
+		if err != nil {
+			serverLog, _ := ioutil.ReadFile(path.Join(workDir, "microWeb.log"))
+			t.Errorf("TLS handshake for %s failed with error: %s, server log:\n%s", hostname, err.Error(), string(serverLog))
+			continue
+		}
+		leaf := conn.ConnectionState().PeerCertificates[0]
+		conn.Close()
+		if len(leaf.DNSNames) != 1 || leaf.DNSNames[0] != hostname || !strings.Contains(leaf.Issuer.CommonName, "Pebble") {
+			t.Errorf("wrong certificate for %s, names: %v issuer: %s", hostname, leaf.DNSNames, leaf.Issuer.CommonName)
+		}
+	}
+}
+
+//waitForListener returns true once a connection to addr succeeds, false if that does not happen within timeout
+func waitForListener(addr string, timeout time.Duration) bool {
+	for startTime := time.Now(); time.Since(startTime) < timeout; time.Sleep(20 * time.Millisecond) {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return true
+		}
+	}
+	return false
+}
+
+/*
+serveTestDNS starts a DNS server on a random tcp port of 127.0.0.1 (pebble only talks DNS over tcp) that answers
+A queries for the fully qualified names in addrs. All other queries get an empty answer. Returns the address of
+the server and a function that stops it.
+*/
+func serveTestDNS(addrs map[string][4]byte) (string, func(), error) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+
+	answer := func(query []byte) ([]byte, error) {
+		var parser dnsmessage.Parser
+		header, err := parser.Start(query)
+		if err != nil {
+			return nil, err
+		}
+		question, err := parser.Question()
+		if err != nil {
+			return nil, err
+		}
+
+		builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: header.ID, Response: true, Authoritative: true, RecursionDesired: header.RecursionDesired})
+		builder.StartQuestions()
+		builder.Question(question)
+		builder.StartAnswers()
+		if addr, bOk := addrs[strings.ToLower(question.Name.String())]; bOk && question.Type == dnsmessage.TypeA {
+			builder.AResource(dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: 60}, dnsmessage.AResource{A: addr})
+		}
+		return builder.Finish()
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				// every message is prefixed with its length
+				for {
+					length := make([]byte, 2)
+					if _, err := io.ReadFull(conn, length); err != nil {
+						return
+					}
+					query := make([]byte, int(length[0])<<8|int(length[1]))
+					if _, err := io.ReadFull(conn, query); err != nil {
+						return
+					}
+					response, err := answer(query)
+					if err != nil {
+						return
+					}
+					conn.Write(append([]byte{byte(len(response) >> 8), byte(len(response))}, response...))
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), func() { listener.Close() }, nil
+}
+
+//test that in-flight requests complete when the server is shutdown
+func TestGracefulShutdown(t *testing.T) {
+	logger.LogToStd(logger.VError)
+	mwsettings.ClearSettings()
+	mwsettings.AddSetting("tune/httpReadTimeout", "1s")
+	mwsettings.AddSetting("tune/httpResponseTimeout", "1s")
+
+	httpServer, err := CreateHTTPServer("127.0.0.1:8095", "tcp4", nil, nil)
+	if err != nil {
+		fmt.Printf("could not create server: %s\n", err.Error())
+		t.Fail()
+		return
+	}
+	requestStarted := make(chan bool)
+	httpServer.server.Handler = http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/ws" {
+			conn, err := pluginUtil.UpgradeWebSocket(res, req)
+			for err == nil {
+				_, _, err = conn.ReadMessage()
+			}
+			return
+		}
+		close(requestStarted)
+		time.Sleep(200 * time.Millisecond)
+		res.Write([]byte("drained"))
+	})
+
+	serverDone := make(chan bool)
+	go func() {
+		httpServer.ServeHTTP()
+		close(serverDone)
+	}()
+
+	// WebSocket connections are hijacked, the server has to close them itself
+	wsClient, response, err := dialWebSocketAt("127.0.0.1:8095", "/ws", "")
+	if err != nil || response.StatusCode != http.StatusSwitchingProtocols {
+		fmt.Printf("WebSocket handshake failed: %v %v\n", response, err)
+		t.FailNow()
+	}
+	defer wsClient.conn.Close()
+
+	requestDone := make(chan error)
+	go func() {
+		requestDone <- doGet("http://127.0.0.1:8095/", 200, func(b []byte) {
+			if string(b) != "drained" {
+				fmt.Printf("in-flight request got: %s expecting: drained\n", string(b))
+				t.Fail()
+			}
+		})
+	}()
+
+	<-requestStarted
+	httpServer.Shutdown(1 * time.Second)
+
+	if err := <-requestDone; err != nil {
+		t.Fail()
+	}
+	if _, opcode, payload := wsClient.readFrame(); opcode != 8 || len(payload) < 2 || string(payload[:2]) != "\x03\xe9" {
+		fmt.Printf("WebSocket not closed with going away on shutdown, got opcode %d payload %q\n", opcode, string(payload))
+		t.Fail()
+	}
+	select {
+	case <-serverDone:
+	case <-time.After(1 * time.Second):
+		fmt.Print("ServeHTTP did not return after shutdown\n")
+		t.Fail()
+	}
+
+	if _, err := net.Dial("tcp", "127.0.0.1:8095"); err == nil {
+		fmt.Print("server still accepting connections after shutdown\n")
+		t.Fail()
+	}
+}
+
+//test that TLS certificates and policy are reloaded without recreating the listener
+func TestTLSReload(t *testing.T) {
+	logger.LogToStd(logger.VError)
+	mwsettings.ClearSettings()
+	certReloadCheckInterval = 0
+
+	certFile := path.Join(os.TempDir(), "microweb-test-cert.pem")
+	keyFile := path.Join(os.TempDir(), "microweb-test-key.pem")
+	defer os.Remove(certFile)
+	defer os.Remove(keyFile)
+	if err := writeTestCertificate(certFile, keyFile, "first"); err != nil {
+		fmt.Printf("could not create test certificate: %s\n", err.Error())
+		t.Fail()
+		return
+	}
+
+	mwsettings.AddSetting("general/TCPPort", "127.0.0.1:8096")
+	mwsettings.AddSetting("tls/enableTLS", true)
+	mwsettings.AddSetting("tls/certFile", certFile)
+	mwsettings.AddSetting("tls/keyFile", keyFile)
+	mwsettings.AddSetting("tls/minVersion", "1.3")
+
+	tlsConfig, err := CreateTLSConfig("127.0.0.1:8096")
+	if err != nil || tlsConfig == nil {
+		fmt.Printf("could not create TLS config: %v\n", err)
+		t.Fail()
+		return
+	}
+
+	checkConfig := func(expectedCN string, expectedMinVersion uint16) {
+		hello := &tls.ClientHelloInfo{ServerName: "localhost"}
+		listenerConfig, _ := tlsConfig.GetConfigForClient(hello)
+		if listenerConfig.MinVersion != expectedMinVersion {
+			fmt.Printf("wrong min TLS version, expecting %x got %x\n", expectedMinVersion, listenerConfig.MinVersion)
+			t.Fail()
+		}
+
+		cert, err := listenerConfig.GetCertificate(hello)
+		if err != nil {
+			fmt.Printf("could not get certificate: %s\n", err.Error())
+			t.Fail()
+			return
+		}
+		leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+		if leaf.Subject.CommonName != expectedCN {
+			fmt.Printf("wrong certificate, expecting %s got %s\n", expectedCN, leaf.Subject.CommonName)
+			t.Fail()
+		}
+	}
+	checkConfig("first", tls.VersionTLS13)
+
+	//rotate certificate on disk
+	writeTestCertificate(certFile, keyFile, "second")
+	future := time.Now().Add(10 * time.Second)
+	os.Chtimes(certFile, future, future)
+	checkConfig("second", tls.VersionTLS13)
+
+	//change policy
+	mwsettings.AddSetting("tls/minVersion", "1.2")
+	reloadTLSConfigs()
+	checkConfig("second", tls.VersionTLS12)
+
+	//bad policy keeps old configuration
+	mwsettings.AddSetting("tls/cipherSuites", []interface{}{"NOT_A_CIPHER"})
+	reloadTLSConfigs()
+	checkConfig("second", tls.VersionTLS12)
+
+	//cipher suites HTTP/2 cannot use are refused unless h2 is turned off
+	mwsettings.AddSetting("tls/cipherSuites", []interface{}{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"})
+	if _, err := buildTLSPolicy(); err == nil || !strings.Contains(err.Error(), "HTTP/2") {
+		fmt.Printf("cipher suites without the HTTP/2 required suite got error: %v\n", err)
+		t.Fail()
+	}
+	mwsettings.AddSetting("tls/alpn", []interface{}{"http/1.1"})
+	if _, err := buildTLSPolicy(); err != nil {
+		fmt.Printf("cipher suites without the HTTP/2 required suite and no h2 got error: %s\n", err.Error())
+		t.Fail()
+	}
+
+	//client certificates are never verified without a client CA
+	mwsettings.AddSetting("tls/cipherSuites", []interface{}{})
+	mwsettings.AddSetting("tls/clientAuth", "require")
+	if _, err := buildTLSPolicy(); err == nil || !strings.Contains(err.Error(), "tls/clientCAFile") {
+		fmt.Printf("verifying client certificates without tls/clientCAFile got error: %v\n", err)
+		t.Fail()
+	}
+}
+
+//writeTestCertificate writes a self signed certificate + key for commonName to the given files
+func writeTestCertificate(certFile string, keyFile string, commonName string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-1 * time.Hour),
+		NotAfter:     time.Now().Add(1 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+}
+
+//newTestClientCertificate creates a client certificate for commonName issued by a new, untrusted, CA
+func newTestClientCertificate(commonName string) (tls.Certificate, error) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "other CA"},
+		NotBefore:             time.Now().Add(-1 * time.Hour),
+		NotAfter:              time.Now().Add(1 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	caCert, err := x509.ParseCertificate(caDer)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano() + 1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-1 * time.Hour),
+		NotAfter:     time.Now().Add(1 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der, caDer}, PrivateKey: key}, nil
+}
+
 func TestLogRotationBySize(t *testing.T) {
 	tmpFile, err := ioutil.TempFile("/tmp/", "microweb-size-")
 	if err != nil {
@@ -325,9 +2018,22 @@ func checkForMissingLogMessages(t *testing.T, logFile *os.File) {
 }
 
 func doGet(url string, validStatus int, validationFunc func([]byte)) error {
+	return doGetHost(url, "", validStatus, validationFunc)
+}
+
+//doGetHost is doGet with the Host header set to host (if not "")
+func doGetHost(url string, host string, validStatus int, validationFunc func([]byte)) error {
 	var client = http.Client{}
 
-	response, err := client.Get(url)
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	if host != "" {
+		request.Host = host
+	}
+
+	response, err := client.Do(request)
 	if err != nil {
 		fmt.Printf("Could Not send GET request with error: %s\n", err.Error())
 		return errors.New("could not send GET request")
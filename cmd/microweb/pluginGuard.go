@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/CanadianCommander/MicroWeb/pkg/logger"
+)
+
+const (
+	defaultPluginFailureThreshold = 5
+	defaultPluginCooldown         = 30 * time.Second
+)
+
+/*
+PluginLimits configures how a plugin is isolated from the rest of the server, key "limits" of a plugin binding, ex:
+	{"binding": "/api/", "plugin": "/path/to/api.so", "limits": {"timeout": "5s", "maxConcurrent": 16, "failureThreshold": 3, "cooldown": "1m"}}
+Requests the plugin takes longer than "timeout" (no limit by default) to answer get a 504. The plugin cannot be stopped,
+but the request context is canceled and anything it writes afterwards is discarded. Only WebSocket connections are
+exempt, "timeout" cuts off other streaming responses (ex. Server-Sent Events) too. "timeout" has to be shorter than the
+response timeout of the binding ("responseTimeout" or "tune/httpResponseTimeout") for the 504 to make it out. At most "maxConcurrent" (0 for no limit)
+requests are handed to the plugin at once, others wait for a free slot up to "timeout", or get a 503 right away if there is no timeout.
+After "failureThreshold" (5 by default, 0 disables the circuit breaker) panics or timeouts in a row the circuit opens:
+requests get a 503 without reaching the plugin for "cooldown" (30s by default), after which a single request is let through
+to probe the plugin. Limits apply to the plugin, if it is bound several times the first "limits" block (see pluginConfig) is used.
+A settings reload resets them.
+*/
+type PluginLimits struct {
+	Timeout          time.Duration
+	MaxConcurrent    int
+	FailureThreshold int
+	Cooldown         time.Duration
+}
+
+// limits of plugins whose bindings have no "limits" block
+var defaultPluginLimits = PluginLimits{FailureThreshold: defaultPluginFailureThreshold, Cooldown: defaultPluginCooldown}
+
+/*
+decodePluginLimits decodes the "limits" object of a plugin binding, see PluginLimits
+*/
+func decodePluginLimits(raw interface{}) (*PluginLimits, error) {
+	limitsMap, bOk := raw.(map[string]interface{})
+	if !bOk {
+		return nil, errors.New("limits must be an object")
+	}
+
+	limits := defaultPluginLimits
+	var err error
+	if timeoutString, bOk := limitsMap["timeout"].(string); bOk {
+		if limits.Timeout, err = time.ParseDuration(timeoutString); err != nil || limits.Timeout < 0 {
+			return nil, errors.New("bad timeout: " + timeoutString)
+		}
+	}
+	if cooldownString, bOk := limitsMap["cooldown"].(string); bOk {
+		if limits.Cooldown, err = time.ParseDuration(cooldownString); err != nil || limits.Cooldown <= 0 {
+			return nil, errors.New("bad cooldown: " + cooldownString)
+		}
+	}
+	if maxConcurrent, bOk := limitsMap["maxConcurrent"].(float64); bOk {
+		if maxConcurrent < 0 {
+			return nil, errors.New("maxConcurrent cannot be negative")
+		}
+		limits.MaxConcurrent = int(maxConcurrent)
+	}
+	if failureThreshold, bOk := limitsMap["failureThreshold"].(float64); bOk {
+		if failureThreshold < 0 {
+			return nil, errors.New("failureThreshold cannot be negative")
+		}
+		limits.FailureThreshold = int(failureThreshold)
+	}
+	return &limits, nil
+}
+
+/*
+pluginLimits returns the limits of the plugin at pluginPath, the first "limits" block it is bound with (in the same
+order as pluginConfig) or defaultPluginLimits if there is none.
+*/
+func pluginLimits(pluginPath string) *PluginLimits {
+	for _, vhost := range append([]*VirtualHost{GetDefaultVirtualHost()}, GetVirtualHosts()...) {
+		for _, binding := range vhost.Plugins {
+			if binding.Plugin == pluginPath && binding.Limits != nil {
+				return binding.Limits
+			}
+		}
+	}
+	return &defaultPluginLimits
+}
+
+/*
+pluginGuard enforces the limits of one plugin, see PluginLimits.
+*/
+type pluginGuard struct {
+	path   string
+	limits *PluginLimits
+	// request slots, nil if MaxConcurrent is 0
+	slots chan bool
+
+	lock sync.Mutex
+	// panics and timeouts in a row
+	failures  int
+	openUntil time.Time
+	bProbing  bool
+}
+
+var (
+	pluginGuardsLock sync.Mutex
+	// guards by plugin path, dropped on settings reload
+	pluginGuards = make(map[string]*pluginGuard)
+)
+
+/*
+getPluginGuard returns the guard of the plugin at pluginPath, creating it if needed.
+*/
+func getPluginGuard(pluginPath string) *pluginGuard {
+	pluginGuardsLock.Lock()
+	defer pluginGuardsLock.Unlock()
+
+	guard, bOk := pluginGuards[pluginPath]
+	if !bOk {
+		guard = &pluginGuard{path: pluginPath, limits: pluginLimits(pluginPath)}
+		if guard.limits.MaxConcurrent > 0 {
+			guard.slots = make(chan bool, guard.limits.MaxConcurrent)
+		}
+		pluginGuards[pluginPath] = guard
+	}
+	return guard
+}
+
+/*
+resetPluginGuards drops all plugin guards so that they are recreated with the current limits. Called on settings reload.
+Requests in-flight finish under their old guard.
+*/
+func resetPluginGuards() {
+	pluginGuardsLock.Lock()
+	defer pluginGuardsLock.Unlock()
+	pluginGuards = make(map[string]*pluginGuard)
+}
+
+/*
+allow returns true if a request may be handed to the plugin. bProbe is true for the single request let through
+once the cooldown of an open circuit is over, its outcome decides if the circuit closes.
+*/
+func (guard *pluginGuard) allow() (bAllowed bool, bProbe bool) {
+	guard.lock.Lock()
+	defer guard.lock.Unlock()
+
+	if guard.limits.FailureThreshold == 0 || guard.failures < guard.limits.FailureThreshold {
+		return true, false
+	}
+	if guard.bProbing || time.Now().Before(guard.openUntil) {
+		return false, false
+	}
+	guard.bProbing = true
+	return true, true
+}
+
+/*
+record counts the outcome of a request, bFailed if the plugin panicked or timed out, opening the circuit once
+FailureThreshold failures happened in a row.
+*/
+func (guard *pluginGuard) record(bFailed bool, bProbe bool) {
+	guard.lock.Lock()
+	defer guard.lock.Unlock()
+
+	if bProbe {
+		guard.bProbing = false
+	}
+	if !bFailed {
+		if guard.failures >= guard.limits.FailureThreshold && guard.limits.FailureThreshold > 0 {
+			logger.LogInfo("Plugin: %s recovered, circuit closed", guard.path)
+		}
+		guard.failures = 0
+		return
+	}
+
+	guard.failures++
+	if guard.limits.FailureThreshold > 0 && guard.failures >= guard.limits.FailureThreshold {
+		if guard.failures == guard.limits.FailureThreshold || bProbe {
+			logger.LogError("Plugin: %s failed %d times in a row, circuit open for %s", guard.path, guard.failures, guard.limits.Cooldown)
+		}
+		guard.openUntil = time.Now().Add(guard.limits.Cooldown)
+	}
+}
+
+// endProbe lets another probe through, used when a probe ended without telling if the plugin works
+func (guard *pluginGuard) endProbe() {
+	guard.lock.Lock()
+	defer guard.lock.Unlock()
+	guard.bProbing = false
+}
+
+/*
+openFor returns how much longer the circuit stays open, 0 if it is closed or a probe may be sent.
+*/
+func (guard *pluginGuard) openFor() time.Duration {
+	guard.lock.Lock()
+	defer guard.lock.Unlock()
+
+	if guard.limits.FailureThreshold == 0 || guard.failures < guard.limits.FailureThreshold {
+		return 0
+	}
+	if remaining := time.Until(guard.openUntil); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+/*
+callPlugin calls handler, which hands req to a version of the plugin bound to binding, within the limits of the
+plugin (see PluginLimits). bStream requests, ex. WebSocket, have no timeout. A panic in handler is logged, with the
+plugin, binding and stack, and answered with a 500 if nothing has been sent yet. version is released once handler
+returns, even if the request timed out before that. returns false if the request failed or handler returned false.
+*/
+func callPlugin(res http.ResponseWriter, req *http.Request, binding *pluginBinding, version *pluginVersion, bStream bool,
+	handler func(res http.ResponseWriter, req *http.Request) bool) bool {
+	guard := getPluginGuard(version.path)
+	bindingPrefix := bindingPrefixOf(binding, req.URL.Path)
+
+	bAllowed, bProbe := guard.allow()
+	if !bAllowed {
+		version.release()
+		logger.LogWarning("Plugin: %s circuit open, rejected [%s]", version.path, req.URL.Path)
+		res.Header().Set("Retry-After", strconv.Itoa(int(guard.openFor().Seconds())+1))
+		WriteErrorResponse(res, req, http.StatusServiceUnavailable, "")
+		return false
+	}
+	bRecorded := false
+	defer func() {
+		// a probe without an outcome must not keep the circuit half open
+		if bProbe && !bRecorded {
+			guard.endProbe()
+		}
+	}()
+
+	timeout := guard.limits.Timeout
+	if bStream {
+		timeout = 0
+	}
+	ctx, cancel := req.Context(), context.CancelFunc(func() {})
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	defer cancel()
+
+	if guard.slots != nil {
+		if timeout == 0 {
+			select {
+			case guard.slots <- true:
+			default:
+				version.release()
+				logger.LogWarning("Plugin: %s is handling %d requests, rejected [%s]", version.path, guard.limits.MaxConcurrent, req.URL.Path)
+				WriteErrorResponse(res, req, http.StatusServiceUnavailable, "")
+				return false
+			}
+		} else {
+			select {
+			case guard.slots <- true:
+			case <-ctx.Done():
+				version.release()
+				logger.LogWarning("Plugin: %s had no free slot for [%s] within %s", version.path, req.URL.Path, timeout)
+				WriteErrorResponse(res, req, http.StatusServiceUnavailable, "")
+				return false
+			}
+		}
+	}
+
+	gRes := newGuardedResponseWriter(res)
+	run := func() (bHandled bool, panicValue interface{}) {
+		defer func() {
+			if guard.slots != nil {
+				<-guard.slots
+			}
+			version.release()
+		}()
+		defer func() {
+			if r := recover(); r != nil {
+				// deliberate aborts are not a fault of the plugin
+				if r != http.ErrAbortHandler {
+					logger.LogError("Plugin: %s panicked serving [%s] for binding %s: %v\n%s", version.path, req.URL.Path, bindingPrefix, r, string(debug.Stack()))
+				}
+				panicValue = r
+			}
+		}()
+		return handler(gRes, req.WithContext(ctx)), nil
+	}
+
+	var bHandled bool
+	var panicValue interface{}
+	if timeout == 0 {
+		bHandled, panicValue = run()
+	} else {
+		type callResult struct {
+			bHandled   bool
+			panicValue interface{}
+		}
+		done := make(chan callResult, 1)
+		go func() {
+			bHandled, panicValue := run()
+			done <- callResult{bHandled, panicValue}
+		}()
+
+		select {
+		case result := <-done:
+			bHandled, panicValue = result.bHandled, result.panicValue
+		case <-ctx.Done():
+			bStarted := gRes.cutOff()
+			if req.Context().Err() != nil {
+				// the client went away, the plugin is not to blame
+				return false
+			}
+			bRecorded = true
+			guard.record(true, bProbe)
+			logger.LogWarning("Plugin: %s timed out after %s serving [%s] for binding %s", version.path, timeout, req.URL.Path, bindingPrefix)
+			if !bStarted {
+				WriteErrorResponse(res, req, http.StatusGatewayTimeout, "")
+			}
+			return false
+		}
+	}
+
+	// anything the plugin left running (ex. a Server-Sent Events heartbeat) must not write to the finished response
+	bStarted := gRes.cutOff()
+	if panicValue == http.ErrAbortHandler {
+		panic(http.ErrAbortHandler)
+	}
+
+	bRecorded = true
+	guard.record(panicValue != nil, bProbe)
+	if panicValue != nil {
+		if bStarted {
+			// the client already has part of the response, a 500 cannot be sent any more.
+			// abort the connection so that the truncated response is not taken as complete.
+			panic(http.ErrAbortHandler)
+		}
+		WriteErrorResponse(res, req, http.StatusInternalServerError, "")
+		return false
+	}
+	return bHandled
+}
+
+/*
+guardedResponseWriter is handed to plugins in place of the real response writer, so that a plugin that timed out or
+panicked can no longer write to the response once the server has taken it over (see cutOff).
+*/
+type guardedResponseWriter struct {
+	res    http.ResponseWriter
+	header http.Header
+
+	lock      sync.Mutex
+	bStarted  bool
+	bCutOff   bool
+	bHijacked bool
+}
+
+func newGuardedResponseWriter(res http.ResponseWriter) *guardedResponseWriter {
+	return &guardedResponseWriter{res: res, header: res.Header().Clone()}
+}
+
+func (gRes *guardedResponseWriter) Header() http.Header {
+	return gRes.header
+}
+
+func (gRes *guardedResponseWriter) WriteHeader(statusCode int) {
+	gRes.lock.Lock()
+	defer gRes.lock.Unlock()
+	if gRes.bCutOff {
+		return
+	}
+	gRes.start()
+	gRes.res.WriteHeader(statusCode)
+}
+
+func (gRes *guardedResponseWriter) Write(data []byte) (int, error) {
+	gRes.lock.Lock()
+	defer gRes.lock.Unlock()
+	if gRes.bCutOff {
+		return 0, http.ErrHandlerTimeout
+	}
+	gRes.start()
+	return gRes.res.Write(data)
+}
+
+// start copies the header the plugin built up to the real response writer, once, before anything is sent. lock first
+func (gRes *guardedResponseWriter) start() {
+	if gRes.bStarted {
+		return
+	}
+	gRes.bStarted = true
+	header := gRes.res.Header()
+	for key := range header {
+		if _, bOk := gRes.header[key]; !bOk {
+			delete(header, key)
+		}
+	}
+	for key, values := range gRes.header {
+		header[key] = append([]string(nil), values...)
+	}
+}
+
+/*
+cutOff stops the plugin from writing to the response. returns true if the plugin already started the response,
+in which case no error response can be sent.
+*/
+func (gRes *guardedResponseWriter) cutOff() bool {
+	gRes.lock.Lock()
+	defer gRes.lock.Unlock()
+	gRes.bCutOff = true
+	return gRes.bStarted || gRes.bHijacked
+}
+
+// Flush sends any buffered data to the client, ex. for Server-Sent Events
+func (gRes *guardedResponseWriter) Flush() {
+	gRes.lock.Lock()
+	defer gRes.lock.Unlock()
+	if gRes.bCutOff {
+		return
+	}
+	gRes.start()
+	if flusher, bOk := gRes.res.(http.Flusher); bOk {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets plugins take over the connection, ex. for WebSocket
+func (gRes *guardedResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	gRes.lock.Lock()
+	defer gRes.lock.Unlock()
+	if gRes.bCutOff {
+		return nil, nil, http.ErrHandlerTimeout
+	}
+	gRes.start()
+	conn, rw, err := http.NewResponseController(gRes.res).Hijack()
+	if err == nil {
+		gRes.bHijacked = true
+	}
+	return conn, rw, err
+}
+
+// Unwrap returns the wrapped response writer, for use by http.ResponseController
+func (gRes *guardedResponseWriter) Unwrap() http.ResponseWriter {
+	return gRes.res
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CanadianCommander/MicroWeb/pkg/logger"
+	mwsettings "github.com/CanadianCommander/MicroWeb/pkg/mwSettings"
+	"github.com/CanadianCommander/MicroWeb/pkg/pluginUtil"
+)
+
+// how long a plugin has to report its health before it is considered unhealthy
+const pluginHealthTimeout = 2 * time.Second
+
+const (
+	healthOK          = "ok"
+	healthUnhealthy   = "unhealthy"
+	healthUnavailable = "unavailable"
+)
+
+/*
+pluginHealthReport is the health of a single plugin, as reported by the health endpoint. Why a plugin is unhealthy
+is logged, not reported, so that the endpoint does not leak internals.
+*/
+type pluginHealthReport struct {
+	Status  string `json:"status"`
+	Version string `json:"version,omitempty"`
+}
+
+/*
+healthReport is the body of the health endpoint.
+*/
+type healthReport struct {
+	Status    string                        `json:"status"`
+	Plugins   map[string]pluginHealthReport `json:"plugins"`
+	Processes map[string]pluginHealthReport `json:"processes"`
+}
+
+/*
+healthRouter serves the aggregated plugin health at the path set with "plugin/healthEndpoint", see servePluginHealth.
+Only clients on the loopback interface, those presenting a TLS client certificate issued by "tls/clientCAFile" and
+the hosts listed in "plugin/healthAllow" (IP addresses or CIDR ranges, ex. ["10.0.0.0/8"]) get the report. For everyone else the
+endpoint does not exist.
+*/
+type healthRouter struct {
+	priority int
+}
+
+/*
+Route sends the health report, no other router sees the request.
+*/
+func (hRouter *healthRouter) Route(req *http.Request, res http.ResponseWriter) bool {
+	servePluginHealth(res, req)
+	return false
+}
+
+/*
+CanRoute returns true if the url is the health endpoint
+*/
+func (hRouter *healthRouter) CanRoute(routeURL *url.URL) bool {
+	return mwsettings.HasSetting("plugin/healthEndpoint") && routeURL.Path == mwsettings.GetSettingString("plugin/healthEndpoint")
+}
+
+/*
+CanRouteRequest returns true if the request is for the health endpoint and the client may see it
+*/
+func (hRouter *healthRouter) CanRouteRequest(req *http.Request) bool {
+	return hRouter.CanRoute(req.URL) && isHealthClientAllowed(req)
+}
+
+// isHealthClientAllowed returns true if the client sending req may see the health report, see healthRouter
+func isHealthClientAllowed(req *http.Request) bool {
+	// only trust certificates checked against our own CA
+	if _, bOk := pluginUtil.GetClientCertificate(req); bOk && mwsettings.HasSetting("tls/clientCAFile") {
+		return true
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	clientIP := net.ParseIP(host)
+	if clientIP == nil {
+		return false
+	}
+	if clientIP.IsLoopback() {
+		return true
+	}
+
+	if mwsettings.HasSetting("plugin/healthAllow") {
+		allowList, err := decodeStringList(mwsettings.GetSetting("plugin/healthAllow"))
+		if err != nil {
+			logger.LogError("bad value for plugin/healthAllow: %s", err.Error())
+			return false
+		}
+		for _, allowed := range allowList {
+			if _, allowedNet, err := net.ParseCIDR(allowed); err == nil && allowedNet.Contains(clientIP) {
+				return true
+			} else if allowedIP := net.ParseIP(allowed); allowedIP != nil && allowedIP.Equal(clientIP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+GetPriority returns this routers priority
+*/
+func (hRouter *healthRouter) GetPriority() int {
+	return hRouter.priority
+}
+
+/*
+servePluginHealth asks every loaded plugin for its health (see IPlugin.Health), plugins that failed to load
+are unavailable and those whose circuit is open (see PluginLimits) unhealthy, and checks that the plugin processes are running.
+Plugins and processes are named after their first binding, see bindingKey.String. The report is sent as JSON, ex:
+	{"status": "unhealthy",
+	 "plugins":   {"/api/": {"status": "ok", "version": "4f6c1a0b2d3e4f50"},
+	               "example.com/broken/": {"status": "unavailable"}},
+	 "processes": {"/ext/": {"status": "ok"}}}
+with a 200 if everything is ok and a 503 otherwise.
+*/
+func servePluginHealth(res http.ResponseWriter, req *http.Request) {
+	report := healthReport{Status: healthOK, Plugins: collectPluginHealth(), Processes: collectProcessHealth()}
+	for _, reportSet := range []map[string]pluginHealthReport{report.Plugins, report.Processes} {
+		for _, pluginReport := range reportSet {
+			if pluginReport.Status != healthOK {
+				report.Status = healthUnhealthy
+			}
+		}
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Cache-Control", "no-store")
+	if report.Status == healthOK {
+		res.WriteHeader(http.StatusOK)
+	} else {
+		res.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if req.Method != http.MethodHead {
+		json.NewEncoder(res).Encode(report)
+	}
+}
+
+// collectPluginHealth checks the health of every loaded plugin in parallel
+func collectPluginHealth() map[string]pluginHealthReport {
+	names := pluginHealthNames()
+	pluginRegistryLock.RLock()
+	versionList := make([]*pluginVersion, 0, len(pluginRegistry))
+	for _, version := range pluginRegistry {
+		versionList = append(versionList, version)
+	}
+	reports := make(map[string]pluginHealthReport, len(pluginRegistry)+len(pluginFailures))
+	for path := range pluginFailures {
+		reports[names(path)] = pluginHealthReport{Status: healthUnavailable}
+	}
+	pluginRegistryLock.RUnlock()
+
+	var reportLock sync.Mutex
+	var waitGroup sync.WaitGroup
+	for _, version := range versionList {
+		waitGroup.Add(1)
+		go func(version *pluginVersion) {
+			defer waitGroup.Done()
+			report := pluginHealthReport{Status: healthOK, Version: shortHash(version.hash)}
+			if openFor := getPluginGuard(version.path).openFor(); openFor > 0 {
+				report.Status = healthUnhealthy
+			} else if err := checkPluginHealth(version.plugin); err != nil {
+				logger.LogWarning("Plugin: %s is unhealthy: %s", version.path, err.Error())
+				report.Status = healthUnhealthy
+			}
+			reportLock.Lock()
+			reports[names(version.path)] = report
+			reportLock.Unlock()
+		}(version)
+	}
+	waitGroup.Wait()
+	return reports
+}
+
+// checkPluginHealth calls the plugins Health, giving up after pluginHealthTimeout
+func checkPluginHealth(plugin IPlugin) error {
+	result := make(chan error, 1)
+	go func() {
+		result <- plugin.Health()
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(pluginHealthTimeout):
+		return errors.New("health check timed out")
+	}
+}
+
+// collectProcessHealth reports the plugin processes that are not running as unhealthy
+func collectProcessHealth() map[string]pluginHealthReport {
+	pluginProcessesLock.Lock()
+	defer pluginProcessesLock.Unlock()
+
+	reports := make(map[string]pluginHealthReport, len(pluginProcesses))
+	for key, process := range pluginProcesses {
+		process.lock.Lock()
+		bRunning := process.conn != nil
+		process.lock.Unlock()
+
+		if bRunning {
+			reports[key.String()] = pluginHealthReport{Status: healthOK}
+		} else {
+			reports[key.String()] = pluginHealthReport{Status: healthUnhealthy}
+		}
+	}
+	return reports
+}
+
+/*
+pluginHealthNames returns a function naming the plugin at a path after its first binding, in the default virtual host
+then in the order of the virtual hosts. Plugins that are no longer bound are named after their file.
+*/
+func pluginHealthNames() func(path string) string {
+	names := make(map[string]string)
+	for _, vhost := range append([]*VirtualHost{GetDefaultVirtualHost()}, GetVirtualHosts()...) {
+		for i := range vhost.Plugins {
+			if _, bOk := names[vhost.Plugins[i].Plugin]; !bOk && vhost.Plugins[i].Plugin != "" {
+				names[vhost.Plugins[i].Plugin] = vhost.bindingKeyOf(&vhost.Plugins[i]).String()
+			}
+		}
+	}
+
+	return func(path string) string {
+		if name, bOk := names[path]; bOk {
+			return name
+		}
+		return strings.TrimSuffix(filepath.Base(path), ".so")
+	}
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/CanadianCommander/MicroWeb/pkg/logger"
+	"github.com/CanadianCommander/MicroWeb/pkg/pluginUtil"
+	"github.com/CanadianCommander/MicroWeb/pkg/processPlugin"
+)
+
+const (
+	defaultProcessStartTimeout = 10 * time.Second
+	// request bodies larger than this are refused, they are sent to the plugin in a single frame
+	maxProcessRequestBody = 32 * 1024 * 1024
+	// restart back off, doubled after each crash that happens sooner than processStableTime after the start
+	minProcessRestartDelay = 100 * time.Millisecond
+	maxProcessRestartDelay = 30 * time.Second
+	processStableTime      = 10 * time.Second
+	// how long a stopping plugin has to exit after its stdin is closed before it is killed
+	processStopTimeout = 5 * time.Second
+	// how long a frame write to the stdin of a plugin may block before the plugin is considered hung and killed
+	processWriteTimeout = 10 * time.Second
+	// longest stderr line of a plugin that is logged as is, longer lines are logged in pieces
+	maxProcessLogLine = 64 * 1024
+)
+
+/*
+ProcessSettings configures a plugin binding that is served by an out-of-process plugin, ex:
+	{
+	  "binding": "/ext/",
+	  "process": {
+	    "command":      "/usr/local/bin/my-plugin",
+	    "args":         ["--flag"],
+	    "env":          {"MY_VAR": "value"},
+	    "dir":          "/var/lib/my-plugin",
+	    "startTimeout": "10s"
+	  }
+	}
+The command is started once the server has dropped its root privileges and speaks the protocol of package
+processPlugin on its stdin and stdout. It is restarted, with back off, whenever it exits. Requests wait up to
+"startTimeout" for the plugin to (re)start.
+*/
+type ProcessSettings struct {
+	Command      string
+	Args         []string
+	Env          []string
+	Dir          string
+	StartTimeout time.Duration
+}
+
+/*
+decodeProcessSettings decodes the "process" object of a plugin binding, see ProcessSettings
+*/
+func decodeProcessSettings(raw interface{}) (*ProcessSettings, error) {
+	processMap, bOk := raw.(map[string]interface{})
+	if !bOk {
+		return nil, errors.New("process must be an object")
+	}
+
+	processSettings := &ProcessSettings{StartTimeout: defaultProcessStartTimeout}
+	if processSettings.Command, bOk = processMap["command"].(string); !bOk || processSettings.Command == "" {
+		return nil, errors.New("process needs a command")
+	}
+	var err error
+	if processSettings.Args, err = decodeStringList(processMap["args"]); err != nil {
+		return nil, errors.New("bad process args: " + err.Error())
+	}
+	if envMap, bOk := processMap["env"].(map[string]interface{}); bOk {
+		for name, value := range envMap {
+			strValue, bOk := value.(string)
+			if !bOk {
+				return nil, errors.New("process env values must be strings")
+			}
+			processSettings.Env = append(processSettings.Env, name+"="+strValue)
+		}
+		sort.Strings(processSettings.Env)
+	}
+	processSettings.Dir, _ = processMap["dir"].(string)
+	if timeoutString, bOk := processMap["startTimeout"].(string); bOk {
+		if processSettings.StartTimeout, err = time.ParseDuration(timeoutString); err != nil || processSettings.StartTimeout <= 0 {
+			return nil, errors.New("bad process startTimeout: " + timeoutString)
+		}
+	}
+	return processSettings, nil
+}
+
+/*
+pluginProcess supervises one out-of-process plugin, restarting it whenever it exits.
+*/
+type pluginProcess struct {
+	settings *ProcessSettings
+
+	lock sync.Mutex
+	// the running, ready, plugin. nil while (re)starting
+	conn *processConn
+	// closed, and replaced, when conn changes
+	connChanged chan bool
+	stopChan    chan bool
+}
+
+/*
+processConn is one run of a plugin process.
+*/
+type processConn struct {
+	cmd       *exec.Cmd
+	writeLock sync.Mutex
+	// a pipe of our own, instead of cmd.StdinPipe, so that writes can have a deadline
+	stdin *os.File
+
+	pendingLock sync.Mutex
+	nextID      uint64
+	// response channels of in-flight requests by request id
+	pending map[uint64]chan *processPlugin.Frame
+	// closed once the process has exited
+	done chan bool
+}
+
+var (
+	pluginProcessesLock sync.Mutex
+	// running plugin processes by binding, see bindingKey
+	pluginProcesses = make(map[bindingKey]*pluginProcess)
+)
+
+/*
+getPluginProcess returns the supervisor of the plugin process of the binding identified by key, starting the process
+if needed. A process started with different settings, ex. before a settings reload, is stopped and replaced.
+*/
+func getPluginProcess(key bindingKey, processSettings *ProcessSettings) *pluginProcess {
+	pluginProcessesLock.Lock()
+	defer pluginProcessesLock.Unlock()
+	if process, bOk := pluginProcesses[key]; bOk {
+		if reflect.DeepEqual(process.settings, processSettings) {
+			return process
+		}
+		process.stop()
+	}
+
+	process := &pluginProcess{settings: processSettings, connChanged: make(chan bool), stopChan: make(chan bool)}
+	go process.supervise()
+	pluginProcesses[key] = process
+	return process
+}
+
+/*
+StartPluginProcesses starts the out-of-process plugins of all bindings, in all virtual hosts.
+Called after root privileges have been dropped, so that plugins do not run as root.
+*/
+func StartPluginProcesses() {
+	for _, vhost := range append([]*VirtualHost{GetDefaultVirtualHost()}, GetVirtualHosts()...) {
+		for i := range vhost.Plugins {
+			if vhost.Plugins[i].Process != nil {
+				getPluginProcess(vhost.bindingKeyOf(&vhost.Plugins[i]), vhost.Plugins[i].Process)
+			}
+		}
+	}
+}
+
+/*
+prunePluginProcesses stops the plugin processes that are no longer bound in any virtual host, or whose settings changed,
+ex. after a settings reload. Processes whose settings are unchanged keep running.
+*/
+func prunePluginProcesses() {
+	bound := make(map[bindingKey]*ProcessSettings)
+	for _, vhost := range append([]*VirtualHost{GetDefaultVirtualHost()}, GetVirtualHosts()...) {
+		for i := range vhost.Plugins {
+			if vhost.Plugins[i].Process != nil {
+				bound[vhost.bindingKeyOf(&vhost.Plugins[i])] = vhost.Plugins[i].Process
+			}
+		}
+	}
+
+	pluginProcessesLock.Lock()
+	defer pluginProcessesLock.Unlock()
+	for key, process := range pluginProcesses {
+		if processSettings, bOk := bound[key]; !bOk || !reflect.DeepEqual(process.settings, processSettings) {
+			process.stop()
+			delete(pluginProcesses, key)
+		}
+	}
+}
+
+/*
+stopAllPluginProcesses stops every plugin process. Called when the server exits.
+*/
+func stopAllPluginProcesses() {
+	pluginProcessesLock.Lock()
+	defer pluginProcessesLock.Unlock()
+	for key, process := range pluginProcesses {
+		process.stop()
+		delete(pluginProcesses, key)
+	}
+}
+
+func (process *pluginProcess) stop() {
+	close(process.stopChan)
+}
+
+func (process *pluginProcess) isStopped() bool {
+	select {
+	case <-process.stopChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// setConn publishes conn, which may be nil, to requests waiting in getConn
+func (process *pluginProcess) setConn(conn *processConn) {
+	process.lock.Lock()
+	defer process.lock.Unlock()
+	process.conn = conn
+	close(process.connChanged)
+	process.connChanged = make(chan bool)
+}
+
+/*
+getConn returns the running plugin, waiting for it to (re)start if needed. An error is returned if the plugin
+is not ready before ctx is done or the plugin is stopped.
+*/
+func (process *pluginProcess) getConn(ctx context.Context) (*processConn, error) {
+	for {
+		process.lock.Lock()
+		conn, connChanged := process.conn, process.connChanged
+		process.lock.Unlock()
+		if conn != nil {
+			return conn, nil
+		}
+
+		select {
+		case <-connChanged:
+		case <-ctx.Done():
+			return nil, errors.New("plugin process not ready")
+		case <-process.stopChan:
+			return nil, errors.New("plugin process stopped")
+		}
+	}
+}
+
+/*
+supervise runs the plugin process until the plugin is stopped, restarting it whenever it exits.
+*/
+func (process *pluginProcess) supervise() {
+	restartDelay := minProcessRestartDelay
+	for !process.isStopped() {
+		startTime := time.Now()
+		if err := process.run(); err != nil {
+			logger.LogError("Plugin process %s exited with error: %s", process.settings.Command, err.Error())
+		} else if !process.isStopped() {
+			logger.LogWarning("Plugin process %s exited", process.settings.Command)
+		}
+
+		if time.Since(startTime) >= processStableTime {
+			restartDelay = minProcessRestartDelay
+		}
+		select {
+		case <-process.stopChan:
+			return
+		case <-time.After(restartDelay):
+		}
+		logger.LogInfo("Restarting plugin process %s", process.settings.Command)
+		if restartDelay *= 2; restartDelay > maxProcessRestartDelay {
+			restartDelay = maxProcessRestartDelay
+		}
+	}
+}
+
+/*
+run starts the plugin process and serves its frames until it exits. The process is asked to exit, by closing
+its stdin, when the plugin is stopped.
+*/
+func (process *pluginProcess) run() error {
+	cmd := exec.Command(process.settings.Command, process.settings.Args...)
+	cmd.Env = append(os.Environ(), process.settings.Env...)
+	cmd.Dir = process.settings.Dir
+	stdinReader, stdin, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stdin = stdinReader
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		stdinReader.Close()
+		stdin.Close()
+		return err
+	}
+	cmd.Stderr = &pluginOutputLogger{command: process.settings.Command}
+	err = cmd.Start()
+	stdinReader.Close()
+	if err != nil {
+		stdin.Close()
+		return err
+	}
+	logger.LogVerbose("Started plugin process %s [%d]", process.settings.Command, cmd.Process.Pid)
+
+	conn := &processConn{cmd: cmd, stdin: stdin, pending: make(map[uint64]chan *processPlugin.Frame), done: make(chan bool)}
+	go func() {
+		select {
+		case <-process.stopChan:
+			stdin.Close()
+			select {
+			case <-conn.done:
+			case <-time.After(processStopTimeout):
+				cmd.Process.Kill()
+			}
+		case <-conn.done:
+		}
+	}()
+
+	readErr := process.readFrames(conn, bufio.NewReader(stdout))
+	process.setConn(nil)
+	if readErr != io.EOF {
+		// the plugin broke the protocol
+		cmd.Process.Kill()
+	} else {
+		// the plugin may have closed stdout without exiting
+		stdin.Close()
+	}
+	waitErr := cmd.Wait()
+	close(conn.done)
+	conn.failPending()
+
+	if readErr != io.EOF && !process.isStopped() {
+		return readErr
+	}
+	return waitErr
+}
+
+// readFrames reads the frames sent by the plugin until it closes stdout. The plugin becomes ready once it says so
+func (process *pluginProcess) readFrames(conn *processConn, reader io.Reader) error {
+	readyTimer := time.AfterFunc(process.settings.StartTimeout, func() {
+		logger.LogError("Plugin process %s not ready after %s, killing it", process.settings.Command, process.settings.StartTimeout)
+		conn.cmd.Process.Kill()
+	})
+	defer readyTimer.Stop()
+
+	for {
+		frame, err := processPlugin.ReadFrame(reader)
+		if err != nil {
+			return err
+		}
+
+		switch frame.Type {
+		case processPlugin.FrameReady:
+			if frame.Protocol != processPlugin.ProtocolVersion {
+				return errors.New("plugin process speaks an unsupported protocol version")
+			}
+			readyTimer.Stop()
+			logger.LogVerbose("Plugin process %s is ready", process.settings.Command)
+			process.setConn(conn)
+		case processPlugin.FrameResponse:
+			conn.pendingLock.Lock()
+			responseChan, bOk := conn.pending[frame.ID]
+			delete(conn.pending, frame.ID)
+			conn.pendingLock.Unlock()
+			if bOk {
+				responseChan <- frame
+			}
+		default:
+			logger.LogWarning("Plugin process %s sent unknown frame type: %s", process.settings.Command, frame.Type)
+		}
+	}
+}
+
+// pluginOutputLogger is the stderr of plugin processes, each line written to it is logged
+type pluginOutputLogger struct {
+	command string
+	partial []byte
+}
+
+func (output *pluginOutputLogger) Write(data []byte) (int, error) {
+	output.partial = append(output.partial, data...)
+	for {
+		lineEnd := bytes.IndexByte(output.partial, '\n')
+		if lineEnd < 0 {
+			break
+		}
+		logger.LogInfo("[%s] %s", output.command, string(output.partial[:lineEnd]))
+		output.partial = output.partial[lineEnd+1:]
+	}
+	// a plugin that never ends its line must not grow the buffer without bound
+	for len(output.partial) > maxProcessLogLine {
+		logger.LogInfo("[%s] %s", output.command, string(output.partial[:maxProcessLogLine]))
+		output.partial = output.partial[maxProcessLogLine:]
+	}
+	if len(output.partial) == 0 {
+		output.partial = nil
+	}
+	return len(data), nil
+}
+
+/*
+roundTrip sends the request frame to the plugin and waits for the response. An error is returned if the plugin
+exits first, or ctx is done, in which case the plugin is told to cancel the request.
+*/
+func (conn *processConn) roundTrip(ctx context.Context, request *processPlugin.Frame) (*processPlugin.Frame, error) {
+	responseChan := make(chan *processPlugin.Frame, 1)
+	conn.pendingLock.Lock()
+	if conn.pending == nil {
+		conn.pendingLock.Unlock()
+		return nil, errors.New("plugin process exited")
+	}
+	conn.nextID++
+	request.ID = conn.nextID
+	conn.pending[request.ID] = responseChan
+	conn.pendingLock.Unlock()
+
+	if err := conn.writeFrame(request); err != nil {
+		conn.pendingLock.Lock()
+		delete(conn.pending, request.ID)
+		conn.pendingLock.Unlock()
+		return nil, err
+	}
+
+	select {
+	case response, bOk := <-responseChan:
+		if !bOk {
+			return nil, errors.New("plugin process exited")
+		}
+		return response, nil
+	case <-ctx.Done():
+		conn.pendingLock.Lock()
+		delete(conn.pending, request.ID)
+		conn.pendingLock.Unlock()
+		conn.writeFrame(&processPlugin.Frame{Type: processPlugin.FrameCancel, ID: request.ID})
+		return nil, ctx.Err()
+	}
+}
+
+/*
+writeFrame sends frame to the plugin. A plugin that does not read its stdin for processWriteTimeout is killed,
+a partly written frame leaves no way to recover the stream anyway.
+*/
+func (conn *processConn) writeFrame(frame *processPlugin.Frame) error {
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+	conn.stdin.SetWriteDeadline(time.Now().Add(processWriteTimeout))
+	err := processPlugin.WriteFrame(conn.stdin, frame)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		logger.LogError("Plugin process %s did not read its input for %s, killing it", conn.cmd.Path, processWriteTimeout)
+		conn.cmd.Process.Kill()
+	}
+	return err
+}
+
+// failPending fails every in-flight request, the process has exited
+func (conn *processConn) failPending() {
+	conn.pendingLock.Lock()
+	defer conn.pendingLock.Unlock()
+	for id, responseChan := range conn.pending {
+		close(responseChan)
+		delete(conn.pending, id)
+	}
+	conn.pending = nil
+}
+
+/*
+serveProcessResource passes req on to the out-of-process plugin of binding. If the plugin is not running, crashes
+while handling the request or responds with an invalid status, a 502 is sent. WebSockets are not supported.
+*/
+func serveProcessResource(res http.ResponseWriter, req *http.Request, binding *pluginBinding) bool {
+	process := getPluginProcess(GetVirtualHost(req).bindingKeyOf(binding), binding.Process)
+
+	body, err := io.ReadAll(http.MaxBytesReader(res, req.Body, maxProcessRequestBody))
+	if err != nil {
+		WriteErrorResponse(res, req, http.StatusRequestEntityTooLarge, "")
+		return false
+	}
+
+	startCtx, cancel := context.WithTimeout(req.Context(), process.settings.StartTimeout)
+	conn, err := process.getConn(startCtx)
+	cancel()
+	if err != nil {
+		logger.LogWarning("Plugin process %s cannot serve [%s]: %s", process.settings.Command, req.URL.Path, err.Error())
+		WriteErrorResponse(res, req, http.StatusBadGateway, "")
+		return false
+	}
+
+	response, err := conn.roundTrip(req.Context(), &processPlugin.Frame{
+		Type:       processPlugin.FrameRequest,
+		Method:     req.Method,
+		URL:        req.URL.RequestURI(),
+		Proto:      req.Proto,
+		Host:       req.Host,
+		RemoteAddr: req.RemoteAddr,
+		RequestID:  pluginUtil.GetRequestID(req),
+		Header:     req.Header,
+		Body:       body,
+	})
+	if err != nil {
+		if req.Context().Err() == nil {
+			logger.LogWarning("Plugin process %s failed to serve [%s]: %s", process.settings.Command, req.URL.Path, err.Error())
+			WriteErrorResponse(res, req, http.StatusBadGateway, "")
+		}
+		return false
+	}
+
+	if response.Status == 0 {
+		response.Status = http.StatusOK
+	} else if response.Status < 100 || response.Status > 999 {
+		logger.LogWarning("Plugin process %s responded to [%s] with invalid status %d", process.settings.Command, req.URL.Path, response.Status)
+		WriteErrorResponse(res, req, http.StatusBadGateway, "")
+		return false
+	}
+	for name, values := range response.Header {
+		res.Header()[name] = values
+	}
+	res.WriteHeader(response.Status)
+	if req.Method != http.MethodHead {
+		res.Write(response.Body)
+	}
+	return true
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CanadianCommander/MicroWeb/pkg/logger"
+	mwsettings "github.com/CanadianCommander/MicroWeb/pkg/mwSettings"
+	"github.com/CanadianCommander/MicroWeb/pkg/route"
+	"github.com/fsnotify/fsnotify"
+)
+
+// how long a plugin file has to be left alone before a change to it is loaded
+const pluginChangeSettleTime = 250 * time.Millisecond
+
+//errPluginUnavailable is returned for plugins that failed to load or initialize
+var errPluginUnavailable = errors.New("plugin unavailable")
+
+/*
+pluginVersion is one build of a plugin. Go cannot unload a plugin nor open the same path twice, so each build is
+copied to a path named by its content hash (see versionPluginFile) and opened from there.
+*/
+type pluginVersion struct {
+	plugin IPlugin
+	// the path the plugin is bound under in the config file
+	path string
+	// the content hash path copy the plugin was opened from
+	versionPath string
+	hash        string
+	// the routers the plugin added in RegisterRouters, wrapped in inFlightMiddleware and removed when the version is replaced
+	routers []route.Router
+	// requests being served by this version
+	inFlight sync.WaitGroup
+}
+
+var (
+	// current plugin version by plugin path. versions are swapped while holding the write lock
+	pluginRegistryLock sync.RWMutex
+	pluginRegistry     = make(map[string]*pluginVersion)
+	// why the plugins that could not be loaded, and have no older version to fall back on, are unavailable
+	pluginFailures = make(map[string]error)
+
+	// only one plugin is loaded at a time, keeps RegisterRouters of different plugins apart
+	pluginLoadLock sync.Mutex
+
+	pluginWatcherLock sync.Mutex
+	pluginWatcher     *fsnotify.Watcher
+	// pending reloads of changed plugin files, by plugin path
+	pluginChangeTimers = make(map[string]*time.Timer)
+)
+
+//AddPluginRegistrySettingDecoders adds setting decoders for plugin reloading and the plugin health endpoint
+func AddPluginRegistrySettingDecoders() {
+	mwsettings.AddSettingDecoder(mwsettings.NewBasicDecoder("plugin/autoReload"))
+	mwsettings.AddSettingDecoder(mwsettings.NewBasicDecoder("plugin/healthEndpoint"))
+	mwsettings.AddSettingDecoder(mwsettings.NewBasicDecoder("plugin/healthAllow"))
+}
+
+/*
+acquirePlugin returns the current version of the plugin at path, loading it if needed.
+The version counts as in-flight, and will not be shut down, until release is called.
+If the plugin failed to load the error wraps errPluginUnavailable.
+*/
+func acquirePlugin(path string) (*pluginVersion, error) {
+	for {
+		pluginRegistryLock.RLock()
+		version, bOk := pluginRegistry[path]
+		if bOk {
+			version.inFlight.Add(1)
+		}
+		pluginRegistryLock.RUnlock()
+		if bOk {
+			return version, nil
+		}
+
+		if err := loadPluginVersion(path, false); err != nil {
+			return nil, err
+		}
+	}
+}
+
+/*
+release marks a request acquired with acquirePlugin as finished.
+*/
+func (version *pluginVersion) release() {
+	version.inFlight.Done()
+}
+
+/*
+acquireRouted counts a request routed by one of the routers the version registered as in-flight, like acquirePlugin.
+Returns false, without doing so, if the version is no longer the current one, ex. it is being retired.
+*/
+func (version *pluginVersion) acquireRouted() bool {
+	pluginRegistryLock.RLock()
+	defer pluginRegistryLock.RUnlock()
+	if pluginRegistry[version.path] != version {
+		return false
+	}
+	version.inFlight.Add(1)
+	return true
+}
+
+/*
+inFlightMiddleware wraps the routers the version registered, see acquireRouted. A router of a replaced version
+passes the request on to the routers after it.
+*/
+func (version *pluginVersion) inFlightMiddleware(next route.Handler) route.Handler {
+	return func(req *http.Request, res http.ResponseWriter) bool {
+		if !version.acquireRouted() {
+			return true
+		}
+		defer version.release()
+		return next(req, res)
+	}
+}
+
+/*
+drain waits for the requests in-flight on the version to finish. Returns false if ctx is done first.
+*/
+func (version *pluginVersion) drain(ctx context.Context) bool {
+	drained := make(chan struct{})
+	go func() {
+		version.inFlight.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+/*
+ReloadPlugin loads the plugin file at path again. If its content changed since it was last loaded the new build is
+swapped in, new requests go to it while the requests in-flight on the old build finish. The old build is then shut down.
+*/
+func ReloadPlugin(path string) error {
+	return loadPluginVersion(path, true)
+}
+
+/*
+ReloadAllPlugins reloads every loaded plugin, and retries those that failed to load, see ReloadPlugin.
+*/
+func ReloadAllPlugins() {
+	pluginRegistryLock.RLock()
+	pathList := make([]string, 0, len(pluginRegistry)+len(pluginFailures))
+	for path := range pluginRegistry {
+		pathList = append(pathList, path)
+	}
+	for path := range pluginFailures {
+		pathList = append(pathList, path)
+	}
+	pluginRegistryLock.RUnlock()
+
+	for _, path := range pathList {
+		if err := ReloadPlugin(path); err != nil {
+			logger.LogError("Could not reload plugin: %s with error: %s", path, err.Error())
+		}
+	}
+}
+
+/*
+ShutdownAllPlugins removes every plugin from the registry and shuts each down once its in-flight requests finish,
+or the shutdown timeout (see GetShutdownTimeout) runs out. Plugin processes are stopped too. Called when the server exits.
+*/
+func ShutdownAllPlugins() {
+	stopAllPluginProcesses()
+
+	pluginWatcherLock.Lock()
+	if pluginWatcher != nil {
+		pluginWatcher.Close()
+		pluginWatcher = nil
+	}
+	pluginWatcherLock.Unlock()
+
+	pluginRegistryLock.Lock()
+	versionList := make([]*pluginVersion, 0, len(pluginRegistry))
+	for path, version := range pluginRegistry {
+		versionList = append(versionList, version)
+		delete(pluginRegistry, path)
+	}
+	pluginRegistryLock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), GetShutdownTimeout())
+	defer cancel()
+	for _, version := range versionList {
+		if !version.drain(ctx) {
+			logger.LogWarning("Plugin: %s still has requests in-flight after %s, shutting it down anyway", version.path, GetShutdownTimeout())
+		}
+		version.plugin.Shutdown(ctx)
+	}
+}
+
+/*
+notifyPluginsSettingsChanged calls OnSettingsChanged on every loaded plugin with its current config (see pluginConfig),
+ex. after a settings reload.
+*/
+func notifyPluginsSettingsChanged() {
+	pluginRegistryLock.RLock()
+	versionList := make([]*pluginVersion, 0, len(pluginRegistry))
+	for _, version := range pluginRegistry {
+		versionList = append(versionList, version)
+	}
+	pluginRegistryLock.RUnlock()
+
+	for _, version := range versionList {
+		version.plugin.OnSettingsChanged(pluginConfig(version.path))
+	}
+}
+
+/*
+loadPluginVersion opens, initializes (see pluginConfig) and registers the plugin at path. If a version of the plugin is
+already loaded nothing is done, unless bReload is set and the plugin file has changed, in which case the new version
+replaces the old one (see retirePluginVersion). On error the old version, if any, stays in place. Without an old
+version the plugin is marked unavailable until it is reloaded, requests for it fail with errPluginUnavailable.
+*/
+func loadPluginVersion(path string, bReload bool) (err error) {
+	pluginLoadLock.Lock()
+	defer pluginLoadLock.Unlock()
+
+	pluginRegistryLock.RLock()
+	oldVersion, failure := pluginRegistry[path], pluginFailures[path]
+	pluginRegistryLock.RUnlock()
+	if oldVersion != nil && !bReload {
+		return nil
+	}
+	if failure != nil && !bReload {
+		return failure
+	}
+	if oldVersion == nil && failure == nil && mwsettings.HasSetting("plugin/autoReload") && mwsettings.GetSettingBool("plugin/autoReload") {
+		// first attempt, broken plugins are watched too so that fixing them brings them up
+		watchPluginFile(path)
+	}
+	if oldVersion == nil {
+		defer func() {
+			pluginRegistryLock.Lock()
+			defer pluginRegistryLock.Unlock()
+			if err != nil {
+				pluginFailures[path] = fmt.Errorf("%w: %s", errPluginUnavailable, err.Error())
+			} else {
+				delete(pluginFailures, path)
+			}
+		}()
+	}
+
+	hash, err := hashPluginFile(path)
+	if err != nil {
+		logger.LogError("Could not read plugin: %s with Error: %s", path, err.Error())
+		return err
+	}
+	if oldVersion != nil && oldVersion.hash == hash {
+		logger.LogVerbose("Plugin: %s is unchanged", path)
+		return nil
+	}
+
+	versionPath, err := versionPluginFile(path, hash)
+	if err != nil {
+		logger.LogError("Could not copy plugin: %s with Error: %s", path, err.Error())
+		return err
+	}
+
+	logger.LogVerbose("Loading plugin from file: %s (%s)", path, versionPath)
+	rawPlugin, err := _loadPlugin(versionPath)
+	if err != nil {
+		if strings.Contains(err.Error(), "already loaded") {
+			logger.LogError("Plugin: %s has the same plugin path as a previous build. To reload it build it from its source files, ex. go build -buildmode=plugin plugin.go", path)
+		}
+		return err
+	}
+
+	plugin := constructPlugin(rawPlugin)
+	if plugin == nil {
+		return errors.New("plugin has incorrect format")
+	}
+
+	//initialize
+	version := &pluginVersion{plugin: plugin, path: path, versionPath: versionPath, hash: hash}
+	if err = plugin.InitWithConfig(pluginConfig(path)); err != nil {
+		logger.LogError("Plugin: %s failed to initialize with error: %s", path, err.Error())
+		return err
+	}
+	routerSet := make(map[route.Router]bool)
+	for _, router := range GetRoutingManager().GetRouters() {
+		routerSet[router] = true
+	}
+	plugin.RegisterRouters(GetRoutingManager())
+	for _, router := range GetRoutingManager().GetRouters() {
+		if !routerSet[router] {
+			GetRoutingManager().WrapRouter(router, version.inFlightMiddleware)
+			version.routers = append(version.routers, router)
+		}
+	}
+
+	pluginRegistryLock.Lock()
+	pluginRegistry[path] = version
+	pluginRegistryLock.Unlock()
+
+	if oldVersion != nil {
+		logger.LogInfo("Plugin: %s reloaded, version %s replaces %s", path, shortHash(hash), shortHash(oldVersion.hash))
+		retirePluginVersion(oldVersion)
+	}
+	return nil
+}
+
+/*
+retirePluginVersion removes the routers of a replaced plugin version and, once the requests in-flight on it
+have finished or the shutdown timeout (see GetShutdownTimeout) runs out, shuts it down. The plugin itself stays
+in memory, Go cannot unload plugins.
+*/
+func retirePluginVersion(version *pluginVersion) {
+	for _, router := range version.routers {
+		GetRoutingManager().RemoveRouter(router)
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), GetShutdownTimeout())
+		defer cancel()
+		if !version.drain(ctx) {
+			logger.LogWarning("Plugin: %s version %s still has requests in-flight after %s, shutting it down anyway",
+				version.path, shortHash(version.hash), GetShutdownTimeout())
+		}
+		version.plugin.Shutdown(ctx)
+		logger.LogVerbose("Plugin: %s version %s drained and shut down", version.path, shortHash(version.hash))
+	}()
+}
+
+// hashPluginFile returns the hex sha256 of the file at path
+func hashPluginFile(path string) (string, error) {
+	pluginFile, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer pluginFile.Close()
+
+	hasher := sha256.New()
+	if _, err = io.Copy(hasher, pluginFile); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+/*
+versionPluginFile copies the plugin at path, whose content hash is hash, to the plugin version directory and
+returns the path of the copy. A copy that already exists is never written to, it may be open.
+*/
+func versionPluginFile(path string, hash string) (string, error) {
+	versionDir := filepath.Join(os.TempDir(), fmt.Sprintf("microweb-plugins-%d", os.Getuid()))
+	if err := os.MkdirAll(versionDir, 0700); err != nil {
+		return "", err
+	}
+	versionPath := filepath.Join(versionDir, strings.TrimSuffix(filepath.Base(path), ".so")+"-"+shortHash(hash)+".so")
+	if _, err := os.Stat(versionPath); err == nil {
+		return versionPath, nil
+	}
+
+	source, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer source.Close()
+	copyFile, err := os.CreateTemp(versionDir, ".copy-*")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(copyFile, source)
+	if cErr := copyFile.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		// rename so that a half written copy is never opened
+		err = os.Rename(copyFile.Name(), versionPath)
+	}
+	if err != nil {
+		os.Remove(copyFile.Name())
+		return "", err
+	}
+	return versionPath, nil
+}
+
+func shortHash(hash string) string {
+	if len(hash) > 16 {
+		return hash[:16]
+	}
+	return hash
+}
+
+/*
+watchPluginFile reloads the plugin at path whenever the file changes. Build tools often write the file in several
+steps, so the reload happens once the file has been left alone for pluginChangeSettleTime.
+*/
+func watchPluginFile(path string) {
+	pluginWatcherLock.Lock()
+	defer pluginWatcherLock.Unlock()
+
+	if pluginWatcher == nil {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			logger.LogError("Cannot watch plugins for changes with error: %s", err.Error())
+			return
+		}
+		pluginWatcher = watcher
+		go watchPlugins(watcher)
+	}
+
+	// watch the directory, the file itself is often replaced instead of written to
+	if err := pluginWatcher.Add(filepath.Dir(path)); err != nil {
+		logger.LogError("Cannot watch plugin: %s for changes with error: %s", path, err.Error())
+		return
+	}
+	logger.LogVerbose("Watching plugin @ %s for changes", path)
+}
+
+func watchPlugins(watcher *fsnotify.Watcher) {
+	for {
+		select {
+		case event, bOk := <-watcher.Events:
+			if !bOk {
+				return
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+
+			changedPath := filepath.Clean(event.Name)
+			pluginRegistryLock.RLock()
+			_, bLoaded := pluginRegistry[changedPath]
+			_, bFailed := pluginFailures[changedPath]
+			pluginRegistryLock.RUnlock()
+			if bLoaded || bFailed {
+				schedulePluginReload(changedPath)
+			}
+		case err, bOk := <-watcher.Errors:
+			if !bOk {
+				return
+			}
+			logger.LogError("Got error while watching plugins: %s", err.Error())
+		}
+	}
+}
+
+// schedulePluginReload reloads the plugin at path after pluginChangeSettleTime, restarting the wait if one is pending
+func schedulePluginReload(path string) {
+	pluginWatcherLock.Lock()
+	defer pluginWatcherLock.Unlock()
+
+	if timer, bOk := pluginChangeTimers[path]; bOk {
+		timer.Reset(pluginChangeSettleTime)
+		return
+	}
+	pluginChangeTimers[path] = time.AfterFunc(pluginChangeSettleTime, func() {
+		pluginWatcherLock.Lock()
+		delete(pluginChangeTimers, path)
+		pluginWatcherLock.Unlock()
+
+		logger.LogInfo("Plugin: %s changed, reloading", path)
+		if err := ReloadPlugin(path); err != nil {
+			logger.LogError("Could not reload plugin: %s with error: %s", path, err.Error())
+		}
+	})
+}
@@ -1,18 +1,21 @@
 package main
 
 import (
-	"errors"
+	"context"
 	"mime"
 	"net/http"
+	"os"
 	"path"
 	"plugin"
 	"reflect"
-	"sort"
+	"strings"
 	"time"
 
 	"github.com/CanadianCommander/MicroWeb/pkg/cache"
 	"github.com/CanadianCommander/MicroWeb/pkg/logger"
 	mwsettings "github.com/CanadianCommander/MicroWeb/pkg/mwSettings"
+	"github.com/CanadianCommander/MicroWeb/pkg/pluginUtil"
+	"github.com/CanadianCommander/MicroWeb/pkg/route"
 )
 
 /*
@@ -22,11 +25,37 @@ type IPlugin interface {
 	//called to intialize the plugin.
 	Init()
 
+	//called instead of Init() with the "config" block of the plugins binding (nil if it has none), if the plugin
+	//exports it (optional). If it fails the plugin is not used and its bindings answer with 503 until it is reloaded.
+	InitWithConfig(config map[string]interface{}) error
+
 	//called to handle normal resource requests
 	HandleRequest(req *http.Request, res http.ResponseWriter, fsName string) bool
 
 	//called to handle virtual resource requests (a request the does not target a physical file on the server)
 	HandleVirtualRequest(req *http.Request, res http.ResponseWriter) bool
+
+	//called once after Init() to let the plugin add its own pre / normal / post routers to the global routing manager
+	RegisterRouters(manager *route.RoutingManager)
+
+	//called with the upgraded connection when a client opens a WebSocket to a resource bound to the plugin (optional).
+	//The connection is closed when the function returns.
+	HandleWebSocket(conn *pluginUtil.WebSocketConn)
+
+	//returns true if the plugin handles WebSocket connections
+	HandlesWebSocket() bool
+
+	//called once the plugin has been replaced by a new version, or the server is exiting, and all of its requests
+	//have finished. lets the plugin release its resources before ctx is done (optional, may be exported as func()).
+	Shutdown(ctx context.Context)
+
+	//reports the health of the plugin, nil if healthy. see the "plugin/healthEndpoint" setting (optional).
+	Health() error
+
+	//called after the settings have been reloaded with the, possibly changed, "config" block of the plugins binding.
+	//a plugin whose file did not change is not initialized again, this is how it learns of a new config
+	//(optional, may be exported as func()).
+	OnSettingsChanged(config map[string]interface{})
 }
 
 /*
@@ -37,6 +66,14 @@ type BasicPlugin struct {
 	InitFunc                 func()
 	HandleRequestFunc        func(req *http.Request, res http.ResponseWriter, fsName string) bool
 	HandleVirtualRequestFunc func(req *http.Request, res http.ResponseWriter) bool
+	RegisterRoutersFunc      func(manager *route.RoutingManager)
+	// nil if the plugin does not handle WebSockets
+	HandleWebSocketFunc func(conn *pluginUtil.WebSocketConn)
+	// the optional lifecycle functions, nil if the plugin does not export them
+	InitWithConfigFunc    func(config map[string]interface{}) error
+	ShutdownFunc          func(ctx context.Context)
+	HealthFunc            func() error
+	OnSettingsChangedFunc func(config map[string]interface{})
 }
 
 /*
@@ -47,6 +84,22 @@ func (tp *BasicPlugin) Init() {
 	tp.bIsInti = true
 }
 
+/*
+InitWithConfig calls the InitWithConfig function provided by the plugins symbol table, or Init if there is none.
+*/
+func (tp *BasicPlugin) InitWithConfig(config map[string]interface{}) error {
+	if tp.InitWithConfigFunc == nil {
+		tp.Init()
+		return nil
+	}
+
+	if err := tp.InitWithConfigFunc(config); err != nil {
+		return err
+	}
+	tp.bIsInti = true
+	return nil
+}
+
 /*
 HandleRequest passes through the function call to a function pointer loaded from the plugins symbol table
 */
@@ -61,17 +114,73 @@ func (tp *BasicPlugin) HandleVirtualRequest(req *http.Request, res http.Response
 	return tp.HandleVirtualRequestFunc(req, res)
 }
 
+/*
+RegisterRouters passes through the function call to a function pointer loaded from the plugins symbol table
+*/
+func (tp *BasicPlugin) RegisterRouters(manager *route.RoutingManager) {
+	tp.RegisterRoutersFunc(manager)
+}
+
+/*
+HandleWebSocket passes through the function call to a function pointer loaded from the plugins symbol table
+*/
+func (tp *BasicPlugin) HandleWebSocket(conn *pluginUtil.WebSocketConn) {
+	tp.HandleWebSocketFunc(conn)
+}
+
+/*
+HandlesWebSocket returns true if the plugin exports HandleWebSocket
+*/
+func (tp *BasicPlugin) HandlesWebSocket() bool {
+	return tp.HandleWebSocketFunc != nil
+}
+
+/*
+Shutdown calls the shutdown function provided by the plugins symbol table, if any.
+*/
+func (tp *BasicPlugin) Shutdown(ctx context.Context) {
+	if tp.ShutdownFunc != nil {
+		tp.ShutdownFunc(ctx)
+	}
+}
+
+/*
+Health calls the health function provided by the plugins symbol table. Plugins without one are always healthy.
+*/
+func (tp *BasicPlugin) Health() error {
+	if tp.HealthFunc == nil {
+		return nil
+	}
+	return tp.HealthFunc()
+}
+
+/*
+OnSettingsChanged calls the settings changed function provided by the plugins symbol table, if any.
+*/
+func (tp *BasicPlugin) OnSettingsChanged(config map[string]interface{}) {
+	if tp.OnSettingsChangedFunc != nil {
+		tp.OnSettingsChangedFunc(config)
+	}
+}
+
 func defaultInit() {
 	//nop
 }
 
+func defaultRegisterRouters(manager *route.RoutingManager) {
+	//nop
+}
+
 func defaultHandleVirtualRequest(req *http.Request, res http.ResponseWriter) bool {
-	res.WriteHeader(404)
+	WriteErrorResponse(res, req, http.StatusNotFound, "")
 	return false
 }
 
 func defaultHandleRequest(req *http.Request, res http.ResponseWriter, fsName string) bool {
 	//just serve the file up as is.
+	if fileInfo, err := os.Stat(fsName); err == nil && cache.IsLargeResource(fileInfo.Size()) {
+		return serveLargeStaticResource(res, req, fsName, mime.TypeByExtension(path.Ext(fsName)), "")
+	}
 	buff := ReadFileToBuff(fsName)
 	if buff != nil {
 		mimeType := mime.TypeByExtension(path.Ext(fsName))
@@ -80,64 +189,59 @@ func defaultHandleRequest(req *http.Request, res http.ResponseWriter, fsName str
 		return true
 	}
 
-	res.WriteHeader(500)
+	WriteErrorResponse(res, req, http.StatusInternalServerError, "")
 	return false
 }
 
 /*
-LoadAllPlugins loads all the plugins in the configuration file and calls their init methods.
+LoadAllPlugins loads all the plugins in the configuration file (including those of virtual hosts) and calls their init methods.
 */
 func LoadAllPlugins() {
-	if mwsettings.HasSetting("plugin/plugins") {
+	var pluginList []pluginBinding
+	for _, vhost := range append([]*VirtualHost{GetDefaultVirtualHost()}, GetVirtualHosts()...) {
+		pluginList = append(pluginList, vhost.Plugins...)
+	}
+
+	if len(pluginList) > 0 {
 		startTime := time.Now()
 		logger.LogInfo("loading plugins....")
-		pluginList := mwsettings.GetSetting("plugin/plugins").([]pluginBinding)
 
+		// start the proxies, and there health checks, now rather than on the first request
+		startReverseProxies()
 		for _, plugin := range pluginList {
+			if plugin.Proxy != nil {
+				continue
+			} else if plugin.Process != nil {
+				// started once root privileges have been dropped, see StartPluginProcesses
+				continue
+			} else if plugin.CGI != nil {
+				continue
+			}
 			_, err := LoadPlugin(plugin.Plugin)
 			if err != nil {
 				logger.LogError("failed to load plugin with error: %s", err)
+			} else {
+				logger.LogVerbose("plugin: %s loaded", plugin.Plugin)
 			}
-			logger.LogVerbose("plugin: %s loaded", plugin.Plugin)
 		}
 		logger.LogInfo("plugins loaded in %d ms", time.Since(startTime)/time.Millisecond)
 	}
 }
 
 /*
-LoadPlugin loades the plugin found at path and constructs it.
-The constructed plugin is returned as an IPlugin interface on success.
+LoadPlugin returns the current version of the plugin found at path, loading and initializing it if
+it has not been loaded yet, see loadPluginVersion.
 
-Note. This function uses caching. Therfore you may receive a pointer to an
+Note. Plugins are kept in the plugin registry. Therfore you may receive a pointer to an
 already initialized plugin
 */
 func LoadPlugin(path string) (IPlugin, error) {
-	cachePlugin := cache.FetchFromCache(cache.CacheTypePlugin, path)
-	if cachePlugin != nil {
-		//cache hit
-		plugin := cachePlugin.(IPlugin)
-		logger.LogVerbose("Loading plugin from cache: %s", path)
-		return plugin, nil
-	}
-
-	//cache miss
-	logger.LogVerbose("Loading plugin from file: %s", path)
-	rawPlugin, pError := _loadPlugin(path)
-	if pError != nil {
-		return nil, pError
-	}
-
-	plugin := constructPlugin(rawPlugin)
-	if plugin == nil {
-		return nil, errors.New("plugin has incorrect format")
+	version, err := acquirePlugin(path)
+	if err != nil {
+		return nil, err
 	}
-
-	//initialize
-	plugin.Init()
-
-	cache.AddToCacheTTLOverride(cache.CacheTypePlugin, path, cache.MaxTTL, plugin)
-	return plugin, nil
-
+	defer version.release()
+	return version.plugin, nil
 }
 
 func _loadPlugin(path string) (*plugin.Plugin, error) {
@@ -169,6 +273,59 @@ func constructPlugin(plugin *plugin.Plugin) IPlugin {
 		logger.LogInfo("Plugin does not export optional function 'func HandleVirtualRequest(req *http.Request, res http.ResponseWriter) bool', using default")
 		handleVirtualReqFunc = defaultHandleVirtualRequest
 	}
+	registerRoutersFunc, err := plugin.Lookup("RegisterRouters")
+	if err != nil {
+		logger.LogInfo("Plugin does not export optional function 'func RegisterRouters(manager *route.RoutingManager)', using default")
+		registerRoutersFunc = defaultRegisterRouters
+	}
+
+	if handleWebSocketFunc, err := plugin.Lookup("HandleWebSocket"); err == nil {
+		var bOk bool
+		NewPlugin.HandleWebSocketFunc, bOk = handleWebSocketFunc.(func(conn *pluginUtil.WebSocketConn))
+		if !bOk {
+			logger.LogError("Plugin HandleWebSocket(...) function does not match IPlugin interface")
+			return nil
+		}
+	}
+
+	if initWithConfigFunc, err := plugin.Lookup("InitWithConfig"); err == nil {
+		var bOk bool
+		NewPlugin.InitWithConfigFunc, bOk = initWithConfigFunc.(func(config map[string]interface{}) error)
+		if !bOk {
+			logger.LogError("Plugin InitWithConfig(...) function does not match IPlugin interface")
+			return nil
+		}
+	}
+	if shutdownFunc, err := plugin.Lookup("Shutdown"); err == nil {
+		switch shutdown := shutdownFunc.(type) {
+		case func(ctx context.Context):
+			NewPlugin.ShutdownFunc = shutdown
+		case func():
+			NewPlugin.ShutdownFunc = func(ctx context.Context) { shutdown() }
+		default:
+			logger.LogError("Plugin Shutdown(...) function does not match IPlugin interface")
+			return nil
+		}
+	}
+	if healthFunc, err := plugin.Lookup("Health"); err == nil {
+		var bOk bool
+		NewPlugin.HealthFunc, bOk = healthFunc.(func() error)
+		if !bOk {
+			logger.LogError("Plugin Health() function does not match IPlugin interface")
+			return nil
+		}
+	}
+	if settingsChangedFunc, err := plugin.Lookup("OnSettingsChanged"); err == nil {
+		switch settingsChanged := settingsChangedFunc.(type) {
+		case func(config map[string]interface{}):
+			NewPlugin.OnSettingsChangedFunc = settingsChanged
+		case func():
+			NewPlugin.OnSettingsChangedFunc = func(config map[string]interface{}) { settingsChanged() }
+		default:
+			logger.LogError("Plugin OnSettingsChanged(...) function does not match IPlugin interface")
+			return nil
+		}
+	}
 
 	var bOk bool
 	NewPlugin.InitFunc, bOk = initFunc.(func())
@@ -186,6 +343,11 @@ func constructPlugin(plugin *plugin.Plugin) IPlugin {
 		logger.LogError("Plugin HandleVirtualRequest(...) function does not match IPlugin interface")
 		return nil
 	}
+	NewPlugin.RegisterRoutersFunc, bOk = registerRoutersFunc.(func(manager *route.RoutingManager))
+	if !bOk {
+		logger.LogError("Plugin RegisterRouters(...) function does not match IPlugin interface")
+		return nil
+	}
 
 	return &NewPlugin
 }
@@ -194,6 +356,20 @@ func constructPlugin(plugin *plugin.Plugin) IPlugin {
 type pluginBinding struct {
 	BindingList []string
 	Plugin      string
+	// Proxy is set, instead of Plugin, if the bindings are forwarded to upstream servers
+	Proxy *ProxySettings
+	// Process is set, instead of Plugin, if the bindings are served by an out-of-process plugin
+	Process *ProcessSettings
+	// CGI is set, instead of Plugin, if the bindings are served by CGI scripts or a FastCGI responder
+	CGI *CGISettings
+	// RequireClientCert restricts the binding to clients presenting a TLS client certificate issued by "tls/clientCAFile"
+	RequireClientCert bool
+	// ResponseTimeout replaces "tune/httpResponseTimeout" for the binding if not nil, 0 means no limit
+	ResponseTimeout *time.Duration
+	// Config is handed to the plugins InitWithConfig, nil if the binding has no "config" block
+	Config map[string]interface{}
+	// Limits isolates the plugin from the rest of the server, nil if the binding has no "limits" block (see pluginLimits)
+	Limits *PluginLimits
 }
 
 //AddPluginSettingDecoder adds a decoder for the plugin setting format in the config file.
@@ -201,25 +377,8 @@ func AddPluginSettingDecoder() {
 	var pluginPath = "plugin/plugins"
 
 	mwsettings.AddSettingDecoder(mwsettings.NewFunctionalSettingDecoder(func(s interface{}) (string, interface{}) {
-		if reflect.ValueOf(s).Type().Kind() == reflect.Slice {
-			pluginList := s.([]interface{})
-			outList := make([]pluginBinding, len(pluginList))
-
-			for i, plugin := range pluginList {
-				outList[i] = pluginBinding{}
-
-				binding := plugin.(map[string]interface{})["binding"]
-				if reflect.ValueOf(binding).Kind() == reflect.Slice {
-					outList[i].BindingList = make([]string, len(binding.([]interface{})))
-					for z, bind := range binding.([]interface{}) {
-						outList[i].BindingList[z] = bind.(string)
-					}
-				} else {
-					outList[i].BindingList = make([]string, 1)
-					outList[i].BindingList[0] = binding.(string)
-				}
-				outList[i].Plugin = plugin.(map[string]interface{})["plugin"].(string)
-			}
+		outList, bOk := decodePluginBindings(s)
+		if bOk {
 			return pluginPath, outList
 		}
 
@@ -235,45 +394,155 @@ func AddPluginSettingDecoder() {
 }
 
 /*
-GetPluginByResourcePath returns the path of the plugin that has the longest binding
-match with the given fsPath or an error if no plugin matches at all.
-
-Longest match means, given these two bindings
-/index/
-/index/web.html
-the second binding will be selected for fsPath=/index/web.html because it is longer than
-the match produced by the /index/ binding, while for all other queries, ex fsPath=/index/foo.html
-the frist binding will be used.
+decodePluginBindings decodes a plugin list from the config file, ex:
+	[{"binding": ["/api/", "/otherAPI/"], "plugin": "/path/to/plugin.so", "requireClientCert": true}, {"binding": "/foo", "plugin": "..."},
+	 {"binding": "/service/", "proxy": {"upstreams": ["http://127.0.0.1:9000"]}}, {"binding": "/events/", "plugin": "...", "responseTimeout": "2h"},
+	 {"binding": "/ext/", "process": {"command": "/path/to/plugin"}}, {"binding": "/php/", "fastcgi": {"address": "unix:/run/php-fpm.sock", "root": "/var/www/php"}}]
+A binding has either a "plugin", a "proxy" (see ProxySettings), a "process" (see ProcessSettings) or a "cgi" / "fastcgi" (see CGISettings).
+A "plugin" binding may have a "config" object, it is handed to the plugins InitWithConfig, see pluginConfig, and a "limits" object,
+see PluginLimits. "responseTimeout" overrides "tune/httpResponseTimeout"
+for the binding, ex. for streaming responses, "0s" removes the limit. returns false if the list has the wrong format.
 */
-func GetPluginByResourcePath(fsPath string) (string, error) {
-	if mwsettings.HasSetting("plugin/plugins") {
+func decodePluginBindings(s interface{}) ([]pluginBinding, bool) {
+	if reflect.ValueOf(s).Type().Kind() != reflect.Slice {
+		return nil, false
+	}
 
-		type bindingMapping struct {
-			Binding,
-			Plugin string
-		}
+	pluginList := s.([]interface{})
+	outList := make([]pluginBinding, len(pluginList))
 
-		var pluginList []bindingMapping
-		for _, plugin := range mwsettings.GetSetting("plugin/plugins").([]pluginBinding) {
-			for _, binding := range plugin.BindingList {
-				pluginList = append(pluginList, bindingMapping{binding, plugin.Plugin})
+	for i, plugin := range pluginList {
+		outList[i] = pluginBinding{}
+
+		binding := plugin.(map[string]interface{})["binding"]
+		if reflect.ValueOf(binding).Kind() == reflect.Slice {
+			outList[i].BindingList = make([]string, len(binding.([]interface{})))
+			for z, bind := range binding.([]interface{}) {
+				outList[i].BindingList[z] = bind.(string)
+			}
+		} else {
+			outList[i].BindingList = make([]string, 1)
+			outList[i].BindingList[0] = binding.(string)
+		}
+		if rawProxy, bOk := plugin.(map[string]interface{})["proxy"]; bOk {
+			proxySettings, err := decodeProxySettings(rawProxy)
+			if err != nil {
+				logger.LogError("Error parsing proxy for binding %v: %s", outList[i].BindingList, err.Error())
+				return nil, false
+			}
+			outList[i].Proxy = proxySettings
+		} else if rawProcess, bOk := plugin.(map[string]interface{})["process"]; bOk {
+			processSettings, err := decodeProcessSettings(rawProcess)
+			if err != nil {
+				logger.LogError("Error parsing process for binding %v: %s", outList[i].BindingList, err.Error())
+				return nil, false
+			}
+			outList[i].Process = processSettings
+		} else if rawCGI, bFastCGI := plugin.(map[string]interface{})["fastcgi"]; bFastCGI || plugin.(map[string]interface{})["cgi"] != nil {
+			if !bFastCGI {
+				rawCGI = plugin.(map[string]interface{})["cgi"]
+			}
+			cgiSettings, err := decodeCGISettings(rawCGI, bFastCGI)
+			if err != nil {
+				logger.LogError("Error parsing cgi for binding %v: %s", outList[i].BindingList, err.Error())
+				return nil, false
+			}
+			outList[i].CGI = cgiSettings
+		} else if outList[i].Plugin, bOk = plugin.(map[string]interface{})["plugin"].(string); !bOk {
+			return nil, false
+		}
+		outList[i].RequireClientCert, _ = plugin.(map[string]interface{})["requireClientCert"].(bool)
+		if rawConfig, bOk := plugin.(map[string]interface{})["config"]; bOk {
+			if outList[i].Config, bOk = rawConfig.(map[string]interface{}); !bOk {
+				logger.LogError("Error parsing config for binding %v: config must be an object", outList[i].BindingList)
+				return nil, false
+			}
+		}
+		if rawLimits, bOk := plugin.(map[string]interface{})["limits"]; bOk {
+			limits, err := decodePluginLimits(rawLimits)
+			if err != nil {
+				logger.LogError("Error parsing limits for binding %v: %s", outList[i].BindingList, err.Error())
+				return nil, false
+			}
+			outList[i].Limits = limits
+		}
+		if timeoutString, bOk := plugin.(map[string]interface{})["responseTimeout"].(string); bOk {
+			responseTimeout, err := time.ParseDuration(timeoutString)
+			if err != nil || responseTimeout < 0 {
+				logger.LogError("Bad responseTimeout for binding %v: %s", outList[i].BindingList, timeoutString)
+				return nil, false
 			}
+			outList[i].ResponseTimeout = &responseTimeout
 		}
+	}
+	return outList, true
+}
+
+/*
+bindingKey identifies a plugin binding across settings reloads by the host names of its virtual host and its binding paths.
+The state kept for a binding, ex. a running proxy or plugin process, is keyed by it so that a reload only replaces
+the state of the bindings whose settings changed.
+*/
+type bindingKey struct {
+	hostnames string
+	bindings  string
+}
+
+// String returns the first host name of the key followed by its first binding path, ex. "example.com/api/"
+func (key bindingKey) String() string {
+	return strings.SplitN(key.hostnames, ",", 2)[0] + strings.SplitN(key.bindings, ",", 2)[0]
+}
+
+// bindingKeyOf returns the key of binding in the virtual host
+func (vhost *VirtualHost) bindingKeyOf(binding *pluginBinding) bindingKey {
+	return bindingKey{strings.Join(vhost.Hostnames, ","), strings.Join(binding.BindingList, ",")}
+}
 
-		lessFunction := func(i, j int) bool {
-			iDist := StringMatchLength(path.Join(mwsettings.GetSettingString("general/staticDirectory"), pluginList[i].Binding), fsPath)
-			jDist := StringMatchLength(path.Join(mwsettings.GetSettingString("general/staticDirectory"), pluginList[j].Binding), fsPath)
-			return iDist > jDist
+// bindingPrefixOf returns the longest binding of binding that urlPath starts with
+func bindingPrefixOf(binding *pluginBinding, urlPath string) string {
+	bindingPrefix := ""
+	for _, bind := range binding.BindingList {
+		if strings.HasPrefix(urlPath, bind) && len(bind) > len(bindingPrefix) {
+			bindingPrefix = bind
 		}
-		sort.Slice(pluginList[:], lessFunction)
+	}
+	return bindingPrefix
+}
 
-		for _, plugin := range pluginList {
-			if StringMatchLength(path.Join(mwsettings.GetSettingString("general/staticDirectory"), plugin.Binding), fsPath) ==
-				len(path.Join(mwsettings.GetSettingString("general/staticDirectory"), plugin.Binding)) {
-				return plugin.Plugin, nil
+/*
+pluginConfig returns the "config" block the plugin at pluginPath is bound with. A plugin is loaded once no matter how
+often it is bound, so if several of its bindings have a config block the first one, in the default virtual host then
+in the order of the virtual hosts, is used.
+*/
+func pluginConfig(pluginPath string) map[string]interface{} {
+	for _, vhost := range append([]*VirtualHost{GetDefaultVirtualHost()}, GetVirtualHosts()...) {
+		for _, binding := range vhost.Plugins {
+			if binding.Plugin == pluginPath && binding.Config != nil {
+				return binding.Config
 			}
 		}
 	}
+	return nil
+}
+
+/*
+GetPluginByResourcePath returns the path of the plugin bound to fsPath in the default virtual host,
+see VirtualHost.GetPluginByResourcePath.
+*/
+func GetPluginByResourcePath(fsPath string) (string, error) {
+	return GetDefaultVirtualHost().GetPluginByResourcePath(fsPath)
+}
 
-	return "", errors.New("No Plugin found for given path: " + fsPath)
+/*
+anyBindingRequiresClientCert returns true if any plugin binding, in any virtual host, requires a TLS client certificate.
+*/
+func anyBindingRequiresClientCert() bool {
+	for _, vhost := range append([]*VirtualHost{GetDefaultVirtualHost()}, GetVirtualHosts()...) {
+		for _, binding := range vhost.Plugins {
+			if binding.RequireClientCert {
+				return true
+			}
+		}
+	}
+	return false
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"mime"
 	"net/http"
@@ -12,129 +13,234 @@ import (
 	"github.com/CanadianCommander/MicroWeb/pkg/cache"
 	"github.com/CanadianCommander/MicroWeb/pkg/logger"
 	mwsettings "github.com/CanadianCommander/MicroWeb/pkg/mwSettings"
+	"github.com/CanadianCommander/MicroWeb/pkg/pluginUtil"
 )
 
-const fileReadBufferSize = 0xFFFF //64 KB
 const templateFileExt = ".gohtml"
 
 /*
-HandleRequest is called to handle any and all http requests made by clients
+HandleRequest is called to handle any and all http requests made by clients.
+Requests are dispatched to a virtual host (see GetVirtualHost) and passed on to the global routing manager, see GetRoutingManager().
 */
 func HandleRequest(res http.ResponseWriter, req *http.Request) {
 	serveTime := time.Now()
 	logger.LogVerbose("%s request from %s for URL %s", req.Method, req.RemoteAddr, req.URL)
 
-	if handleRequest(res, req) {
+	req = withVirtualHost(req)
+	req = assignRequestID(res, req)
+	res = newCompressResponseWriter(res, req)
+	if cRes, bOk := res.(*compressResponseWriter); bOk {
+		defer cRes.Close()
+	}
+	err := GetRoutingManager().RouteRequest(req, res)
+	if err == nil {
 		logger.LogVerbose("Served Request: %s, to %s in %f ms", req.URL.Path, req.RemoteAddr, float64(time.Since(serveTime).Nanoseconds())/1000000.0)
 	} else {
-		logger.LogWarning("failed to serve request, [%s] to %s", req.URL.Path, req.RemoteAddr)
+		logger.LogWarning("failed to route request, [%s] to %s with error: %s", req.URL.Path, req.RemoteAddr, err.Error())
 	}
 }
 
-func handleRequest(res http.ResponseWriter, req *http.Request) bool {
+/*
+serveStaticResource serves the file at fsPath raw. fsErr is the error returned by URLToFilesystem
+when resolving fsPath, if it is not nil a 404 is sent. .gohtml pages are executed, see serveTemplatePage. Conditional requests (If-None-Match, If-Modified-Since, ...)
+and byte range requests, including multipart ranges, are supported. If compression is enabled (see IsCompressionEnabled)
+a precompressed sibling or a cached compressed variant of the file is served when the client accepts it.
+*/
+func serveStaticResource(res http.ResponseWriter, req *http.Request, fsPath string, fsErr error) bool {
+	if fsErr != nil {
+		//file not found
+		logger.LogInfo("Resource not found: %s", req.URL.Path)
+		WriteErrorResponse(res, req, http.StatusNotFound, "")
+		return false
+	}
 
-	fsPath, fsErr := URLToFilesystem(req.URL.Path)
-	pluginToUse, pErr := GetPluginByResourcePath(fsPath)
-	if pErr != nil {
-		//no plugin just serve resource raw
-		if fsErr != nil {
-			//file not found
-			logger.LogInfo("Resource not found: %s", req.URL.Path)
-			res.WriteHeader(404)
-			return false
-		}
-		//read and serve file
-		buff := ReadFileToBuff(fsPath)
-		if buff != nil {
-			mimeType := mime.TypeByExtension(path.Ext(fsPath))
-			res.Header().Add("Content-Type", mimeType)
-			res.Header().Add("Cache-Control", "max-age="+mwsettings.GetSettingString("tune/max-age"))
-			res.Write((*buff)[:])
-		} else {
-			res.WriteHeader(500)
-			return false
-		}
+	if path.Ext(fsPath) == templateFileExt {
+		return serveTemplatePage(res, req, fsPath)
+	}
 
-	} else {
-		//push resorce file through plugin
-		plugin, pErr := LoadPlugin(pluginToUse)
-		if pErr != nil {
-			logger.LogError("Plugin failed to load")
-			res.WriteHeader(500)
-			return false
+	// static files are compressed here, not on the fly, so that compressed variants can be cached
+	pluginUtil.DisableCompression(res)
+	mimeType := mime.TypeByExtension(path.Ext(fsPath))
+	encoding, servePath := "", fsPath
+	if IsCompressionEnabled() {
+		encoding, servePath = findPrecompressedSibling(req, fsPath)
+		res.Header().Add("Vary", "Accept-Encoding")
+	}
+
+	fileInfo, err := os.Stat(servePath)
+	if err == nil && cache.IsLargeResource(fileInfo.Size()) {
+		return serveLargeStaticResource(res, req, servePath, mimeType, encoding)
+	}
+
+	//read and serve file
+	resource := ReadResource(servePath)
+	if resource == nil {
+		WriteErrorResponse(res, req, http.StatusInternalServerError, "")
+		return false
+	}
+
+	if encoding == "" && IsCompressionEnabled() && isCompressibleType(mimeType) && len(*resource.Buffer) >= getCompressMinSize() {
+		if encoding = negotiateEncoding(req, supportedEncodings); encoding != "" {
+			compressed, cErr := getCompressedResource(fsPath, resource, encoding)
+			if cErr != nil {
+				logger.LogError("Could not compress resource: %s with error: %s", fsPath, cErr.Error())
+				encoding = ""
+			} else {
+				resource = compressed
+			}
 		}
+	}
+
+	setStaticResourceHeaders(res, mimeType, encoding, resource.ETag)
+	// ServeContent implements conditional (RFC 7232) and range (RFC 7233) requests using the ETag and ModTime
+	http.ServeContent(res, req, fsPath, resource.ModTime, bytes.NewReader(*resource.Buffer))
+	return true
+}
+
+/*
+serveLargeStaticResource streams the file at fsPath from disk without caching it. When possible the
+file is sent with sendfile, so it never passes through user space. encoding is the content coding of the file, if any.
+*/
+func serveLargeStaticResource(res http.ResponseWriter, req *http.Request, fsPath string, mimeType string, encoding string) bool {
+	file, err := os.Open(fsPath)
+	if err != nil {
+		logger.LogError("Could not open resource file at: %s ", fsPath)
+		WriteErrorResponse(res, req, http.StatusInternalServerError, "")
+		return false
+	}
+	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		logger.LogError("Could not stat resource file at: %s ", fsPath)
+		WriteErrorResponse(res, req, http.StatusInternalServerError, "")
+		return false
+	}
+
+	logger.LogVerbose("Streaming resource from file: %s", fsPath)
+	setStaticResourceHeaders(res, mimeType, encoding, cache.FileETag(fileInfo.ModTime(), fileInfo.Size()))
+	http.ServeContent(res, req, fsPath, fileInfo.ModTime(), file)
+	return true
+}
+
+// setStaticResourceHeaders sets the headers common to all static file responses
+func setStaticResourceHeaders(res http.ResponseWriter, mimeType string, encoding string, eTag string) {
+	if mimeType == "" && encoding != "" {
+		// stop ServeContent from sniffing the type of the compressed data
+		mimeType = "application/octet-stream"
+	}
+	if mimeType != "" {
+		res.Header().Set("Content-Type", mimeType)
+	}
+	if encoding != "" {
+		res.Header().Set("Content-Encoding", encoding)
+	}
+	res.Header().Set("Cache-Control", "max-age="+mwsettings.GetSettingString("tune/max-age"))
+	res.Header().Set("ETag", eTag)
+}
 
+/*
+servePluginResource pushes the request through the plugin bound by binding. If fsErr is not nil
+the request is treated as a virtual request. WebSocket handshakes go to the plugins HandleWebSocket, if it has one.
+The request holds on to the current version of the plugin until it finishes, even if the plugin is reloaded meanwhile.
+The plugin is called within its limits, see callPlugin.
+*/
+func servePluginResource(res http.ResponseWriter, req *http.Request, binding *pluginBinding, fsPath string, fsErr error) bool {
+	version, pErr := acquirePlugin(binding.Plugin)
+	if errors.Is(pErr, errPluginUnavailable) {
+		logger.LogWarning("Plugin: %s is unavailable", binding.Plugin)
+		WriteErrorResponse(res, req, http.StatusServiceUnavailable, "")
+		return false
+	} else if pErr != nil {
+		logger.LogError("Plugin failed to load")
+		WriteErrorResponse(res, req, http.StatusInternalServerError, "")
+		return false
+	}
+	plugin := version.plugin
+
+	if plugin.HandlesWebSocket() && pluginUtil.IsWebSocketRequest(req) {
+		return callPlugin(res, req, binding, version, true, func(res http.ResponseWriter, req *http.Request) bool {
+			return serveWebSocket(res, req, plugin)
+		})
+	}
+
+	return callPlugin(res, req, binding, version, false, func(res http.ResponseWriter, req *http.Request) bool {
 		if fsErr != nil {
 			// virtual file path
 			return plugin.HandleVirtualRequest(req, res)
 		}
-
 		return plugin.HandleRequest(req, res, fsPath)
+	})
+}
+
+/*
+serveWebSocket upgrades req to a WebSocket connection and hands it to the plugin. The connection
+is closed once the plugin returns.
+*/
+func serveWebSocket(res http.ResponseWriter, req *http.Request, plugin IPlugin) bool {
+	conn, err := pluginUtil.UpgradeWebSocket(res, req)
+	if err != nil {
+		logger.LogWarning("WebSocket handshake from %s failed with error: %s", req.RemoteAddr, err.Error())
+		return false
 	}
+	defer conn.Close(pluginUtil.CloseNormalClosure, "")
 
+	logger.LogVerbose("WebSocket opened by %s for URL %s", req.RemoteAddr, req.URL)
+	plugin.HandleWebSocket(conn)
 	return true
 }
 
 /*
 ReadFileToBuff reads the enter file found at fsPath in to a []byte buffer and returns it.
-If any thing goes wrong nil is returned.
-
-Note. This function uses the global cache provided by the,
-"github.com/CanadianCommander/MicroWeb/pkg/cache" package.
+If any thing goes wrong, or the file is over the stream threshold, nil is returned. see pluginUtil.ReadFileToBuff
+and serveLargeStaticResource
 */
 func ReadFileToBuff(fsPath string) *[]byte {
-	cacheBuffer := cache.FetchFromCache(cache.CacheTypeResource, fsPath)
-	if cacheBuffer != nil {
-		//cache hit
-		logger.LogVerbose("Loading resource from cache: %s", fsPath)
-		return cacheBuffer.(*[]byte)
-	}
-	//cache miss
-	logger.LogVerbose("Loading resource from file: %s", fsPath)
-	file, err := os.Open(fsPath)
-	defer file.Close()
-	if err != nil {
-		logger.LogError("Could not open resource file at: %s ", fsPath)
-		return nil
-	}
-	fileInfo, _ := file.Stat()
-	byteBuffer := make([]byte, fileInfo.Size())
-
-	bytesOut := 1
-	byteBufferIndex := 0
-	for bytesOut != 0 {
-		var buff = make([]byte, fileReadBufferSize)
-		bytesOut, _ = file.Read(buff)
-		copy(byteBuffer[byteBufferIndex:], buff[:bytesOut])
-		byteBufferIndex += bytesOut
-	}
+	return pluginUtil.ReadFileToBuff(fsPath)
+}
 
-	cache.AddToCache(cache.CacheTypeResource, fsPath, (&byteBuffer))
-	return &byteBuffer
+/*
+ReadResource is ReadFileToBuff but returns the whole resource cache entry, see pluginUtil.ReadResource
+*/
+func ReadResource(fsPath string) *cache.Resource {
+	return pluginUtil.ReadResource(fsPath)
 }
 
 /*
 URLToFilesystem takes a url and resolves it to a file system path, if possible,
-taking in to account the global setting for static resource path.
+taking in to account the static resource path of the default virtual host.
 */
 func URLToFilesystem(url string) (string, error) {
-	webRoot := mwsettings.GetSettingString("general/staticDirectory")
+	return GetDefaultVirtualHost().urlToFilesystem(url, true)
+}
+
+/*
+urlToFilesystem is URLToFilesystem with optional logging. Routers call this
+with bLog == false when they just want to peek at where a url resolves to.
+*/
+func (vhost *VirtualHost) urlToFilesystem(url string, bLog bool) (string, error) {
+	webRoot := vhost.StaticDirectory
 	templatePath := path.Join(webRoot, url)
 
 	// if some how url contains '..' characters we could accidentally expose the entire filesystem
 	// make sure we are still within the static resource path
-	if !strings.Contains(templatePath, path.Clean(mwsettings.GetSettingString("general/staticDirectory"))) {
-		logger.LogWarning("Suspicius URL activity. URL resolved to: %s", templatePath)
+	if !strings.Contains(templatePath, path.Clean(webRoot)) {
+		if bLog {
+			logger.LogWarning("Suspicius URL activity. URL resolved to: %s", templatePath)
+		}
 		return "", errors.New("URL invalid")
 	}
 
 	fInfo, err := os.Stat(templatePath)
 	if err != nil {
-		logger.LogInfo("Requested resource: %s Not found", templatePath)
+		if bLog {
+			logger.LogInfo("Requested resource: %s Not found", templatePath)
+		}
 		return templatePath, err
 	}
 	if fInfo.IsDir() {
-		logger.LogVerbose("Requested resource is directory. Redirecting to index file")
+		if bLog {
+			logger.LogVerbose("Requested resource is directory. Redirecting to index file")
+		}
 		//attempt to redirect to go index file
 		templatePath = path.Join(webRoot, path.Join(url, "index.gohtml"))
 		fInfo, err = os.Stat(templatePath)
@@ -143,7 +249,9 @@ func URLToFilesystem(url string) (string, error) {
 			templatePath = path.Join(webRoot, path.Join(url, "index.html"))
 			fInfo, err = os.Stat(templatePath)
 			if err != nil {
-				logger.LogInfo("Requsted resource is directory and nether \"index.gohtml\" nor \"index.html\" exist in it")
+				if bLog {
+					logger.LogInfo("Requsted resource is directory and nether \"index.gohtml\" nor \"index.html\" exist in it")
+				}
 				return templatePath, errors.New("File not Found")
 			}
 		}
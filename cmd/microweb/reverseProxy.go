@@ -0,0 +1,441 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/CanadianCommander/MicroWeb/pkg/logger"
+	"github.com/CanadianCommander/MicroWeb/pkg/pluginUtil"
+)
+
+const (
+	balanceRoundRobin = "round-robin"
+	balanceLeastConn  = "least-conn"
+
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 2 * time.Second
+)
+
+/*
+ProxySettings configures a plugin binding that forwards requests to upstream servers instead of a plugin, ex:
+	{
+	  "binding": "/api/",
+	  "proxy": {
+	    "upstreams":    ["http://127.0.0.1:9000", "http://127.0.0.1:9001"],
+	    "balance":      "least-conn",
+	    "stripPrefix":  true,
+	    "preserveHost": false,
+	    "healthCheck":  {"path": "/health", "interval": "10s", "timeout": "2s"},
+	    "headers": {
+	      "request":  {"set": {"X-Env": "prod"}, "remove": ["Cookie"]},
+	      "response": {"set": {"X-Frame-Options": "DENY"}, "remove": ["Server"]}
+	    }
+	  }
+	}
+"balance" is round-robin (the default) or least-conn. With "stripPrefix" the binding is removed from the
+request path before it is passed upstream. Without a "healthCheck" all upstreams are always considered healthy,
+with one each upstream is polled and left out while it does not answer "path" with a 2xx or 3xx status.
+WebSocket (and other) upgrades are tunneled to the upstream.
+*/
+type ProxySettings struct {
+	Upstreams    []string
+	Balance      string
+	StripPrefix  bool
+	PreserveHost bool
+	HealthCheck  HealthCheckSettings
+	// header rewriting of requests to and responses from the upstreams
+	RequestHeaders  HeaderRewrite
+	ResponseHeaders HeaderRewrite
+}
+
+/*
+HealthCheckSettings configures the active health checks of a proxy. An empty Path disables them.
+*/
+type HealthCheckSettings struct {
+	Path     string
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+/*
+HeaderRewrite is a set of headers to set (replacing any existing values) and to remove.
+*/
+type HeaderRewrite struct {
+	Set    map[string]string
+	Remove []string
+}
+
+// apply rewrites header
+func (rewrite *HeaderRewrite) apply(header http.Header) {
+	for _, name := range rewrite.Remove {
+		header.Del(name)
+	}
+	for name, value := range rewrite.Set {
+		header.Set(name, value)
+	}
+}
+
+/*
+decodeProxySettings decodes the "proxy" object of a plugin binding, see ProxySettings
+*/
+func decodeProxySettings(raw interface{}) (*ProxySettings, error) {
+	proxyMap, bOk := raw.(map[string]interface{})
+	if !bOk {
+		return nil, errors.New("proxy must be an object")
+	}
+
+	proxySettings := &ProxySettings{Balance: balanceRoundRobin}
+	var err error
+	if proxySettings.Upstreams, err = decodeStringList(proxyMap["upstreams"]); err != nil || len(proxySettings.Upstreams) == 0 {
+		return nil, errors.New("proxy needs a list of upstreams")
+	}
+	for _, upstream := range proxySettings.Upstreams {
+		if upstreamURL, err := url.Parse(upstream); err != nil || upstreamURL.Scheme == "" || upstreamURL.Host == "" {
+			return nil, errors.New("bad upstream URL: " + upstream)
+		}
+	}
+
+	if balance, bOk := proxyMap["balance"].(string); bOk {
+		if balance != balanceRoundRobin && balance != balanceLeastConn {
+			return nil, errors.New("unknown balance: " + balance + " expecting round-robin or least-conn")
+		}
+		proxySettings.Balance = balance
+	}
+	proxySettings.StripPrefix, _ = proxyMap["stripPrefix"].(bool)
+	proxySettings.PreserveHost, _ = proxyMap["preserveHost"].(bool)
+
+	if healthMap, bOk := proxyMap["healthCheck"].(map[string]interface{}); bOk {
+		proxySettings.HealthCheck.Path, _ = healthMap["path"].(string)
+		proxySettings.HealthCheck.Interval = defaultHealthCheckInterval
+		proxySettings.HealthCheck.Timeout = defaultHealthCheckTimeout
+		for key, dest := range map[string]*time.Duration{"interval": &proxySettings.HealthCheck.Interval, "timeout": &proxySettings.HealthCheck.Timeout} {
+			if durationString, bOk := healthMap[key].(string); bOk {
+				if *dest, err = time.ParseDuration(durationString); err != nil || *dest <= 0 {
+					return nil, errors.New("bad healthCheck " + key + ": " + durationString)
+				}
+			}
+		}
+	}
+
+	if headerMap, bOk := proxyMap["headers"].(map[string]interface{}); bOk {
+		if proxySettings.RequestHeaders, err = decodeHeaderRewrite(headerMap["request"]); err != nil {
+			return nil, err
+		}
+		if proxySettings.ResponseHeaders, err = decodeHeaderRewrite(headerMap["response"]); err != nil {
+			return nil, err
+		}
+	}
+	return proxySettings, nil
+}
+
+// decodeHeaderRewrite decodes {"set": {"name": "value"}, "remove": ["name"]}. nil decodes to an empty rewrite
+func decodeHeaderRewrite(raw interface{}) (HeaderRewrite, error) {
+	rewrite := HeaderRewrite{Set: map[string]string{}}
+	if raw == nil {
+		return rewrite, nil
+	}
+	rewriteMap, bOk := raw.(map[string]interface{})
+	if !bOk {
+		return rewrite, errors.New("header rewrite must be an object")
+	}
+
+	if setMap, bOk := rewriteMap["set"].(map[string]interface{}); bOk {
+		for name, value := range setMap {
+			if rewrite.Set[name], bOk = value.(string); !bOk {
+				return rewrite, errors.New("header value of " + name + " must be a string")
+			}
+		}
+	}
+	var err error
+	if rewrite.Remove, err = decodeStringList(rewriteMap["remove"]); err != nil {
+		return rewrite, errors.New("bad header remove list: " + err.Error())
+	}
+	return rewrite, nil
+}
+
+// proxyBackend is one upstream of a reverseProxy
+type proxyBackend struct {
+	url *url.URL
+	// requests currently in flight
+	activeRequests int64
+	// 1 if healthy, accessed atomically
+	healthy int32
+}
+
+func (backend *proxyBackend) isHealthy() bool {
+	return atomic.LoadInt32(&backend.healthy) == 1
+}
+
+// reverseProxy is the running proxy of a ProxySettings
+type reverseProxy struct {
+	settings *ProxySettings
+	backends []*proxyBackend
+	// round robin position
+	next     uint64
+	handler  *httputil.ReverseProxy
+	stopChan chan bool
+}
+
+// proxyBackendKey is the request context key of the backend chosen for a request
+type proxyBackendKey struct{}
+
+var (
+	reverseProxiesLock sync.Mutex
+	// running proxies by binding, see bindingKey
+	reverseProxies = make(map[bindingKey]*reverseProxy)
+)
+
+/*
+getReverseProxy returns the running proxy of the binding identified by key, starting it if needed. A proxy
+started with different settings, ex. before a settings reload, is stopped and replaced.
+*/
+func getReverseProxy(key bindingKey, proxySettings *ProxySettings) *reverseProxy {
+	reverseProxiesLock.Lock()
+	defer reverseProxiesLock.Unlock()
+	if proxy, bOk := reverseProxies[key]; bOk {
+		if reflect.DeepEqual(proxy.settings, proxySettings) {
+			return proxy
+		}
+		proxy.stop()
+	}
+
+	proxy := newReverseProxy(proxySettings)
+	reverseProxies[key] = proxy
+	return proxy
+}
+
+/*
+startReverseProxies starts the proxies of all bindings, in all virtual hosts.
+*/
+func startReverseProxies() {
+	for _, vhost := range append([]*VirtualHost{GetDefaultVirtualHost()}, GetVirtualHosts()...) {
+		for i := range vhost.Plugins {
+			if vhost.Plugins[i].Proxy != nil {
+				getReverseProxy(vhost.bindingKeyOf(&vhost.Plugins[i]), vhost.Plugins[i].Proxy)
+			}
+		}
+	}
+}
+
+/*
+pruneReverseProxies stops the proxies that are no longer bound in any virtual host, or whose settings changed,
+ex. after a settings reload. Proxies whose settings are unchanged keep running.
+*/
+func pruneReverseProxies() {
+	bound := make(map[bindingKey]*ProxySettings)
+	for _, vhost := range append([]*VirtualHost{GetDefaultVirtualHost()}, GetVirtualHosts()...) {
+		for i := range vhost.Plugins {
+			if vhost.Plugins[i].Proxy != nil {
+				bound[vhost.bindingKeyOf(&vhost.Plugins[i])] = vhost.Plugins[i].Proxy
+			}
+		}
+	}
+
+	reverseProxiesLock.Lock()
+	defer reverseProxiesLock.Unlock()
+	for key, proxy := range reverseProxies {
+		if proxySettings, bOk := bound[key]; !bOk || !reflect.DeepEqual(proxy.settings, proxySettings) {
+			proxy.stop()
+			delete(reverseProxies, key)
+		}
+	}
+}
+
+// newReverseProxy builds the proxy for proxySettings and starts its health checks
+func newReverseProxy(proxySettings *ProxySettings) *reverseProxy {
+	proxy := &reverseProxy{settings: proxySettings, stopChan: make(chan bool)}
+	for _, upstream := range proxySettings.Upstreams {
+		upstreamURL, _ := url.Parse(upstream)
+		proxy.backends = append(proxy.backends, &proxyBackend{url: upstreamURL, healthy: 1})
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// upstreams are reached directly, not through the proxy of the environment
+	transport.Proxy = nil
+	proxy.handler = &httputil.ReverseProxy{
+		Director:       proxy.direct,
+		Transport:      transport,
+		ModifyResponse: proxy.modifyResponse,
+		ErrorHandler:   proxy.handleError,
+	}
+
+	if proxySettings.HealthCheck.Path != "" {
+		go proxy.checkHealth()
+	}
+	return proxy
+}
+
+func (proxy *reverseProxy) stop() {
+	close(proxy.stopChan)
+	proxy.handler.Transport.(*http.Transport).CloseIdleConnections()
+}
+
+/*
+ServeHTTP forwards req to a healthy upstream. bindingPrefix is the url path prefix the proxy is bound to.
+*/
+func (proxy *reverseProxy) ServeHTTP(res http.ResponseWriter, req *http.Request, bindingPrefix string) bool {
+	backend := proxy.pickBackend()
+	if backend == nil {
+		logger.LogWarning("No healthy upstream for [%s]", req.URL.Path)
+		WriteErrorResponse(res, req, http.StatusBadGateway, "no healthy upstream")
+		return false
+	}
+
+	atomic.AddInt64(&backend.activeRequests, 1)
+	defer atomic.AddInt64(&backend.activeRequests, -1)
+
+	if isUpgradeRequest(req) {
+		// the tunnel outlives the response timeouts of the server
+		controller := http.NewResponseController(res)
+		controller.SetReadDeadline(time.Time{})
+		controller.SetWriteDeadline(time.Time{})
+	}
+
+	outReq := req.Clone(context.WithValue(req.Context(), proxyBackendKey{}, backend))
+	if proxy.settings.StripPrefix {
+		outReq.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, strings.TrimSuffix(bindingPrefix, "/")), "/")
+		outReq.URL.RawPath = ""
+	}
+	proxy.handler.ServeHTTP(res, outReq)
+	return true
+}
+
+// pickBackend selects the upstream for the next request, nil if none is healthy
+func (proxy *reverseProxy) pickBackend() *proxyBackend {
+	if proxy.settings.Balance == balanceLeastConn {
+		var best *proxyBackend
+		for _, backend := range proxy.backends {
+			if backend.isHealthy() && (best == nil || atomic.LoadInt64(&backend.activeRequests) < atomic.LoadInt64(&best.activeRequests)) {
+				best = backend
+			}
+		}
+		return best
+	}
+
+	start := atomic.AddUint64(&proxy.next, 1) - 1
+	for i := 0; i < len(proxy.backends); i++ {
+		backend := proxy.backends[(start+uint64(i))%uint64(len(proxy.backends))]
+		if backend.isHealthy() {
+			return backend
+		}
+	}
+	return nil
+}
+
+// direct points the outgoing request at the chosen backend and rewrites its headers. X-Forwarded-For is added by httputil
+func (proxy *reverseProxy) direct(req *http.Request) {
+	backend := req.Context().Value(proxyBackendKey{}).(*proxyBackend)
+
+	req.Header.Set("X-Forwarded-Host", req.Host)
+	if req.TLS != nil {
+		req.Header.Set("X-Forwarded-Proto", "https")
+	} else {
+		req.Header.Set("X-Forwarded-Proto", "http")
+	}
+	if requestID := pluginUtil.GetRequestID(req); requestID != "" {
+		req.Header.Set(requestIDHeader, requestID)
+	}
+
+	req.URL.Scheme = backend.url.Scheme
+	req.URL.Host = backend.url.Host
+	req.URL.Path = joinURLPath(backend.url.Path, req.URL.Path)
+	req.URL.RawPath = ""
+	if !proxy.settings.PreserveHost {
+		req.Host = backend.url.Host
+	}
+	proxy.settings.RequestHeaders.apply(req.Header)
+}
+
+func (proxy *reverseProxy) modifyResponse(res *http.Response) error {
+	proxy.settings.ResponseHeaders.apply(res.Header)
+	return nil
+}
+
+func (proxy *reverseProxy) handleError(res http.ResponseWriter, req *http.Request, err error) {
+	if errors.Is(err, context.Canceled) {
+		// client went away
+		return
+	}
+	backend := req.Context().Value(proxyBackendKey{}).(*proxyBackend)
+	logger.LogWarning("Proxy request for [%s] to %s failed with error: %s", req.URL.Path, backend.url.Host, err.Error())
+	WriteErrorResponse(res, req, http.StatusBadGateway, "")
+}
+
+// checkHealth polls the health check path of every backend until the proxy is stopped
+func (proxy *reverseProxy) checkHealth() {
+	client := &http.Client{
+		Timeout:   proxy.settings.HealthCheck.Timeout,
+		Transport: proxy.handler.Transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	ticker := time.NewTicker(proxy.settings.HealthCheck.Interval)
+	defer ticker.Stop()
+
+	for {
+		for _, backend := range proxy.backends {
+			bHealthy := false
+			checkURL := *backend.url
+			checkURL.Path = joinURLPath(backend.url.Path, proxy.settings.HealthCheck.Path)
+			if response, err := client.Get(checkURL.String()); err == nil {
+				response.Body.Close()
+				bHealthy = response.StatusCode >= 200 && response.StatusCode < 400
+			}
+
+			var healthy int32
+			if bHealthy {
+				healthy = 1
+			}
+			if atomic.SwapInt32(&backend.healthy, healthy) != healthy {
+				if bHealthy {
+					logger.LogInfo("Upstream %s is healthy", backend.url.Host)
+				} else {
+					logger.LogWarning("Upstream %s failed its health check", backend.url.Host)
+				}
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-proxy.stopChan:
+			return
+		}
+	}
+}
+
+// isUpgradeRequest returns true if req asks to switch protocols, ex. to WebSocket
+func isUpgradeRequest(req *http.Request) bool {
+	for _, value := range req.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return req.Header.Get("Upgrade") != ""
+			}
+		}
+	}
+	return false
+}
+
+// joinURLPath joins the path of an upstream URL and a request path
+func joinURLPath(basePath string, requestPath string) string {
+	if basePath == "" || basePath == "/" {
+		return requestPath
+	}
+	return strings.TrimSuffix(basePath, "/") + "/" + strings.TrimPrefix(requestPath, "/")
+}
+
+/*
+serveProxyResource forwards req through the proxy of binding.
+*/
+func serveProxyResource(res http.ResponseWriter, req *http.Request, binding *pluginBinding) bool {
+	vhost := GetVirtualHost(req)
+	return getReverseProxy(vhost.bindingKeyOf(binding), binding.Proxy).ServeHTTP(res, req, bindingPrefixOf(binding, req.URL.Path))
+}
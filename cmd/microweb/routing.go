@@ -0,0 +1,192 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/CanadianCommander/MicroWeb/pkg/logger"
+	"github.com/CanadianCommander/MicroWeb/pkg/pluginUtil"
+	"github.com/CanadianCommander/MicroWeb/pkg/route"
+)
+
+/*
+CoreRouterPriority is the priority of the built in static resource and plugin routers.
+It is lower than route.DefaultRouterPriority so that normal routers registered by plugins
+get a crack at the request first.
+*/
+const CoreRouterPriority = route.DefaultRouterPriority + 100
+
+// routingManager is the global routing manager through which all requests are routed.
+var routingManager = newCoreRoutingManager()
+
+/*
+GetRoutingManager returns the global routing manager. Plugins are handed this manager
+through there optional RegisterRouters(manager *route.RoutingManager) export.
+*/
+func GetRoutingManager() *route.RoutingManager {
+	return routingManager
+}
+
+/*
+newCoreRoutingManager creates a routing manager with the core (health + static + plugin) routers installed.
+Client certificates are checked by global middleware so that no router, including those registered by plugins, sees
+a request for a binding requiring one without it.
+*/
+func newCoreRoutingManager() *route.RoutingManager {
+	manager := route.NewRoutingManager()
+	manager.Use(requireClientCert)
+	manager.AddPreRouter(&healthRouter{CoreRouterPriority})
+	manager.AddNormalRouter(&staticRouter{CoreRouterPriority})
+	manager.AddNormalRouter(&pluginRouter{CoreRouterPriority})
+	return manager
+}
+
+/*
+isPluginResource returns true if the resource targeted by the url path has a plugin bound to it in the virtual host.
+*/
+func isPluginResource(vhost *VirtualHost, urlPath string) bool {
+	fsPath, _ := vhost.urlToFilesystem(urlPath, false)
+	_, err := vhost.GetPluginByResourcePath(fsPath)
+	return err == nil
+}
+
+/*
+requireClientCert is middleware that sends a 403, instead of routing the request, if the plugin binding of the
+requested resource requires a TLS client certificate and the client has not presented a verified one.
+*/
+func requireClientCert(next route.Handler) route.Handler {
+	return func(req *http.Request, res http.ResponseWriter) bool {
+		vhost := GetVirtualHost(req)
+		fsPath, _ := vhost.urlToFilesystem(req.URL.Path, false)
+		binding, pErr := vhost.GetPluginBinding(fsPath)
+		if pErr == nil && binding.RequireClientCert {
+			if _, bOk := pluginUtil.GetClientCertificate(req); !bOk {
+				logger.LogWarning("Rejected request for [%s] from %s, no verified client certificate", req.URL.Path, req.RemoteAddr)
+				WriteErrorResponse(res, req, http.StatusForbidden, "a verified TLS client certificate is required")
+				return false
+			}
+		}
+		return next(req, res)
+	}
+}
+
+/*
+staticRouter serves the files in the static directory of the requests virtual host that do not have a plugin bound to them.
+*/
+type staticRouter struct {
+	priority int
+}
+
+/*
+Route serves the requested file raw. Directories without an index file are listed if the virtual host allows it, see AutoIndex.
+*/
+func (sRouter *staticRouter) Route(req *http.Request, res http.ResponseWriter) bool {
+	vhost := GetVirtualHost(req)
+	fsPath, fsErr := vhost.URLToFilesystem(req.URL.Path)
+	if fsErr != nil {
+		if dirPath, bOk := vhost.autoIndexDirectory(req.URL.Path); bOk {
+			if !serveDirectoryListing(res, req, vhost, dirPath) {
+				logger.LogWarning("failed to serve directory listing, [%s] to %s", req.URL.Path, req.RemoteAddr)
+			}
+			return true
+		}
+	}
+
+	if !serveStaticResource(res, req, fsPath, fsErr) {
+		logger.LogWarning("failed to serve request, [%s] to %s", req.URL.Path, req.RemoteAddr)
+	}
+	return true
+}
+
+/*
+CanRoute returns true if no plugin is bound to the url in the default virtual host
+*/
+func (sRouter *staticRouter) CanRoute(routeURL *url.URL) bool {
+	return !isPluginResource(GetDefaultVirtualHost(), routeURL.Path)
+}
+
+/*
+CanRouteRequest returns true if no plugin is bound to the url in the requests virtual host
+*/
+func (sRouter *staticRouter) CanRouteRequest(req *http.Request) bool {
+	return !isPluginResource(GetVirtualHost(req), req.URL.Path)
+}
+
+/*
+GetPriority returns this routers priority
+*/
+func (sRouter *staticRouter) GetPriority() int {
+	return sRouter.priority
+}
+
+/*
+pluginRouter passes requests on to the plugin bound to the requested resource in the requests virtual host.
+*/
+type pluginRouter struct {
+	priority int
+}
+
+/*
+Route pushes the request through the plugin bound to the requested resource, forwards it to the upstreams
+of a proxy binding (see ProxySettings), to the out-of-process plugin of a process binding (see ProcessSettings)
+or to the CGI scripts / FastCGI responder of a cgi binding (see CGISettings). Client certificates
+have already been checked, see requireClientCert. Bindings with a "responseTimeout" get that instead of the servers response timeout.
+*/
+func (pRouter *pluginRouter) Route(req *http.Request, res http.ResponseWriter) bool {
+	vhost := GetVirtualHost(req)
+	fsPath, fsErr := vhost.URLToFilesystem(req.URL.Path)
+	binding, pErr := vhost.GetPluginBinding(fsPath)
+	if pErr != nil {
+		// binding removed between CanRoute and Route (settings reload)
+		WriteErrorResponse(res, req, http.StatusNotFound, "")
+		return false
+	}
+
+	if binding.ResponseTimeout != nil {
+		if err := pluginUtil.SetResponseTimeout(res, *binding.ResponseTimeout); err != nil {
+			logger.LogWarning("Could not override response timeout for [%s] with error: %s", req.URL.Path, err.Error())
+		}
+	}
+
+	if binding.Proxy != nil {
+		if !serveProxyResource(res, req, binding) {
+			logger.LogWarning("failed to proxy request, [%s] to %s", req.URL.Path, req.RemoteAddr)
+		}
+		return true
+	} else if binding.Process != nil {
+		if !serveProcessResource(res, req, binding) {
+			logger.LogWarning("failed to serve request through plugin process, [%s] to %s", req.URL.Path, req.RemoteAddr)
+		}
+		return true
+	} else if binding.CGI != nil {
+		if !serveCGIResource(res, req, binding) {
+			logger.LogWarning("failed to serve request through CGI, [%s] to %s", req.URL.Path, req.RemoteAddr)
+		}
+		return true
+	}
+	if !servePluginResource(res, req, binding, fsPath, fsErr) {
+		logger.LogWarning("failed to serve request, [%s] to %s", req.URL.Path, req.RemoteAddr)
+	}
+	return true
+}
+
+/*
+CanRoute returns true if a plugin is bound to the url in the default virtual host
+*/
+func (pRouter *pluginRouter) CanRoute(routeURL *url.URL) bool {
+	return isPluginResource(GetDefaultVirtualHost(), routeURL.Path)
+}
+
+/*
+CanRouteRequest returns true if a plugin is bound to the url in the requests virtual host
+*/
+func (pRouter *pluginRouter) CanRouteRequest(req *http.Request) bool {
+	return isPluginResource(GetVirtualHost(req), req.URL.Path)
+}
+
+/*
+GetPriority returns this routers priority
+*/
+func (pRouter *pluginRouter) GetPriority() int {
+	return pRouter.priority
+}
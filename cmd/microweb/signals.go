@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/CanadianCommander/MicroWeb/pkg/logger"
+)
+
+/*
+HandleSignals starts a go routine that shuts down svr gracefully when the process receives SIGTERM or SIGINT.
+On SIGUSR2 the listening sockets are first handed off to a new copy of this program (see HandOffListeners),
+this allows for binary upgrades without dropping connections. A second SIGTERM or SIGINT received while
+shutting down kills the process immediately. SIGHUP reloads changed plugins, see ReloadAllPlugins.
+*/
+func HandleSignals(svr *HTTPServer) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2, syscall.SIGHUP)
+
+	go func() {
+		for sig := range sigChan {
+			if sig == syscall.SIGHUP {
+				logger.LogInfo("Received %s, reloading plugins", sig)
+				ReloadAllPlugins()
+				continue
+			} else if sig == syscall.SIGUSR2 {
+				logger.LogInfo("Received %s, handing off sockets to new process", sig)
+				newPid, err := HandOffListeners(svr)
+				if err != nil {
+					logger.LogError("Socket hand off failed, continuing to serve. error: %s", err.Error())
+					continue
+				}
+				logger.LogInfo("New process [%d] is ready", newPid)
+			} else {
+				logger.LogInfo("Received %s", sig)
+				notifySystemd("STOPPING=1")
+			}
+
+			logger.LogInfo("Shutting down, waiting up to %s for in-flight requests", GetShutdownTimeout())
+			signal.Stop(sigChan)
+			svr.Shutdown(GetShutdownTimeout())
+			return
+		}
+	}()
+}
+
+/*
+NotifyReady tells systemd (if we are running under a Type=notify unit) and the process we took over
+from (if any) that we are ready to serve requests.
+*/
+func NotifyReady() {
+	notifySystemd("READY=1\nMAINPID=" + strconv.Itoa(os.Getpid()))
+	SignalHandOffReady()
+}
+
+// notifySystemd sends a state string to systemd. see sd_notify(3)
+func notifySystemd(state string) {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return
+	}
+
+	conn, err := net.Dial("unixgram", socketPath)
+	if err != nil {
+		logger.LogWarning("Could not notify systemd with error: %s", err.Error())
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte(state))
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+
+	"github.com/CanadianCommander/MicroWeb/pkg/logger"
+	mwsettings "github.com/CanadianCommander/MicroWeb/pkg/mwSettings"
+	"github.com/CanadianCommander/MicroWeb/pkg/pluginUtil"
+	"github.com/CanadianCommander/MicroWeb/pkg/templateHelper"
+)
+
+const (
+	defaultLayoutDirectory  = "layouts"
+	defaultPartialDirectory = "partials"
+)
+
+var (
+	templateEnginesLock sync.Mutex
+	// template engines by static directory, layout directory and partial directory
+	templateEngines = make(map[string]*templateHelper.Engine)
+)
+
+/*
+getTemplateEngine returns the template engine for the pages in staticDirectory, creating it if needed.
+Layouts and partials come from the "templateHelper/layoutDirectory" and "templateHelper/partialDirectory"
+settings ("layouts" and "partials" by default), the engine watches those for changes. Pages are checked
+for changes when they are looked up, so the rest of the static directory is not watched.
+*/
+func getTemplateEngine(staticDirectory string) *templateHelper.Engine {
+	layoutDirectory, partialDirectory := defaultLayoutDirectory, defaultPartialDirectory
+	if mwsettings.HasSetting("templateHelper/layoutDirectory") {
+		layoutDirectory = mwsettings.GetSettingString("templateHelper/layoutDirectory")
+	}
+	if mwsettings.HasSetting("templateHelper/partialDirectory") {
+		partialDirectory = mwsettings.GetSettingString("templateHelper/partialDirectory")
+	}
+
+	engineKey := staticDirectory + "|" + layoutDirectory + "|" + partialDirectory
+	templateEnginesLock.Lock()
+	defer templateEnginesLock.Unlock()
+	if engine, bOk := templateEngines[engineKey]; bOk {
+		return engine
+	}
+
+	engine := templateHelper.NewEngine(staticDirectory, layoutDirectory, partialDirectory)
+	if err := engine.Watch(); err != nil {
+		logger.LogError("Cannot watch the layouts and partials of: %s for changes with error: %s", staticDirectory, err.Error())
+	}
+	templateEngines[engineKey] = engine
+	return engine
+}
+
+/*
+serveTemplatePage executes the .gohtml page at fsPath, which has no plugin bound to it, and sends the result.
+The page is executed with a templateHelper.RequestData by the template engine of the requests virtual host,
+so layouts, partials, the templateHelper.StandardFuncs and every template configured in the "templateHelper"
+section of the config file are available to it, ex. {{template `template1` template1 nil}}.
+Layouts and partials themselves are not served. Pages are dynamic so they are never cached by clients,
+they are compressed on the fly if compression is enabled.
+*/
+func serveTemplatePage(res http.ResponseWriter, req *http.Request, fsPath string) bool {
+	engine := getTemplateEngine(GetVirtualHost(req).StaticDirectory)
+	if !engine.IsPage(fsPath) {
+		logger.LogInfo("Refusing to serve layout / partial: %s", fsPath)
+		WriteErrorResponse(res, req, http.StatusNotFound, "")
+		return false
+	}
+
+	// render in to a buffer first so that a broken page results in an error page, not half a page
+	var page bytes.Buffer
+	requestData := templateHelper.NewRequestData(req, pluginUtil.GetRequestID(req))
+	if err := engine.Render(&page, fsPath, requestData); err != nil {
+		logger.LogError("Could not render template page: %s with error: %s", fsPath, err.Error())
+		WriteErrorResponse(res, req, http.StatusInternalServerError, "")
+		return false
+	}
+
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	res.Header().Set("Cache-Control", "no-cache")
+	if req.Method != http.MethodHead {
+		res.Write(page.Bytes())
+	}
+	return true
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CanadianCommander/MicroWeb/pkg/logger"
+	mwsettings "github.com/CanadianCommander/MicroWeb/pkg/mwSettings"
+	"golang.org/x/crypto/acme"
+)
+
+// certReloadCheckInterval is the minimum time between checks of a certificate's files for changes
+var certReloadCheckInterval = 1 * time.Second
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+var tlsClientAuthModes = map[string]tls.ClientAuthType{
+	"none":          tls.NoClientCert,
+	"request":       tls.RequestClientCert,
+	"requireAny":    tls.RequireAnyClientCert,
+	"verifyIfGiven": tls.VerifyClientCertIfGiven,
+	"require":       tls.RequireAndVerifyClientCert,
+}
+
+// tlsListenerConfigs holds the current TLS configuration of every TLS listener, rebuilt when settings change
+var tlsListenerConfigs = make(map[string]*tls.Config)
+var tlsListenerConfigLock = sync.Mutex{}
+var tlsSettingListenerOnce sync.Once
+
+// certificates loaded so far, keyed by cert file + key file
+var certificateCache = make(map[string]*reloadableCertificate)
+var certificateCacheLock = sync.Mutex{}
+
+/*
+reloadableCertificate is a certificate / key pair that is reloaded from disk when either file changes.
+*/
+type reloadableCertificate struct {
+	certFile, keyFile string
+
+	lock        sync.Mutex
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+	lastCheck   time.Time
+}
+
+//AddTLSSettingDecoders adds setting decoders for the TLS policy settings in the "tls" section of the config file
+func AddTLSSettingDecoders() {
+	tlsSettings := []string{"tls/minVersion", "tls/maxVersion", "tls/cipherSuites", "tls/curves", "tls/alpn",
+		"tls/sessionTicketKeys", "tls/clientAuth", "tls/clientCAFile"}
+
+	for _, set := range tlsSettings {
+		mwsettings.AddSettingDecoder(mwsettings.NewBasicDecoder(set))
+	}
+}
+
+/*
+CreateTLSConfig builds the TLS configuration for the listener at listenAddr. Certificates are selected by SNI
+from the virtual hosts bound to the listener, falling back to ACME (see GetACMEManager) for ACME managed
+host names. If no virtual host on the listener has a certificate or uses ACME, and the listener is not
+the default TLS listener, nil is returned and the listener serves plain HTTP.
+
+The returned configuration defers to the current listener configuration on every handshake so that
+certificate files are reloaded when they change, and the whole configuration (certificates and policy)
+is rebuilt when settings are reloaded. The policy is set in the "tls" section of the config file:
+	"tls": {
+	  "enableTLS":         true,
+	  "certFile":          "/etc/ssl/cert.pem",
+	  "keyFile":           "/etc/ssl/key.pem",
+	  "minVersion":        "1.2",
+	  "maxVersion":        "1.3",
+	  "cipherSuites":      ["TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"],
+	  "curves":            ["X25519", "P256"],
+	  "alpn":              ["h2", "http/1.1"],
+	  "sessionTicketKeys": ["<64 hex characters>"],
+	  "clientAuth":        "verifyIfGiven",
+	  "clientCAFile":      "/etc/ssl/clientCA.pem"
+	}
+"clientAuth" is one of none, request, requireAny, verifyIfGiven or require. If it is not set and a plugin binding
+has "requireClientCert" it defaults to verifyIfGiven. Client certificates are only ever verified against "clientCAFile",
+the configuration is refused if certificates are to be verified without it. Whether a listener uses TLS at all is
+decided at startup.
+*/
+func CreateTLSConfig(listenAddr string) (*tls.Config, error) {
+	tlsConfig, err := buildTLSConfig(listenAddr)
+	if tlsConfig == nil || err != nil {
+		return nil, err
+	}
+
+	tlsListenerConfigLock.Lock()
+	tlsListenerConfigs[listenAddr] = tlsConfig
+	tlsListenerConfigLock.Unlock()
+	tlsSettingListenerOnce.Do(func() {
+		mwsettings.AddSettingListener(reloadTLSConfigs)
+	})
+
+	return &tls.Config{
+		NextProtos: tlsConfig.NextProtos,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			return getTLSListenerConfig(listenAddr), nil
+		},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return getTLSListenerConfig(listenAddr).GetCertificate(hello)
+		},
+	}, nil
+}
+
+// getTLSListenerConfig returns the current TLS configuration of the listener at listenAddr
+func getTLSListenerConfig(listenAddr string) *tls.Config {
+	tlsListenerConfigLock.Lock()
+	defer tlsListenerConfigLock.Unlock()
+	return tlsListenerConfigs[listenAddr]
+}
+
+/*
+reloadTLSConfigs rebuilds the TLS configuration of every TLS listener from the current settings.
+Listeners whose new configuration cannot be built keep there old one.
+*/
+func reloadTLSConfigs() {
+	tlsListenerConfigLock.Lock()
+	defer tlsListenerConfigLock.Unlock()
+
+	// force all certificates to be checked on next use
+	certificateCacheLock.Lock()
+	for _, cert := range certificateCache {
+		cert.lock.Lock()
+		cert.lastCheck = time.Time{}
+		cert.lock.Unlock()
+	}
+	certificateCacheLock.Unlock()
+
+	for listenAddr := range tlsListenerConfigs {
+		tlsConfig, err := buildTLSConfig(listenAddr)
+		if err != nil {
+			logger.LogError("Could not reload TLS configuration for %s, keeping old configuration. error: %s", listenAddr, err.Error())
+			continue
+		}
+		if tlsConfig == nil {
+			logger.LogWarning("Listener %s no longer has any certificates, keeping old TLS configuration", listenAddr)
+			continue
+		}
+		tlsListenerConfigs[listenAddr] = tlsConfig
+		logger.LogInfo("Reloaded TLS configuration for %s", listenAddr)
+	}
+}
+
+// buildTLSConfig builds the TLS configuration of the listener at listenAddr from the current settings. nil if the listener does not use TLS
+func buildTLSConfig(listenAddr string) (*tls.Config, error) {
+	defaultHost := GetDefaultVirtualHost()
+	bDefaultTLS := mwsettings.GetSettingBool("tls/enableTLS") && defaultHost.listensOn(listenAddr)
+	bACME := listenerUsesACME(listenAddr)
+
+	var certHosts []*VirtualHost
+	certs := make(map[*VirtualHost]*reloadableCertificate)
+	for _, vhost := range virtualHostsOnListener(listenAddr) {
+		if !vhost.hasCertificate() {
+			continue
+		}
+		cert, err := loadCertificate(vhost.CertFile, vhost.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		certHosts = append(certHosts, vhost)
+		certs[vhost] = cert
+	}
+
+	var defaultCert *reloadableCertificate
+	if bDefaultTLS && (defaultHost.hasCertificate() || !bACME) {
+		cert, err := loadCertificate(defaultHost.CertFile, defaultHost.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		defaultCert = cert
+	} else if len(certHosts) > 0 {
+		defaultCert = certs[certHosts[0]]
+	} else if !bACME {
+		return nil, nil
+	}
+
+	tlsConfig, err := buildTLSPolicy()
+	if err != nil {
+		return nil, err
+	}
+	if bACME {
+		tlsConfig.NextProtos = append(tlsConfig.NextProtos, acme.ALPNProto)
+	}
+
+	tlsConfig.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if bACME && IsACMEHostname(hello.ServerName) {
+			for _, proto := range hello.SupportedProtos {
+				if proto == acme.ALPNProto {
+					// TLS-ALPN-01 challenge
+					return GetACMEManager().GetCertificate(hello)
+				}
+			}
+		}
+		if vhost := matchVirtualHost(certHosts, hello.ServerName); vhost != nil {
+			return certs[vhost].get(), nil
+		}
+		if bACME && IsACMEHostname(hello.ServerName) {
+			return GetACMEManager().GetCertificate(hello)
+		}
+		if defaultCert == nil {
+			return nil, errors.New("no certificate for server name: " + hello.ServerName)
+		}
+		return defaultCert.get(), nil
+	}
+	return tlsConfig, nil
+}
+
+// buildTLSPolicy builds a TLS configuration, without certificates, from the policy settings in the "tls" section
+func buildTLSPolicy() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+
+	var err error
+	if mwsettings.HasSetting("tls/minVersion") {
+		if tlsConfig.MinVersion, err = parseTLSVersion(mwsettings.GetSettingString("tls/minVersion")); err != nil {
+			return nil, err
+		}
+	}
+	if mwsettings.HasSetting("tls/maxVersion") {
+		if tlsConfig.MaxVersion, err = parseTLSVersion(mwsettings.GetSettingString("tls/maxVersion")); err != nil {
+			return nil, err
+		}
+	}
+
+	if mwsettings.HasSetting("tls/cipherSuites") {
+		names, err := decodeStringList(mwsettings.GetSetting("tls/cipherSuites"))
+		if err != nil {
+			return nil, errors.New("bad value for tls/cipherSuites: " + err.Error())
+		}
+		if tlsConfig.CipherSuites, err = parseCipherSuites(names); err != nil {
+			return nil, err
+		}
+	}
+
+	if mwsettings.HasSetting("tls/curves") {
+		names, err := decodeStringList(mwsettings.GetSetting("tls/curves"))
+		if err != nil {
+			return nil, errors.New("bad value for tls/curves: " + err.Error())
+		}
+		for _, name := range names {
+			curve, bOk := tlsCurves[name]
+			if !bOk {
+				return nil, errors.New("unknown TLS curve: " + name)
+			}
+			tlsConfig.CurvePreferences = append(tlsConfig.CurvePreferences, curve)
+		}
+	}
+
+	if mwsettings.HasSetting("tls/alpn") {
+		if tlsConfig.NextProtos, err = decodeStringList(mwsettings.GetSetting("tls/alpn")); err != nil {
+			return nil, errors.New("bad value for tls/alpn: " + err.Error())
+		}
+	}
+	// every listener hands out its own configuration, http2.ConfigureServer never sees them
+	if err = checkHTTP2CipherSuites(tlsConfig); err != nil {
+		return nil, err
+	}
+
+	if mwsettings.HasSetting("tls/sessionTicketKeys") {
+		keys, err := parseSessionTicketKeys(mwsettings.GetSetting("tls/sessionTicketKeys"))
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.SetSessionTicketKeys(keys)
+	}
+
+	if mwsettings.HasSetting("tls/clientAuth") {
+		clientAuth, bOk := tlsClientAuthModes[mwsettings.GetSettingString("tls/clientAuth")]
+		if !bOk {
+			return nil, errors.New("unknown tls/clientAuth mode: " + mwsettings.GetSettingString("tls/clientAuth"))
+		}
+		tlsConfig.ClientAuth = clientAuth
+	} else if anyBindingRequiresClientCert() {
+		// ask for certificates so that plugin bindings with "requireClientCert" can be enforced
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	if tlsConfig.ClientAuth < tls.VerifyClientCertIfGiven && anyBindingRequiresClientCert() {
+		logger.LogWarning("tls/clientAuth does not verify client certificates, plugin bindings requiring a client certificate will reject all requests")
+	}
+	if mwsettings.HasSetting("tls/clientCAFile") {
+		pemData, err := ioutil.ReadFile(mwsettings.GetSettingString("tls/clientCAFile"))
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(pemData) {
+			return nil, errors.New("no certificates found in " + mwsettings.GetSettingString("tls/clientCAFile"))
+		}
+	} else if tlsConfig.ClientAuth >= tls.VerifyClientCertIfGiven {
+		// without ClientCAs crypto/tls verifies client certificates against the system roots, accepting any public certificate
+		return nil, errors.New("tls/clientCAFile must be set to verify client certificates (tls/clientAuth or a plugin binding with requireClientCert)")
+	}
+
+	return tlsConfig, nil
+}
+
+func parseTLSVersion(version string) (uint16, error) {
+	tlsVersion, bOk := tlsVersions[strings.TrimPrefix(version, "TLS")]
+	if !bOk {
+		return 0, errors.New("unknown TLS version: " + version)
+	}
+	return tlsVersion, nil
+}
+
+// parseCipherSuites converts cipher suite names (as used by crypto/tls) to there ids
+func parseCipherSuites(names []string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[suite.Name] = suite.ID
+	}
+
+	var ids []uint16
+	for _, name := range names {
+		id, bOk := known[name]
+		if !bOk {
+			return nil, errors.New("unknown TLS cipher suite: " + name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// parseSessionTicketKeys decodes a list of hex encoded 32 byte session ticket keys. The first key is used to encrypt new tickets
+func parseSessionTicketKeys(raw interface{}) ([][32]byte, error) {
+	hexKeys, err := decodeStringList(raw)
+	if err != nil {
+		return nil, errors.New("bad value for tls/sessionTicketKeys: " + err.Error())
+	}
+
+	keys := make([][32]byte, len(hexKeys))
+	for i, hexKey := range hexKeys {
+		key, err := hex.DecodeString(hexKey)
+		if err != nil || len(key) != 32 {
+			return nil, errors.New("session ticket keys must be 64 hex characters (32 bytes)")
+		}
+		copy(keys[i][:], key)
+	}
+	return keys, nil
+}
+
+/*
+loadCertificate returns the reloadable certificate for the given files, loading it if this is the first use.
+An error is returned if the certificate cannot be loaded.
+*/
+func loadCertificate(certFile string, keyFile string) (*reloadableCertificate, error) {
+	certificateCacheLock.Lock()
+	defer certificateCacheLock.Unlock()
+
+	cacheKey := certFile + "|" + keyFile
+	if cert, bOk := certificateCache[cacheKey]; bOk {
+		return cert, nil
+	}
+
+	cert := &reloadableCertificate{certFile: certFile, keyFile: keyFile}
+	if err := cert.reload(); err != nil {
+		logger.LogError("Could not load TLS certificate %s with error: %s", certFile, err.Error())
+		return nil, err
+	}
+	certificateCache[cacheKey] = cert
+	return cert, nil
+}
+
+/*
+get returns the certificate, first reloading it from disk if the files have changed since they were last loaded.
+If reloading fails the old certificate is kept.
+*/
+func (cert *reloadableCertificate) get() *tls.Certificate {
+	cert.lock.Lock()
+	defer cert.lock.Unlock()
+
+	if time.Since(cert.lastCheck) >= certReloadCheckInterval {
+		if err := cert.reload(); err != nil {
+			logger.LogError("Could not reload TLS certificate %s, keeping old certificate. error: %s", cert.certFile, err.Error())
+		}
+	}
+	return cert.cert
+}
+
+// reload loads the certificate if its files have changed. Lock cert.lock first (unless cert is not shared yet)
+func (cert *reloadableCertificate) reload() error {
+	cert.lastCheck = time.Now()
+
+	certInfo, err := os.Stat(cert.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(cert.keyFile)
+	if err != nil {
+		return err
+	}
+	if cert.cert != nil && certInfo.ModTime().Equal(cert.certModTime) && keyInfo.ModTime().Equal(cert.keyModTime) {
+		return nil
+	}
+
+	newCert, err := tls.LoadX509KeyPair(cert.certFile, cert.keyFile)
+	if err != nil {
+		return err
+	}
+	if cert.cert != nil {
+		logger.LogInfo("Reloaded TLS certificate %s", cert.certFile)
+	}
+	cert.cert = &newCert
+	cert.certModTime = certInfo.ModTime()
+	cert.keyModTime = keyInfo.ModTime()
+	return nil
+}
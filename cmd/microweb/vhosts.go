@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/CanadianCommander/MicroWeb/pkg/logger"
+	mwsettings "github.com/CanadianCommander/MicroWeb/pkg/mwSettings"
+)
+
+const vhostSettingPath = "vhosts"
+
+type virtualHostKey struct{}
+
+/*
+VirtualHost is one site served by microweb. Sites are configured in the "vhosts" section of
+the configuration file, ex:
+	"vhosts": [
+	  {
+	    "hostnames":       ["example.com", "*.example.com"],
+	    "staticDirectory": "/var/www/example/",
+	    "listeners":       [":443"],
+	    "tls":             {"certFile": "/etc/ssl/example.pem", "keyFile": "/etc/ssl/example.key"},
+	    "plugins":         [{"binding": "/api/", "plugin": "/usr/lib/microweb/api.so"}]
+	  },
+	  {
+	    "hostnames":       "other.example.com",
+	    "staticDirectory": "/var/www/other/",
+	    "listeners":       [":443"],
+	    "tls":             {"acme": true},
+	    "autoIndex":       {"enable": true},
+	    "errorPages":      {"404": "/var/www/other/404.gohtml"}
+	  }
+	]
+Requests are dispatched to a virtual host based on the listener they arrive on and there Host header.
+TLS certificates are selected by SNI. The top level "general/staticDirectory", "plugin/plugins",
+"tls", "autoIndex" and "errorPages" settings make up the default virtual host, which serves any request not claimed by another.
+*/
+type VirtualHost struct {
+	Hostnames       []string
+	StaticDirectory string
+	Listeners       []string
+	CertFile        string
+	KeyFile         string
+	// ACME is true if the certificates for the host names are obtained through ACME, see GetACMEManager
+	ACME      bool
+	Plugins   []pluginBinding
+	AutoIndex AutoIndex
+	// status code, status class ("4xx") or "default" to error page, see decodeErrorPages
+	ErrorPages map[string]string
+}
+
+/*
+GetDefaultVirtualHost returns the virtual host built from the top level settings.
+It has no host names and listens on "general/TCPPort".
+*/
+func GetDefaultVirtualHost() *VirtualHost {
+	vhost := &VirtualHost{
+		StaticDirectory: mwsettings.GetSettingString("general/staticDirectory"),
+		Listeners:       []string{mwsettings.GetSettingString("general/TCPPort")},
+		CertFile:        mwsettings.GetSettingString("tls/certFile"),
+		KeyFile:         mwsettings.GetSettingString("tls/keyFile"),
+		AutoIndex: AutoIndex{
+			Enable:     mwsettings.GetSettingBool("autoIndex/enable"),
+			Template:   mwsettings.GetSettingString("autoIndex/template"),
+			ShowHidden: mwsettings.GetSettingBool("autoIndex/showHidden"),
+		},
+	}
+	if mwsettings.HasSetting("plugin/plugins") {
+		vhost.Plugins = mwsettings.GetSetting("plugin/plugins").([]pluginBinding)
+	}
+	if mwsettings.HasSetting(errorPageSettingPath) {
+		vhost.ErrorPages, _ = mwsettings.GetSetting(errorPageSettingPath).(map[string]string)
+	}
+	return vhost
+}
+
+/*
+GetVirtualHosts returns the virtual hosts configured in the "vhosts" section, not including the default virtual host.
+*/
+func GetVirtualHosts() []*VirtualHost {
+	if !mwsettings.HasSetting(vhostSettingPath) {
+		return nil
+	}
+	vhosts, _ := mwsettings.GetSetting(vhostSettingPath).([]*VirtualHost)
+	return vhosts
+}
+
+/*
+GetVirtualHost returns the virtual host a request has been dispatched to.
+*/
+func GetVirtualHost(req *http.Request) *VirtualHost {
+	if vhost, bOk := req.Context().Value(virtualHostKey{}).(*VirtualHost); bOk {
+		return vhost
+	}
+	return ResolveVirtualHost(req)
+}
+
+/*
+withVirtualHost resolves the virtual host of the request and attaches it to the request context
+so that later calls to GetVirtualHost are cheap and consistent.
+*/
+func withVirtualHost(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), virtualHostKey{}, ResolveVirtualHost(req)))
+}
+
+/*
+ResolveVirtualHost picks the virtual host for a request. Of the virtual hosts bound to the listener the request
+arrived on, exact host name matches are preferred over wildcard matches. If none match the default virtual host
+is used, unless it is not bound to the listener, in which case the first virtual host bound to the listener is used.
+*/
+func ResolveVirtualHost(req *http.Request) *VirtualHost {
+	listenAddr := ""
+	if server, bOk := req.Context().Value(http.ServerContextKey).(*http.Server); bOk {
+		listenAddr = server.Addr
+	}
+	return resolveVirtualHost(listenAddr, req.Host)
+}
+
+func resolveVirtualHost(listenAddr string, host string) *VirtualHost {
+	defaultHost := GetDefaultVirtualHost()
+	candidates := virtualHostsOnListener(listenAddr)
+
+	if vhost := matchVirtualHost(candidates, host); vhost != nil {
+		return vhost
+	}
+	if defaultHost.listensOn(listenAddr) || len(candidates) == 0 {
+		return defaultHost
+	}
+	return candidates[0]
+}
+
+// virtualHostsOnListener returns the configured virtual hosts bound to listenAddr. "" matches all listeners
+func virtualHostsOnListener(listenAddr string) []*VirtualHost {
+	var out []*VirtualHost
+	for _, vhost := range GetVirtualHosts() {
+		if listenAddr == "" || vhost.listensOn(listenAddr) {
+			out = append(out, vhost)
+		}
+	}
+	return out
+}
+
+// matchVirtualHost returns the virtual host matching host, exact matches first. nil if there is no match
+func matchVirtualHost(vhosts []*VirtualHost, host string) *VirtualHost {
+	host = normalizeHostname(host)
+	if host == "" {
+		return nil
+	}
+
+	for _, vhost := range vhosts {
+		for _, name := range vhost.Hostnames {
+			if name == host {
+				return vhost
+			}
+		}
+	}
+	for _, vhost := range vhosts {
+		for _, name := range vhost.Hostnames {
+			if strings.HasPrefix(name, "*.") && strings.HasSuffix(host, name[1:]) {
+				return vhost
+			}
+		}
+	}
+	return nil
+}
+
+// normalizeHostname strips the port and trailing dot from host and lower cases it
+func normalizeHostname(host string) string {
+	if hostOnly, _, err := net.SplitHostPort(host); err == nil {
+		host = hostOnly
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+/*
+listensOn returns true if the virtual host is served on listenAddr. Virtual hosts without
+listeners of there own are served on "general/TCPPort".
+*/
+func (vhost *VirtualHost) listensOn(listenAddr string) bool {
+	listeners := vhost.Listeners
+	if len(listeners) == 0 {
+		listeners = []string{mwsettings.GetSettingString("general/TCPPort")}
+	}
+	for _, listener := range listeners {
+		if listener == listenAddr {
+			return true
+		}
+	}
+	return false
+}
+
+// hasCertificate returns true if a TLS certificate is configured for this virtual host
+func (vhost *VirtualHost) hasCertificate() bool {
+	return vhost.CertFile != "" && vhost.KeyFile != ""
+}
+
+/*
+URLToFilesystem takes a url and resolves it to a file system path within the virtual hosts static directory, if possible.
+*/
+func (vhost *VirtualHost) URLToFilesystem(url string) (string, error) {
+	return vhost.urlToFilesystem(url, true)
+}
+
+/*
+GetPluginByResourcePath returns the path of the plugin that has the longest binding
+match with the given fsPath or an error if no plugin matches at all.
+
+Longest match means, given these two bindings
+/index/
+/index/web.html
+the second binding will be selected for fsPath=/index/web.html because it is longer than
+the match produced by the /index/ binding, while for all other queries, ex fsPath=/index/foo.html
+the frist binding will be used.
+*/
+func (vhost *VirtualHost) GetPluginByResourcePath(fsPath string) (string, error) {
+	binding, err := vhost.GetPluginBinding(fsPath)
+	if err != nil {
+		return "", err
+	}
+	return binding.Plugin, nil
+}
+
+/*
+GetPluginBinding is GetPluginByResourcePath but returns the whole plugin binding.
+*/
+func (vhost *VirtualHost) GetPluginBinding(fsPath string) (*pluginBinding, error) {
+	type bindingMapping struct {
+		Binding string
+		Plugin  *pluginBinding
+	}
+
+	var pluginList []bindingMapping
+	for i, plugin := range vhost.Plugins {
+		for _, binding := range plugin.BindingList {
+			pluginList = append(pluginList, bindingMapping{path.Join(vhost.StaticDirectory, binding), &vhost.Plugins[i]})
+		}
+	}
+
+	lessFunction := func(i, j int) bool {
+		return StringMatchLength(pluginList[i].Binding, fsPath) > StringMatchLength(pluginList[j].Binding, fsPath)
+	}
+	sort.Slice(pluginList[:], lessFunction)
+
+	for _, plugin := range pluginList {
+		if StringMatchLength(plugin.Binding, fsPath) == len(plugin.Binding) {
+			return plugin.Plugin, nil
+		}
+	}
+
+	return nil, errors.New("No Plugin found for given path: " + fsPath)
+}
+
+/*
+GetAllListeners returns the address of every listener needed to serve the default and configured virtual hosts.
+The default virtual host listener ("general/TCPPort") is always first.
+*/
+func GetAllListeners() []string {
+	listeners := []string{mwsettings.GetSettingString("general/TCPPort")}
+	for _, vhost := range GetVirtualHosts() {
+		for _, listener := range vhost.Listeners {
+			bFound := false
+			for _, known := range listeners {
+				if known == listener {
+					bFound = true
+					break
+				}
+			}
+			if !bFound {
+				listeners = append(listeners, listener)
+			}
+		}
+	}
+	return listeners
+}
+
+//AddVirtualHostSettingDecoder adds a decoder for the "vhosts" section of the config file.
+func AddVirtualHostSettingDecoder() {
+	mwsettings.AddSettingDecoder(mwsettings.NewFunctionalSettingDecoder(func(s interface{}) (string, interface{}) {
+		vhostList, bOk := s.([]interface{})
+		if !bOk {
+			logger.LogError("Error parsing vhosts list. format incorrect")
+			return "ERROR", nil
+		}
+
+		outList := make([]*VirtualHost, 0, len(vhostList))
+		for _, rawVhost := range vhostList {
+			vhost, err := decodeVirtualHost(rawVhost)
+			if err != nil {
+				logger.LogError("Error parsing vhost: %s", err.Error())
+				continue
+			}
+			outList = append(outList, vhost)
+		}
+		return vhostSettingPath, outList
+	},
+		func(path string) bool {
+			return path == vhostSettingPath
+		}))
+}
+
+func decodeVirtualHost(rawVhost interface{}) (*VirtualHost, error) {
+	vhostMap, bOk := rawVhost.(map[string]interface{})
+	if !bOk {
+		return nil, errors.New("vhost must be an object")
+	}
+
+	vhost := &VirtualHost{}
+	var err error
+	if vhost.Hostnames, err = decodeStringList(vhostMap["hostnames"]); err != nil {
+		return nil, errors.New("bad \"hostnames\": " + err.Error())
+	}
+	for i, name := range vhost.Hostnames {
+		vhost.Hostnames[i] = normalizeHostname(name)
+	}
+	if len(vhost.Hostnames) == 0 {
+		return nil, errors.New("vhost has no hostnames")
+	}
+
+	if vhost.StaticDirectory, bOk = vhostMap["staticDirectory"].(string); !bOk {
+		return nil, errors.New("vhost " + vhost.Hostnames[0] + " has no staticDirectory")
+	}
+	if vhost.Listeners, err = decodeStringList(vhostMap["listeners"]); err != nil {
+		return nil, errors.New("bad \"listeners\": " + err.Error())
+	}
+
+	if tlsMap, bOk := vhostMap["tls"].(map[string]interface{}); bOk {
+		vhost.CertFile, _ = tlsMap["certFile"].(string)
+		vhost.KeyFile, _ = tlsMap["keyFile"].(string)
+		vhost.ACME, _ = tlsMap["acme"].(bool)
+	}
+	vhost.AutoIndex = decodeAutoIndex(vhostMap["autoIndex"])
+	if rawErrorPages, bOk := vhostMap["errorPages"]; bOk {
+		if vhost.ErrorPages, err = decodeErrorPages(rawErrorPages); err != nil {
+			return nil, errors.New("vhost " + vhost.Hostnames[0] + " has bad errorPages: " + err.Error())
+		}
+	}
+
+	if rawPlugins, bOk := vhostMap["plugins"]; bOk {
+		if vhost.Plugins, bOk = decodePluginBindings(rawPlugins); !bOk {
+			return nil, errors.New("vhost " + vhost.Hostnames[0] + " has a malformed plugin list")
+		}
+	}
+	return vhost, nil
+}
+
+// decodeStringList decodes a JSON string or list of strings. nil decodes to an empty list
+func decodeStringList(raw interface{}) ([]string, error) {
+	if raw == nil {
+		return []string{}, nil
+	}
+	if str, bOk := raw.(string); bOk {
+		return []string{str}, nil
+	}
+	if reflect.ValueOf(raw).Kind() != reflect.Slice {
+		return nil, errors.New("expecting string or list of strings")
+	}
+
+	var out []string
+	for _, item := range raw.([]interface{}) {
+		str, bOk := item.(string)
+		if !bOk {
+			return nil, errors.New("expecting string or list of strings")
+		}
+		out = append(out, str)
+	}
+	return out, nil
+}
@@ -9,6 +9,10 @@ else
   INSTALL_DIR=`dirname "$0"`
 
   mkdir -p /var/www /etc/microweb 
+  # ACME certificate cache, written after root privileges are dropped
+  mkdir -p /var/lib/microweb/acme
+  chown www-data /var/lib/microweb/acme
+  chmod 700 /var/lib/microweb/acme
   cp ${INSTALL_DIR}/microweb.cfg.json /etc/microweb/
 
   go build -o /bin/microweb github.com/CanadianCommander/MicroWeb/cmd/microweb/
@@ -7,6 +7,7 @@ package cache
 
 import (
 	"regexp"
+	"sort"
 	"sync"
 	"time"
 
@@ -28,9 +29,17 @@ const (
 var cacheSettingsLock = sync.Mutex{}
 var (
 	cacheTTL = 60 * time.Second
+	// max total size of sized objects (see SizedObject) in the cache, in bytes. 0 for no limit
+	cacheMemoryBudget = int64(defaultCacheMaxMB) * 1024 * 1024
 )
 
 var cacheMap map[string]*cacheObject
+
+// total size of the sized objects in the cache. only accessed from the cache goroutine
+var cachedBytes int64
+
+// counts cache object uses, orders objects for least recently used eviction. only accessed from the cache goroutine
+var cacheUseCount uint64
 var cacheChannel chan cacheChannelMsg
 
 // cache messaging format
@@ -48,11 +57,28 @@ type cacheObject struct {
 	object    interface{}
 	timeStamp time.Time
 	ttl       time.Duration
+	// value of cacheUseCount when the object was last added or fetched
+	lastUse uint64
+}
+
+/*
+SizedObject is implemented by cache objects that count towards the cache memory budget ("tune/cacheMaxMB").
+When the budget is exceeded the least recently used sized objects are evicted.
+*/
+type SizedObject interface {
+	CacheSize() int64
 }
 
 //AddCacheSettingDecoders adds setting decoders for cache settings in config file
 func AddCacheSettingDecoders() {
 	mwsettings.AddSettingDecoder(mwsettings.NewBasicDecoder("tune/cacheTTL"))
+	mwsettings.AddSettingDecoder(mwsettings.NewBasicDecoder("tune/cacheMaxMB"))
+	mwsettings.AddSettingDecoder(mwsettings.NewBasicDecoder("tune/streamThresholdMB"))
+	mwsettings.AddSettingListener(func() {
+		if mwsettings.HasSetting("tune/cacheMaxMB") {
+			UpdateCacheMemoryBudget(int64(mwsettings.GetSettingInt("tune/cacheMaxMB")) * 1024 * 1024)
+		}
+	})
 	mwsettings.AddSettingListener(func() {
 		TTLString := mwsettings.GetSettingString("tune/cacheTTL")
 		TTL, err := time.ParseDuration(TTLString)
@@ -88,6 +114,7 @@ func AddToCache(cacheType string, name string, object interface{}) {
 		cacheSettingsLock.Lock()
 		defer cacheSettingsLock.Unlock()
 		addToCache(cacheType, name, cacheTTL, object)
+		enforceMemoryBudget(cacheMemoryBudget)
 		return nil
 	}
 	cacheChannel <- msg
@@ -99,7 +126,10 @@ AddToCacheTTLOverride is like AddToCache but allows overriding of global ttl val
 func AddToCacheTTLOverride(cacheType string, name string, ttl time.Duration, object interface{}) {
 	msg := cacheChannelMsg{}
 	msg.operation = func() interface{} {
+		cacheSettingsLock.Lock()
+		defer cacheSettingsLock.Unlock()
 		addToCache(cacheType, name, ttl, object)
+		enforceMemoryBudget(cacheMemoryBudget)
 		return nil
 	}
 	cacheChannel <- msg
@@ -114,6 +144,25 @@ func UpdateCacheTTL(newTTL time.Duration) {
 	cacheTTL = newTTL
 }
 
+/*
+UpdateCacheMemoryBudget sets the max total size, in bytes, of sized objects in the cache. 0 for no limit.
+The budget is enforced the next time an object is added.
+*/
+func UpdateCacheMemoryBudget(budget int64) {
+	cacheSettingsLock.Lock()
+	defer cacheSettingsLock.Unlock()
+	cacheMemoryBudget = budget
+}
+
+/*
+GetCacheMemoryBudget returns the max total size, in bytes, of sized objects in the cache. 0 for no limit.
+*/
+func GetCacheMemoryBudget() int64 {
+	cacheSettingsLock.Lock()
+	defer cacheSettingsLock.Unlock()
+	return cacheMemoryBudget
+}
+
 /*
 FlushCache removes all objects from the cache
 */
@@ -222,41 +271,83 @@ func updateTTL() {
 	}
 
 	for _, key := range delList {
+		deleteCacheObject(key)
+	}
+}
+
+// evict the least recently used sized objects until the cache is within budget
+func enforceMemoryBudget(budget int64) {
+	if budget <= 0 || cachedBytes <= budget {
+		return
+	}
+
+	var keys []string
+	for key, obj := range cacheMap {
+		if _, bOk := obj.object.(SizedObject); bOk {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return cacheMap[keys[i]].lastUse < cacheMap[keys[j]].lastUse
+	})
+
+	for _, key := range keys {
+		if cachedBytes <= budget {
+			break
+		}
+		logger.LogVerbose("Cache memory budget exceeded, evicting: %s", key)
+		deleteCacheObject(key)
+	}
+}
+
+// remove a object from the cache keeping cachedBytes up to date
+func deleteCacheObject(key string) {
+	if obj, bOk := cacheMap[key]; bOk {
+		if sized, bOk := obj.object.(SizedObject); bOk {
+			cachedBytes -= sized.CacheSize()
+		}
 		delete(cacheMap, key)
 	}
 }
 
 func createCacheObject(ttl time.Duration, object interface{}) *cacheObject {
-	return &cacheObject{object, time.Now(), ttl}
+	cacheUseCount++
+	return &cacheObject{object, time.Now(), ttl, cacheUseCount}
 }
 
 func addToCache(cacheType string, name string, ttl time.Duration, object interface{}) {
 	if cacheMap[cacheType+name] == nil {
 		cacheMap[cacheType+name] = createCacheObject(ttl, object)
+		if sized, bOk := object.(SizedObject); bOk {
+			cachedBytes += sized.CacheSize()
+		}
 	}
 }
 
 func flushCache() {
 	cacheMap = make(map[string]*cacheObject)
+	cachedBytes = 0
 }
 
 func flushCacheByType(cacheType string) {
 	delMap := getAllOfType(cacheType)
 	if delMap != nil {
 		for key := range delMap {
-			delete(cacheMap, key)
+			deleteCacheObject(key)
 		}
 	}
 }
 
 func removeFromCache(cacheType string, name string) {
-	delete(cacheMap, cacheType+name)
+	deleteCacheObject(cacheType + name)
 }
 
 func fetchFromCache(cacheType string, name string) interface{} {
 	obj := cacheMap[cacheType+name]
 	if obj != nil {
+		cacheUseCount++
 		obj.timeStamp = time.Now()
+		obj.lastUse = cacheUseCount
 		return obj.object
 	}
 	return nil
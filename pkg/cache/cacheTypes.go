@@ -7,9 +7,11 @@ import (
 //cache object "types"
 const (
 	CacheTypeResource             = "static:"
+	CacheTypeCompressedResource   = "compressed:"
 	CacheTypePlugin               = "Plugin:"
 	CacheTypeDatabase             = "Database:"
 	CacheTypeTemplateHelperPlugin = "templateHelperPlugin:"
+	CacheTypeTemplate             = "template:"
 )
 
 //MaxTTL is the max possible TTL value (aprox 290 years)
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/CanadianCommander/MicroWeb/pkg/cache"
+	"github.com/CanadianCommander/MicroWeb/pkg/logger"
 )
 
 func TestCacheAdd(t *testing.T) {
@@ -93,3 +94,48 @@ func TestCacheRemoveByType(t *testing.T){
 		}
 	}
 }
+
+func TestCacheMemoryBudget(t *testing.T) {
+	logger.LogToStd(logger.VError)
+	cache.StartCache()
+	cache.UpdateCacheTTL(60 * time.Second)
+	cache.UpdateCacheMemoryBudget(100)
+	defer cache.UpdateCacheMemoryBudget(0)
+	cache.FlushCache()
+
+	newResource := func() *cache.Resource {
+		buff := make([]byte, 40)
+		return cache.NewResource(&buff, time.Now())
+	}
+
+	cache.AddToCache(cache.CacheTypeResource, "budget1", newResource())
+	cache.AddToCache(cache.CacheTypeResource, "budget2", newResource())
+	// make budget1 the most recently used
+	cache.FetchFromCache(cache.CacheTypeResource, "budget1")
+	cache.AddToCache(cache.CacheTypeResource, "budget3", newResource())
+
+	if cache.FetchFromCache(cache.CacheTypeResource, "budget2") != nil {
+		t.Errorf("budget2 (40 bytes, least recently used) not evicted, expected 80 of 100 bytes cached got %d", cachedResourceBytes())
+	}
+	for _, name := range []string{"budget1", "budget3"} {
+		if cache.FetchFromCache(cache.CacheTypeResource, name) == nil {
+			t.Errorf("%s (40 bytes) evicted, expected 80 of 100 bytes cached got %d", name, cachedResourceBytes())
+		}
+	}
+
+	// objects larger than the budget are never kept
+	buff := make([]byte, 200)
+	cache.AddToCache(cache.CacheTypeResource, "budgetHuge", cache.NewResource(&buff, time.Now()))
+	if cache.FetchFromCache(cache.CacheTypeResource, "budgetHuge") != nil {
+		t.Errorf("budgetHuge (200 bytes) kept with a budget of 100 bytes, %d bytes cached", cachedResourceBytes())
+	}
+}
+
+// cachedResourceBytes returns the total size of the resources in the cache
+func cachedResourceBytes() int64 {
+	var total int64
+	for _, object := range cache.FetchAllOfType(cache.CacheTypeResource) {
+		total += object.(*cache.Resource).CacheSize()
+	}
+	return total
+}
@@ -0,0 +1,67 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"time"
+
+	mwsettings "github.com/CanadianCommander/MicroWeb/pkg/mwSettings"
+)
+
+const (
+	// used when "tune/cacheMaxMB" is not set
+	defaultCacheMaxMB = 256
+	// used when "tune/streamThresholdMB" is not set
+	defaultStreamThresholdMB = 8
+)
+
+/*
+Resource is the cache entry of a file stored under CacheTypeResource. Along side the file contents it keeps
+the validators used for conditional requests, so that they are computed once per load instead of per request.
+*/
+type Resource struct {
+	Buffer  *[]byte
+	ModTime time.Time
+	// strong entity tag (RFC 7232) derived from the file contents, quotes included
+	ETag string
+}
+
+/*
+NewResource creates a resource cache entry for the file contents buff, last modified at modTime.
+*/
+func NewResource(buff *[]byte, modTime time.Time) *Resource {
+	hash := sha256.Sum256(*buff)
+	return &Resource{
+		Buffer:  buff,
+		ModTime: modTime,
+		ETag:    "\"" + hex.EncodeToString(hash[:16]) + "\"",
+	}
+}
+
+/*
+CacheSize returns the size of the file contents, so that resources count towards the cache memory budget.
+*/
+func (resource *Resource) CacheSize() int64 {
+	return int64(len(*resource.Buffer))
+}
+
+/*
+FileETag returns an entity tag for a file based on its modification time and size. It is used for
+large files (see IsLargeResource), which are not hashed as that would mean reading them in full.
+*/
+func FileETag(modTime time.Time, size int64) string {
+	return "\"" + strconv.FormatInt(modTime.UnixNano(), 16) + "-" + strconv.FormatInt(size, 16) + "\""
+}
+
+/*
+IsLargeResource returns true if a file of the given size is over "tune/streamThresholdMB". Large files are never
+cached, static files are streamed from disk instead of being read in to memory. A threshold of 0 disables streaming.
+*/
+func IsLargeResource(size int64) bool {
+	thresholdMB := int64(defaultStreamThresholdMB)
+	if mwsettings.HasSetting("tune/streamThresholdMB") {
+		thresholdMB = int64(mwsettings.GetSettingInt("tune/streamThresholdMB"))
+	}
+	return thresholdMB > 0 && size > thresholdMB*1024*1024
+}
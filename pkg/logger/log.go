@@ -153,6 +153,20 @@ func GetCurrentLogFile() *os.File {
 	return currLogFile
 }
 
+/*
+Flush commits any log output written to the current log file to stable storage.
+Call before exiting.
+*/
+func Flush() error {
+	logMutex.RLock()
+	defer logMutex.RUnlock()
+
+	if currLogFile != nil {
+		return currLogFile.Sync()
+	}
+	return nil
+}
+
 //nullWriter is simply a "fake" writer that does nothing.
 type nullWriter struct{}
 
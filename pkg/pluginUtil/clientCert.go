@@ -0,0 +1,45 @@
+package pluginUtil
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+/*
+ClientCertificate describes the verified TLS client certificate presented with a request.
+*/
+type ClientCertificate struct {
+	Subject        pkix.Name
+	CommonName     string
+	DNSNames       []string
+	EmailAddresses []string
+	IPAddresses    []net.IP
+	URIs           []*url.URL
+	// Certificate is the full leaf certificate
+	Certificate *x509.Certificate
+}
+
+/*
+GetClientCertificate returns the TLS client certificate presented with req. Only certificates verified
+against the configured client CA ("tls/clientCAFile") are returned, the server refuses to verify client
+certificates without one. If the client did not present a verified certificate (nil, false) is returned.
+*/
+func GetClientCertificate(req *http.Request) (*ClientCertificate, bool) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil, false
+	}
+
+	leaf := req.TLS.VerifiedChains[0][0]
+	return &ClientCertificate{
+		Subject:        leaf.Subject,
+		CommonName:     leaf.Subject.CommonName,
+		DNSNames:       leaf.DNSNames,
+		EmailAddresses: leaf.EmailAddresses,
+		IPAddresses:    leaf.IPAddresses,
+		URIs:           leaf.URIs,
+		Certificate:    leaf,
+	}, true
+}
@@ -0,0 +1,33 @@
+package pluginUtil
+
+import (
+	"net/http"
+)
+
+/*
+compressionDisabler is implemented by the response writer microweb hands to plugins when
+on-the-fly compression ("tune/compress") is enabled.
+*/
+type compressionDisabler interface {
+	DisableCompression()
+}
+
+/*
+DisableCompression opts the response written to res out of on-the-fly compression. It must be called
+before the first call to Write or WriteHeader. Responses that set a Content-Encoding header
+are never compressed either. If compression is not enabled this does nothing.
+*/
+func DisableCompression(res http.ResponseWriter) {
+	for res != nil {
+		if disabler, bOk := res.(compressionDisabler); bOk {
+			disabler.DisableCompression()
+			return
+		}
+
+		wrapper, bOk := res.(interface{ Unwrap() http.ResponseWriter })
+		if !bOk {
+			return
+		}
+		res = wrapper.Unwrap()
+	}
+}
@@ -0,0 +1,61 @@
+package pluginUtil
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+type requestIDKey struct{}
+
+/*
+ErrorRenderer writes an error response with the given status to res. detail is a human readable
+explanation of the error, it may be "".
+*/
+type ErrorRenderer func(res http.ResponseWriter, req *http.Request, status int, detail string)
+
+var errorRendererLock = sync.Mutex{}
+var errorRenderer ErrorRenderer
+
+/*
+SetErrorRenderer sets the function WriteError uses to render errors. microweb sets this on startup
+to render the configured error pages.
+*/
+func SetErrorRenderer(renderer ErrorRenderer) {
+	errorRendererLock.Lock()
+	defer errorRendererLock.Unlock()
+	errorRenderer = renderer
+}
+
+/*
+WriteError writes an error response the same way microweb does for its own errors. That is the error page
+configured for the status, or for API clients that ask for JSON, a RFC 7807 problem+json body.
+*/
+func WriteError(res http.ResponseWriter, req *http.Request, status int, detail string) {
+	errorRendererLock.Lock()
+	renderer := errorRenderer
+	errorRendererLock.Unlock()
+
+	if renderer == nil {
+		http.Error(res, strconv.Itoa(status)+" "+http.StatusText(status), status)
+		return
+	}
+	renderer(res, req, status, detail)
+}
+
+/*
+WithRequestID returns a copy of req carrying the given request ID, see GetRequestID.
+*/
+func WithRequestID(req *http.Request, requestID string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), requestIDKey{}, requestID))
+}
+
+/*
+GetRequestID returns the ID microweb assigned to req. The same ID is sent to the client
+in the X-Request-Id header and shown on error pages. "" if the request has no ID.
+*/
+func GetRequestID(req *http.Request) string {
+	requestID, _ := req.Context().Value(requestIDKey{}).(string)
+	return requestID
+}
@@ -2,51 +2,69 @@ package pluginUtil
 
 import (
 	"bufio"
+	"io"
 	"os"
 
 	"github.com/CanadianCommander/MicroWeb/pkg/cache"
 	"github.com/CanadianCommander/MicroWeb/pkg/logger"
 )
 
-const fileReadBufferSize = 0xFFFF //64 KB
-
 /*
 ReadFileToBuff reads the enter file found at fsPath in to a []byte buffer and returns it.
-If any thing goes wrong nil is returned.
+If any thing goes wrong nil is returned. Files over the stream threshold (see cache.IsLargeResource)
+are not read, nil is returned, they have to be streamed from disk instead (ex. with http.ServeContent).
 
 Note. This function uses the global cache provided by the,
 "github.com/CanadianCommander/MicroWeb/pkg/cache" package.
 */
 func ReadFileToBuff(fsPath string) *[]byte {
-	cacheBuffer := cache.FetchFromCache(cache.CacheTypeResource, fsPath)
-	if cacheBuffer != nil {
+	resource := ReadResource(fsPath)
+	if resource == nil {
+		return nil
+	}
+	return resource.Buffer
+}
+
+/*
+ReadResource is ReadFileToBuff but returns the whole resource cache entry, including the
+modification time and ETag of the file.
+*/
+func ReadResource(fsPath string) *cache.Resource {
+	cacheResource := cache.FetchFromCache(cache.CacheTypeResource, fsPath)
+	if cacheResource != nil {
 		//cache hit
 		logger.LogVerbose("Loading resource from cache: %s", fsPath)
-		return cacheBuffer.(*[]byte)
+		return cacheResource.(*cache.Resource)
 	}
 
 	//cache miss
 	logger.LogVerbose("Loading resource from file: %s", fsPath)
 	file, err := os.Open(fsPath)
-	defer file.Close()
 	if err != nil {
 		logger.LogError("Could not open resource file at: %s ", fsPath)
 		return nil
 	}
-	fileInfo, _ := file.Stat()
-	byteBuffer := make([]byte, fileInfo.Size())
+	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		logger.LogError("Could not stat resource file at: %s ", fsPath)
+		return nil
+	}
 
-	bytesOut := 1
-	byteBufferIndex := 0
-	for bytesOut != 0 {
-		var buff = make([]byte, fileReadBufferSize)
-		bytesOut, _ = file.Read(buff)
-		copy(byteBuffer[byteBufferIndex:], buff[:bytesOut])
-		byteBufferIndex += bytesOut
+	if cache.IsLargeResource(fileInfo.Size()) {
+		logger.LogError("Resource file at: %s is over the stream threshold, it must be streamed not read in to memory", fsPath)
+		return nil
+	}
+
+	byteBuffer := make([]byte, fileInfo.Size())
+	if _, err = io.ReadFull(file, byteBuffer); err != nil {
+		logger.LogError("Could not read resource file at: %s with error: %s", fsPath, err.Error())
+		return nil
 	}
 
-	cache.AddToCache(cache.CacheTypeResource, fsPath, (&byteBuffer))
-	return &byteBuffer
+	resource := cache.NewResource(&byteBuffer, fileInfo.ModTime())
+	cache.AddToCache(cache.CacheTypeResource, fsPath, resource)
+	return resource
 }
 
 /*
@@ -0,0 +1,181 @@
+package pluginUtil
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+SSEEvent is a Server-Sent Event. All fields are optional, but a event without Data is not dispatched by browsers.
+*/
+type SSEEvent struct {
+	// ID is remembered by the client and sent back in the Last-Event-ID header when it reconnects
+	ID string
+	// Event is the event type, "message" if empty
+	Event string
+	// Data may contain new lines ("\r\n", "\r" or "\n"), each line is sent as its own data field
+	Data string
+	// Retry tells the client how long to wait before reconnecting, 0 to leave it as is
+	Retry time.Duration
+}
+
+/*
+SSEWriter streams Server-Sent Events (text/event-stream) to a client. It is safe to use from multiple goroutines.
+The response is exempt from compression. Long lived streams need a plugin binding with a long (or no)
+"responseTimeout", or a call to SetResponseTimeout, else the servers response timeout cuts them off.
+The "timeout" in the "limits" of the plugin binding cuts them off too, leave it unset for plugins that stream events.
+*/
+type SSEWriter struct {
+	res http.ResponseWriter
+	req *http.Request
+
+	lock          sync.Mutex
+	bClosed       bool
+	bHeartbeat    bool
+	stopHeartbeat chan bool
+}
+
+/*
+NewSSEWriter starts a event stream on res. The response headers are sent immediately.
+An error is returned if the connection cannot stream. Callers must defer sse.Close(), so that
+nothing is written to the response after the handler returns.
+*/
+func NewSSEWriter(res http.ResponseWriter, req *http.Request) (*SSEWriter, error) {
+	DisableCompression(res)
+	header := res.Header()
+	header.Set("Content-Type", "text/event-stream; charset=utf-8")
+	header.Set("Cache-Control", "no-cache")
+	// stop buffering reverse proxies (nginx) from holding back events
+	header.Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+	if err := Flush(res); err != nil {
+		return nil, errors.New("response cannot be streamed: " + err.Error())
+	}
+
+	return &SSEWriter{res: res, req: req, stopHeartbeat: make(chan bool)}, nil
+}
+
+/*
+LastEventID returns the ID of the last event the client received before it reconnected, "" on the first connection.
+Streams resume by sending the events after it.
+*/
+func (sse *SSEWriter) LastEventID() string {
+	if lastID := sse.req.Header.Get("Last-Event-ID"); lastID != "" {
+		return lastID
+	}
+	// EventSource polyfills that cannot set headers send it as a query parameter
+	return sse.req.URL.Query().Get("lastEventId")
+}
+
+/*
+Send sends event to the client and flushes it.
+*/
+func (sse *SSEWriter) Send(event SSEEvent) error {
+	var message strings.Builder
+	if event.ID != "" {
+		message.WriteString("id: " + sseField(event.ID) + "\n")
+	}
+	if event.Event != "" {
+		message.WriteString("event: " + sseField(event.Event) + "\n")
+	}
+	if event.Retry > 0 {
+		message.WriteString("retry: " + strconv.FormatInt(int64(event.Retry/time.Millisecond), 10) + "\n")
+	}
+	for _, line := range strings.Split(sseLineEnds.Replace(event.Data), "\n") {
+		message.WriteString("data: " + line + "\n")
+	}
+	message.WriteString("\n")
+	return sse.write(message.String())
+}
+
+/*
+SendData sends a "message" event with data and no ID.
+*/
+func (sse *SSEWriter) SendData(data string) error {
+	return sse.Send(SSEEvent{Data: data})
+}
+
+/*
+Comment sends a comment, which clients ignore. Useful to keep the connection open.
+*/
+func (sse *SSEWriter) Comment(text string) error {
+	return sse.write(": " + sseField(text) + "\n\n")
+}
+
+/*
+StartHeartbeat sends a comment every interval until the stream is closed or the client goes away, so that idle
+streams are not dropped by proxies and broken connections are noticed. Only one heartbeat runs at a time.
+The heartbeat runs until Close even if the handler returned, so Close must be deferred in the handler.
+*/
+func (sse *SSEWriter) StartHeartbeat(interval time.Duration) {
+	sse.lock.Lock()
+	defer sse.lock.Unlock()
+	if sse.bHeartbeat || sse.bClosed {
+		return
+	}
+	sse.bHeartbeat = true
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				// the tick may race the client going away, do not write to a finished response
+				if sse.req.Context().Err() != nil || sse.Comment("heartbeat") != nil {
+					return
+				}
+			case <-sse.stopHeartbeat:
+				return
+			case <-sse.req.Context().Done():
+				return
+			}
+		}
+	}()
+}
+
+/*
+Done returns a channel that is closed when the client goes away.
+*/
+func (sse *SSEWriter) Done() <-chan struct{} {
+	return sse.req.Context().Done()
+}
+
+/*
+Close stops the heartbeat. Nothing is written once Close returns, the response ends when the plugin returns.
+*/
+func (sse *SSEWriter) Close() {
+	sse.lock.Lock()
+	defer sse.lock.Unlock()
+	if !sse.bClosed {
+		sse.bClosed = true
+		close(sse.stopHeartbeat)
+	}
+}
+
+func (sse *SSEWriter) write(message string) error {
+	sse.lock.Lock()
+	defer sse.lock.Unlock()
+	if sse.bClosed {
+		return errors.New("event stream is closed")
+	}
+	if err := sse.req.Context().Err(); err != nil {
+		return err
+	}
+	if _, err := sse.res.Write([]byte(message)); err != nil {
+		return err
+	}
+	return Flush(sse.res)
+}
+
+// sseLineEnds turns every line ending the event stream format knows into "\n"
+var sseLineEnds = strings.NewReplacer("\r\n", "\n", "\r", "\n")
+
+// sseField strips new lines, which would end the field
+func sseField(value string) string {
+	return strings.NewReplacer("\r", "", "\n", " ").Replace(value)
+}
@@ -0,0 +1,27 @@
+package pluginUtil
+
+import (
+	"net/http"
+	"time"
+)
+
+/*
+Flush sends everything written to res so far to the client. Plugins streaming a response call this after each
+chunk. An error is returned if the connection does not support flushing.
+*/
+func Flush(res http.ResponseWriter) error {
+	return http.NewResponseController(res).Flush()
+}
+
+/*
+SetResponseTimeout replaces the servers response timeout ("tune/httpResponseTimeout") for the response
+written to res. The response has to be complete within timeout from now, 0 removes the limit.
+Plugin bindings can set this in the config file with "responseTimeout", see the plugin settings.
+*/
+func SetResponseTimeout(res http.ResponseWriter, timeout time.Duration) error {
+	deadline := time.Time{}
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	return http.NewResponseController(res).SetWriteDeadline(deadline)
+}
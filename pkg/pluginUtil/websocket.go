@@ -0,0 +1,668 @@
+package pluginUtil
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	mwsettings "github.com/CanadianCommander/MicroWeb/pkg/mwSettings"
+)
+
+// WebSocket message types (frame opcodes), see RFC 6455 section 5.2
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+	CloseMessage  = 8
+	PingMessage   = 9
+	PongMessage   = 10
+
+	continuationFrame = 0
+)
+
+// WebSocket close codes, see RFC 6455 section 7.4.1
+const (
+	CloseNormalClosure           = 1000
+	CloseGoingAway               = 1001
+	CloseProtocolError           = 1002
+	CloseUnsupportedData         = 1003
+	CloseNoStatusReceived        = 1005
+	CloseAbnormalClosure         = 1006
+	CloseInvalidFramePayloadData = 1007
+	ClosePolicyViolation         = 1008
+	CloseMessageTooBig           = 1009
+	CloseInternalServerErr       = 1011
+)
+
+const (
+	// magic value the Sec-WebSocket-Accept header is derived from
+	webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	// largest payload of a control frame
+	maxControlPayload = 125
+
+	defaultWebSocketPingInterval = 30 * time.Second
+	defaultWebSocketIdleTimeout  = 60 * time.Second
+	defaultWebSocketWriteTimeout = 10 * time.Second
+	defaultWebSocketMaxMessageKB = 1024
+)
+
+/*
+ErrWebSocketClosed is returned when writing to a WebSocket connection after it has been closed.
+*/
+var ErrWebSocketClosed = errors.New("websocket connection is closed")
+
+/*
+CloseError is returned by ReadMessage when the connection is closed, either by the client (Code is the
+code the client sent) or because the client broke the protocol (Code is the code sent to the client).
+*/
+type CloseError struct {
+	Code int
+	Text string
+}
+
+func (closeErr *CloseError) Error() string {
+	return "websocket closed with code " + strconv.Itoa(closeErr.Code) + " " + closeErr.Text
+}
+
+/*
+AddWebSocketSettingDecoders adds setting decoders for the WebSocket settings in the "tune" section of the config file:
+	"webSocketPingInterval": "30s"  how often clients are pinged
+	"webSocketIdleTimeout":  "60s"  how long a connection may go without receiving anything (pongs included)
+	"webSocketWriteTimeout": "10s"  how long writing a single message may take
+	"webSocketMaxMessageKB": 1024   largest message accepted from clients
+	"webSocketAllowedOrigins": ["https://app.example.com"]  other origins browsers may connect from, see checkWebSocketOrigin
+*/
+func AddWebSocketSettingDecoders() {
+	webSocketSettings := []string{"tune/webSocketPingInterval", "tune/webSocketIdleTimeout", "tune/webSocketWriteTimeout",
+		"tune/webSocketMaxMessageKB", "tune/webSocketAllowedOrigins"}
+
+	for _, set := range webSocketSettings {
+		mwsettings.AddSettingDecoder(mwsettings.NewBasicDecoder(set))
+	}
+}
+
+// getDurationSetting returns the duration setting at settingPath or def if it is not set or malformed
+func getDurationSetting(settingPath string, def time.Duration) time.Duration {
+	if mwsettings.HasSetting(settingPath) {
+		if duration, err := time.ParseDuration(mwsettings.GetSettingString(settingPath)); err == nil {
+			return duration
+		}
+	}
+	return def
+}
+
+/*
+WebSocketConn is a server side RFC 6455 WebSocket connection, see UpgradeWebSocket. Control frames are
+handled for you: pings are answered, the client is pinged periodically and the closing handshake is completed.
+Only one goroutine may call ReadMessage at a time, and it has to be called for control frames to be processed.
+Writes are safe from any goroutine.
+
+The connection is exempt from the servers response timeout. Instead every read must arrive within the
+idle timeout and every write must complete within the write timeout, see SetIdleTimeout and SetWriteTimeout.
+*/
+type WebSocketConn struct {
+	// Request is the request that was upgraded
+	Request *http.Request
+	// Subprotocol is the subprotocol selected during the upgrade, "" if none
+	Subprotocol string
+
+	conn   net.Conn
+	reader *bufio.Reader
+
+	settingsLock sync.Mutex
+	idleTimeout  time.Duration
+	writeTimeout time.Duration
+	readLimit    int64
+	fragmentSize int
+
+	writeLock  sync.Mutex
+	bCloseSent bool
+
+	closeOnce sync.Once
+	done      chan bool
+}
+
+var (
+	openWebSocketsLock sync.Mutex
+	// every open connection, hijacked connections are not tracked by http.Server. see CloseAllWebSockets
+	openWebSockets = make(map[*WebSocketConn]bool)
+)
+
+/*
+IsWebSocketRequest returns true if req asks to be upgraded to a WebSocket connection.
+*/
+func IsWebSocketRequest(req *http.Request) bool {
+	if req.Method != http.MethodGet || !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, value := range req.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+UpgradeWebSocket completes the WebSocket handshake of req and takes over the connection. subprotocols are the
+subprotocols the plugin speaks in order of preference, the first one also offered by the client is selected.
+If the handshake fails, or the origin of the browser is not allowed (see checkWebSocketOrigin), an error response
+is written to res and an error returned. Plugins exporting HandleWebSocket do not need to call this, microweb does it for them.
+*/
+func UpgradeWebSocket(res http.ResponseWriter, req *http.Request, subprotocols ...string) (*WebSocketConn, error) {
+	if !IsWebSocketRequest(req) {
+		WriteError(res, req, http.StatusBadRequest, "not a websocket handshake")
+		return nil, errors.New("not a websocket handshake")
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		res.Header().Set("Sec-WebSocket-Version", "13")
+		WriteError(res, req, http.StatusUpgradeRequired, "unsupported websocket version")
+		return nil, errors.New("unsupported websocket version: " + req.Header.Get("Sec-WebSocket-Version"))
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if decodedKey, err := base64.StdEncoding.DecodeString(key); err != nil || len(decodedKey) != 16 {
+		WriteError(res, req, http.StatusBadRequest, "bad Sec-WebSocket-Key")
+		return nil, errors.New("bad Sec-WebSocket-Key")
+	}
+
+	if !checkWebSocketOrigin(req) {
+		WriteError(res, req, http.StatusForbidden, "websocket origin not allowed")
+		return nil, errors.New("websocket origin not allowed: " + req.Header.Get("Origin"))
+	}
+
+	selectedProtocol := selectSubprotocol(req, subprotocols)
+
+	conn, buffRW, err := http.NewResponseController(res).Hijack()
+	if err != nil {
+		WriteError(res, req, http.StatusInternalServerError, "")
+		return nil, err
+	}
+	// clear the deadlines of the server, the connection manages its own
+	conn.SetDeadline(time.Time{})
+
+	webSocket := &WebSocketConn{
+		Request:      req,
+		Subprotocol:  selectedProtocol,
+		conn:         conn,
+		reader:       buffRW.Reader,
+		idleTimeout:  getDurationSetting("tune/webSocketIdleTimeout", defaultWebSocketIdleTimeout),
+		writeTimeout: getDurationSetting("tune/webSocketWriteTimeout", defaultWebSocketWriteTimeout),
+		readLimit:    int64(defaultWebSocketMaxMessageKB) * 1024,
+		done:         make(chan bool),
+	}
+	if mwsettings.HasSetting("tune/webSocketMaxMessageKB") {
+		webSocket.readLimit = int64(mwsettings.GetSettingInt("tune/webSocketMaxMessageKB")) * 1024
+	}
+
+	response := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " +
+		webSocketAccept(key) + "\r\n"
+	if selectedProtocol != "" {
+		response += "Sec-WebSocket-Protocol: " + selectedProtocol + "\r\n"
+	}
+	if requestID := GetRequestID(req); requestID != "" {
+		response += "X-Request-Id: " + requestID + "\r\n"
+	}
+	if webSocket.writeTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(webSocket.writeTimeout))
+	}
+	if _, err = conn.Write([]byte(response + "\r\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	openWebSocketsLock.Lock()
+	openWebSockets[webSocket] = true
+	openWebSocketsLock.Unlock()
+
+	go webSocket.keepAlive(getDurationSetting("tune/webSocketPingInterval", defaultWebSocketPingInterval))
+	return webSocket, nil
+}
+
+/*
+checkWebSocketOrigin returns true if the browser that sent req may open a WebSocket, guarding against cross site
+WebSocket hijacking. Requests without an Origin header do not come from a browser and are allowed. Otherwise the origin
+has to be the host the request was sent to or be listed in "tune/webSocketAllowedOrigins", where "*" allows any origin.
+*/
+func checkWebSocketOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if originURL, err := url.Parse(origin); err == nil && strings.EqualFold(originURL.Host, req.Host) {
+		return true
+	}
+
+	if mwsettings.HasSetting("tune/webSocketAllowedOrigins") {
+		allowedList, _ := mwsettings.GetSetting("tune/webSocketAllowedOrigins").([]interface{})
+		for _, allowed := range allowedList {
+			if allowedOrigin, bOk := allowed.(string); bOk && (allowedOrigin == "*" || strings.EqualFold(strings.TrimSuffix(allowedOrigin, "/"), origin)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+CloseAllWebSockets closes every open WebSocket connection with CloseGoingAway. http.Server.Shutdown does not
+know about hijacked connections, so the server calls this when it shuts down.
+*/
+func CloseAllWebSockets() {
+	openWebSocketsLock.Lock()
+	connList := make([]*WebSocketConn, 0, len(openWebSockets))
+	for ws := range openWebSockets {
+		connList = append(connList, ws)
+	}
+	openWebSocketsLock.Unlock()
+
+	// each close may take up to the write timeout
+	var waitGroup sync.WaitGroup
+	for _, ws := range connList {
+		waitGroup.Add(1)
+		go func(ws *WebSocketConn) {
+			defer waitGroup.Done()
+			ws.Close(CloseGoingAway, "server shutting down")
+		}(ws)
+	}
+	waitGroup.Wait()
+}
+
+// webSocketAccept computes the Sec-WebSocket-Accept value for key
+func webSocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// selectSubprotocol returns the first of subprotocols the client offered, "" if none
+func selectSubprotocol(req *http.Request, subprotocols []string) string {
+	offered := make(map[string]bool)
+	for _, value := range req.Header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(value, ",") {
+			offered[strings.TrimSpace(protocol)] = true
+		}
+	}
+	for _, protocol := range subprotocols {
+		if offered[protocol] {
+			return protocol
+		}
+	}
+	return ""
+}
+
+/*
+SetIdleTimeout sets how long the connection may go without receiving a frame. 0 disables the timeout.
+*/
+func (ws *WebSocketConn) SetIdleTimeout(timeout time.Duration) {
+	ws.settingsLock.Lock()
+	defer ws.settingsLock.Unlock()
+	ws.idleTimeout = timeout
+}
+
+/*
+SetWriteTimeout sets how long writing a single message may take. 0 disables the timeout.
+*/
+func (ws *WebSocketConn) SetWriteTimeout(timeout time.Duration) {
+	ws.settingsLock.Lock()
+	defer ws.settingsLock.Unlock()
+	ws.writeTimeout = timeout
+}
+
+/*
+SetReadLimit sets the size of the largest message accepted from the client. Larger messages close the
+connection with CloseMessageTooBig.
+*/
+func (ws *WebSocketConn) SetReadLimit(limit int64) {
+	ws.settingsLock.Lock()
+	defer ws.settingsLock.Unlock()
+	ws.readLimit = limit
+}
+
+/*
+SetWriteFragmentSize makes WriteMessage split messages larger than size bytes in to fragments. 0 (the default)
+sends every message as a single frame.
+*/
+func (ws *WebSocketConn) SetWriteFragmentSize(size int) {
+	ws.settingsLock.Lock()
+	defer ws.settingsLock.Unlock()
+	ws.fragmentSize = size
+}
+
+/*
+Done returns a channel that is closed once the connection is closed.
+*/
+func (ws *WebSocketConn) Done() <-chan bool {
+	return ws.done
+}
+
+/*
+ReadMessage reads the next text or binary message, reassembling fragmented messages. Text messages are
+checked to be valid UTF-8. When the connection closes a *CloseError is returned (or the network error if
+the connection broke), after which the connection can no longer be used.
+*/
+func (ws *WebSocketConn) ReadMessage() (int, []byte, error) {
+	messageType := 0
+	var message []byte
+
+	for {
+		ws.settingsLock.Lock()
+		readLimit := ws.readLimit
+		ws.settingsLock.Unlock()
+
+		bFin, opcode, payload, err := ws.readFrame(readLimit - int64(len(message)))
+		if err != nil {
+			return 0, nil, ws.fail(err)
+		}
+
+		switch opcode {
+		case PingMessage:
+			if err = ws.writeControl(PongMessage, payload); err != nil {
+				return 0, nil, ws.fail(err)
+			}
+			continue
+		case PongMessage:
+			continue
+		case CloseMessage:
+			return 0, nil, ws.handleClose(payload)
+		case TextMessage, BinaryMessage:
+			if messageType != 0 {
+				return 0, nil, ws.fail(&CloseError{CloseProtocolError, "new message before the last was finished"})
+			}
+			messageType = opcode
+			message = payload
+		case continuationFrame:
+			if messageType == 0 {
+				return 0, nil, ws.fail(&CloseError{CloseProtocolError, "continuation frame without a message"})
+			}
+			message = append(message, payload...)
+		default:
+			return 0, nil, ws.fail(&CloseError{CloseProtocolError, "unknown opcode " + strconv.Itoa(opcode)})
+		}
+
+		if bFin {
+			if messageType == TextMessage && !utf8.Valid(message) {
+				return 0, nil, ws.fail(&CloseError{CloseInvalidFramePayloadData, "text message is not valid UTF-8"})
+			}
+			return messageType, message, nil
+		}
+	}
+}
+
+// readFrame reads one frame from the client, allowing a payload of at most limit bytes for data frames
+func (ws *WebSocketConn) readFrame(limit int64) (bool, int, []byte, error) {
+	ws.settingsLock.Lock()
+	idleTimeout := ws.idleTimeout
+	ws.settingsLock.Unlock()
+	if idleTimeout > 0 {
+		ws.conn.SetReadDeadline(time.Now().Add(idleTimeout))
+	} else {
+		ws.conn.SetReadDeadline(time.Time{})
+	}
+
+	var header [2]byte
+	if _, err := io.ReadFull(ws.reader, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	bFin := header[0]&0x80 != 0
+	opcode := int(header[0] & 0x0f)
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, &CloseError{CloseProtocolError, "reserved bits set without an extension"}
+	}
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, &CloseError{CloseProtocolError, "client frames must be masked"}
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(ws.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(ws.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+		if length>>63 != 0 {
+			return false, 0, nil, &CloseError{CloseProtocolError, "bad frame length"}
+		}
+	}
+
+	if limit < 0 {
+		limit = 0
+	}
+	if opcode >= CloseMessage {
+		if !bFin || length > maxControlPayload {
+			return false, 0, nil, &CloseError{CloseProtocolError, "control frames must not be fragmented or longer than 125 bytes"}
+		}
+	} else if length > uint64(limit) {
+		return false, 0, nil, &CloseError{CloseMessageTooBig, "message too big"}
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(ws.reader, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(ws.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return bFin, opcode, payload, nil
+}
+
+// handleClose completes a closing handshake started by the client
+func (ws *WebSocketConn) handleClose(payload []byte) error {
+	closeErr := &CloseError{Code: CloseNoStatusReceived}
+	switch {
+	case len(payload) == 1:
+		return ws.fail(&CloseError{CloseProtocolError, "bad close frame"})
+	case len(payload) >= 2:
+		closeErr.Code = int(binary.BigEndian.Uint16(payload))
+		closeErr.Text = string(payload[2:])
+		if !isValidCloseCode(closeErr.Code) {
+			return ws.fail(&CloseError{CloseProtocolError, "bad close code " + strconv.Itoa(closeErr.Code)})
+		}
+		if !utf8.Valid(payload[2:]) {
+			return ws.fail(&CloseError{CloseInvalidFramePayloadData, "close reason is not valid UTF-8"})
+		}
+	}
+
+	// echo the code back, an empty close frame if the client did not send one
+	var reply []byte
+	if closeErr.Code != CloseNoStatusReceived {
+		reply = payload[:2]
+	}
+	ws.writeClose(reply)
+	ws.closeConn()
+	return closeErr
+}
+
+// isValidCloseCode returns true if code may be sent in a close frame
+func isValidCloseCode(code int) bool {
+	return (code >= 1000 && code <= 1003) || (code >= 1007 && code <= 1011) || (code >= 3000 && code <= 4999)
+}
+
+// fail closes the connection because of err. Protocol errors are reported to the client with there close code
+func (ws *WebSocketConn) fail(err error) error {
+	var closeErr *CloseError
+	if errors.As(err, &closeErr) {
+		ws.writeClose(closePayload(closeErr.Code, closeErr.Text))
+	}
+	ws.closeConn()
+	return err
+}
+
+/*
+WriteMessage sends a text or binary message, split in to fragments if SetWriteFragmentSize has been set.
+*/
+func (ws *WebSocketConn) WriteMessage(messageType int, data []byte) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return errors.New("messageType must be TextMessage or BinaryMessage")
+	}
+	ws.settingsLock.Lock()
+	fragmentSize := ws.fragmentSize
+	ws.settingsLock.Unlock()
+	if fragmentSize <= 0 {
+		fragmentSize = len(data)
+	}
+
+	ws.writeLock.Lock()
+	defer ws.writeLock.Unlock()
+	if ws.bCloseSent {
+		return ErrWebSocketClosed
+	}
+
+	opcode := messageType
+	for {
+		fragment := data
+		if len(fragment) > fragmentSize {
+			fragment = data[:fragmentSize]
+		}
+		data = data[len(fragment):]
+		if err := ws.writeFrame(len(data) == 0, opcode, fragment); err != nil {
+			return err
+		}
+		if len(data) == 0 {
+			return nil
+		}
+		opcode = continuationFrame
+	}
+}
+
+/*
+Ping sends a ping with the given payload (at most 125 bytes). The client answers with a pong.
+*/
+func (ws *WebSocketConn) Ping(data []byte) error {
+	return ws.writeControl(PingMessage, data)
+}
+
+/*
+Close sends a close frame with code and reason and closes the connection. Closing an already closed connection does nothing.
+*/
+func (ws *WebSocketConn) Close(code int, reason string) error {
+	err := ws.writeClose(closePayload(code, reason))
+	ws.closeConn()
+	if err == ErrWebSocketClosed {
+		return nil
+	}
+	return err
+}
+
+// closePayload builds the payload of a close frame, cutting reason to fit in a control frame
+func closePayload(code int, reason string) []byte {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	if len(payload) > maxControlPayload {
+		payload = payload[:maxControlPayload]
+	}
+	return payload
+}
+
+// writeClose sends a close frame, unless one has been sent already. Nothing can be written after it
+func (ws *WebSocketConn) writeClose(payload []byte) error {
+	ws.writeLock.Lock()
+	defer ws.writeLock.Unlock()
+	if ws.bCloseSent {
+		return ErrWebSocketClosed
+	}
+	ws.bCloseSent = true
+	return ws.writeFrame(true, CloseMessage, payload)
+}
+
+// writeControl sends a ping or pong frame
+func (ws *WebSocketConn) writeControl(opcode int, payload []byte) error {
+	if len(payload) > maxControlPayload {
+		return errors.New("control frame payload longer than 125 bytes")
+	}
+	ws.writeLock.Lock()
+	defer ws.writeLock.Unlock()
+	if ws.bCloseSent {
+		return ErrWebSocketClosed
+	}
+	return ws.writeFrame(true, opcode, payload)
+}
+
+// writeFrame writes a single unmasked frame. The caller must hold writeLock
+func (ws *WebSocketConn) writeFrame(bFin bool, opcode int, payload []byte) error {
+	frame := make([]byte, 0, 10+len(payload))
+	firstByte := byte(opcode)
+	if bFin {
+		firstByte |= 0x80
+	}
+	frame = append(frame, firstByte)
+
+	switch length := len(payload); {
+	case length <= 125:
+		frame = append(frame, byte(length))
+	case length <= 0xffff:
+		frame = append(frame, 126, byte(length>>8), byte(length))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(length))
+	}
+	frame = append(frame, payload...)
+
+	ws.settingsLock.Lock()
+	writeTimeout := ws.writeTimeout
+	ws.settingsLock.Unlock()
+	if writeTimeout > 0 {
+		ws.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	} else {
+		ws.conn.SetWriteDeadline(time.Time{})
+	}
+	_, err := ws.conn.Write(frame)
+	return err
+}
+
+// closeConn closes the network connection and stops the keep alive
+func (ws *WebSocketConn) closeConn() {
+	ws.closeOnce.Do(func() {
+		ws.writeLock.Lock()
+		ws.bCloseSent = true
+		ws.writeLock.Unlock()
+		close(ws.done)
+		ws.conn.Close()
+
+		openWebSocketsLock.Lock()
+		delete(openWebSockets, ws)
+		openWebSocketsLock.Unlock()
+	})
+}
+
+// keepAlive pings the client every interval until the connection is closed
+func (ws *WebSocketConn) keepAlive(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := ws.Ping(nil); err != nil {
+				return
+			}
+		case <-ws.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package pluginUtil
+
+import (
+	"sync"
+)
+
+/*
+WebSocketHub is a set of WebSocket connections messages can be broadcast to, ex. the members of a chat room.
+Connections leave the hub on there own when they close.
+*/
+type WebSocketHub struct {
+	lock  sync.RWMutex
+	conns map[*WebSocketConn]bool
+}
+
+/*
+NewWebSocketHub creates an empty hub.
+*/
+func NewWebSocketHub() *WebSocketHub {
+	return &WebSocketHub{conns: make(map[*WebSocketConn]bool)}
+}
+
+/*
+Join adds conn to the hub.
+*/
+func (hub *WebSocketHub) Join(conn *WebSocketConn) {
+	hub.lock.Lock()
+	if hub.conns[conn] {
+		hub.lock.Unlock()
+		return
+	}
+	hub.conns[conn] = true
+	hub.lock.Unlock()
+
+	go func() {
+		<-conn.Done()
+		hub.Leave(conn)
+	}()
+}
+
+/*
+Leave removes conn from the hub.
+*/
+func (hub *WebSocketHub) Leave(conn *WebSocketConn) {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	delete(hub.conns, conn)
+}
+
+/*
+Count returns the number of connections in the hub.
+*/
+func (hub *WebSocketHub) Count() int {
+	hub.lock.RLock()
+	defer hub.lock.RUnlock()
+	return len(hub.conns)
+}
+
+/*
+Broadcast sends a message to every connection in the hub except those listed in except, ex. the sender.
+Connections are written to in parallel so a slow client only delays the broadcast by up to its write timeout.
+Connections that cannot be written to are closed. The number of connections the message was sent to is returned.
+*/
+func (hub *WebSocketHub) Broadcast(messageType int, data []byte, except ...*WebSocketConn) int {
+	excluded := make(map[*WebSocketConn]bool, len(except))
+	for _, conn := range except {
+		excluded[conn] = true
+	}
+
+	hub.lock.RLock()
+	targets := make([]*WebSocketConn, 0, len(hub.conns))
+	for conn := range hub.conns {
+		if !excluded[conn] {
+			targets = append(targets, conn)
+		}
+	}
+	hub.lock.RUnlock()
+
+	sent := 0
+	var sentLock sync.Mutex
+	var waitGroup sync.WaitGroup
+	for _, conn := range targets {
+		waitGroup.Add(1)
+		go func(conn *WebSocketConn) {
+			defer waitGroup.Done()
+			if err := conn.WriteMessage(messageType, data); err != nil {
+				conn.Close(CloseGoingAway, "")
+				return
+			}
+			sentLock.Lock()
+			sent++
+			sentLock.Unlock()
+		}(conn)
+	}
+	waitGroup.Wait()
+	return sent
+}
+
+/*
+CloseAll closes every connection in the hub with the given code and reason.
+*/
+func (hub *WebSocketHub) CloseAll(code int, reason string) {
+	hub.lock.RLock()
+	targets := make([]*WebSocketConn, 0, len(hub.conns))
+	for conn := range hub.conns {
+		targets = append(targets, conn)
+	}
+	hub.lock.RUnlock()
+
+	for _, conn := range targets {
+		conn.Close(code, reason)
+	}
+}
@@ -0,0 +1,54 @@
+package processPlugin
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestServeConn(t *testing.T) {
+	serverReader, pluginWriter := io.Pipe()
+	pluginReader, serverWriter := io.Pipe()
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- ServeConn(pluginReader, pluginWriter, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/panic" {
+				panic("test panic")
+			}
+			body, _ := ioutil.ReadAll(req.Body)
+			res.Header().Set("X-Host", req.Host)
+			res.WriteHeader(http.StatusAccepted)
+			fmt.Fprintf(res, "%s %s %s %s", req.Method, req.URL.RequestURI(), req.Header.Get("X-Test"), string(body))
+		}))
+	}()
+
+	frame, err := ReadFrame(serverReader)
+	if err != nil || frame.Type != FrameReady || frame.Protocol != ProtocolVersion {
+		fmt.Printf("expected ready frame got: %v error: %v\n", frame, err)
+		t.FailNow()
+	}
+
+	WriteFrame(serverWriter, &Frame{Type: FrameRequest, ID: 1, Method: "POST", URL: "/foo?a=b", Host: "example.com",
+		Header: http.Header{"X-Test": []string{"header"}}, Body: []byte("body")})
+	frame, err = ReadFrame(serverReader)
+	if err != nil || frame.Type != FrameResponse || frame.ID != 1 || frame.Status != http.StatusAccepted ||
+		frame.Header.Get("X-Host") != "example.com" || string(frame.Body) != "POST /foo?a=b header body" {
+		fmt.Printf("bad response frame: %+v error: %v\n", frame, err)
+		t.Fail()
+	}
+
+	WriteFrame(serverWriter, &Frame{Type: FrameRequest, ID: 2, Method: "GET", URL: "/panic"})
+	frame, err = ReadFrame(serverReader)
+	if err != nil || frame.ID != 2 || frame.Status != http.StatusInternalServerError {
+		fmt.Printf("expected 500 on panic got: %+v error: %v\n", frame, err)
+		t.Fail()
+	}
+
+	serverWriter.Close()
+	if err = <-serveErr; err != nil {
+		fmt.Printf("ServeConn returned error: %s\n", err.Error())
+		t.Fail()
+	}
+}
@@ -0,0 +1,114 @@
+/*
+Package processPlugin implements the protocol spoken between MicroWeb and out-of-process plugins.
+An out-of-process plugin is a program the server runs as a child process. Unlike .so plugins it does not have
+to be built with the servers toolchain, or even in Go, and when it crashes only the plugin is restarted.
+
+The server and the plugin exchange frames over the plugins stdin (server to plugin) and stdout (plugin to server).
+Anything the plugin writes to stderr ends up in the server log. Each frame is a 4 byte big endian length followed by
+that many bytes of JSON, see Frame. The exchange goes:
+
+	plugin -> server	{"type": "ready", "protocol": 1}
+	server -> plugin	{"type": "request", "id": 1, "method": "GET", "url": "/ext/foo?a=b", "header": {...}, "body": "<base64>", ...}
+	plugin -> server	{"type": "response", "id": 1, "status": 200, "header": {...}, "body": "<base64>"}
+	server -> plugin	{"type": "cancel", "id": 2}
+
+The plugin sends "ready" once it can take requests. Requests are numbered and may be in-flight concurrently,
+responses can be sent in any order. A "cancel" means the client went away, no response to it is expected.
+The server closes the plugins stdin when it wants the plugin to exit.
+
+Go plugins need only call Serve with an http.Handler.
+*/
+package processPlugin
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+)
+
+//ProtocolVersion is the version of the protocol implemented by this package
+const ProtocolVersion = 1
+
+//frame types
+const (
+	FrameReady    = "ready"
+	FrameRequest  = "request"
+	FrameResponse = "response"
+	FrameCancel   = "cancel"
+)
+
+//MaxFrameSize is the largest frame, in bytes, that will be read
+const MaxFrameSize = 64 * 1024 * 1024
+
+//ErrFrameTooLarge is returned by ReadFrame for frames larger than MaxFrameSize
+var ErrFrameTooLarge = errors.New("frame too large")
+
+/*
+Frame is the unit of exchange between the server and a plugin. Which fields are set depends on Type.
+*/
+type Frame struct {
+	Type string `json:"type"`
+	// request id, set in request, response and cancel frames
+	ID uint64 `json:"id,omitempty"`
+	// ready frames
+	Protocol int `json:"protocol,omitempty"`
+
+	// request frames
+	Method     string `json:"method,omitempty"`
+	URL        string `json:"url,omitempty"`
+	Proto      string `json:"proto,omitempty"`
+	Host       string `json:"host,omitempty"`
+	RemoteAddr string `json:"remoteAddr,omitempty"`
+	RequestID  string `json:"requestId,omitempty"`
+
+	// response frames
+	Status int `json:"status,omitempty"`
+
+	// request and response frames
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"body,omitempty"`
+}
+
+/*
+ReadFrame reads one frame from reader.
+*/
+func ReadFrame(reader io.Reader) (*Frame, error) {
+	var length uint32
+	if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if length > MaxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+
+	buffer := make([]byte, length)
+	if _, err := io.ReadFull(reader, buffer); err != nil {
+		return nil, err
+	}
+	frame := &Frame{}
+	if err := json.Unmarshal(buffer, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+/*
+WriteFrame writes frame to writer in a single write. Writers shared between goroutines must be locked by the caller.
+*/
+func WriteFrame(writer io.Writer, frame *Frame) error {
+	payload, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+	if len(payload) > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+
+	buffer := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(buffer, uint32(len(payload)))
+	copy(buffer[4:], payload)
+	_, err = writer.Write(buffer)
+	return err
+}
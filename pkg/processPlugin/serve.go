@@ -0,0 +1,141 @@
+package processPlugin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"sync"
+)
+
+/*
+Serve runs handler as an out-of-process plugin on stdin and stdout, see ServeConn.
+It returns once the server closes stdin. Nothing else may be written to stdout, log to stderr instead.
+*/
+func Serve(handler http.Handler) error {
+	return ServeConn(os.Stdin, os.Stdout, handler)
+}
+
+/*
+ServeConn sends a ready frame to writer and then answers each request frame read from reader by calling handler
+on its own goroutine. The request context is canceled when the server sends a cancel frame. A panic in handler
+results in a 500 response. The full response is buffered and sent when handler returns.
+Returns nil once reader reaches EOF and all requests have been answered.
+*/
+func ServeConn(reader io.Reader, writer io.Writer, handler http.Handler) error {
+	var writeLock sync.Mutex
+	writeFrame := func(frame *Frame) error {
+		writeLock.Lock()
+		defer writeLock.Unlock()
+		return WriteFrame(writer, frame)
+	}
+	if err := writeFrame(&Frame{Type: FrameReady, Protocol: ProtocolVersion}); err != nil {
+		return err
+	}
+
+	var cancelLock sync.Mutex
+	cancelFuncs := make(map[uint64]context.CancelFunc)
+	var waitGroup sync.WaitGroup
+	defer waitGroup.Wait()
+
+	for {
+		frame, err := ReadFrame(reader)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		switch frame.Type {
+		case FrameRequest:
+			ctx, cancel := context.WithCancel(context.Background())
+			cancelLock.Lock()
+			cancelFuncs[frame.ID] = cancel
+			cancelLock.Unlock()
+
+			waitGroup.Add(1)
+			go func(frame *Frame) {
+				defer waitGroup.Done()
+				response := serveFrame(ctx, frame, handler)
+				cancelLock.Lock()
+				delete(cancelFuncs, frame.ID)
+				cancelLock.Unlock()
+				cancel()
+
+				// the server drops responses to canceled requests
+				if wErr := writeFrame(response); wErr != nil {
+					fmt.Fprintf(os.Stderr, "could not send response to request %d: %s\n", frame.ID, wErr.Error())
+				}
+			}(frame)
+		case FrameCancel:
+			cancelLock.Lock()
+			if cancel, bOk := cancelFuncs[frame.ID]; bOk {
+				cancel()
+			}
+			cancelLock.Unlock()
+		}
+	}
+}
+
+// serveFrame calls handler with the request in frame and returns the response frame
+func serveFrame(ctx context.Context, frame *Frame, handler http.Handler) (response *Frame) {
+	recorder := newResponseRecorder()
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "panic serving %s: %v\n%s", frame.URL, r, debug.Stack())
+			response = &Frame{Type: FrameResponse, ID: frame.ID, Status: http.StatusInternalServerError}
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, frame.Method, frame.URL, bytes.NewReader(frame.Body))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bad request frame %d: %s\n", frame.ID, err.Error())
+		return &Frame{Type: FrameResponse, ID: frame.ID, Status: http.StatusBadRequest}
+	}
+	if frame.Header != nil {
+		req.Header = frame.Header
+	}
+	if frame.Proto != "" {
+		if major, minor, bOk := http.ParseHTTPVersion(frame.Proto); bOk {
+			req.Proto, req.ProtoMajor, req.ProtoMinor = frame.Proto, major, minor
+		}
+	}
+	req.Host = frame.Host
+	req.RemoteAddr = frame.RemoteAddr
+	req.RequestURI = frame.URL
+	req.ContentLength = int64(len(frame.Body))
+
+	handler.ServeHTTP(recorder, req)
+	return &Frame{Type: FrameResponse, ID: frame.ID, Status: recorder.status, Header: recorder.header, Body: recorder.body.Bytes()}
+}
+
+// responseRecorder is the http.ResponseWriter handed to plugin handlers, it buffers the whole response
+type responseRecorder struct {
+	header     http.Header
+	status     int
+	bWroteHead bool
+	body       bytes.Buffer
+}
+
+func newResponseRecorder() *responseRecorder {
+	return &responseRecorder{header: make(http.Header), status: http.StatusOK}
+}
+
+func (recorder *responseRecorder) Header() http.Header {
+	return recorder.header
+}
+
+func (recorder *responseRecorder) WriteHeader(status int) {
+	if !recorder.bWroteHead {
+		recorder.status = status
+		recorder.bWroteHead = true
+	}
+}
+
+func (recorder *responseRecorder) Write(data []byte) (int, error) {
+	recorder.bWroteHead = true
+	return recorder.body.Write(data)
+}
@@ -0,0 +1,398 @@
+package route
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"runtime/debug"
+	"sort"
+	"strings"
+
+	"github.com/CanadianCommander/MicroWeb/pkg/logger"
+)
+
+const (
+	jsonRPCVersion = "2.0"
+	//max size of a JSON-RPC POST body
+	jsonRPCMaxBodySize = 0xA00000 //10 MB
+)
+
+//JSON-RPC 2.0 error codes
+const (
+	RPCParseError     = -32700
+	RPCInvalidRequest = -32600
+	RPCMethodNotFound = -32601
+	RPCInvalidParams  = -32602
+	RPCInternalError  = -32603
+	//RPCServerError is used when a method returns an error that is not an *RPCError
+	RPCServerError = -32000
+)
+
+var (
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+	requestType = reflect.TypeOf((*http.Request)(nil))
+)
+
+/*
+RPCError is a JSON-RPC error object. Methods called in JSON-RPC mode may return an *RPCError
+to control the error code and data sent to the client. Any other error is sent with code RPCServerError.
+*/
+type RPCError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (rpcErr *RPCError) Error() string {
+	return rpcErr.Message
+}
+
+/*
+RPCMethodDescription describes a method exposed by a MethodRouter in JSON-RPC mode.
+Params and Result describe the JSON structure of the method argument / return value.
+*/
+type RPCMethodDescription struct {
+	Name   string      `json:"name"`
+	Params interface{} `json:"params,omitempty"`
+	Result interface{} `json:"result,omitempty"`
+}
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// rpcMethod is a target method that can be called in JSON-RPC mode
+type rpcMethod struct {
+	method       reflect.Value
+	takesRequest bool
+	paramType    reflect.Type
+	resultType   reflect.Type
+}
+
+/*
+routeJSONRPC handles a request in JSON-RPC mode. POST requests carry a JSON-RPC 2.0 call or batch of calls.
+GET requests return a listing of the callable methods (see RPCMethods). Target methods must be exported
+and have the form:
+	func (t *T) Name([req *http.Request,] [params P]) ([R,] error)
+where P is decoded from the call params and R is marshaled in to the call result. Positional params
+containing a single value are unwrapped before being decoded in to P.
+The request is always fully handled, so false is returned to stop propagation.
+*/
+func (mrouter *MethodRouter) routeJSONRPC(req *http.Request, res http.ResponseWriter) bool {
+	switch req.Method {
+	case http.MethodPost:
+	case http.MethodGet, http.MethodHead:
+		writeJSON(res, mrouter.RPCMethods())
+		return false
+	default:
+		res.Header().Set("Allow", "GET, HEAD, POST")
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return false
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(res, req.Body, jsonRPCMaxBodySize))
+	if err != nil {
+		logger.LogWarning("failed to read JSON-RPC request body with error: %s", err.Error())
+		writeJSON(res, rpcErrorResponse(nil, &RPCError{Code: RPCParseError, Message: "could not read request body"}))
+		return false
+	}
+
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(body, &batch); err != nil {
+			writeJSON(res, rpcErrorResponse(nil, &RPCError{Code: RPCParseError, Message: err.Error()}))
+			return false
+		}
+		if len(batch) == 0 {
+			writeJSON(res, rpcErrorResponse(nil, &RPCError{Code: RPCInvalidRequest, Message: "empty batch"}))
+			return false
+		}
+
+		responses := make([]interface{}, 0, len(batch))
+		for _, call := range batch {
+			if response := mrouter.callJSONRPC(req, call); response != nil {
+				responses = append(responses, response)
+			}
+		}
+
+		if len(responses) == 0 {
+			// batch of notifications
+			res.WriteHeader(http.StatusNoContent)
+		} else {
+			writeJSON(res, responses)
+		}
+		return false
+	}
+
+	if response := mrouter.callJSONRPC(req, body); response != nil {
+		writeJSON(res, response)
+	} else {
+		res.WriteHeader(http.StatusNoContent)
+	}
+	return false
+}
+
+/*
+callJSONRPC performs a single JSON-RPC call and returns the response object.
+nil is returned if the call is a notification.
+*/
+func (mrouter *MethodRouter) callJSONRPC(req *http.Request, rawCall json.RawMessage) map[string]interface{} {
+	var call rpcRequest
+	if err := json.Unmarshal(rawCall, &call); err != nil {
+		if _, bSyntax := err.(*json.SyntaxError); bSyntax {
+			return rpcErrorResponse(nil, &RPCError{Code: RPCParseError, Message: err.Error()})
+		}
+		return rpcErrorResponse(nil, &RPCError{Code: RPCInvalidRequest, Message: err.Error()})
+	}
+
+	bNotification := len(call.ID) == 0
+	if call.JSONRPC != jsonRPCVersion || call.Method == "" || !validRPCID(call.ID) {
+		return rpcErrorResponse(nil, &RPCError{Code: RPCInvalidRequest, Message: "invalid JSON-RPC 2.0 request"})
+	}
+
+	method, bOk := mrouter.lookupRPCMethod(call.Method)
+	if !bOk {
+		if bNotification {
+			return nil
+		}
+		return rpcErrorResponse(call.ID, &RPCError{Code: RPCMethodNotFound, Message: "method not found: " + call.Method})
+	}
+
+	result, rpcErr := method.call(req, call.Params)
+	if bNotification {
+		return nil
+	}
+	if rpcErr != nil {
+		return rpcErrorResponse(call.ID, rpcErr)
+	}
+	return map[string]interface{}{"jsonrpc": jsonRPCVersion, "result": result, "id": call.ID}
+}
+
+/*
+RPCMethods returns a description of every target method callable in JSON-RPC mode, sorted by name.
+*/
+func (mrouter *MethodRouter) RPCMethods() []RPCMethodDescription {
+	var out []RPCMethodDescription
+	targetValue := reflect.ValueOf(mrouter.target)
+
+	for i := 0; i < targetValue.NumMethod(); i++ {
+		name := targetValue.Type().Method(i).Name
+		method, bOk := newRPCMethod(targetValue.Method(i))
+		if !bOk {
+			continue
+		}
+
+		description := RPCMethodDescription{Name: name}
+		if method.paramType != nil {
+			description.Params = describeJSONType(method.paramType, map[reflect.Type]bool{})
+		}
+		if method.resultType != nil {
+			description.Result = describeJSONType(method.resultType, map[reflect.Type]bool{})
+		}
+		out = append(out, description)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+func (mrouter *MethodRouter) lookupRPCMethod(name string) (*rpcMethod, bool) {
+	methodValue := reflect.ValueOf(mrouter.target).MethodByName(name)
+	if !methodValue.IsValid() {
+		return nil, false
+	}
+	return newRPCMethod(methodValue)
+}
+
+// newRPCMethod checks that method has a JSON-RPC compatible signature and wraps it.
+func newRPCMethod(method reflect.Value) (*rpcMethod, bool) {
+	methodType := method.Type()
+	rMethod := &rpcMethod{method: method}
+
+	numIn := methodType.NumIn()
+	argIndex := 0
+	if numIn > 0 && methodType.In(0) == requestType {
+		rMethod.takesRequest = true
+		argIndex++
+	}
+	if numIn-argIndex > 1 {
+		return nil, false
+	}
+	if numIn-argIndex == 1 {
+		rMethod.paramType = methodType.In(argIndex)
+	}
+
+	switch methodType.NumOut() {
+	case 1:
+	case 2:
+		rMethod.resultType = methodType.Out(0)
+	default:
+		return nil, false
+	}
+	if methodType.Out(methodType.NumOut()-1) != errorType {
+		return nil, false
+	}
+
+	return rMethod, true
+}
+
+/*
+call decodes params and calls the method, returning the result or an error. A panicking method gets
+a RPCInternalError, so that the other calls of a batch are still answered.
+*/
+func (method *rpcMethod) call(req *http.Request, params json.RawMessage) (result interface{}, rpcErr *RPCError) {
+	var args []reflect.Value
+	if method.takesRequest {
+		args = append(args, reflect.ValueOf(req))
+	}
+
+	if method.paramType != nil {
+		param, err := decodeRPCParams(params, method.paramType)
+		if err != nil {
+			return nil, &RPCError{Code: RPCInvalidParams, Message: err.Error()}
+		}
+		args = append(args, param)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			if r == http.ErrAbortHandler {
+				panic(r)
+			}
+			logger.LogError("JSON-RPC method panicked: %v\n%s", r, string(debug.Stack()))
+			result, rpcErr = nil, &RPCError{Code: RPCInternalError, Message: "internal error"}
+		}
+	}()
+	results := method.method.Call(args)
+
+	errValue := results[len(results)-1]
+	if !errValue.IsNil() {
+		if rpcErr, bOk := errValue.Interface().(*RPCError); bOk {
+			return nil, rpcErr
+		}
+		return nil, &RPCError{Code: RPCServerError, Message: errValue.Interface().(error).Error()}
+	}
+
+	if len(results) == 2 {
+		return results[0].Interface(), nil
+	}
+	return nil, nil
+}
+
+// decodeRPCParams decodes the JSON-RPC params in to a new value of paramType
+func decodeRPCParams(params json.RawMessage, paramType reflect.Type) (reflect.Value, error) {
+	bPointer := paramType.Kind() == reflect.Ptr
+	target := reflect.New(paramType)
+	if bPointer {
+		target = reflect.New(paramType.Elem())
+	}
+
+	params = bytes.TrimSpace(params)
+	if len(params) > 0 && params[0] == '[' && paramType.Kind() != reflect.Slice && paramType.Kind() != reflect.Array {
+		//positional params, unwrap single value
+		var positional []json.RawMessage
+		if err := json.Unmarshal(params, &positional); err != nil {
+			return reflect.Value{}, err
+		}
+		switch len(positional) {
+		case 0:
+			params = nil
+		case 1:
+			params = positional[0]
+		default:
+			return reflect.Value{}, &RPCError{Code: RPCInvalidParams, Message: "expecting a single positional parameter"}
+		}
+	}
+
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, target.Interface()); err != nil {
+			return reflect.Value{}, err
+		}
+	}
+
+	if bPointer {
+		return target, nil
+	}
+	return target.Elem(), nil
+}
+
+// describeJSONType produces a JSON friendly description of the structure of t
+func describeJSONType(t reflect.Type, visited map[reflect.Type]bool) interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if visited[t] {
+			return t.String()
+		}
+		visited[t] = true
+		defer delete(visited, t)
+
+		fields := make(map[string]interface{})
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			name := field.Name
+			if tag := field.Tag.Get("json"); tag != "" {
+				tagName := strings.Split(tag, ",")[0]
+				if tagName == "-" {
+					continue
+				}
+				if tagName != "" {
+					name = tagName
+				}
+			}
+			fields[name] = describeJSONType(field.Type, visited)
+		}
+		return fields
+	case reflect.Slice, reflect.Array:
+		return []interface{}{describeJSONType(t.Elem(), visited)}
+	case reflect.Map:
+		return map[string]interface{}{"<" + t.Key().String() + ">": describeJSONType(t.Elem(), visited)}
+	default:
+		return t.String()
+	}
+}
+
+// validRPCID checks that the id is a string, number or null (absent ids are notifications and also valid)
+func validRPCID(id json.RawMessage) bool {
+	if len(id) == 0 {
+		return true
+	}
+	switch id[0] {
+	case '"', 'n', '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		return true
+	}
+	return false
+}
+
+func rpcErrorResponse(id json.RawMessage, rpcErr *RPCError) map[string]interface{} {
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+	return map[string]interface{}{"jsonrpc": jsonRPCVersion, "error": rpcErr, "id": id}
+}
+
+func writeJSON(res http.ResponseWriter, obj interface{}) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		logger.LogError("failed to marshal JSON-RPC response with error: %s", err.Error())
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.Write(data)
+}
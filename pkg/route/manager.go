@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"runtime/debug"
 	"sort"
+	"sync"
 
 	"github.com/CanadianCommander/MicroWeb/pkg/logger"
 )
@@ -22,52 +23,62 @@ RoutingManager manages routers and routing operation. simply add routers to the
 feed in http requests and the manager will pass the message on to the correct routers.
 */
 type RoutingManager struct {
-	preRouters  []Router
-	routers     []Router
-	postRouters []Router
+	preRouters  []routerEntry
+	routers     []routerEntry
+	postRouters []routerEntry
+
+	middleware      []Middleware
+	stageMiddleware [3][]Middleware
+	lock            sync.RWMutex
+}
+
+// routerEntry is a router plus the middleware that wraps it
+type routerEntry struct {
+	router     Router
+	middleware []Middleware
 }
 
 //NewRoutingManager creates a new routing Manager.
 func NewRoutingManager() *RoutingManager {
-	return &RoutingManager{make([]Router, 0), make([]Router, 0), make([]Router, 0)}
+	return &RoutingManager{preRouters: make([]routerEntry, 0), routers: make([]routerEntry, 0), postRouters: make([]routerEntry, 0)}
 }
 
 /*
-RouteRequest routes an http request through the registered routers
+RouteRequest routes an http request through the registered routers.
+Global middleware (see Use) wraps the routing of the request as a whole, while stage
+and per router middleware wrap each individual router.
 */
 func (manager *RoutingManager) RouteRequest(req *http.Request, res http.ResponseWriter) error {
 	//catch any panics
 	defer func() {
 		if r := recover(); r != nil {
+			if r == http.ErrAbortHandler {
+				// let net/http abort the connection
+				panic(r)
+			}
 			logger.LogError("Caught panic while routing: %s \n", string(debug.Stack()))
 		}
 	}()
 
 	// sort routers based on priority
-	targetSlice := manager.preRouters
-	routerSortFunc := func(i, j int) bool {
-		return targetSlice[i].GetPriority() < targetSlice[j].GetPriority()
-	}
-	targetSlice = manager.preRouters
-	sort.Slice(manager.preRouters, routerSortFunc)
-	targetSlice = manager.routers
-	sort.Slice(manager.routers, routerSortFunc)
-	targetSlice = manager.postRouters
-	sort.Slice(manager.postRouters, routerSortFunc)
+	routerSet, globalMiddleware := manager.getSortedRouters()
 
 	//go through routers
-	routerSet := [][]Router{manager.preRouters, manager.routers, manager.postRouters}
-	for _, set := range routerSet {
-		for _, r := range set {
-			if r.CanRoute(req.URL) {
-				if !r.Route(req, res) {
-					// cancel further propagation
-					return nil
+	routeAll := func(req *http.Request, res http.ResponseWriter) bool {
+		for _, set := range routerSet {
+			for _, handler := range set {
+				if handler.canRoute(req) {
+					if !handler.route(req, res) {
+						// cancel further propagation
+						return false
+					}
 				}
 			}
 		}
+		return true
 	}
 
+	chain(routeAll, globalMiddleware)(req, res)
 	return nil
 }
 
@@ -97,14 +108,153 @@ func (manager *RoutingManager) AddPostRouter(router Router) {
 
 /*
 AddRouter adds a router to the manager with the given router type.
+It is safe to call this while requests are being routed.
 */
 func (manager *RoutingManager) AddRouter(router Router, routerType int) {
+	manager.AddRouterWithMiddleware(router, routerType)
+}
+
+/*
+AddRouterWithMiddleware is like AddRouter but the given middleware wraps every call to the routers Route method.
+The first middleware is the outer most one.
+*/
+func (manager *RoutingManager) AddRouterWithMiddleware(router Router, routerType int, middleware ...Middleware) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	entry := routerEntry{router, middleware}
 	switch routerType {
 	case PreRouter:
-		manager.preRouters = append(manager.preRouters, router)
+		manager.preRouters = append(manager.preRouters, entry)
 	case NormalRouter:
-		manager.routers = append(manager.routers, router)
+		manager.routers = append(manager.routers, entry)
 	case PostRouter:
-		manager.postRouters = append(manager.postRouters, router)
+		manager.postRouters = append(manager.postRouters, entry)
+	}
+}
+
+/*
+WrapRouter wraps router, added with any of the Add*Router functions, in more middleware. The new middleware is
+outside of any the router already has, the first being the outer most. Routers are compared with ==, as in RemoveRouter.
+Returns false if the router was not found.
+*/
+func (manager *RoutingManager) WrapRouter(router Router, middleware ...Middleware) bool {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	for _, set := range [][]routerEntry{manager.preRouters, manager.routers, manager.postRouters} {
+		for i, entry := range set {
+			if entry.router == router {
+				// entries are copied by getSortedRouters, replace the middleware list instead of appending to it
+				set[i].middleware = joinMiddleware(middleware, entry.middleware)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+RemoveRouter removes router, added with any of the Add*Router functions, from the manager.
+Routers are compared with ==, so router must be comparable, ex. a pointer. Returns false if the router was not found.
+*/
+func (manager *RoutingManager) RemoveRouter(router Router) bool {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	for _, set := range []*[]routerEntry{&manager.preRouters, &manager.routers, &manager.postRouters} {
+		for i, entry := range *set {
+			if entry.router == router {
+				*set = append((*set)[:i:i], (*set)[i+1:]...)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+GetRouters returns every router in the manager, pre routers first, then normal and post routers.
+*/
+func (manager *RoutingManager) GetRouters() []Router {
+	manager.lock.RLock()
+	defer manager.lock.RUnlock()
+
+	routers := make([]Router, 0, len(manager.preRouters)+len(manager.routers)+len(manager.postRouters))
+	for _, set := range [][]routerEntry{manager.preRouters, manager.routers, manager.postRouters} {
+		for _, entry := range set {
+			routers = append(routers, entry.router)
+		}
+	}
+	return routers
+}
+
+/*
+Use adds global middleware to the manager. Global middleware wraps the routing of a request through
+all pre, normal and post routers. Middleware runs in the order it was added, the first being the outer most.
+*/
+func (manager *RoutingManager) Use(middleware ...Middleware) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	manager.middleware = append(manager.middleware, middleware...)
+}
+
+/*
+UseStage adds middleware to every router of the given router type (PreRouter, NormalRouter or PostRouter).
+Stage middleware runs inside of global middleware but outside of any middleware added with the router itself.
+*/
+func (manager *RoutingManager) UseStage(routerType int, middleware ...Middleware) {
+	if routerType < PreRouter || routerType > PostRouter {
+		return
+	}
+
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	manager.stageMiddleware[routerType] = append(manager.stageMiddleware[routerType], middleware...)
+}
+
+/*
+getSortedRouters returns a copy of the pre, normal and post router lists, each sorted by priority and with
+the stage middleware of that list folded in to each entry. Routers of equal priority keep the order in which they
+were added. The global middleware list is returned as well. Working on a copy lets many requests be routed at once
+while routers are being added.
+*/
+func (manager *RoutingManager) getSortedRouters() ([][]routerEntry, []Middleware) {
+	manager.lock.RLock()
+	sourceSet := [][]routerEntry{manager.preRouters, manager.routers, manager.postRouters}
+	routerSet := make([][]routerEntry, len(sourceSet))
+	for stage, set := range sourceSet {
+		routerSet[stage] = make([]routerEntry, len(set))
+		for i, entry := range set {
+			routerSet[stage][i] = routerEntry{entry.router, joinMiddleware(manager.stageMiddleware[stage], entry.middleware)}
+		}
+	}
+	globalMiddleware := manager.middleware
+	manager.lock.RUnlock()
+
+	for _, set := range routerSet {
+		targetSlice := set
+		sort.SliceStable(targetSlice, func(i, j int) bool {
+			return targetSlice[i].router.GetPriority() < targetSlice[j].router.GetPriority()
+		})
+	}
+	return routerSet, globalMiddleware
+}
+
+// canRoute asks the router if it wants the request, preferring CanRouteRequest when implemented
+func (entry *routerEntry) canRoute(req *http.Request) bool {
+	if reqRouter, bOk := entry.router.(RequestRouter); bOk {
+		return reqRouter.CanRouteRequest(req)
+	}
+	return entry.router.CanRoute(req.URL)
+}
+
+// route calls the router wrapped in its middleware
+func (entry *routerEntry) route(req *http.Request, res http.ResponseWriter) bool {
+	if len(entry.middleware) == 0 {
+		return entry.router.Route(req, res)
 	}
+	return chain(entry.router.Route, entry.middleware)(req, res)
 }
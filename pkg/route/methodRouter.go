@@ -6,14 +6,23 @@ import (
 	"reflect"
 )
 
+const (
+	//MethodModeForm selects the target method with a http parameter. Target methods take (req, res)
+	MethodModeForm = iota
+	//MethodModeJSONRPC accepts JSON-RPC 2.0 POST bodies. Target methods take typed parameters, see routeJSONRPC
+	MethodModeJSONRPC
+)
+
 /*
 MethodRouter routes requests to methods on a receiver interface (target).
-The method to which the request is routed is selected via a http parameter "method".
+In MethodModeForm (the default) the method to which the request is routed is selected via a http parameter "method".
+In MethodModeJSONRPC the request body is a JSON-RPC 2.0 call or batch of calls.
 */
 type MethodRouter struct {
 	target          interface{}
 	priority        int
 	methodParameter string
+	mode            int
 	URL             string
 }
 
@@ -28,10 +37,23 @@ func NewMethodRouter(target interface{}, targetURL string) *MethodRouter {
 	return &methodR
 }
 
+/*
+NewJSONRPCRouter constructs a new method router, in JSON-RPC mode, on the target struct at the given url.
+*/
+func NewJSONRPCRouter(target interface{}, targetURL string) *MethodRouter {
+	methodR := NewMethodRouter(target, targetURL)
+	methodR.SetMode(MethodModeJSONRPC)
+	return methodR
+}
+
 /*
 Route routes the incoming request to the requested method of the target class
 */
 func (mrouter *MethodRouter) Route(req *http.Request, res http.ResponseWriter) bool {
+	if mrouter.mode == MethodModeJSONRPC {
+		return mrouter.routeJSONRPC(req, res)
+	}
+
 	req.ParseForm()
 
 	methodName, bOk := req.Form[mrouter.methodParameter]
@@ -115,3 +137,17 @@ the router target.
 func (mrouter *MethodRouter) GetMethodParameter() string {
 	return mrouter.methodParameter
 }
+
+/*
+SetMode sets the routing mode, one of MethodModeForm or MethodModeJSONRPC
+*/
+func (mrouter *MethodRouter) SetMode(mode int) {
+	mrouter.mode = mode
+}
+
+/*
+GetMode returns the routing mode, one of MethodModeForm or MethodModeJSONRPC
+*/
+func (mrouter *MethodRouter) GetMode() int {
+	return mrouter.mode
+}
@@ -0,0 +1,40 @@
+package route
+
+import (
+	"net/http"
+)
+
+/*
+Handler handles an http request. The return value has the same meaning as that of Router.Route,
+if false the request will not be propagated any further.
+*/
+type Handler func(req *http.Request, res http.ResponseWriter) bool
+
+/*
+Middleware wraps a Handler, returning a new Handler. Middleware may do work before and / or after
+calling next, replace the request or response writer passed to next (ex. to rewrite the response)
+or not call next at all to stop the request (ex. failed authentication).
+*/
+type Middleware func(next Handler) Handler
+
+/*
+chain wraps handler in the given middleware. The first middleware is the outer most.
+*/
+func chain(handler Handler, middleware []Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+/*
+joinMiddleware returns a new middleware list consisting of outer followed by inner.
+*/
+func joinMiddleware(outer []Middleware, inner []Middleware) []Middleware {
+	if len(outer) == 0 {
+		return inner
+	}
+	joined := make([]Middleware, 0, len(outer)+len(inner))
+	joined = append(joined, outer...)
+	return append(joined, inner...)
+}
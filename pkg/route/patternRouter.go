@@ -0,0 +1,316 @@
+package route
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// path segment types, in order of decreasing specificity
+const (
+	segmentLiteral = iota
+	segmentParameter
+	segmentWildcard
+	segmentCatchAll
+)
+
+type pathParameterKey struct{}
+
+/*
+PatternRouter routes http requests to end points based on url path templates. A template is a
+"/" separated list of segments where each segment is one of:
+	literal   - matches the segment exactly. Ex: /users
+	{name}    - matches any one segment and captures it under name. Ex: /users/{id}
+	*         - matches any one segment. Ex: /files/{dir}/*
+	{name...} - must be the last segment. matches the rest of the path (including "/") and captures it under name.
+Ex: /users/{id}/posts/{postID} or /files/{filePath...}.
+Captured parameters are retrieved with PathParameter(req, name).
+When more than one template matches a path, the most specific one (literals before parameters,
+parameters before catch-alls) is used.
+*/
+type PatternRouter struct {
+	routes   []*patternRoute
+	priority int
+	lock     sync.RWMutex
+}
+
+type patternSegment struct {
+	segType int
+	value   string
+}
+
+type patternRoute struct {
+	pattern  string
+	segments []patternSegment
+	methods  map[string]bool
+	function func(req *http.Request, res http.ResponseWriter) bool
+}
+
+//NewPatternRouter creates a new PatternRouter.
+func NewPatternRouter() *PatternRouter {
+	return &PatternRouter{routes: make([]*patternRoute, 0), priority: DefaultRouterPriority}
+}
+
+/*
+Route calls the function associated with the most specific template matching the request path.
+If templates match the path but none allow the request method a 405 response is sent
+and propagation is stopped. Otherwise the return value of the function is returned.
+*/
+func (pRouter *PatternRouter) Route(req *http.Request, res http.ResponseWriter) bool {
+	segments, err := splitURLPath(req.URL)
+	if err != nil {
+		return true
+	}
+
+	allowed := make(map[string]bool)
+	for _, r := range pRouter.getRoutes() {
+		params, bMatch := r.match(segments)
+		if !bMatch {
+			continue
+		}
+
+		if r.allowsMethod(req.Method) {
+			ctx := context.WithValue(req.Context(), pathParameterKey{}, params)
+			return r.function(req.WithContext(ctx), res)
+		}
+		for method := range r.methods {
+			allowed[method] = true
+		}
+	}
+
+	if len(allowed) > 0 {
+		allowList := make([]string, 0, len(allowed))
+		for method := range allowed {
+			allowList = append(allowList, method)
+		}
+		sort.Strings(allowList)
+		res.Header().Set("Allow", strings.Join(allowList, ", "))
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+/*
+CanRoute returns true if any template matches the url path.
+*/
+func (pRouter *PatternRouter) CanRoute(routeURL *url.URL) bool {
+	segments, err := splitURLPath(routeURL)
+	if err != nil {
+		return false
+	}
+
+	for _, r := range pRouter.getRoutes() {
+		if _, bMatch := r.match(segments); bMatch {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+GetPriority returns this routers priority
+*/
+func (pRouter *PatternRouter) GetPriority() int {
+	return pRouter.priority
+}
+
+/*
+SetPriority sets the priority of this router.
+*/
+func (pRouter *PatternRouter) SetPriority(pri int) {
+	pRouter.priority = pri
+}
+
+/*
+AddRoute adds a new template -> function mapping to the router. If methods are given
+the mapping only applies to requests using one of those http methods (GET implies HEAD),
+else it applies to all methods. An error is returned if the template is malformed.
+*/
+func (pRouter *PatternRouter) AddRoute(pattern string, function func(req *http.Request, res http.ResponseWriter) bool, methods ...string) error {
+	segments, err := parsePattern(pattern)
+	if err != nil {
+		return err
+	}
+
+	newRoute := &patternRoute{pattern: pattern, segments: segments, function: function}
+	if len(methods) > 0 {
+		newRoute.methods = make(map[string]bool)
+		for _, method := range methods {
+			newRoute.methods[strings.ToUpper(method)] = true
+		}
+		if newRoute.methods[http.MethodGet] {
+			newRoute.methods[http.MethodHead] = true
+		}
+	}
+
+	pRouter.lock.Lock()
+	defer pRouter.lock.Unlock()
+
+	routes := make([]*patternRoute, len(pRouter.routes), len(pRouter.routes)+1)
+	copy(routes, pRouter.routes)
+	routes = append(routes, newRoute)
+	sort.SliceStable(routes, func(i, j int) bool {
+		return routes[i].moreSpecific(routes[j])
+	})
+	pRouter.routes = routes
+	return nil
+}
+
+/*
+RemoveRoute removes all mappings for the given template
+*/
+func (pRouter *PatternRouter) RemoveRoute(pattern string) {
+	pRouter.lock.Lock()
+	defer pRouter.lock.Unlock()
+
+	routes := make([]*patternRoute, 0, len(pRouter.routes))
+	for _, r := range pRouter.routes {
+		if r.pattern != pattern {
+			routes = append(routes, r)
+		}
+	}
+	pRouter.routes = routes
+}
+
+/*
+PathParameter returns the path parameter captured under name for a request routed by a PatternRouter.
+If no such parameter exists "" is returned.
+*/
+func PathParameter(req *http.Request, name string) string {
+	return PathParameters(req)[name]
+}
+
+/*
+PathParameters returns all path parameters captured for a request routed by a PatternRouter.
+*/
+func PathParameters(req *http.Request) map[string]string {
+	params, bOk := req.Context().Value(pathParameterKey{}).(map[string]string)
+	if !bOk {
+		return map[string]string{}
+	}
+	return params
+}
+
+func (pRouter *PatternRouter) getRoutes() []*patternRoute {
+	pRouter.lock.RLock()
+	defer pRouter.lock.RUnlock()
+	return pRouter.routes
+}
+
+// match checks if the path segments match this route. If they do the captured parameters are returned.
+func (r *patternRoute) match(segments []string) (map[string]string, bool) {
+	params := make(map[string]string)
+
+	for i, seg := range r.segments {
+		if seg.segType == segmentCatchAll {
+			params[seg.value] = strings.Join(segments[i:], "/")
+			return params, true
+		}
+		if i >= len(segments) {
+			return nil, false
+		}
+
+		switch seg.segType {
+		case segmentLiteral:
+			if segments[i] != seg.value {
+				return nil, false
+			}
+		case segmentParameter:
+			if segments[i] == "" {
+				return nil, false
+			}
+			params[seg.value] = segments[i]
+		case segmentWildcard:
+			if segments[i] == "" {
+				return nil, false
+			}
+		}
+	}
+
+	if len(segments) != len(r.segments) {
+		return nil, false
+	}
+	return params, true
+}
+
+func (r *patternRoute) allowsMethod(method string) bool {
+	return r.methods == nil || r.methods[method]
+}
+
+// moreSpecific returns true if route r should be tried before route other.
+func (r *patternRoute) moreSpecific(other *patternRoute) bool {
+	for i := 0; i < len(r.segments) && i < len(other.segments); i++ {
+		if r.segments[i].segType != other.segments[i].segType {
+			return r.segments[i].segType < other.segments[i].segType
+		}
+	}
+
+	rCatchAll := len(r.segments) > 0 && r.segments[len(r.segments)-1].segType == segmentCatchAll
+	otherCatchAll := len(other.segments) > 0 && other.segments[len(other.segments)-1].segType == segmentCatchAll
+	if rCatchAll != otherCatchAll {
+		return !rCatchAll
+	}
+	return len(r.segments) > len(other.segments)
+}
+
+// parsePattern converts a url path template in to its segment list
+func parsePattern(pattern string) ([]patternSegment, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, errors.New("pattern must start with \"/\": " + pattern)
+	}
+
+	rawSegments := strings.Split(pattern[1:], "/")
+	segments := make([]patternSegment, len(rawSegments))
+	names := make(map[string]bool)
+
+	for i, raw := range rawSegments {
+		switch {
+		case raw == "*":
+			segments[i] = patternSegment{segmentWildcard, ""}
+		case strings.HasPrefix(raw, "{") && strings.HasSuffix(raw, "...}"):
+			if i != len(rawSegments)-1 {
+				return nil, errors.New("catch all parameter must be the last segment of pattern: " + pattern)
+			}
+			segments[i] = patternSegment{segmentCatchAll, raw[1 : len(raw)-4]}
+		case strings.HasPrefix(raw, "{") && strings.HasSuffix(raw, "}"):
+			segments[i] = patternSegment{segmentParameter, raw[1 : len(raw)-1]}
+		default:
+			if strings.ContainsAny(raw, "{}") {
+				return nil, errors.New("malformed segment [" + raw + "] in pattern: " + pattern)
+			}
+			segments[i] = patternSegment{segmentLiteral, raw}
+		}
+
+		if segments[i].segType == segmentParameter || segments[i].segType == segmentCatchAll {
+			if segments[i].value == "" {
+				return nil, errors.New("parameter without name in pattern: " + pattern)
+			}
+			if names[segments[i].value] {
+				return nil, errors.New("duplicate parameter [" + segments[i].value + "] in pattern: " + pattern)
+			}
+			names[segments[i].value] = true
+		}
+	}
+
+	return segments, nil
+}
+
+// splitURLPath splits the url path in to its unescaped segments
+func splitURLPath(routeURL *url.URL) ([]string, error) {
+	rawPath := strings.TrimPrefix(routeURL.EscapedPath(), "/")
+	segments := strings.Split(rawPath, "/")
+
+	for i, seg := range segments {
+		unescaped, err := url.PathUnescape(seg)
+		if err != nil {
+			return nil, err
+		}
+		segments[i] = unescaped
+	}
+	return segments, nil
+}
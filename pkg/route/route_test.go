@@ -1,11 +1,17 @@
 package route
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"reflect"
 	"sort"
+	"strings"
 	"testing"
+
+	"github.com/CanadianCommander/MicroWeb/pkg/logger"
 )
 
 func TestBasicRoute(t *testing.T) {
@@ -66,6 +72,31 @@ func TestBasicRoute(t *testing.T) {
 	}
 }
 
+func TestRemoveRouter(t *testing.T) {
+	rManager := NewRoutingManager()
+	calls := 0
+
+	keepRouter := NewDumbRouter()
+	removeRouter := NewDumbRouter()
+	keepRouter.AddFunctionMapping("/foobar.do", func(req *http.Request, res http.ResponseWriter) { calls++ })
+	removeRouter.AddFunctionMapping("/foobar.do", func(req *http.Request, res http.ResponseWriter) { calls += 10 })
+	rManager.AddNormalRouter(keepRouter)
+	rManager.AddPostRouter(removeRouter)
+
+	if len(rManager.GetRouters()) != 2 || !rManager.RemoveRouter(removeRouter) || rManager.RemoveRouter(removeRouter) {
+		fmt.Print("Router not removed\n")
+		t.Fail()
+	}
+
+	req := &http.Request{}
+	req.URL, _ = url.Parse("/foobar.do")
+	rManager.RouteRequest(req, nil)
+	if routers := rManager.GetRouters(); calls != 1 || len(routers) != 1 || routers[0] != keepRouter {
+		fmt.Printf("Removed router still routes, calls: %d routers: %v\n", calls, routers)
+		t.Fail()
+	}
+}
+
 type MethodRouterTestTarget struct {
 	Msg string
 }
@@ -114,3 +145,224 @@ func TestMethodRouter(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestPatternRouter(t *testing.T) {
+	rManager := NewRoutingManager()
+	patternRouter := NewPatternRouter()
+	rManager.AddNormalRouter(patternRouter)
+
+	var hit string
+	var params map[string]string
+	mapping := func(name string) func(req *http.Request, res http.ResponseWriter) bool {
+		return func(req *http.Request, res http.ResponseWriter) bool {
+			hit = name
+			params = PathParameters(req)
+			return false
+		}
+	}
+
+	patternRouter.AddRoute("/users/{id}/posts/{postID}", mapping("post"), http.MethodGet)
+	patternRouter.AddRoute("/users/{id}", mapping("user"))
+	patternRouter.AddRoute("/users/me", mapping("me"))
+	patternRouter.AddRoute("/files/*/{path...}", mapping("files"))
+	if patternRouter.AddRoute("/bad/{rest...}/foo", mapping("bad")) == nil {
+		fmt.Print("catch all in the middle of a pattern should be rejected\n")
+		t.Fail()
+	}
+
+	testCases := []struct {
+		method, url, hit string
+		params          map[string]string
+		status          int
+	}{
+		{http.MethodGet, "/users/42/posts/7?x=1", "post", map[string]string{"id": "42", "postID": "7"}, 200},
+		{http.MethodGet, "/users/42", "user", map[string]string{"id": "42"}, 200},
+		{http.MethodGet, "/users/me", "me", map[string]string{}, 200},
+		{http.MethodGet, "/users/a%2Fb", "user", map[string]string{"id": "a/b"}, 200},
+		{http.MethodGet, "/files/bin/a/b/c.txt", "files", map[string]string{"path": "a/b/c.txt"}, 200},
+		{http.MethodPost, "/users/42/posts/7", "", nil, http.StatusMethodNotAllowed},
+		{http.MethodGet, "/users/", "", nil, 200},
+	}
+
+	for _, testCase := range testCases {
+		hit = ""
+		params = nil
+		req := httptest.NewRequest(testCase.method, testCase.url, nil)
+		recorder := httptest.NewRecorder()
+
+		err := rManager.RouteRequest(req, recorder)
+		if err != nil {
+			fmt.Printf("Error while routing: %s\n", err.Error())
+			t.Fail()
+			continue
+		}
+
+		if hit != testCase.hit || recorder.Code != testCase.status {
+			fmt.Printf("%s %s routed to [%s] with status %d, expecting [%s] with status %d\n",
+				testCase.method, testCase.url, hit, recorder.Code, testCase.hit, testCase.status)
+			t.Fail()
+		}
+		if testCase.params != nil && !reflect.DeepEqual(params, testCase.params) {
+			fmt.Printf("%s got path parameters %v expecting %v\n", testCase.url, params, testCase.params)
+			t.Fail()
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	rManager := NewRoutingManager()
+	var trace []string
+
+	tracer := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(req *http.Request, res http.ResponseWriter) bool {
+				trace = append(trace, name+"-in")
+				result := next(req, res)
+				trace = append(trace, name+"-out")
+				return result
+			}
+		}
+	}
+
+	preRouter := NewDumbRouter()
+	preRouter.AddFunctionMapping("/foobar.do", func(req *http.Request, res http.ResponseWriter) {
+		trace = append(trace, "pre")
+	})
+	normRouter := NewDumbRouter()
+	normRouter.AddFunctionMapping("/foobar.do", func(req *http.Request, res http.ResponseWriter) {
+		trace = append(trace, "normal")
+	})
+
+	rManager.AddPreRouter(preRouter)
+	rManager.AddRouterWithMiddleware(normRouter, NormalRouter, tracer("router1"), tracer("router2"))
+	rManager.UseStage(NormalRouter, tracer("stage"))
+	rManager.Use(tracer("global"))
+
+	req := &http.Request{}
+	req.URL, _ = url.Parse("/foobar.do")
+	rManager.RouteRequest(req, &myResponseWriter{})
+
+	expected := []string{"global-in", "pre", "stage-in", "router1-in", "router2-in", "normal",
+		"router2-out", "router1-out", "stage-out", "global-out"}
+	if !reflect.DeepEqual(trace, expected) {
+		fmt.Printf("middleware ran in the wrong order. got: %v expecting: %v\n", trace, expected)
+		t.Fail()
+	}
+
+	// middleware that does not call next stops the request
+	trace = nil
+	rManager.UseStage(PreRouter, func(next Handler) Handler {
+		return func(req *http.Request, res http.ResponseWriter) bool {
+			trace = append(trace, "blocked")
+			return false
+		}
+	})
+	rManager.RouteRequest(req, &myResponseWriter{})
+
+	expected = []string{"global-in", "blocked", "global-out"}
+	if !reflect.DeepEqual(trace, expected) {
+		fmt.Printf("blocking middleware did not stop the request. got: %v expecting: %v\n", trace, expected)
+		t.Fail()
+	}
+
+	// wrapping a router puts the new middleware outside of its own
+	wrapManager := NewRoutingManager()
+	wrapManager.AddRouterWithMiddleware(normRouter, NormalRouter, tracer("router1"))
+	if !wrapManager.WrapRouter(normRouter, tracer("wrap")) || wrapManager.WrapRouter(preRouter, tracer("wrap")) {
+		fmt.Printf("WrapRouter did not find the right routers\n")
+		t.Fail()
+	}
+	trace = nil
+	wrapManager.RouteRequest(req, &myResponseWriter{})
+
+	expected = []string{"wrap-in", "router1-in", "normal", "router1-out", "wrap-out"}
+	if !reflect.DeepEqual(trace, expected) {
+		fmt.Printf("wrapped router ran in the wrong order. got: %v expecting: %v\n", trace, expected)
+		t.Fail()
+	}
+}
+
+type RPCTestTarget struct{}
+
+type AddParams struct {
+	A int `json:"a"`
+	B int `json:"b"`
+}
+
+func (target *RPCTestTarget) Add(params AddParams) (int, error) {
+	return params.A + params.B, nil
+}
+
+func (target *RPCTestTarget) Fail(params *AddParams) error {
+	return &RPCError{Code: 42, Message: "failed on purpose"}
+}
+
+func (target *RPCTestTarget) Path(req *http.Request) (string, error) {
+	return req.URL.Path, nil
+}
+
+func (target *RPCTestTarget) Panic() error {
+	panic("panicked on purpose")
+}
+
+func TestJSONRPCRouter(t *testing.T) {
+	logger.LogToStd(logger.VError)
+	rManager := NewRoutingManager()
+	rManager.AddNormalRouter(NewJSONRPCRouter(&RPCTestTarget{}, "/rpc"))
+
+	testCases := []struct {
+		body, response string
+		status         int
+	}{
+		{`{"jsonrpc": "2.0", "method": "Add", "params": {"a": 1, "b": 2}, "id": 1}`,
+			`{"id":1,"jsonrpc":"2.0","result":3}`, 200},
+		{`{"jsonrpc": "2.0", "method": "Add", "params": [{"a": 5, "b": 5}], "id": "x"}`,
+			`{"id":"x","jsonrpc":"2.0","result":10}`, 200},
+		{`{"jsonrpc": "2.0", "method": "Path", "id": 2}`,
+			`{"id":2,"jsonrpc":"2.0","result":"/rpc"}`, 200},
+		{`{"jsonrpc": "2.0", "method": "Fail", "id": 3}`,
+			`{"error":{"code":42,"message":"failed on purpose"},"id":3,"jsonrpc":"2.0"}`, 200},
+		{`{"jsonrpc": "2.0", "method": "Nope", "id": 4}`,
+			`{"error":{"code":-32601,"message":"method not found: Nope"},"id":4,"jsonrpc":"2.0"}`, 200},
+		{`{"jsonrpc": "2.0", "method": "Add", "params": {"a": "one"}, "id": 5}`,
+			`-32602`, 200},
+		{`{"jsonrpc": "2.0", "method": "Add", "params": {"a": 1, "b": 1}}`, ``, http.StatusNoContent},
+		{`{"jsonrpc": "2.0", "method": "Add", `, `-32700`, 200},
+		{`[]`, `{"error":{"code":-32600,"message":"empty batch"},"id":null,"jsonrpc":"2.0"}`, 200},
+		{`[{"jsonrpc": "2.0", "method": "Add", "params": {"a": 1, "b": 1}, "id": 1},
+		   {"jsonrpc": "2.0", "method": "Add", "params": {"a": 1, "b": 1}},
+		   {"jsonrpc": "1.0", "method": "Add", "id": 3}]`,
+			`[{"id":1,"jsonrpc":"2.0","result":2},{"error":{"code":-32600,"message":"invalid JSON-RPC 2.0 request"},"id":null,"jsonrpc":"2.0"}]`, 200},
+		// a panicking method only fails its own call
+		{`[{"jsonrpc": "2.0", "method": "Add", "params": {"a": 1, "b": 1}, "id": 1},
+		   {"jsonrpc": "2.0", "method": "Panic", "id": 2},
+		   {"jsonrpc": "2.0", "method": "Add", "params": {"a": 2, "b": 2}, "id": 3}]`,
+			`[{"id":1,"jsonrpc":"2.0","result":2},{"error":{"code":-32603,"message":"internal error"},"id":2,"jsonrpc":"2.0"},{"id":3,"jsonrpc":"2.0","result":4}]`, 200},
+	}
+
+	for _, testCase := range testCases {
+		req := httptest.NewRequest(http.MethodPost, "/rpc", strings.NewReader(testCase.body))
+		recorder := httptest.NewRecorder()
+		rManager.RouteRequest(req, recorder)
+
+		if recorder.Code != testCase.status || !strings.Contains(recorder.Body.String(), testCase.response) {
+			fmt.Printf("JSON-RPC call %s\n got [%d] %s\n expecting [%d] %s\n", testCase.body, recorder.Code,
+				recorder.Body.String(), testCase.status, testCase.response)
+			t.Fail()
+		}
+	}
+
+	// method listing
+	req := httptest.NewRequest(http.MethodGet, "/rpc", nil)
+	recorder := httptest.NewRecorder()
+	rManager.RouteRequest(req, recorder)
+
+	var methods []RPCMethodDescription
+	if err := json.Unmarshal(recorder.Body.Bytes(), &methods); err != nil || len(methods) != 4 {
+		fmt.Printf("bad JSON-RPC method listing: %s\n", recorder.Body.String())
+		t.Fail()
+	} else if methods[0].Name != "Add" || !reflect.DeepEqual(methods[0].Params, map[string]interface{}{"a": "int", "b": "int"}) {
+		fmt.Printf("bad description of method Add: %v\n", methods[0])
+		t.Fail()
+	}
+}
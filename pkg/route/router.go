@@ -29,3 +29,15 @@ type Router interface {
 	*/
 	GetPriority() int
 }
+
+/*
+RequestRouter is an optional extension of Router for routers that need more than the url
+(ex: the Host header) to decide if they can route a request. When a router implements it the
+RoutingManager calls CanRouteRequest in place of CanRoute.
+*/
+type RequestRouter interface {
+	Router
+
+	// CanRouteRequest returns true if the router can / wants to route this request.
+	CanRouteRequest(req *http.Request) bool
+}
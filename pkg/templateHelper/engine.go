@@ -0,0 +1,285 @@
+package templateHelper
+
+import (
+	"errors"
+	templateHTML "html/template"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/CanadianCommander/MicroWeb/pkg/cache"
+	"github.com/CanadianCommander/MicroWeb/pkg/logger"
+	"github.com/fsnotify/fsnotify"
+)
+
+// file extension of the templates an Engine loads
+const templateExt = ".gohtml"
+
+/*
+Engine renders the .gohtml pages in a template directory. Every page is parsed once, together with all layouts,
+partials and templateHelper plugins (see AddAllTemplates), and the compiled set is kept in the cache.
+A page is parsed again when its modification time changes. Call Watch to have cached sets thrown away when a layout
+or partial changes.
+
+Layouts and partials are named after there path in the layout / partial directory without the extension,
+so "layouts/base.gohtml" is "base" and "partials/forms/login.gohtml" is "forms/login". A page uses a layout
+by overriding its blocks and then executing it:
+	{{define "title"}}Home{{end}}
+	{{define "content"}}{{template "nav" .}} Hello {{.Name}}{{end}}
+	{{template "base" .}}
+where "layouts/base.gohtml" is:
+	<title>{{block "title" .}}Untitled{{end}}</title><body>{{block "content" .}}{{end}}</body>
+The functions in StandardFuncs are available to all templates.
+*/
+type Engine struct {
+	templateDirectory string
+	layoutDirectory   string
+	partialDirectory  string
+
+	funcLock sync.RWMutex
+	funcs    templateHTML.FuncMap
+
+	// part of the cache key, bumped to invalidate all compiled sets of this engine
+	generation uint64
+
+	watchLock sync.Mutex
+	watcher   *fsnotify.Watcher
+	stopChan  chan bool
+}
+
+// cachedPage is the compiled template set of a page and the modification time of the page it was parsed at
+type cachedPage struct {
+	template *templateHTML.Template
+	modTime  time.Time
+}
+
+/*
+NewEngine creates an engine for the pages in templateDirectory. layoutDirectory and partialDirectory are
+relative to templateDirectory unless absolute, "" for none.
+*/
+func NewEngine(templateDirectory string, layoutDirectory string, partialDirectory string) *Engine {
+	resolve := func(dir string) string {
+		if path.IsAbs(dir) {
+			return path.Clean(dir)
+		}
+		return path.Join(templateDirectory, dir)
+	}
+
+	engine := &Engine{templateDirectory: path.Clean(templateDirectory), funcs: templateHTML.FuncMap{}}
+	if layoutDirectory != "" {
+		engine.layoutDirectory = resolve(layoutDirectory)
+	}
+	if partialDirectory != "" {
+		engine.partialDirectory = resolve(partialDirectory)
+	}
+	return engine
+}
+
+/*
+Funcs adds funcMap to the functions available to templates, on top of StandardFuncs.
+*/
+func (engine *Engine) Funcs(funcMap templateHTML.FuncMap) *Engine {
+	engine.funcLock.Lock()
+	for name, function := range funcMap {
+		engine.funcs[name] = function
+	}
+	engine.funcLock.Unlock()
+
+	engine.Invalidate()
+	return engine
+}
+
+/*
+IsPage returns true if fsPath is a page of the engine, a .gohtml file in the template directory that is
+not a layout or partial.
+*/
+func (engine *Engine) IsPage(fsPath string) bool {
+	fsPath = path.Clean(fsPath)
+	return path.Ext(fsPath) == templateExt && isInDirectory(fsPath, engine.templateDirectory) &&
+		!isInDirectory(fsPath, engine.layoutDirectory) && !isInDirectory(fsPath, engine.partialDirectory)
+}
+
+/*
+Render executes the page (a path relative to the template directory or an absolute path within it) with data.
+*/
+func (engine *Engine) Render(out io.Writer, page string, data interface{}) error {
+	pageTemplate, err := engine.Lookup(page)
+	if err != nil {
+		return err
+	}
+	return pageTemplate.Execute(out, data)
+}
+
+/*
+Lookup returns the compiled template set of page, parsing it if it is not in the cache or the page has been
+modified since it was parsed. Executing the returned template executes the page.
+*/
+func (engine *Engine) Lookup(page string) (*templateHTML.Template, error) {
+	pagePath := page
+	if !path.IsAbs(pagePath) {
+		pagePath = path.Join(engine.templateDirectory, page)
+	}
+	if !engine.IsPage(pagePath) {
+		return nil, errors.New("not a page of template directory " + engine.templateDirectory + ": " + page)
+	}
+
+	fInfo, err := os.Stat(pagePath)
+	if err != nil {
+		return nil, err
+	}
+
+	cacheKey := engine.templateDirectory + ":" + strconv.FormatUint(atomic.LoadUint64(&engine.generation), 10) + ":" + pagePath
+	if cached, bOk := cache.FetchFromCache(cache.CacheTypeTemplate, cacheKey).(*cachedPage); bOk && cached.modTime.Equal(fInfo.ModTime()) {
+		return cached.template, nil
+	}
+
+	logger.LogVerbose("Parsing template page: %s", pagePath)
+	pageTemplate, err := engine.parsePage(pagePath)
+	if err != nil {
+		return nil, err
+	}
+	cache.RemoveFromCache(cache.CacheTypeTemplate, cacheKey)
+	cache.AddToCache(cache.CacheTypeTemplate, cacheKey, &cachedPage{template: pageTemplate, modTime: fInfo.ModTime()})
+	return pageTemplate, nil
+}
+
+/*
+Invalidate throws away all compiled template sets of the engine. Old sets age out of the cache.
+*/
+func (engine *Engine) Invalidate() {
+	atomic.AddUint64(&engine.generation, 1)
+}
+
+/*
+Watch invalidates the engine whenever a file in the layout or partial directory is written, created, removed or renamed.
+Pages are not watched, Lookup notices changes to them. Stop watching with Close.
+*/
+func (engine *Engine) Watch() error {
+	engine.watchLock.Lock()
+	defer engine.watchLock.Unlock()
+	if engine.watcher != nil {
+		return nil
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	for _, dir := range []string{engine.layoutDirectory, engine.partialDirectory} {
+		if dir != "" {
+			watchDirectoryTree(watcher, dir)
+		}
+	}
+
+	engine.watcher = watcher
+	engine.stopChan = make(chan bool)
+	go engine.watch(watcher, engine.stopChan)
+	return nil
+}
+
+/*
+Close stops watching the template directory.
+*/
+func (engine *Engine) Close() {
+	engine.watchLock.Lock()
+	defer engine.watchLock.Unlock()
+	if engine.watcher != nil {
+		close(engine.stopChan)
+		engine.watcher = nil
+	}
+}
+
+func (engine *Engine) watch(watcher *fsnotify.Watcher, stopChan chan bool) {
+	defer watcher.Close()
+	for {
+		select {
+		case event := <-watcher.Events:
+			if event.Op&fsnotify.Create > 0 {
+				// watch new sub directories too
+				if fInfo, err := os.Stat(event.Name); err == nil && fInfo.IsDir() {
+					watchDirectoryTree(watcher, event.Name)
+				}
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) > 0 {
+				logger.LogVerbose("Template file changed: %s", event.Name)
+				engine.Invalidate()
+			}
+		case err := <-watcher.Errors:
+			logger.LogError("Got error while watching template directory: %s", err.Error())
+		case <-stopChan:
+			return
+		}
+	}
+}
+
+// parsePage parses the page at pagePath together with all layouts, partials and template plugins
+func (engine *Engine) parsePage(pagePath string) (*templateHTML.Template, error) {
+	pageTemplate := templateHTML.New(pagePath).Funcs(StandardFuncs())
+	engine.funcLock.RLock()
+	pageTemplate.Funcs(engine.funcs)
+	engine.funcLock.RUnlock()
+	AddAllTemplates(pageTemplate)
+
+	for _, dir := range []string{engine.layoutDirectory, engine.partialDirectory} {
+		if err := parseTemplateDirectory(pageTemplate, dir); err != nil {
+			return nil, err
+		}
+	}
+
+	// the page is parsed last so that its definitions override the blocks of the layouts
+	pageSource, err := os.ReadFile(pagePath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = pageTemplate.Parse(string(pageSource)); err != nil {
+		return nil, err
+	}
+	return pageTemplate, nil
+}
+
+// parseTemplateDirectory adds every .gohtml file below dir to t, named by its path relative to dir without extension
+func parseTemplateDirectory(t *templateHTML.Template, dir string) error {
+	if dir == "" {
+		return nil
+	}
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	}
+
+	return filepath.Walk(dir, func(filePath string, fInfo os.FileInfo, err error) error {
+		if err != nil || fInfo.IsDir() || path.Ext(filePath) != templateExt {
+			return err
+		}
+
+		source, err := os.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(filePath, dir+"/"), templateExt)
+		_, err = t.New(name).Parse(string(source))
+		return err
+	})
+}
+
+// watchDirectoryTree adds dir and all directories below it to watcher
+func watchDirectoryTree(watcher *fsnotify.Watcher, dir string) {
+	filepath.Walk(dir, func(filePath string, fInfo os.FileInfo, err error) error {
+		if err == nil && fInfo.IsDir() {
+			if wErr := watcher.Add(filePath); wErr != nil {
+				logger.LogError("Cannot watch template directory: %s with error: %s", filePath, wErr.Error())
+			}
+		}
+		return nil
+	})
+}
+
+// isInDirectory returns true if fsPath is dir or below it. dir "" contains nothing
+func isInDirectory(fsPath string, dir string) bool {
+	return dir != "" && (fsPath == dir || strings.HasPrefix(fsPath, strings.TrimSuffix(dir, "/")+"/"))
+}
@@ -0,0 +1,83 @@
+package templateHelper
+
+import (
+	"encoding/json"
+	"fmt"
+	templateHTML "html/template"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+StandardFuncs returns the function library available to all Engine templates:
+	now                                  the current time
+	formatDate "2006-01-02" .Time        format a time.Time with a time package layout
+	rfc3339 .Time                        format a time.Time as RFC 3339
+	since .Time                          time passed since .Time, rounded to the second
+	pathEscape .Name / queryEscape .Name escape a string for use in a URL path segment / query
+	joinURL "/blog" .Year .Slug          join URL path segments, escaping each one
+	json .Value                          encode a value as JSON, ex. <script>var data = {{json .Value}};</script>
+	truncate 20 .Text                    cut text to at most 20 characters, ending in "…" if cut
+	pluralize .Count "item" "items"      "1 item", "3 items"
+The argument order puts the value last so functions can be used in pipelines, ex. {{.Text | truncate 20}}.
+*/
+func StandardFuncs() templateHTML.FuncMap {
+	return templateHTML.FuncMap{
+		"now":         time.Now,
+		"formatDate":  formatDate,
+		"rfc3339":     func(t time.Time) string { return t.Format(time.RFC3339) },
+		"since":       func(t time.Time) time.Duration { return time.Since(t).Round(time.Second) },
+		"pathEscape":  url.PathEscape,
+		"queryEscape": url.QueryEscape,
+		"joinURL":     joinURL,
+		"json":        toJSON,
+		"truncate":    truncate,
+		"pluralize":   pluralize,
+	}
+}
+
+func formatDate(layout string, t time.Time) string {
+	return t.Format(layout)
+}
+
+// joinURL joins base with the path escaped segments
+func joinURL(base string, segments ...interface{}) string {
+	joined := strings.TrimSuffix(base, "/")
+	for _, segment := range segments {
+		joined += "/" + url.PathEscape(strings.Trim(fmt.Sprint(segment), "/"))
+	}
+	return joined
+}
+
+/*
+toJSON encodes v as JSON. The result is a JavaScript value, so that in a script it is used as is rather than
+quoted as a string. encoding/json escapes <, > and & so it cannot end the script early.
+*/
+func toJSON(v interface{}) (templateHTML.JS, error) {
+	buff, err := json.Marshal(v)
+	return templateHTML.JS(buff), err
+}
+
+// truncate cuts s to at most length characters (not bytes), the last of which is "…" if s was cut
+func truncate(length int, s string) string {
+	if length <= 0 {
+		return ""
+	}
+	if utf8.RuneCountInString(s) <= length {
+		return s
+	}
+	runes := []rune(s)
+	return string(runes[:length-1]) + "…"
+}
+
+// pluralize returns count followed by singular if count is 1, else plural
+func pluralize(count int, singular string, plural string) string {
+	word := plural
+	if count == 1 {
+		word = singular
+	}
+	return strconv.Itoa(count) + " " + word
+}
@@ -53,7 +53,7 @@ func getPlugin(name string) (iTemplatePlugin, error) {
 }
 
 func pathFromTemplateName(name string) (string, error) {
-	tList := mwsettings.GetSetting("templateHelper/plugins").([]TemplatePluginSettings)
+	tList := mwsettings.GetSetting(templateHelperPath).([]TemplatePluginSettings)
 	for _, it := range tList {
 		if it.TemplateName == name {
 			return it.PluginPath, nil
@@ -63,7 +63,7 @@ func pathFromTemplateName(name string) (string, error) {
 }
 
 func pathsFromGroupName(groupName string) ([]string, error) {
-	pList := mwsettings.GetSetting("templateHelper/plugins").([]TemplatePluginSettings)
+	pList := mwsettings.GetSetting(templateHelperPath).([]TemplatePluginSettings)
 	var outList []string
 
 	for _, plugin := range pList {
@@ -79,7 +79,7 @@ func pathsFromGroupName(groupName string) ([]string, error) {
 }
 
 func namesFromGroupName(groupName string) ([]string, error) {
-	pList := mwsettings.GetSetting("templateHelper/plugins").([]TemplatePluginSettings)
+	pList := mwsettings.GetSetting(templateHelperPath).([]TemplatePluginSettings)
 	var outList []string
 
 	for _, plugin := range pList {
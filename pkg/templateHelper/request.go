@@ -0,0 +1,58 @@
+package templateHelper
+
+import (
+	"net/http"
+	"net/url"
+)
+
+/*
+RequestData is the data .gohtml pages served by the core server are executed with. In a page:
+	{{.Query.Get "name"}}  {{.Form.Get "name"}}  {{.Headers.Get "User-Agent"}}  {{index .Cookies "session"}}
+*/
+type RequestData struct {
+	Method     string
+	Path       string
+	Host       string
+	RemoteAddr string
+	RequestID  string
+	// url query parameters
+	Query url.Values
+	// query parameters and url encoded or multipart form values of the body, body values first
+	Form    url.Values
+	Headers http.Header
+	// cookie values by cookie name
+	Cookies map[string]string
+	// the raw request, for anything not covered above
+	Request *http.Request
+}
+
+// largest amount of a multipart form body kept in memory, the rest goes to temporary files
+const maxFormMemory = 32 << 20
+
+/*
+NewRequestData builds the RequestData for req, parsing its form body. requestID is the ID of the request, if any.
+*/
+func NewRequestData(req *http.Request, requestID string) *RequestData {
+	if err := req.ParseMultipartForm(maxFormMemory); err != nil && err != http.ErrNotMultipart {
+		// a malformed body leaves the form empty, the page is still rendered
+		req.ParseForm()
+	}
+
+	cookies := make(map[string]string)
+	for _, cookie := range req.Cookies() {
+		cookies[cookie.Name] = cookie.Value
+	}
+
+	return &RequestData{
+		Method:     req.Method,
+		Path:       req.URL.Path,
+		Host:       req.Host,
+		RemoteAddr: req.RemoteAddr,
+		RequestID:  requestID,
+		Query:      req.URL.Query(),
+		Form:       req.Form,
+		Headers:    req.Header,
+		Cookies:    cookies,
+		Request:    req,
+	}
+}
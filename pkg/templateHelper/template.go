@@ -1,11 +1,14 @@
 package templateHelper
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	templateHTML "html/template"
 	"io"
 	"reflect"
 	templateText "text/template"
 
+	"github.com/CanadianCommander/MicroWeb/pkg/cache"
 	"github.com/CanadianCommander/MicroWeb/pkg/logger"
 	mwsettings "github.com/CanadianCommander/MicroWeb/pkg/mwSettings"
 )
@@ -41,12 +44,34 @@ func AddTemplateGroup(t *templateHTML.Template, groupName string) (*templateHTML
 	return t, nil
 }
 
+/*
+AddAllTemplates adds every template configured in the "templateHelper/plugins" section of the configuration file,
+so all groups are available to t. Templates that fail to load are logged and left out.
+*/
+func AddAllTemplates(t *templateHTML.Template) *templateHTML.Template {
+	if !mwsettings.HasSetting(templateHelperPath) {
+		return t
+	}
+
+	for _, plugin := range mwsettings.GetSetting(templateHelperPath).([]TemplatePluginSettings) {
+		AddTemplate(t, plugin.TemplateName)
+	}
+	return t
+}
+
 /*
 ProcessTemplateHTML takes the template described by templateFileBuffer and uses the html/template
 package to parse and execute the template, pushing output on the, out io.Writer.
 The big difference between this and ProcessTemplateText, is that this function performs HTML escaping of text.
+The parsed template is cached by the content of templateFileBuffer, so the same source is only parsed once.
+For directories of pages with layouts and partials see Engine.
 */
 func ProcessTemplateHTML(templateFileBuffer *[]byte, out io.Writer, tStruct interface{}) error {
+	cacheKey := "html:" + templateSourceKey(templateFileBuffer)
+	if cached := cache.FetchFromCache(cache.CacheTypeTemplate, cacheKey); cached != nil {
+		return cached.(*templateHTML.Template).Execute(out, tStruct)
+	}
+
 	templateParser := templateHTML.New("root")
 	_, tErr := templateParser.Parse(string((*templateFileBuffer)[:]))
 	if tErr != nil {
@@ -54,14 +79,21 @@ func ProcessTemplateHTML(templateFileBuffer *[]byte, out io.Writer, tStruct inte
 		return tErr
 	}
 
+	cache.AddToCache(cache.CacheTypeTemplate, cacheKey, templateParser)
 	return templateParser.Execute(out, tStruct)
 }
 
 /*
 ProcessTemplateText takes the template described by templateFileBuffer and uses the text/template
 package to parse and execute the template, pushing output on the, out io.Writer.
+Like ProcessTemplateHTML the parsed template is cached.
 */
 func ProcessTemplateText(templateFileBuffer *[]byte, out io.Writer, tStruct interface{}) error {
+	cacheKey := "text:" + templateSourceKey(templateFileBuffer)
+	if cached := cache.FetchFromCache(cache.CacheTypeTemplate, cacheKey); cached != nil {
+		return cached.(*templateText.Template).Execute(out, tStruct)
+	}
+
 	templateParser := templateText.New("root")
 	_, tErr := templateParser.Parse(string((*templateFileBuffer)[:]))
 	if tErr != nil {
@@ -69,9 +101,16 @@ func ProcessTemplateText(templateFileBuffer *[]byte, out io.Writer, tStruct inte
 		return tErr
 	}
 
+	cache.AddToCache(cache.CacheTypeTemplate, cacheKey, templateParser)
 	return templateParser.Execute(out, tStruct)
 }
 
+// templateSourceKey identifies template source for caching
+func templateSourceKey(templateFileBuffer *[]byte) string {
+	sum := sha256.Sum256(*templateFileBuffer)
+	return hex.EncodeToString(sum[:])
+}
+
 //TemplatePluginSettings represents the settings for a template plugin
 type TemplatePluginSettings struct {
 	PluginPath,
@@ -79,9 +118,17 @@ type TemplatePluginSettings struct {
 	Groups []string
 }
 
-// AddTemplateHelperSettingDecoders adds a decoder for the template Helper setting format in the config file.
+// setting path of the template plugin list
+const templateHelperPath = "templateHelper/plugins"
+
+/*
+AddTemplateHelperSettingDecoders adds a decoder for the template Helper setting format in the config file.
+Besides the plugin list the "templateHelper" section has "layoutDirectory" and "partialDirectory", the
+layout and partial directories of the Engine that renders .gohtml pages, relative to the static directory.
+*/
 func AddTemplateHelperSettingDecoders() {
-	var templateHelperPath = "templateHelper/plugins"
+	mwsettings.AddSettingDecoder(mwsettings.NewBasicDecoder("templateHelper/layoutDirectory"))
+	mwsettings.AddSettingDecoder(mwsettings.NewBasicDecoder("templateHelper/partialDirectory"))
 
 	mwsettings.AddSettingDecoder(mwsettings.NewFunctionalSettingDecoder(func(s interface{}) (string, interface{}) {
 		if reflect.ValueOf(s).Type().Kind() == reflect.Slice {
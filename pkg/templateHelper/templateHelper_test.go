@@ -9,6 +9,7 @@ import (
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/CanadianCommander/MicroWeb/pkg/cache"
 	"github.com/CanadianCommander/MicroWeb/pkg/logger"
@@ -110,3 +111,97 @@ func TestGroups(t *testing.T) {
 	}
 
 }
+
+func TestEngine(t *testing.T) {
+	//setup
+	cache.StartCache()
+	logger.LogToStd(logger.VError)
+	mwsettings.ClearSettings()
+
+	templateDir, _ := ioutil.TempDir("", "engineTest")
+	defer os.RemoveAll(templateDir)
+	os.MkdirAll(path.Join(templateDir, "layouts"), 0755)
+	os.MkdirAll(path.Join(templateDir, "partials", "widgets"), 0755)
+	ioutil.WriteFile(path.Join(templateDir, "layouts", "base.gohtml"),
+		[]byte(`[{{block "title" .}}Untitled{{end}}|{{template "widgets/greeting" .}}|{{block "content" .}}{{end}}]`), 0644)
+	ioutil.WriteFile(path.Join(templateDir, "partials", "widgets", "greeting.gohtml"), []byte(`Hello {{.Name}}`), 0644)
+	ioutil.WriteFile(path.Join(templateDir, "page.gohtml"),
+		[]byte(`{{define "content"}}{{pluralize .Count "cat" "cats"}} {{shout .Name}}{{end}}{{template "base" .}}`), 0644)
+
+	engine := NewEngine(templateDir, "layouts", "partials").Funcs(template.FuncMap{"shout": strings.ToUpper})
+	if err := engine.Watch(); err != nil {
+		fmt.Printf("Could not watch template directory: %s\n", err.Error())
+		t.Fail()
+	}
+	defer engine.Close()
+
+	render := func() string {
+		out := strings.Builder{}
+		if err := engine.Render(&out, "page.gohtml", map[string]interface{}{"Name": "bob", "Count": 2}); err != nil {
+			fmt.Printf("Render failed with error: %s\n", err.Error())
+			t.Fail()
+		}
+		return out.String()
+	}
+
+	if output := render(); output != "[Untitled|Hello bob|2 cats BOB]" {
+		fmt.Printf("Engine output does not match expected output! output is: %s\n", output)
+		t.Fail()
+	}
+	if engine.IsPage(path.Join(templateDir, "layouts", "base.gohtml")) || !engine.IsPage(path.Join(templateDir, "page.gohtml")) {
+		fmt.Printf("Layouts must not be pages\n")
+		t.Fail()
+	}
+
+	// changing a partial invalidates the cached page
+	ioutil.WriteFile(path.Join(templateDir, "partials", "widgets", "greeting.gohtml"), []byte(`Bye {{.Name}}`), 0644)
+	output := ""
+	for i := 0; i < 50; i++ {
+		if output = render(); output == "[Untitled|Bye bob|2 cats BOB]" {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if output != "[Untitled|Bye bob|2 cats BOB]" {
+		fmt.Printf("Engine did not pick up the changed partial. output is: %s\n", output)
+		t.Fail()
+	}
+
+	// pages are not watched, a changed modification time is noticed on lookup
+	pagePath := path.Join(templateDir, "page.gohtml")
+	ioutil.WriteFile(pagePath, []byte(`{{define "content"}}edited{{end}}{{template "base" .}}`), 0644)
+	os.Chtimes(pagePath, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	if output = render(); output != "[Untitled|Bye bob|edited]" {
+		fmt.Printf("Engine did not pick up the changed page. output is: %s\n", output)
+		t.Fail()
+	}
+}
+
+func TestStandardFuncs(t *testing.T) {
+	date := time.Date(2019, time.March, 4, 5, 6, 7, 0, time.UTC)
+	tests := map[string]string{
+		`{{formatDate "2006-01-02" .}}`:                  "2019-03-04",
+		`{{rfc3339 .}}`:                                  "2019-03-04T05:06:07Z",
+		`{{joinURL "/blog/" 2019 "a b"}}`:                "/blog/2019/a%20b",
+		`{{queryEscape "a&b"}}`:                          "a%26b",
+		`{{json (pluralize 1 "item" "items")}}`:          "&#34;1 item&#34;",
+		`{{"héllo world" | truncate 5}}`:                 "héll…",
+		`{{"short" | truncate 5}}`:                       "short",
+		`{{pluralize 0 "item" "items"}}`:                 "0 items",
+		`<script>var x = {{json .}};</script>`:           `<script>var x = "2019-03-04T05:06:07Z";</script>`,
+		`<script>var x = {{json "</script>"}};</script>`: `<script>var x = "\u003c/script\u003e";</script>`,
+		`{{if lt (since .).Hours 0.0}}future{{end}}past`: "past",
+	}
+
+	for source, expected := range tests {
+		out := strings.Builder{}
+		tmpl, err := template.New("test").Funcs(StandardFuncs()).Parse(source)
+		if err == nil {
+			err = tmpl.Execute(&out, date)
+		}
+		if err != nil || out.String() != expected {
+			fmt.Printf("Template: %s expected: %s got: %s (error: %v)\n", source, expected, out.String(), err)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,8 @@
+#!/bin/sh
+# echos the request back, answers 418 when the query string is "teapot"
+body=$(cat)
+if [ "$QUERY_STRING" = "teapot" ]; then
+	printf 'Status: 418 I am a teapot\r\n'
+fi
+printf 'Content-Type: text/plain\r\nX-Script: echo\r\n\r\n'
+printf '%s|%s|%s|%s|%s|%s|%s' "$REQUEST_METHOD" "$SCRIPT_NAME" "$PATH_INFO" "$QUERY_STRING" "$HTTP_X_TEST" "$CGI_TEST" "$body"
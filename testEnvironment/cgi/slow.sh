@@ -0,0 +1,4 @@
+#!/bin/sh
+# never answers in time
+sleep 5
+printf 'Content-Type: text/plain\r\n\r\ntoo late'
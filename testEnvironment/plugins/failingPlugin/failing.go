@@ -0,0 +1,17 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+//InitWithConfig always fails, its bindings should be unavailable
+func InitWithConfig(config map[string]interface{}) error {
+	return errors.New("failing on purpose")
+}
+
+//HandleVirtualRequest should never be called
+func HandleVirtualRequest(req *http.Request, res http.ResponseWriter) bool {
+	res.Write([]byte("failingPlugin was used"))
+	return true
+}
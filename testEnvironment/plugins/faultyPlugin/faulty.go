@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+//HandleVirtualRequest panics on "/panic", panics after sending part of the response on "/panicLate",
+//takes 500ms on "/slow" and answers "ok" otherwise
+func HandleVirtualRequest(req *http.Request, res http.ResponseWriter) bool {
+	if strings.HasSuffix(req.URL.Path, "/panic") {
+		panic("faultyPlugin panic")
+	} else if strings.HasSuffix(req.URL.Path, "/panicLate") {
+		res.Write([]byte("partial"))
+		res.(http.Flusher).Flush()
+		panic("faultyPlugin late panic")
+	} else if strings.HasSuffix(req.URL.Path, "/slow") {
+		time.Sleep(500 * time.Millisecond)
+	}
+	res.Write([]byte("ok"))
+	return true
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+var greeting string
+var settingsChanges int32
+
+var shutdownLock sync.Mutex
+var shutdownState = "running"
+
+//InitWithConfig takes the greeting to serve from the "config" block of the plugins binding
+func InitWithConfig(config map[string]interface{}) error {
+	var bOk bool
+	greeting, bOk = config["greeting"].(string)
+	if !bOk {
+		return errors.New("config is missing a greeting")
+	}
+	return nil
+}
+
+//HandleVirtualRequest writes the configured greeting to res
+func HandleVirtualRequest(req *http.Request, res http.ResponseWriter) bool {
+	shutdownLock.Lock()
+	state := shutdownState
+	shutdownLock.Unlock()
+	fmt.Fprintf(res, "%s (settings changed %d times, %s)", greeting, atomic.LoadInt32(&settingsChanges), state)
+	return true
+}
+
+//Health reports the plugin as healthy once it has a greeting
+func Health() error {
+	if greeting == "" {
+		return errors.New("no greeting")
+	}
+	return nil
+}
+
+//OnSettingsChanged counts settings reloads and picks up a changed greeting
+func OnSettingsChanged(config map[string]interface{}) {
+	atomic.AddInt32(&settingsChanges, 1)
+	if newGreeting, bOk := config["greeting"].(string); bOk {
+		greeting = newGreeting
+	}
+}
+
+//Shutdown notes that it was called with a deadline that had not yet passed
+func Shutdown(ctx context.Context) {
+	shutdownLock.Lock()
+	defer shutdownLock.Unlock()
+	if _, bDeadline := ctx.Deadline(); bDeadline && ctx.Err() == nil {
+		shutdownState = "shut down"
+	} else {
+		shutdownState = "shut down without a usable context"
+	}
+}
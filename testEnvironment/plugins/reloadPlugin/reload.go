@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// overridden with -ldflags "-X main.version=..." to build new versions of the plugin
+var version = "1"
+
+//HandleVirtualRequest writes the version of the plugin to res, after a delay if the path ends in "/slow"
+func HandleVirtualRequest(req *http.Request, res http.ResponseWriter) bool {
+	if strings.HasSuffix(req.URL.Path, "/slow") {
+		time.Sleep(500 * time.Millisecond)
+	}
+	fmt.Fprintf(res, "version %s", version)
+	return true
+}
+
+//Shutdown leaves a marker file so that tests can tell the version was shut down
+func Shutdown() {
+	os.WriteFile("/tmp/reloadPlugin-shutdown-"+version, []byte(version), 0644)
+}
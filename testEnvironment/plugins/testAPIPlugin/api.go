@@ -3,9 +3,14 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/CanadianCommander/MicroWeb/pkg/database"
+	"github.com/CanadianCommander/MicroWeb/pkg/pluginUtil"
+	"github.com/CanadianCommander/MicroWeb/pkg/route"
 )
 
 var apiVar = 0
@@ -18,6 +23,25 @@ func Init() {
 	apiVar = 42
 }
 
+type routedRouter struct{}
+
+func (r *routedRouter) Route(req *http.Request, res http.ResponseWriter) bool {
+	fmt.Fprint(res, "ROUTED BY PLUGIN ROUTER")
+	return false
+}
+
+func (r *routedRouter) CanRoute(routeURL *url.URL) bool {
+	return routeURL.Path == "/api/routed" || routeURL.Path == "/mtls/routed"
+}
+
+func (r *routedRouter) GetPriority() int {
+	return route.DefaultRouterPriority
+}
+
+func RegisterRouters(manager *route.RoutingManager) {
+	manager.AddNormalRouter(&routedRouter{})
+}
+
 func HandleRequest(req *http.Request, res http.ResponseWriter, fsName string) bool {
 	return false
 }
@@ -54,8 +78,65 @@ func HandleVirtualRequest(req *http.Request, res http.ResponseWriter) bool {
 
 	} else if string(req.URL.Path) == "/api/magicNumber" {
 		fmt.Fprint(res, strconv.Itoa(apiVar))
+	} else if string(req.URL.Path) == "/api/repeat" {
+		if req.URL.Query().Get("compress") == "no" {
+			pluginUtil.DisableCompression(res)
+		}
+		fmt.Fprint(res, strings.Repeat("REPEAT ", 1000))
+	} else if string(req.URL.Path) == "/api/teapot" {
+		pluginUtil.WriteError(res, req, http.StatusTeapot, "short and stout")
+	} else if strings.HasSuffix(req.URL.Path, "/stream") {
+		// three events 150ms apart, resuming after Last-Event-ID
+		sse, err := pluginUtil.NewSSEWriter(res, req)
+		if err != nil {
+			return false
+		}
+		defer sse.Close()
+		sse.StartHeartbeat(50 * time.Millisecond)
+
+		lastID, _ := strconv.Atoi(sse.LastEventID())
+		for id := lastID + 1; id <= lastID+3; id++ {
+			event := pluginUtil.SSEEvent{ID: strconv.Itoa(id), Event: "tick", Data: "tick " + strconv.Itoa(id) + "\rsecond line"}
+			if id == lastID+1 {
+				event.Retry = 2 * time.Second
+			}
+			if sse.Send(event) != nil {
+				return false
+			}
+			time.Sleep(150 * time.Millisecond)
+		}
+	} else if strings.HasSuffix(req.URL.Path, "/whoami") {
+		clientCert, bOk := pluginUtil.GetClientCertificate(req)
+		if !bOk {
+			fmt.Fprint(res, "ANONYMOUS")
+		} else {
+			fmt.Fprint(res, clientCert.CommonName+" "+strings.Join(clientCert.DNSNames, ","))
+		}
 	} else {
 		fmt.Fprint(res, "HELLO FROM AN API FUNCTION!")
 	}
 	return true
 }
+
+var chatHub = pluginUtil.NewWebSocketHub()
+
+// echo messages back. "broadcast:<msg>" sends <msg> to every connection, "fragment:<msg>" echoes <msg> in 2 byte fragments
+func HandleWebSocket(conn *pluginUtil.WebSocketConn) {
+	chatHub.Join(conn)
+	for {
+		messageType, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		if strings.HasPrefix(string(message), "broadcast:") {
+			chatHub.Broadcast(pluginUtil.TextMessage, message[len("broadcast:"):])
+		} else if strings.HasPrefix(string(message), "fragment:") {
+			conn.SetWriteFragmentSize(2)
+			conn.WriteMessage(messageType, message[len("fragment:"):])
+			conn.SetWriteFragmentSize(0)
+		} else {
+			conn.WriteMessage(messageType, message)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/CanadianCommander/MicroWeb/pkg/processPlugin"
+)
+
+//an out-of-process plugin that echos requests back, crashes on "/crash", panics on "/panic" and sends a bad status on "/badStatus"
+func main() {
+	greeting := "hello"
+	if len(os.Args) > 1 {
+		greeting = os.Args[1]
+	}
+
+	err := processPlugin.Serve(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch {
+		case strings.HasSuffix(req.URL.Path, "/crash"):
+			fmt.Fprintln(os.Stderr, "crashing on request")
+			os.Exit(1)
+		case strings.HasSuffix(req.URL.Path, "/panic"):
+			panic("panic on request")
+		case strings.HasSuffix(req.URL.Path, "/badStatus"):
+			res.WriteHeader(42)
+		case strings.HasSuffix(req.URL.Path, "/pid"):
+			fmt.Fprintf(res, "%d", os.Getpid())
+		default:
+			body, _ := ioutil.ReadAll(req.Body)
+			res.Header().Set("X-Echo-Env", os.Getenv("ECHO_ENV"))
+			res.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(res, "%s %s %s %s body: %s", greeting, req.Method, req.URL.RequestURI(), req.Header.Get("X-Test"), string(body))
+		}
+	}))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}